@@ -0,0 +1,42 @@
+package ami
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+var subs = map[string]struct {
+	help string
+	main func()
+}{
+	"build":  {"build an ECS-optimized AMI or launch template with batchit installed", BuildMain},
+	"attach": {"use an AMI or launch template for the instances of a compute environment", AttachMain},
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: batchit ami <command> [options]\n\ncommands:")
+	var keys []string
+	for k := range subs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(os.Stderr, "  %-8s: %s\n", k, subs[k].help)
+	}
+	os.Exit(1)
+}
+
+// Main dispatches to the AMI commands.
+func Main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	s, ok := subs[os.Args[1]]
+	if !ok {
+		usage()
+	}
+	// remove the command name as is done for batchit itself.
+	os.Args = append(os.Args[:1], os.Args[2:]...)
+	s.main()
+}
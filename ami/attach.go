@@ -0,0 +1,70 @@
+package ami
+
+import (
+	"context"
+	"log"
+
+	"github.com/base2genomics/batchit"
+	"github.com/base2genomics/batchit/ce"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/batch"
+	batchtypes "github.com/aws/aws-sdk-go-v2/service/batch/types"
+)
+
+type attachArgs struct {
+	Region          string `arg:"env:AWS_DEFAULT_REGION,help:region for batch setup. see batchit help for the default."`
+	Image           string `arg:"help:AMI from batchit ami build."`
+	Template        string `arg:"help:launch template from batchit ami build --template."`
+	TemplateVersion string `arg:"help:version of --template."`
+	Name            string `arg:"required,positional,help:name or ARN of the compute environment."`
+}
+
+func (c attachArgs) Version() string {
+	return batchit.Version
+}
+
+func (c attachArgs) Description() string {
+	return `Update a compute environment to start instances from an AMI or with a launch template from
+batchit ami build. Instances that are running are replaced by batch as jobs finish. Batch only allows
+this for compute environments that use the BEST_FIT_PROGRESSIVE or SPOT_CAPACITY_OPTIMIZED allocation
+strategy. An image_id_override in the ec2 configuration of the environment takes precedence over --image.`
+}
+
+// Attach updates the compute environment name to use image and/or the launch template lt.
+func Attach(ctx context.Context, b *batch.Client, name, image string, lt *batchtypes.LaunchTemplateSpecification) error {
+	cr := &batchtypes.ComputeResourceUpdate{LaunchTemplate: lt}
+	if image != "" {
+		cr.ImageId = aws.String(image)
+	}
+	if _, err := b.UpdateComputeEnvironment(ctx, &batch.UpdateComputeEnvironmentInput{
+		ComputeEnvironment: aws.String(name),
+		ComputeResources:   cr,
+	}); err != nil {
+		return err
+	}
+	return ce.WaitValid(ctx, b, name)
+}
+
+func AttachMain() {
+	cli := &attachArgs{TemplateVersion: "$Latest"}
+	p := batchit.MustParse(cli)
+	if (cli.Image == "") == (cli.Template == "") {
+		p.Fail("specify one of --image or --template")
+	}
+	ctx := context.Background()
+	cfg, err := batchit.LoadConfig(ctx, cli.Region)
+	if err != nil {
+		log.Fatal(err)
+	}
+	b := batch.NewFromConfig(cfg)
+
+	var lt *batchtypes.LaunchTemplateSpecification
+	if cli.Template != "" {
+		lt = &batchtypes.LaunchTemplateSpecification{LaunchTemplateName: aws.String(cli.Template), Version: aws.String(cli.TemplateVersion)}
+	}
+	if err := Attach(ctx, b, cli.Name, cli.Image, lt); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("[batchit ami] %s will start new instances with %s%s", cli.Name, cli.Image, cli.Template)
+}
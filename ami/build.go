@@ -0,0 +1,172 @@
+package ami
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/base2genomics/batchit"
+	"github.com/base2genomics/batchit/ce"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+type buildArgs struct {
+	Region         string   `arg:"env:AWS_DEFAULT_REGION,help:region for batch setup. see batchit help for the default."`
+	Name           string   `arg:"help:name of the AMI or launch template. default is batchit-<version>-<date>."`
+	Template       bool     `arg:"help:create a launch template that sets up each instance as it boots instead of building an AMI."`
+	Arch           string   `arg:"help:x86_64 or arm64."`
+	Base           string   `arg:"help:AMI to start from. default is the latest ECS-optimized Amazon Linux 2 AMI."`
+	InstanceType   string   `arg:"help:instance type used to build the AMI. default is m5.large or m6g.large for arm64."`
+	Subnet         string   `arg:"help:subnet for the build instance. it must be able to reach the internet."`
+	SecurityGroups []string `arg:"help:security groups of the build instance."`
+	Keep           bool     `help:"do not terminate the build instance, e.g. to debug a failed build."`
+}
+
+func (c buildArgs) Version() string {
+	return batchit.Version
+}
+
+func (c buildArgs) Description() string {
+	return `Build an ECS-optimized AMI with this version of batchit, mdadm and efs-utils installed and a higher
+open file limit for containers so that jobs can use --ebs without installing anything on the host.
+An instance is started from the base AMI, set up, stopped and imaged, then terminated. This takes several
+minutes. With --template, a launch template that does the same setup as each instance boots is created
+instead. Use batchit ami attach to use the result in a compute environment.`
+}
+
+// ParameterName returns the SSM parameter with the latest ECS-optimized Amazon Linux 2 AMI for arch.
+func ParameterName(arch string) string {
+	if arch == "arm64" {
+		return "/aws/service/ecs/optimized-ami/amazon-linux-2/arm64/recommended/image_id"
+	}
+	return "/aws/service/ecs/optimized-ami/amazon-linux-2/recommended/image_id"
+}
+
+// LatestECS returns the id of the latest ECS-optimized Amazon Linux 2 AMI for arch.
+func LatestECS(ctx context.Context, svc *ssm.Client, arch string) (string, error) {
+	out, err := svc.GetParameter(ctx, &ssm.GetParameterInput{Name: aws.String(ParameterName(arch))})
+	if err != nil {
+		return "", err
+	}
+	return aws.ToString(out.Parameter.Value), nil
+}
+
+// bakeSetup is run on the build instance. The ECS agent state is removed so that instances from the
+// image register as themselves, then the instance stops itself so it can be imaged.
+const bakeSetup = `
+systemctl stop ecs
+rm -rf /var/lib/ecs/data/*
+shutdown -h now
+`
+
+// Build starts an instance from base, sets it up with ce.HostSetup and returns the id of an AMI
+// made from it. The instance is terminated unless keep is true.
+func Build(ctx context.Context, svc *ec2.Client, base, itype, subnet string, groups []string, name string, keep bool) (string, error) {
+	in := &ec2.RunInstancesInput{
+		ImageId:                           aws.String(base),
+		InstanceType:                      ec2types.InstanceType(itype),
+		MinCount:                          aws.Int32(1),
+		MaxCount:                          aws.Int32(1),
+		InstanceInitiatedShutdownBehavior: ec2types.ShutdownBehaviorStop,
+		UserData:                          aws.String(base64.StdEncoding.EncodeToString([]byte(ce.HostSetup() + bakeSetup))),
+		TagSpecifications: []ec2types.TagSpecification{{
+			ResourceType: ec2types.ResourceTypeInstance,
+			Tags:         []ec2types.Tag{{Key: aws.String("Name"), Value: aws.String("batchit-ami-build")}},
+		}},
+	}
+	if subnet != "" {
+		in.SubnetId = aws.String(subnet)
+	}
+	if len(groups) > 0 {
+		in.SecurityGroupIds = groups
+	}
+	r, err := svc.RunInstances(ctx, in)
+	if err != nil {
+		return "", err
+	}
+	iid := r.Instances[0].InstanceId
+	log.Printf("[batchit ami] started %s from %s. waiting for setup to finish", *iid, base)
+	if !keep {
+		defer func() {
+			if _, err := svc.TerminateInstances(ctx, &ec2.TerminateInstancesInput{InstanceIds: []string{*iid}}); err != nil {
+				log.Printf("[batchit ami] error terminating %s: %s", *iid, err)
+			}
+		}()
+	}
+	stopped := ec2.NewInstanceStoppedWaiter(svc)
+	if err := stopped.Wait(ctx, &ec2.DescribeInstancesInput{InstanceIds: []string{*iid}}, 10*time.Minute); err != nil {
+		return "", fmt.Errorf("ami: %s did not stop. its console output may show why: %s", *iid, err)
+	}
+	co, err := svc.CreateImage(ctx, &ec2.CreateImageInput{
+		InstanceId:  iid,
+		Name:        aws.String(name),
+		Description: aws.String(fmt.Sprintf("%s with batchit %s", base, batchit.Version)),
+		TagSpecifications: []ec2types.TagSpecification{{
+			ResourceType: ec2types.ResourceTypeImage,
+			Tags: []ec2types.Tag{{Key: aws.String("Name"), Value: aws.String(name)},
+				{Key: aws.String("batchit-version"), Value: aws.String(batchit.Version)}},
+		}},
+	})
+	if err != nil {
+		return "", err
+	}
+	log.Printf("[batchit ami] creating %s. waiting for it to be available", *co.ImageId)
+	available := ec2.NewImageAvailableWaiter(svc)
+	if err := available.Wait(ctx, &ec2.DescribeImagesInput{ImageIds: []string{*co.ImageId}}, 10*time.Minute); err != nil {
+		return "", err
+	}
+	return *co.ImageId, nil
+}
+
+func BuildMain() {
+	cli := &buildArgs{Arch: "x86_64"}
+	p := batchit.MustParse(cli)
+	if cli.Arch != "x86_64" && cli.Arch != "arm64" {
+		p.Fail("--arch must be x86_64 or arm64")
+	}
+	if cli.Name == "" {
+		cli.Name = fmt.Sprintf("batchit-%s-%s", batchit.Version, time.Now().UTC().Format("20060102-1504"))
+	}
+	ctx := context.Background()
+	cfg, err := batchit.LoadConfig(ctx, cli.Region)
+	if err != nil {
+		log.Fatal(err)
+	}
+	svc := ec2.NewFromConfig(cfg)
+
+	if cli.Template {
+		name, err := ce.LaunchTemplate(ctx, svc, cli.Name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("[batchit ami] created launch template %s. use it with: batchit ami attach --template %s <compute environment>", name, name)
+		fmt.Println(name)
+		return
+	}
+
+	base := cli.Base
+	if base == "" {
+		if base, err = LatestECS(ctx, ssm.NewFromConfig(cfg), cli.Arch); err != nil {
+			log.Fatal(err)
+		}
+	}
+	itype := cli.InstanceType
+	if itype == "" {
+		itype = "m5.large"
+		if cli.Arch == "arm64" {
+			itype = "m6g.large"
+		}
+	}
+	id, err := Build(ctx, svc, base, itype, cli.Subnet, cli.SecurityGroups, cli.Name, cli.Keep)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("[batchit ami] created %s. use it with: batchit ami attach --image %s <compute environment>", id, id)
+	fmt.Println(id)
+}
@@ -0,0 +1,249 @@
+package arraymap
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/base2genomics/batchit"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// IndexEnv is set by batch to the index of each child of an array job.
+const IndexEnv = "AWS_BATCH_JOB_ARRAY_INDEX"
+
+type cliargs struct {
+	Region   string   `arg:"env:AWS_DEFAULT_REGION,help:region for batch setup. see batchit help for the default."`
+	Manifest string   `arg:"required,help:S3 path or local file of the manifest with a row for each index."`
+	Field    []string `help:"1-based number or, with --header, name of each column to print. default is the whole row."`
+	Header   bool     `arg:"help:the first row of the manifest names the columns. it is not counted as a row."`
+	Sep      string   `help:"column separator. default is , for .csv files and a tab otherwise."`
+	Index    int      `arg:"help:row to print counting from 0. default is $AWS_BATCH_JOB_ARRAY_INDEX."`
+	Shell    bool     `arg:"help:print 'export name=value' for each column for use with eval. requires --header."`
+}
+
+func (c cliargs) Version() string {
+	return batchit.Version
+}
+
+func (c cliargs) Description() string {
+	return `Print the row of a manifest for the index of a child of an array job, e.g. in the script of the job:
+    read sample fq1 fq2 <<< $(batchit array-map --manifest s3://bucket/samples.tsv --field 1 --field 2 --field 3)
+or, for a manifest with a header:
+    eval $(batchit array-map --manifest s3://bucket/samples.tsv --header --shell)
+Index 0 is the first row, or the first row after the header with --header. Blank lines and lines starting with #
+are not rows. The fields are printed separated by tabs.`
+}
+
+// GetObjectAPI is the part of the S3 client that Open uses.
+type GetObjectAPI interface {
+	GetObject(context.Context, *s3.GetObjectInput, ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+}
+
+// DefaultSep returns the column separator of the manifest at path: , for .csv files and a tab
+// otherwise.
+func DefaultSep(path string) string {
+	if strings.HasSuffix(strings.ToLower(path), ".csv") {
+		return ","
+	}
+	return "\t"
+}
+
+// Open returns a reader of the manifest at path, which is a local file or an S3 path.
+func Open(ctx context.Context, svc GetObjectAPI, path string) (io.ReadCloser, error) {
+	if !strings.HasPrefix(path, "s3://") {
+		return os.Open(path)
+	}
+	bk := strings.SplitN(strings.TrimPrefix(path, "s3://"), "/", 2)
+	if len(bk) != 2 || bk[1] == "" {
+		return nil, fmt.Errorf("array-map: expected an S3 path like s3://bucket/samples.tsv, got %s", path)
+	}
+	out, err := svc.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(bk[0]), Key: aws.String(bk[1])})
+	if err != nil {
+		return nil, fmt.Errorf("array-map: %s: %s", path, err)
+	}
+	return out.Body, nil
+}
+
+// Row returns the header, if header is true, and the row at index of the manifest.
+func Row(r io.Reader, sep rune, header bool, index int) ([]string, []string, error) {
+	cr := csv.NewReader(r)
+	cr.Comma = sep
+	cr.FieldsPerRecord = -1
+	cr.LazyQuotes = true
+	var names []string
+	i := 0
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			return nil, nil, fmt.Errorf("array-map: index %d is past the last row of the manifest (%d rows)", index, i)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if header && names == nil {
+			// the header is often written as a comment, e.g. #sample.
+			rec[0] = strings.TrimPrefix(rec[0], "#")
+			names = rec
+			continue
+		}
+		if strings.HasPrefix(rec[0], "#") {
+			continue
+		}
+		if i == index {
+			return names, rec, nil
+		}
+		i++
+	}
+}
+
+// Count returns the number of rows of the manifest as Row counts them, which is the size of an
+// array job with a child for each. With header, the first row is the header and is not counted.
+func Count(r io.Reader, sep rune, header bool) (int, error) {
+	cr := csv.NewReader(r)
+	cr.Comma = sep
+	cr.FieldsPerRecord = -1
+	cr.LazyQuotes = true
+	n := 0
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		if header {
+			header = false
+			continue
+		}
+		if !strings.HasPrefix(rec[0], "#") {
+			n++
+		}
+	}
+}
+
+// Select returns the columns of row for each field, which is a 1-based column number or a name in
+// names.
+func Select(names, row []string, fields []string) ([]string, error) {
+	if len(fields) == 0 {
+		return row, nil
+	}
+	out := make([]string, 0, len(fields))
+	for _, f := range fields {
+		col := -1
+		for i, n := range names {
+			if n == f {
+				col = i
+				break
+			}
+		}
+		if col == -1 {
+			n, err := strconv.Atoi(f)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("array-map: unknown column %q. expected a number from 1 or a name in the header", f)
+			}
+			col = n - 1
+		}
+		if col >= len(row) {
+			return nil, fmt.Errorf("array-map: the row has %d columns, %s was requested", len(row), f)
+		}
+		out = append(out, row[col])
+	}
+	return out, nil
+}
+
+var notName = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// Exports returns a line of 'export name=value' for each column of row with the names made into
+// valid shell variable names.
+func Exports(names, row []string) ([]string, error) {
+	lines := make([]string, 0, len(row))
+	for i, v := range row {
+		if i >= len(names) {
+			return nil, fmt.Errorf("array-map: column %d has no name in the header", i+1)
+		}
+		name := notName.ReplaceAllString(names[i], "_")
+		if name == "" || (name[0] >= '0' && name[0] <= '9') {
+			name = "_" + name
+		}
+		lines = append(lines, fmt.Sprintf("export %s=%s", name, shellQuote(v)))
+	}
+	return lines, nil
+}
+
+func Main() {
+	cli := &cliargs{Index: -1}
+	p := batchit.MustParse(cli)
+	if cli.Shell && !cli.Header {
+		p.Fail("--shell requires --header")
+	}
+	if cli.Index < 0 {
+		v := os.Getenv(IndexEnv)
+		if v == "" {
+			p.Fail("$" + IndexEnv + " is not set. use --index outside of an array job")
+		}
+		var err error
+		if cli.Index, err = strconv.Atoi(v); err != nil {
+			p.Fail("$" + IndexEnv + " is not a number: " + v)
+		}
+	}
+	if cli.Sep == "" {
+		cli.Sep = DefaultSep(cli.Manifest)
+	}
+	sep := []rune(strings.Replace(cli.Sep, `\t`, "\t", -1))
+	if len(sep) != 1 {
+		p.Fail("--sep must be a single character")
+	}
+
+	ctx := context.Background()
+	cfg, err := batchit.LoadConfig(ctx, cli.Region)
+	if err != nil {
+		log.Fatal(err)
+	}
+	rc, err := Open(ctx, s3.NewFromConfig(cfg), cli.Manifest)
+	if err != nil {
+		log.Fatal(err)
+	}
+	names, row, err := Row(rc, sep[0], cli.Header, cli.Index)
+	rc.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cli.Shell {
+		if len(cli.Field) > 0 {
+			cols, err := Select(names, names, cli.Field)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if row, err = Select(names, row, cli.Field); err != nil {
+				log.Fatal(err)
+			}
+			names = cols
+		}
+		lines, err := Exports(names, row)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(strings.Join(lines, "\n"))
+		return
+	}
+	fields, err := Select(names, row, cli.Field)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(strings.Join(fields, "\t"))
+}
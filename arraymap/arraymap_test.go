@@ -0,0 +1,85 @@
+package arraymap
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRow(t *testing.T) {
+	const tsv = "#sample\tbam\nNA12878\ts3://b/NA12878.bam\n# skipped\nNA12891\ts3://b/NA12891.bam\n"
+	for _, c := range []struct {
+		name   string
+		data   string
+		header bool
+		index  int
+		names  []string
+		// row is nil if index is past the last row.
+		row []string
+	}{
+		{name: "first", data: tsv, header: true, index: 0,
+			names: []string{"sample", "bam"}, row: []string{"NA12878", "s3://b/NA12878.bam"}},
+		{name: "past comment", data: tsv, header: true, index: 1,
+			names: []string{"sample", "bam"}, row: []string{"NA12891", "s3://b/NA12891.bam"}},
+		{name: "past last", data: tsv, header: true, index: 2},
+		{name: "no header", data: "a\t1\nb\t2\n", index: 1, row: []string{"b", "2"}},
+		{name: "comments without header", data: tsv, index: 0, row: []string{"NA12878", "s3://b/NA12878.bam"}},
+		{name: "ragged", data: "a\t1\nb\n", index: 1, row: []string{"b"}},
+		{name: "empty", data: "", index: 0},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			names, row, err := Row(strings.NewReader(c.data), '\t', c.header, c.index)
+			if c.row == nil {
+				if err == nil {
+					t.Fatalf("expected an error. got %v", row)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(names, c.names) {
+				t.Errorf("expected names %v. got %v", c.names, names)
+			}
+			if !reflect.DeepEqual(row, c.row) {
+				t.Errorf("expected row %v. got %v", c.row, row)
+			}
+		})
+	}
+}
+
+func TestSelect(t *testing.T) {
+	names := []string{"sample", "bam", "bai"}
+	row := []string{"NA12878", "x.bam", "x.bai"}
+	for _, c := range []struct {
+		name   string
+		names  []string
+		fields []string
+		// out is nil for an error.
+		out []string
+	}{
+		{name: "all", names: names, out: row},
+		{name: "names", names: names, fields: []string{"bai", "sample"}, out: []string{"x.bai", "NA12878"}},
+		{name: "numbers", names: names, fields: []string{"2", "1"}, out: []string{"x.bam", "NA12878"}},
+		{name: "numbers without header", fields: []string{"3"}, out: []string{"x.bai"}},
+		{name: "unknown name", names: names, fields: []string{"cram"}},
+		{name: "zero", names: names, fields: []string{"0"}},
+		{name: "past last column", names: names, fields: []string{"4"}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			out, err := Select(c.names, row, c.fields)
+			if c.out == nil {
+				if err == nil {
+					t.Fatalf("expected an error. got %v", out)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(out, c.out) {
+				t.Errorf("expected %v. got %v", c.out, out)
+			}
+		})
+	}
+}
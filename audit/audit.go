@@ -0,0 +1,218 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/base2genomics/batchit"
+	"github.com/base2genomics/batchit/logof"
+	"github.com/base2genomics/batchit/ls"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/batch"
+	batchtypes "github.com/aws/aws-sdk-go-v2/service/batch/types"
+	"github.com/aws/aws-sdk-go-v2/service/cloudtrail"
+	cloudtrailtypes "github.com/aws/aws-sdk-go-v2/service/cloudtrail/types"
+)
+
+type cliargs struct {
+	Region string `arg:"env:AWS_DEFAULT_REGION,help:region for batch setup. see batchit help for the default."`
+	Queue  string `arg:"-q,required,help:job queue to audit."`
+	Since  string `help:"only report submissions within this duration before now, e.g. 12h or 7d. CloudTrail keeps 90 days."`
+	JSON   bool   `arg:"help:print a JSON array with the parameters of each submission rather than a table."`
+}
+
+func (c cliargs) Version() string {
+	return batchit.Version
+}
+
+func (c cliargs) Description() string {
+	return `Report who submitted the jobs in a queue from the SubmitJob events in CloudTrail, e.g. for a security review of a
+shared account:
+    batchit audit --queue big-q --since 7d
+Each submission has the IAM principal, source IP and user agent of the caller and the current status of the job.
+Submissions that were denied or failed are included with their error. The JSON output also has the parameters of
+each submission. Jobs in the queue that have no SubmitJob event, e.g. because CloudTrail has not delivered it yet,
+are listed at the end. The caller needs cloudtrail:LookupEvents.`
+}
+
+// event is the part of a CloudTrail record that is used.
+type event struct {
+	EventTime    time.Time `json:"eventTime"`
+	UserIdentity struct {
+		Type      string `json:"type"`
+		Arn       string `json:"arn"`
+		AccountID string `json:"accountId"`
+		InvokedBy string `json:"invokedBy"`
+	} `json:"userIdentity"`
+	SourceIPAddress   string          `json:"sourceIPAddress"`
+	UserAgent         string          `json:"userAgent"`
+	ErrorCode         string          `json:"errorCode"`
+	ErrorMessage      string          `json:"errorMessage"`
+	RequestParameters json.RawMessage `json:"requestParameters"`
+	ResponseElements  struct {
+		JobID string `json:"jobId"`
+	} `json:"responseElements"`
+}
+
+// Submission is a call to SubmitJob and the job it made.
+type Submission struct {
+	Time       time.Time       `json:"time"`
+	JobID      string          `json:"job_id,omitempty"`
+	JobName    string          `json:"job_name"`
+	Queue      string          `json:"queue"`
+	Status     string          `json:"status"`
+	Principal  string          `json:"principal"`
+	Type       string          `json:"principal_type"`
+	Account    string          `json:"account"`
+	SourceIP   string          `json:"source_ip"`
+	UserAgent  string          `json:"user_agent"`
+	Error      string          `json:"error,omitempty"`
+	Parameters json.RawMessage `json:"parameters"`
+}
+
+// queueName returns the name of a queue from its name or ARN.
+func queueName(q string) string {
+	if i := strings.LastIndex(q, "/"); i != -1 && strings.HasPrefix(q, "arn:") {
+		return q[i+1:]
+	}
+	return q
+}
+
+// Submissions returns the calls to SubmitJob for queue since the given time, most recent first.
+func Submissions(ctx context.Context, ct *cloudtrail.Client, queue string, since time.Time) ([]*Submission, error) {
+	var subs []*Submission
+	pages := cloudtrail.NewLookupEventsPaginator(ct, &cloudtrail.LookupEventsInput{
+		LookupAttributes: []cloudtrailtypes.LookupAttribute{{
+			AttributeKey: cloudtrailtypes.LookupAttributeKeyEventName, AttributeValue: aws.String("SubmitJob")}},
+		StartTime: aws.Time(since),
+	})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, ev := range page.Events {
+			if aws.ToString(ev.EventSource) != "" && aws.ToString(ev.EventSource) != "batch.amazonaws.com" {
+				continue
+			}
+			var e event
+			if err := json.Unmarshal([]byte(aws.ToString(ev.CloudTrailEvent)), &e); err != nil {
+				return nil, fmt.Errorf("audit: reading event %s: %s", aws.ToString(ev.EventId), err)
+			}
+			var params struct {
+				JobName  string `json:"jobName"`
+				JobQueue string `json:"jobQueue"`
+			}
+			// parameters are missing when the call was denied before it reached batch.
+			json.Unmarshal(e.RequestParameters, &params)
+			if queueName(params.JobQueue) != queueName(queue) {
+				continue
+			}
+			s := &Submission{Time: e.EventTime, JobID: e.ResponseElements.JobID, JobName: params.JobName, Queue: params.JobQueue,
+				Principal: e.UserIdentity.Arn, Type: e.UserIdentity.Type, Account: e.UserIdentity.AccountID,
+				SourceIP: e.SourceIPAddress, UserAgent: e.UserAgent, Parameters: e.RequestParameters}
+			if s.Principal == "" {
+				// e.g. a service such as Step Functions or EventBridge.
+				s.Principal = e.UserIdentity.InvokedBy
+			}
+			if e.ErrorCode != "" {
+				s.Error = strings.TrimSpace(e.ErrorCode + " " + e.ErrorMessage)
+				s.Status = "-"
+			}
+			subs = append(subs, s)
+		}
+	}
+	sort.SliceStable(subs, func(i, j int) bool { return subs[i].Time.After(subs[j].Time) })
+	return subs, nil
+}
+
+// Correlate sets the status of each submission from the jobs in the queue and returns the jobs that
+// have no submission.
+func Correlate(subs []*Submission, jobs []*batchtypes.JobSummary) []*batchtypes.JobSummary {
+	byID := make(map[string]*Submission, len(subs))
+	for _, s := range subs {
+		if s.JobID != "" {
+			byID[s.JobID] = s
+			s.Status = "UNKNOWN"
+		}
+	}
+	var unmatched []*batchtypes.JobSummary
+	for _, j := range jobs {
+		if s, ok := byID[aws.ToString(j.JobId)]; ok {
+			s.Status = string(j.Status)
+		} else {
+			unmatched = append(unmatched, j)
+		}
+	}
+	return unmatched
+}
+
+// WriteTable writes a row for each submission.
+func WriteTable(w io.Writer, subs []*Submission) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SUBMITTED\tJOB ID\tNAME\tSTATUS\tPRINCIPAL\tSOURCE IP\tERROR")
+	for _, s := range subs {
+		id, errMsg := s.JobID, s.Error
+		if id == "" {
+			id = "-"
+		}
+		if errMsg == "" {
+			errMsg = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", s.Time.UTC().Format("2006-01-02 15:04:05"), id, s.JobName, s.Status,
+			s.Principal, s.SourceIP, errMsg)
+	}
+	return tw.Flush()
+}
+
+func Main() {
+	cli := &cliargs{Since: "7d"}
+	p := batchit.MustParse(cli)
+	d, err := logof.ParseDuration(cli.Since)
+	if err != nil {
+		p.Fail(err.Error())
+	}
+	since := time.Now().Add(-d)
+	ctx := context.Background()
+	cfg, err := batchit.LoadConfig(ctx, cli.Region)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	subs, err := Submissions(ctx, cloudtrail.NewFromConfig(cfg), cli.Queue, since)
+	if err != nil {
+		log.Fatal(err)
+	}
+	jobs, err := ls.List(ctx, batch.NewFromConfig(cfg), ls.Query{Queue: cli.Queue, Statuses: ls.Statuses, Since: since})
+	if err != nil {
+		log.Fatal(err)
+	}
+	unmatched := Correlate(subs, jobs)
+
+	if cli.JSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(subs)
+	} else {
+		err = WriteTable(os.Stdout, subs)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(unmatched) > 0 {
+		// batch only lists jobs for some days after they finish so this is not the other way around.
+		log.Printf("[batchit audit] %d jobs in %s have no SubmitJob event:", len(unmatched), cli.Queue)
+		if err := ls.WriteTable(os.Stderr, unmatched); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
@@ -1,3 +1,131 @@
 package batchit
 
-const Version = "0.4.3"
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+)
+
+// Version is the version of the batchit command and of the Go packages in this repository. It
+// follows semantic versioning: the exported API of this package and of submit, exsmount, ddv,
+// logof, s3upload and fake only changes incompatibly with a new major version.
+const Version = "1.0.0"
+
+// DefaultRegion is used when neither --region, the environment, the config files nor the instance
+// metadata give a region.
+const DefaultRegion = "us-east-1"
+
+// Profile and EndpointURL are set from the --profile and --endpoint-url flags that every
+// subcommand accepts. They are used by LoadConfig.
+var (
+	Profile     string
+	EndpointURL string
+)
+
+// LoadConfig returns the AWS configuration for region from the environment, shared config files and
+// instance role. Requests are retried with Retry, trust CABundle and are spans of the trace from
+// StartTracing. Batch calls that only read are shared as described at shareCalls and some calls
+// are answered from the cache on disk as described at cacheCalls. If region is empty, it is the
+// first of:
+//
+//	$AWS_REGION, then $AWS_DEFAULT_REGION
+//	region in the batchit config file for Command
+//	region of the profile in the shared AWS config
+//	region of this EC2 instance from the instance metadata
+//	DefaultRegion
+//
+// The --region flag of a subcommand, which is set by MustParse, is used before all of them.
+// RegionSource gives the one that was used.
+func LoadConfig(ctx context.Context, region string) (aws.Config, error) {
+	opts := []func(*config.LoadOptions) error{config.WithRetryer(Retry.Retryer)}
+	client, err := awsHTTPClient()
+	if err != nil {
+		return aws.Config{}, err
+	}
+	if client != nil {
+		opts = append(opts, config.WithHTTPClient(client))
+	}
+	region, source := explicitRegion(region)
+	if region != "" {
+		opts = append(opts, config.WithRegion(region))
+	}
+	if Profile != "" {
+		opts = append(opts, config.WithSharedConfigProfile(Profile))
+	}
+	if EndpointURL != "" {
+		opts = append(opts, config.WithBaseEndpoint(EndpointURL))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return cfg, err
+	}
+	switch {
+	case region != "":
+	case cfg.Region != "":
+		source = RegionFromProfile + " " + profileName()
+	default:
+		if cfg.Region = instanceRegion(ctx, cfg); cfg.Region != "" {
+			source = RegionFromInstance
+		} else {
+			cfg.Region, source = DefaultRegion, RegionFromDefault
+		}
+	}
+	cfg.ConfigSources = append(cfg.ConfigSources, regionSource(source))
+	logRegion(cfg.Region, source)
+	cfg.APIOptions = append(cfg.APIOptions, shareCalls, cacheCalls(cfg))
+	traceConfig(&cfg)
+	return cfg, nil
+}
+
+// GlobalFlags removes --profile, --endpoint-url, --log-format, --ca-bundle, --output and the retry
+// flags from args, as either "--flag value" or "--flag=value", and sets Profile, EndpointURL,
+// LogFormat, CABundle and Output from them. After the subcommand, only --output text or jsonl is
+// removed as logof has its own --output json. The retry flags are used by Configure.
+// --debug-region and --no-cache, which have no value, set DebugRegion and NoCache. The rest of args are returned for the
+// subcommand to parse.
+func GlobalFlags(args []string) ([]string, error) {
+	flags := map[string]*string{"--profile": &Profile, "--endpoint-url": &EndpointURL, "--log-format": &LogFormat, "--ca-bundle": &CABundle, "--output": &Output}
+	for k, v := range retryFlags {
+		flags["--"+k] = v
+	}
+	rest := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		if a == "--" {
+			rest = append(rest, args[i:]...)
+			break
+		}
+		if a == "--debug-region" {
+			DebugRegion = true
+			continue
+		}
+		if a == "--no-cache" {
+			NoCache = true
+			continue
+		}
+		k, v, hasValue := strings.Cut(a, "=")
+		dst, ok := flags[k]
+		if !ok {
+			rest = append(rest, a)
+			continue
+		}
+		start := i
+		if !hasValue {
+			if i+1 >= len(args) {
+				return nil, fmt.Errorf("batchit: %s requires a value", k)
+			}
+			i++
+			v = args[i]
+		}
+		// logof has its own --output json, which can only follow the subcommand.
+		if k == "--output" && v != "text" && v != "jsonl" && len(rest) > 0 {
+			rest = append(rest, args[start:i+1]...)
+			continue
+		}
+		*dst = v
+	}
+	return rest, nil
+}
@@ -0,0 +1,170 @@
+package batchit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/service/batch"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// NoCacheEnvVar is the environment variable that sets NoCache if --no-cache is not given.
+const NoCacheEnvVar = "BATCHIT_NO_CACHE"
+
+// NoCache is set from the --no-cache flag that every subcommand accepts, $BATCHIT_NO_CACHE or
+// no-cache in the config. LoadConfig then neither reads nor writes the cache on disk.
+var NoCache bool
+
+// diskOperations are the calls whose responses are kept on disk for a while, by service and
+// operation, with a function that returns an output to read a kept response into. They are
+// made by most runs, e.g. to find the account, the role of a job or the cluster of a queue, and
+// what they return rarely changes. Those that are only kept for calls with a context from
+// Mapping also return what does change, such as the capacity of compute environments.
+var diskOperations = map[string]map[string]struct {
+	ttl     time.Duration
+	mapping bool
+	out     func() interface{}
+}{
+	sts.ServiceID: {
+		"GetCallerIdentity": {time.Hour, false, func() interface{} { return &sts.GetCallerIdentityOutput{} }},
+	},
+	iam.ServiceID: {
+		"GetRole": {time.Hour, false, func() interface{} { return &iam.GetRoleOutput{} }},
+	},
+	batch.ServiceID: {
+		"DescribeJobQueues":           {10 * time.Minute, true, func() interface{} { return &batch.DescribeJobQueuesOutput{} }},
+		"DescribeComputeEnvironments": {10 * time.Minute, true, func() interface{} { return &batch.DescribeComputeEnvironmentsOutput{} }},
+	},
+}
+
+type mappingKey struct{}
+
+// Mapping returns ctx for Batch calls that only use what rarely changes of job queues and
+// compute environments, such as the compute environments of a queue and their clusters, so that
+// they can be answered from the cache on disk. Other calls always get the current state and
+// capacity.
+func Mapping(ctx context.Context) context.Context {
+	return context.WithValue(ctx, mappingKey{}, true)
+}
+
+// cacheDir returns the directory of the cache, ~/.cache/batchit on Linux.
+func cacheDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "batchit"), nil
+}
+
+// cacheCalls returns the middleware of LoadConfig that answers diskOperations from the cache on
+// disk if they were made with the same access key, region and parameters within their ttl and,
+// for those of job queues and compute environments, with a context from Mapping. The
+// calls of a service that create, update or delete something remove what is kept for it. It is
+// added after shareCalls so that calls made at once read and write the cache once.
+func cacheCalls(cfg aws.Config) func(*middleware.Stack) error {
+	return func(stack *middleware.Stack) error {
+		return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("BatchitCacheCalls",
+			func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+				return handleCached(ctx, cfg, in, next)
+			}), middleware.After)
+	}
+}
+
+func handleCached(ctx context.Context, cfg aws.Config, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+	service, op := awsmiddleware.GetServiceID(ctx), awsmiddleware.GetOperationName(ctx)
+	ops, ok := diskOperations[service]
+	if !ok || NoCache {
+		return next.HandleInitialize(ctx, in)
+	}
+	dir, err := cacheDir()
+	if err != nil {
+		return next.HandleInitialize(ctx, in)
+	}
+	if strings.HasPrefix(op, "Create") || strings.HasPrefix(op, "Update") || strings.HasPrefix(op, "Delete") {
+		out, md, err := next.HandleInitialize(ctx, in)
+		if err == nil {
+			forgetCached(dir, service)
+		}
+		return out, md, err
+	}
+	d, ok := ops[op]
+	if !ok || cfg.Credentials == nil || (d.mapping && ctx.Value(mappingKey{}) == nil) {
+		return next.HandleInitialize(ctx, in)
+	}
+	creds, err := cfg.Credentials.Retrieve(ctx)
+	if err != nil {
+		return next.HandleInitialize(ctx, in)
+	}
+	params, err := json.Marshal(in.Parameters)
+	if err != nil {
+		return next.HandleInitialize(ctx, in)
+	}
+	sum := sha256.Sum256([]byte(strings.Join([]string{creds.AccessKeyID, awsmiddleware.GetRegion(ctx), EndpointURL, op, string(params)}, "\n")))
+	path := filepath.Join(dir, cachePrefix(service)+op+"-"+hex.EncodeToString(sum[:16])+".json")
+
+	if ctx.Value(freshKey{}) == nil {
+		if fi, err := os.Stat(path); err == nil && time.Since(fi.ModTime()) < d.ttl {
+			if b, err := os.ReadFile(path); err == nil {
+				out := d.out()
+				if json.Unmarshal(b, out) == nil {
+					return middleware.InitializeOutput{Result: out}, middleware.Metadata{}, nil
+				}
+			}
+		}
+	}
+	out, md, err := next.HandleInitialize(ctx, in)
+	if err == nil {
+		writeCached(dir, path, out.Result)
+	}
+	return out, md, err
+}
+
+// cachePrefix starts the name of the files kept for service, e.g. batch-.
+func cachePrefix(service string) string {
+	return strings.ToLower(strings.ReplaceAll(service, " ", "")) + "-"
+}
+
+// writeCached writes v to path so that it is only readable by the user. Errors are ignored as
+// the call is then just made again.
+func writeCached(dir, path string, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return
+	}
+	// written to a temporary file first so that a run at the same time never reads half of it.
+	f, err := os.CreateTemp(dir, ".tmp-")
+	if err != nil {
+		return
+	}
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+}
+
+// forgetCached removes the responses kept for service after something of it may have changed.
+func forgetCached(dir, service string) {
+	paths, _ := filepath.Glob(filepath.Join(dir, cachePrefix(service)+"*.json"))
+	for _, p := range paths {
+		os.Remove(p)
+	}
+}
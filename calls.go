@@ -0,0 +1,181 @@
+package batchit
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"sync"
+
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/service/batch"
+	batchtypes "github.com/aws/aws-sdk-go-v2/service/batch/types"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// maxDescribeJobs is the most jobs that Batch accepts in a DescribeJobs call.
+const maxDescribeJobs = 100
+
+// sharedOperations are the Batch calls that are only read so that, when several goroutines make
+// the same call at once, such as for the jobs of one queue, it is made once for all of them.
+var sharedOperations = map[string]bool{
+	"DescribeJobs":                true,
+	"DescribeJobQueues":           true,
+	"DescribeComputeEnvironments": true,
+	"DescribeJobDefinitions":      true,
+	"ListJobs":                    true,
+}
+
+// cachedOperations are the shared calls whose responses are kept for the rest of the command as
+// queues and compute environments rarely change while it runs.
+var cachedOperations = map[string]bool{
+	"DescribeJobQueues":           true,
+	"DescribeComputeEnvironments": true,
+}
+
+type freshKey struct{}
+
+// Fresh returns ctx for calls that must not be answered from the responses kept by LoadConfig
+// in memory or on disk, such as those of a monitor that polls the capacity of compute
+// environments. Their responses are still kept for other calls.
+func Fresh(ctx context.Context) context.Context {
+	return context.WithValue(ctx, freshKey{}, true)
+}
+
+// sharedCall is a call that is being made, or for cachedOperations has been made, for every
+// caller with the same key. done is closed once the response is set.
+type sharedCall struct {
+	done chan struct{}
+	out  middleware.InitializeOutput
+	md   middleware.Metadata
+	err  error
+}
+
+var calls = struct {
+	sync.Mutex
+	m map[string]*sharedCall
+}{m: make(map[string]*sharedCall)}
+
+// shareCalls adds the middleware of LoadConfig that splits DescribeJobs calls into chunks of
+// maxDescribeJobs and shares the responses of sharedOperations until a Batch call that creates,
+// updates or deletes something. Each caller gets its own copy of
+// a shared response but the slices in it are shared so they must not be changed.
+func shareCalls(stack *middleware.Stack) error {
+	return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("BatchitShareCalls", handleShared), middleware.After)
+}
+
+func handleShared(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+	if awsmiddleware.GetServiceID(ctx) != batch.ServiceID {
+		return next.HandleInitialize(ctx, in)
+	}
+	op := awsmiddleware.GetOperationName(ctx)
+	if strings.HasPrefix(op, "Create") || strings.HasPrefix(op, "Update") || strings.HasPrefix(op, "Delete") {
+		out, md, err := next.HandleInitialize(ctx, in)
+		forgetCalls()
+		return out, md, err
+	}
+	if p, ok := in.Parameters.(*batch.DescribeJobsInput); ok && len(p.Jobs) > maxDescribeJobs {
+		return describeJobsChunks(ctx, in, p, next)
+	}
+	if !sharedOperations[op] {
+		return next.HandleInitialize(ctx, in)
+	}
+	params, err := json.Marshal(in.Parameters)
+	if err != nil {
+		return next.HandleInitialize(ctx, in)
+	}
+	key := awsmiddleware.GetRegion(ctx) + " " + op + " " + string(params)
+	// a call from Mapping may be answered from disk so it is not shared with those that need
+	// the current state.
+	if ctx.Value(mappingKey{}) != nil {
+		key += " mapping"
+	}
+
+	calls.Lock()
+	c, ok := calls.m[key]
+	// a call that is still being made is as fresh as a new one.
+	if ok && ctx.Value(freshKey{}) != nil && c.finished() {
+		ok = false
+	}
+	if !ok {
+		c = &sharedCall{done: make(chan struct{})}
+		calls.m[key] = c
+	}
+	calls.Unlock()
+	if ok {
+		select {
+		case <-c.done:
+			return c.result(), c.md, c.err
+		case <-ctx.Done():
+			return middleware.InitializeOutput{}, middleware.Metadata{}, ctx.Err()
+		}
+	}
+
+	c.out, c.md, c.err = next.HandleInitialize(ctx, in)
+	// errors are not kept so that the next caller tries again.
+	if c.err != nil || !cachedOperations[op] {
+		calls.Lock()
+		delete(calls.m, key)
+		calls.Unlock()
+	}
+	close(c.done)
+	return c.result(), c.md, c.err
+}
+
+func (c *sharedCall) finished() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// forgetCalls drops the responses that are kept after a queue or compute environment may have
+// been changed.
+func forgetCalls() {
+	calls.Lock()
+	defer calls.Unlock()
+	for k, c := range calls.m {
+		if c.finished() {
+			delete(calls.m, k)
+		}
+	}
+}
+
+// result returns a copy of the output of c for a caller, as the client of each sets its
+// ResultMetadata.
+func (c *sharedCall) result() middleware.InitializeOutput {
+	v := reflect.ValueOf(c.out.Result)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return c.out
+	}
+	cp := reflect.New(v.Elem().Type())
+	cp.Elem().Set(v.Elem())
+	return middleware.InitializeOutput{Result: cp.Interface()}
+}
+
+// describeJobsChunks makes a DescribeJobs call for each chunk of the jobs of p and returns their
+// jobs as the response of one.
+func describeJobsChunks(ctx context.Context, in middleware.InitializeInput, p *batch.DescribeJobsInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+	var jobs []batchtypes.JobDetail
+	var md middleware.Metadata
+	for i := 0; i < len(p.Jobs); i += maxDescribeJobs {
+		j := i + maxDescribeJobs
+		if j > len(p.Jobs) {
+			j = len(p.Jobs)
+		}
+		chunk := *p
+		chunk.Jobs = p.Jobs[i:j]
+		in.Parameters = &chunk
+		out, m, err := handleShared(ctx, in, next)
+		if err != nil {
+			return out, m, err
+		}
+		if o, ok := out.Result.(*batch.DescribeJobsOutput); ok {
+			jobs = append(jobs, o.Jobs...)
+		}
+		md = m
+	}
+	return middleware.InitializeOutput{Result: &batch.DescribeJobsOutput{Jobs: jobs, ResultMetadata: md}}, md, nil
+}
@@ -0,0 +1,114 @@
+package cancel
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/base2genomics/batchit"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/batch"
+	batchtypes "github.com/aws/aws-sdk-go-v2/service/batch/types"
+)
+
+type cliargs struct {
+	Region     string `arg:"env:AWS_DEFAULT_REGION,help:region for batch setup. see batchit help for the default."`
+	Queue      string `arg:"required,help:job queue to search."`
+	NamePrefix string `arg:"required,help:cancel jobs whose name starts with this."`
+	Reason     string `arg:"help:reason recorded with each cancelled job."`
+	DryRun     bool   `arg:"help:list the jobs that would be cancelled without cancelling them."`
+}
+
+func (c cliargs) Version() string {
+	return batchit.Version
+}
+
+func (c cliargs) Description() string {
+	return `Cancel all jobs in a queue with a name prefix that have not yet started (SUBMITTED, PENDING or RUNNABLE).
+This is useful to abort a submission that was made with the wrong parameters. Use kill to stop jobs that are running.`
+}
+
+// Queued returns the jobs in queue whose names start with prefix and that have not started.
+func Queued(ctx context.Context, b *batch.Client, queue, prefix string) ([]batchtypes.JobSummary, error) {
+	lji := &batch.ListJobsInput{
+		JobQueue: aws.String(queue),
+		// when a filter is given, jobs of every status are returned.
+		Filters: []batchtypes.KeyValuesPair{{Name: aws.String("JOB_NAME"), Values: []string{prefix + "*"}}},
+	}
+	var jobs []batchtypes.JobSummary
+	pages := batch.NewListJobsPaginator(b, lji)
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return jobs, err
+		}
+		for _, j := range page.JobSummaryList {
+			if !strings.HasPrefix(aws.ToString(j.JobName), prefix) {
+				continue
+			}
+			switch j.Status {
+			case batchtypes.JobStatusSubmitted, batchtypes.JobStatusPending, batchtypes.JobStatusRunnable:
+				jobs = append(jobs, j)
+			}
+		}
+	}
+	return jobs, nil
+}
+
+func Main() error {
+	cli := &cliargs{Reason: "cancelled by batchit"}
+	p := batchit.MustParse(cli)
+	if cli.NamePrefix == "" {
+		p.Fail("--nameprefix can not be empty")
+	}
+	ctx := context.Background()
+	cfg, err := batchit.LoadConfig(ctx, cli.Region)
+	if err != nil {
+		return err
+	}
+	b := batch.NewFromConfig(cfg)
+
+	jobs, err := Queued(ctx, b, cli.Queue, cli.NamePrefix)
+	if err != nil {
+		return err
+	}
+	if len(jobs) == 0 {
+		log.Printf("[batchit cancel] no queued jobs starting with %s in %s", cli.NamePrefix, cli.Queue)
+		return nil
+	}
+	failed := 0
+	// first is the first error which sets the exit code when no job was cancelled.
+	var first error
+	for _, j := range jobs {
+		e := batchit.Event{Type: batchit.EventJobCancelled, JobId: *j.JobId, JobName: aws.ToString(j.JobName), Queue: cli.Queue, DryRun: cli.DryRun}
+		if cli.DryRun {
+			log.Printf("[batchit cancel] would cancel %s (%s) which is %s", *j.JobId, aws.ToString(j.JobName), j.Status)
+			batchit.Emit(e)
+			continue
+		}
+		if _, err := b.CancelJob(ctx, &batch.CancelJobInput{JobId: j.JobId, Reason: aws.String(cli.Reason)}); err != nil {
+			log.Printf("[batchit cancel] error cancelling %s: %s", *j.JobId, err)
+			e.Error = err.Error()
+			batchit.Emit(e)
+			if failed++; first == nil {
+				first = err
+			}
+			continue
+		}
+		log.Printf("[batchit cancel] cancelled %s (%s)", *j.JobId, aws.ToString(j.JobName))
+		batchit.Emit(e)
+	}
+	if !cli.DryRun {
+		log.Printf("[batchit cancel] cancelled %d of %d jobs", len(jobs)-failed, len(jobs))
+	}
+	if failed > 0 {
+		err := fmt.Errorf("cancel: %d of %d jobs could not be cancelled", failed, len(jobs))
+		if failed < len(jobs) {
+			return batchit.Exit(batchit.ExitPartial, err)
+		}
+		return batchit.Exit(batchit.ExitCode(first), err)
+	}
+	return nil
+}
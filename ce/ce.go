@@ -0,0 +1,42 @@
+package ce
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+var subs = map[string]struct {
+	help string
+	main func()
+}{
+	"scale":  {"change the capacity of a compute environment or enable/disable it", ScaleMain},
+	"create": {"create a compute environment and job queue from a YAML file", CreateMain},
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: batchit ce <command> [options]\n\ncommands:")
+	var keys []string
+	for k := range subs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(os.Stderr, "  %-8s: %s\n", k, subs[k].help)
+	}
+	os.Exit(1)
+}
+
+// Main dispatches to the compute environment commands.
+func Main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	s, ok := subs[os.Args[1]]
+	if !ok {
+		usage()
+	}
+	// remove the command name as is done for batchit itself.
+	os.Args = append(os.Args[:1], os.Args[2:]...)
+	s.main()
+}
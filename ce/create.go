@@ -0,0 +1,273 @@
+package ce
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"time"
+
+	"github.com/base2genomics/batchit"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/batch"
+	batchtypes "github.com/aws/aws-sdk-go-v2/service/batch/types"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	yaml "gopkg.in/yaml.v2"
+)
+
+type createArgs struct {
+	Region string `arg:"env:AWS_DEFAULT_REGION,help:region for batch setup. see batchit help for the default."`
+	Config string `arg:"required,help:YAML file describing the compute environment and queue."`
+	DryRun bool   `arg:"help:print the parsed configuration without creating anything."`
+}
+
+func (c createArgs) Version() string {
+	return batchit.Version
+}
+
+func (c createArgs) Description() string {
+	return `Create a managed compute environment and a job queue that uses it from a YAML file like:
+
+    name: myproject
+    type: SPOT              # or EC2 for on-demand
+    instance_types: [optimal]
+    min_vcpus: 0
+    max_vcpus: 256
+    bid_percentage: 60      # SPOT only
+    allocation_strategy: SPOT_PRICE_CAPACITY_OPTIMIZED  # SPOT only. default SPOT_CAPACITY_OPTIMIZED
+    spot_fleet_role: arn:aws:iam::123456789012:role/AmazonEC2SpotFleetRole
+    instance_role: ecsInstanceRole
+    subnets: [subnet-aaaa, subnet-bbbb]
+    security_groups: [sg-cccc]
+    install_batchit: true   # create a launch template that installs batchit on each instance
+    queue:
+      name: myproject-queue
+      priority: 1
+    tags:
+      project: myproject`
+}
+
+// Config describes a compute environment and its job queue.
+type Config struct {
+	Name               string            `yaml:"name"`
+	Type               string            `yaml:"type"`
+	InstanceTypes      []string          `yaml:"instance_types"`
+	MinvCpus           int64             `yaml:"min_vcpus"`
+	MaxvCpus           int64             `yaml:"max_vcpus"`
+	DesiredvCpus       int64             `yaml:"desired_vcpus"`
+	BidPercentage      int64             `yaml:"bid_percentage"`
+	AllocationStrategy string            `yaml:"allocation_strategy"`
+	SpotFleetRole      string            `yaml:"spot_fleet_role"`
+	InstanceRole       string            `yaml:"instance_role"`
+	ServiceRole        string            `yaml:"service_role"`
+	Subnets            []string          `yaml:"subnets"`
+	SecurityGroups     []string          `yaml:"security_groups"`
+	KeyPair            string            `yaml:"key_pair"`
+	ImageId            string            `yaml:"image_id"`
+	LaunchTemplate     string            `yaml:"launch_template"`
+	InstallBatchit     bool              `yaml:"install_batchit"`
+	Tags               map[string]string `yaml:"tags"`
+	Queue              struct {
+		Name     string `yaml:"name"`
+		Priority int64  `yaml:"priority"`
+	} `yaml:"queue"`
+}
+
+// ReadConfig reads and checks a Config, filling in defaults.
+func ReadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &Config{Type: string(batchtypes.CRTypeEc2), InstanceTypes: []string{"optimal"}, InstanceRole: "ecsInstanceRole"}
+	if err := yaml.UnmarshalStrict(data, c); err != nil {
+		return nil, err
+	}
+	if c.Name == "" {
+		return nil, fmt.Errorf("ce: name is required in %s", path)
+	}
+	if c.Type != string(batchtypes.CRTypeEc2) && c.Type != string(batchtypes.CRTypeSpot) {
+		return nil, fmt.Errorf("ce: type must be EC2 or SPOT, got: %s", c.Type)
+	}
+	if c.MaxvCpus <= 0 {
+		return nil, fmt.Errorf("ce: max_vcpus must be greater than 0")
+	}
+	if len(c.Subnets) == 0 || len(c.SecurityGroups) == 0 {
+		return nil, fmt.Errorf("ce: subnets and security_groups are required")
+	}
+	if c.LaunchTemplate != "" && c.InstallBatchit {
+		return nil, fmt.Errorf("ce: only one of launch_template and install_batchit can be given")
+	}
+	if c.Type == string(batchtypes.CRTypeSpot) && c.AllocationStrategy == "" {
+		c.AllocationStrategy = string(batchtypes.CRAllocationStrategySpotCapacityOptimized)
+	}
+	if c.Queue.Name == "" {
+		c.Queue.Name = c.Name
+	}
+	if c.Queue.Priority == 0 {
+		c.Queue.Priority = 1
+	}
+	return c, nil
+}
+
+// hostSetup installs batchit with mdadm (for ebsmount -n > 1 and localmount) and efs-utils (for
+// efsmount) on an ECS-optimized Amazon Linux 2 instance and raises the open file limit of containers.
+const hostSetup = `#!/bin/bash
+yum install -y -q mdadm amazon-efs-utils wget
+wget -qO /usr/bin/batchit https://github.com/base2genomics/batchit/releases/download/v%s/batchit || \
+	wget -qO /usr/bin/batchit https://github.com/base2genomics/batchit/releases/latest/download/batchit
+chmod +x /usr/bin/batchit
+if grep -q -- '--default-ulimit nofile=' /etc/sysconfig/docker; then
+	sed -i 's/--default-ulimit nofile=[0-9:]*/--default-ulimit nofile=65536:65536/' /etc/sysconfig/docker
+else
+	sed -i 's/^OPTIONS="/OPTIONS="--default-ulimit nofile=65536:65536 /' /etc/sysconfig/docker
+fi
+systemctl try-restart docker
+`
+
+// HostSetup returns the script that prepares an instance for batchit jobs with this version of batchit.
+func HostSetup() string {
+	return fmt.Sprintf(hostSetup, batchit.Version)
+}
+
+// batchitUserData runs HostSetup when an instance boots. Batch requires MIME multi-part user data.
+const batchitUserData = `MIME-Version: 1.0
+Content-Type: multipart/mixed; boundary="==BATCHIT=="
+
+--==BATCHIT==
+Content-Type: text/x-shellscript; charset="us-ascii"
+
+%s
+--==BATCHIT==--
+`
+
+// LaunchTemplate creates a launch template that prepares instances with HostSetup and returns its name.
+func LaunchTemplate(ctx context.Context, svc *ec2.Client, name string) (string, error) {
+	ud := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf(batchitUserData, HostSetup())))
+	lo, err := svc.CreateLaunchTemplate(ctx, &ec2.CreateLaunchTemplateInput{
+		LaunchTemplateName: aws.String(name),
+		VersionDescription: aws.String("batchit " + batchit.Version),
+		LaunchTemplateData: &ec2types.RequestLaunchTemplateData{UserData: aws.String(ud)},
+	})
+	if err != nil {
+		return "", err
+	}
+	return *lo.LaunchTemplate.LaunchTemplateName, nil
+}
+
+// WaitValid polls until the compute environment is VALID so that a queue can use it or an update has finished.
+func WaitValid(ctx context.Context, b *batch.Client, name string) error {
+	for i := 0; i < 60; i++ {
+		ce, err := Describe(batchit.Fresh(ctx), b, name)
+		if err != nil {
+			return err
+		}
+		switch ce.Status {
+		case batchtypes.CEStatusValid:
+			return nil
+		case batchtypes.CEStatusInvalid:
+			return fmt.Errorf("ce: compute environment %s is INVALID: %s", name, aws.ToString(ce.StatusReason))
+		}
+		time.Sleep(5 * time.Second)
+	}
+	return fmt.Errorf("ce: compute environment %s did not become VALID", name)
+}
+
+// Create makes the compute environment and queue described by c.
+func Create(ctx context.Context, cfg aws.Config, c *Config) error {
+	b := batch.NewFromConfig(cfg)
+	cr := &batchtypes.ComputeResource{
+		Type:             batchtypes.CRType(c.Type),
+		InstanceTypes:    c.InstanceTypes,
+		MinvCpus:         aws.Int32(int32(c.MinvCpus)),
+		MaxvCpus:         aws.Int32(int32(c.MaxvCpus)),
+		DesiredvCpus:     aws.Int32(int32(c.DesiredvCpus)),
+		InstanceRole:     aws.String(c.InstanceRole),
+		Subnets:          c.Subnets,
+		SecurityGroupIds: c.SecurityGroups,
+		Tags:             c.Tags,
+	}
+	if c.Type == string(batchtypes.CRTypeSpot) {
+		cr.AllocationStrategy = batchtypes.CRAllocationStrategy(c.AllocationStrategy)
+		if c.BidPercentage > 0 {
+			cr.BidPercentage = aws.Int32(int32(c.BidPercentage))
+		}
+		if c.SpotFleetRole != "" {
+			cr.SpotIamFleetRole = aws.String(c.SpotFleetRole)
+		}
+	}
+	if c.KeyPair != "" {
+		cr.Ec2KeyPair = aws.String(c.KeyPair)
+	}
+	if c.ImageId != "" {
+		cr.ImageId = aws.String(c.ImageId)
+	}
+	lt := c.LaunchTemplate
+	if c.InstallBatchit {
+		var err error
+		if lt, err = LaunchTemplate(ctx, ec2.NewFromConfig(cfg), c.Name+"-batchit"); err != nil {
+			return err
+		}
+		log.Printf("[batchit ce] created launch template %s", lt)
+	}
+	if lt != "" {
+		cr.LaunchTemplate = &batchtypes.LaunchTemplateSpecification{LaunchTemplateName: aws.String(lt)}
+	}
+	cci := &batch.CreateComputeEnvironmentInput{
+		ComputeEnvironmentName: aws.String(c.Name),
+		Type:                   batchtypes.CETypeManaged,
+		State:                  batchtypes.CEStateEnabled,
+		ComputeResources:       cr,
+		Tags:                   c.Tags,
+	}
+	// without a service role, batch uses its service-linked role.
+	if c.ServiceRole != "" {
+		cci.ServiceRole = aws.String(c.ServiceRole)
+	}
+	if _, err := b.CreateComputeEnvironment(ctx, cci); err != nil {
+		return err
+	}
+	log.Printf("[batchit ce] created compute environment %s. waiting for it to be valid", c.Name)
+	if err := WaitValid(ctx, b, c.Name); err != nil {
+		return err
+	}
+	_, err := b.CreateJobQueue(ctx, &batch.CreateJobQueueInput{
+		JobQueueName: aws.String(c.Queue.Name),
+		Priority:     aws.Int32(int32(c.Queue.Priority)),
+		State:        batchtypes.JQStateEnabled,
+		ComputeEnvironmentOrder: []batchtypes.ComputeEnvironmentOrder{
+			{ComputeEnvironment: aws.String(c.Name), Order: aws.Int32(1)},
+		},
+		Tags: c.Tags,
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("[batchit ce] created job queue %s", c.Queue.Name)
+	return nil
+}
+
+func CreateMain() {
+	cli := &createArgs{}
+	p := batchit.MustParse(cli)
+	c, err := ReadConfig(cli.Config)
+	if err != nil {
+		p.Fail(err.Error())
+	}
+	if cli.DryRun {
+		out, _ := yaml.Marshal(c)
+		fmt.Print(string(out))
+		return
+	}
+	ctx := context.Background()
+	cfg, err := batchit.LoadConfig(ctx, cli.Region)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := Create(ctx, cfg, c); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,111 @@
+package ce
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/base2genomics/batchit"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/batch"
+	batchtypes "github.com/aws/aws-sdk-go-v2/service/batch/types"
+)
+
+type scaleArgs struct {
+	Region  string `arg:"env:AWS_DEFAULT_REGION,help:region for batch setup. see batchit help for the default."`
+	Desired int64  `arg:"help:desired number of vCPUs."`
+	Min     int64  `arg:"help:minimum number of vCPUs."`
+	Max     int64  `arg:"help:maximum number of vCPUs."`
+	Enable  bool   `arg:"help:enable the compute environment so it can accept jobs."`
+	Disable bool   `arg:"help:disable the compute environment. running jobs continue but no new jobs are placed."`
+	Name    string `arg:"required,positional,help:name or ARN of the compute environment."`
+}
+
+func (s scaleArgs) Version() string {
+	return batchit.Version
+}
+
+func (s scaleArgs) Description() string {
+	return `Change the vCPU capacity of a managed compute environment or enable/disable it.
+Only the values that are given are changed.`
+}
+
+// unset marks a capacity that was not given on the command-line.
+const unset = -1
+
+func capacity(v int64) *int32 {
+	if v == unset {
+		return nil
+	}
+	return aws.Int32(int32(v))
+}
+
+// Describe returns the details of the named compute environment.
+func Describe(ctx context.Context, b *batch.Client, name string) (*batchtypes.ComputeEnvironmentDetail, error) {
+	co, err := b.DescribeComputeEnvironments(ctx, &batch.DescribeComputeEnvironmentsInput{ComputeEnvironments: []string{name}})
+	if err != nil {
+		return nil, err
+	}
+	if len(co.ComputeEnvironments) == 0 {
+		return nil, fmt.Errorf("ce: compute environment %s not found", name)
+	}
+	return &co.ComputeEnvironments[0], nil
+}
+
+func ScaleMain() {
+	cli := &scaleArgs{Desired: unset, Min: unset, Max: unset}
+	p := batchit.MustParse(cli)
+	if cli.Enable && cli.Disable {
+		p.Fail("only one of --enable and --disable can be given")
+	}
+	if cli.Desired == unset && cli.Min == unset && cli.Max == unset && !cli.Enable && !cli.Disable {
+		p.Fail("nothing to change. use --desired, --min, --max, --enable or --disable")
+	}
+	// the capacity that is changed must be the current one.
+	ctx := batchit.Fresh(context.Background())
+	cfg, err := batchit.LoadConfig(ctx, cli.Region)
+	if err != nil {
+		log.Fatal(err)
+	}
+	b := batch.NewFromConfig(cfg)
+
+	uci := &batch.UpdateComputeEnvironmentInput{ComputeEnvironment: aws.String(cli.Name)}
+	if cli.Desired != unset || cli.Min != unset || cli.Max != unset {
+		ce, err := Describe(ctx, b, cli.Name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cr := ce.ComputeResources
+		if cr == nil {
+			log.Fatalf("ce: %s is not a managed compute environment", cli.Name)
+		}
+		// check the new values against the current ones so the error is clearer than the API's.
+		min, max := int64(aws.ToInt32(cr.MinvCpus)), int64(aws.ToInt32(cr.MaxvCpus))
+		if cli.Min != unset {
+			min = cli.Min
+		}
+		if cli.Max != unset {
+			max = cli.Max
+		}
+		if min > max || (cli.Desired != unset && (cli.Desired < min || cli.Desired > max)) {
+			log.Fatalf("ce: need min (%d) <= desired (%d) <= max (%d)", min, cli.Desired, max)
+		}
+		uci.ComputeResources = &batchtypes.ComputeResourceUpdate{
+			DesiredvCpus: capacity(cli.Desired),
+			MinvCpus:     capacity(cli.Min),
+			MaxvCpus:     capacity(cli.Max),
+		}
+		log.Printf("[batchit ce] %s: min %d -> %d, max %d -> %d, desired %d", cli.Name, aws.ToInt32(cr.MinvCpus), min,
+			aws.ToInt32(cr.MaxvCpus), max, aws.ToInt32(cr.DesiredvCpus))
+	}
+	if cli.Enable {
+		uci.State = batchtypes.CEStateEnabled
+	} else if cli.Disable {
+		uci.State = batchtypes.CEStateDisabled
+	}
+	if _, err := b.UpdateComputeEnvironment(ctx, uci); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("[batchit ce] updated %s", cli.Name)
+}
@@ -0,0 +1,410 @@
+package checkpoint
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/base2genomics/batchit/stage"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// ManifestName is the name of the manifest under the destination prefix.
+const ManifestName = "manifest.json"
+
+// File is a file in a checkpoint.
+type File struct {
+	Size    int64       `json:"size"`
+	ModTime time.Time   `json:"mtime"`
+	Mode    os.FileMode `json:"mode"`
+	// Archive is the archive under the destination prefix with the latest copy of the file.
+	Archive string `json:"archive"`
+}
+
+// Manifest describes the latest checkpoint. Each checkpoint only archives the files that changed
+// since the one before so the files of a checkpoint are spread across archives.
+type Manifest struct {
+	// Seq is the number of the latest checkpoint.
+	Seq   int              `json:"seq"`
+	Time  time.Time        `json:"time"`
+	Files map[string]*File `json:"files"`
+}
+
+var archiveName = regexp.MustCompile(`^\d{6}\.tar\.gz$`)
+
+// Checkpointer archives the changes to a directory to an S3 prefix.
+type Checkpointer struct {
+	Dir     string
+	Bucket  string
+	Prefix  string
+	Exclude []string
+
+	svc *s3.Client
+	up  *manager.Uploader
+	m   *Manifest
+}
+
+// New returns a Checkpointer for dir and the latest checkpoint under the s3 prefix dest.
+func New(ctx context.Context, svc *s3.Client, dir, dest string) (*Checkpointer, error) {
+	bucket, prefix := splitPath(dest)
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	c := &Checkpointer{Dir: dir, Bucket: bucket, Prefix: prefix, svc: svc,
+		up: manager.NewUploader(svc)}
+	var err error
+	c.m, err = c.readManifest(ctx)
+	return c, err
+}
+
+func splitPath(s3path string) (bucket, key string) {
+	s3path = strings.TrimPrefix(s3path, "s3://")
+	bk := strings.SplitN(s3path, "/", 2)
+	if len(bk) != 2 {
+		return bk[0], ""
+	}
+	return bk[0], bk[1]
+}
+
+// Seq returns the number of the latest checkpoint. It is 0 if there is none.
+func (c *Checkpointer) Seq() int {
+	return c.m.Seq
+}
+
+func (c *Checkpointer) readManifest(ctx context.Context) (*Manifest, error) {
+	m := &Manifest{Files: make(map[string]*File)}
+	out, err := c.svc.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(c.Bucket), Key: aws.String(c.Prefix + ManifestName)})
+	var missing *s3types.NoSuchKey
+	if errors.As(err, &missing) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+	if err := json.NewDecoder(out.Body).Decode(m); err != nil {
+		return nil, fmt.Errorf("checkpoint: reading s3://%s/%s%s: %s", c.Bucket, c.Prefix, ManifestName, err)
+	}
+	return m, nil
+}
+
+func (c *Checkpointer) excluded(rel string) bool {
+	for _, pat := range c.Exclude {
+		if ok, _ := filepath.Match(pat, rel); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(pat, filepath.Base(rel)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// scan returns the regular files and symlinks under Dir by their slash-separated relative path.
+func (c *Checkpointer) scan() (map[string]os.FileInfo, error) {
+	files := make(map[string]os.FileInfo)
+	err := filepath.Walk(c.Dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			// files can be removed by the job during the walk.
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		rel, err := filepath.Rel(c.Dir, path)
+		if err != nil {
+			return err
+		}
+		if rel != "." && c.excluded(rel) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if fi.Mode().IsRegular() || fi.Mode()&os.ModeSymlink != 0 {
+			files[filepath.ToSlash(rel)] = fi
+		}
+		return nil
+	})
+	return files, err
+}
+
+func changed(f *File, fi os.FileInfo) bool {
+	return f == nil || f.Size != fi.Size() || !f.ModTime.Equal(fi.ModTime()) || f.Mode != fi.Mode()
+}
+
+// addFile writes a file to the archive. It returns nil if the file changed size while it was being
+// read, in which case the copy in the archive is not used.
+func (c *Checkpointer) addFile(tw *tar.Writer, rel string, fi os.FileInfo) (*File, error) {
+	path := filepath.Join(c.Dir, filepath.FromSlash(rel))
+	link := ""
+	if fi.Mode()&os.ModeSymlink != 0 {
+		var err error
+		if link, err = os.Readlink(path); err != nil {
+			return nil, err
+		}
+	}
+	hdr, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return nil, err
+	}
+	hdr.Name = rel
+	var f *os.File
+	if fi.Mode().IsRegular() {
+		if f, err = os.Open(path); err != nil {
+			return nil, err
+		}
+		defer f.Close()
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return nil, err
+	}
+	if f == nil {
+		return &File{Size: fi.Size(), ModTime: fi.ModTime(), Mode: fi.Mode()}, nil
+	}
+	n, err := io.CopyN(tw, f, fi.Size())
+	if err == io.EOF {
+		// the file shrank. the entry must still have the size in its header.
+		_, err = io.CopyN(tw, zeros{}, fi.Size()-n)
+		if err != nil {
+			return nil, err
+		}
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &File{Size: fi.Size(), ModTime: fi.ModTime(), Mode: fi.Mode()}, nil
+}
+
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// writeArchive uploads a gzipped tar of the files to name and returns those that were archived.
+func (c *Checkpointer) writeArchive(ctx context.Context, name string, rels []string, files map[string]os.FileInfo) (map[string]*File, error) {
+	added := make(map[string]*File, len(rels))
+	pr, pw := io.Pipe()
+	go func() {
+		// scratch data is often already compressed so speed matters more than size.
+		z, _ := gzip.NewWriterLevel(pw, gzip.BestSpeed)
+		tw := tar.NewWriter(z)
+		var err error
+		for _, rel := range rels {
+			var f *File
+			if f, err = c.addFile(tw, rel, files[rel]); err != nil {
+				if !os.IsNotExist(err) {
+					break
+				}
+				err = nil
+				continue
+			}
+			if f != nil {
+				f.Archive = name
+				added[rel] = f
+			}
+		}
+		if cerr := tw.Close(); err == nil {
+			err = cerr
+		}
+		if cerr := z.Close(); err == nil {
+			err = cerr
+		}
+		pw.CloseWithError(err)
+	}()
+	_, err := stage.Upload(ctx, c.up, &s3.PutObjectInput{
+		Bucket:      aws.String(c.Bucket),
+		Key:         aws.String(c.Prefix + name),
+		Body:        pr,
+		ContentType: aws.String("application/gzip"),
+	})
+	pr.CloseWithError(err)
+	return added, err
+}
+
+func (c *Checkpointer) writeManifest(ctx context.Context, m *Manifest) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = c.svc.PutObject(ctx, &s3.PutObjectInput{Bucket: aws.String(c.Bucket), Key: aws.String(c.Prefix + ManifestName),
+		Body: bytes.NewReader(data), ContentType: aws.String("application/json")})
+	return err
+}
+
+// gc removes the archives that no file in the manifest uses.
+func (c *Checkpointer) gc(ctx context.Context) error {
+	used := make(map[string]bool)
+	for _, f := range c.m.Files {
+		used[f.Archive] = true
+	}
+	var unused []string
+	pages := s3.NewListObjectsV2Paginator(c.svc, &s3.ListObjectsV2Input{Bucket: aws.String(c.Bucket), Prefix: aws.String(c.Prefix)})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, o := range page.Contents {
+			name := strings.TrimPrefix(aws.ToString(o.Key), c.Prefix)
+			if archiveName.MatchString(name) && !used[name] {
+				unused = append(unused, name)
+			}
+		}
+	}
+	for _, name := range unused {
+		if _, err := c.svc.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(c.Bucket), Key: aws.String(c.Prefix + name)}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Snapshot archives the files that changed since the latest checkpoint and then updates the
+// manifest. It returns the number of files archived.
+func (c *Checkpointer) Snapshot(ctx context.Context) (int, error) {
+	files, err := c.scan()
+	if err != nil {
+		return 0, err
+	}
+	var todo []string
+	for rel, fi := range files {
+		if changed(c.m.Files[rel], fi) {
+			todo = append(todo, rel)
+		}
+	}
+	next := &Manifest{Seq: c.m.Seq + 1, Time: time.Now().UTC(), Files: make(map[string]*File, len(files))}
+	for rel, f := range c.m.Files {
+		if _, ok := files[rel]; ok {
+			next.Files[rel] = f
+		}
+	}
+	if len(todo) == 0 && len(next.Files) == len(c.m.Files) {
+		return 0, nil
+	}
+	sort.Strings(todo)
+	added, err := c.writeArchive(ctx, fmt.Sprintf("%06d.tar.gz", next.Seq), todo, files)
+	if err != nil {
+		return 0, err
+	}
+	for rel, f := range added {
+		next.Files[rel] = f
+	}
+	// the manifest is written last so a checkpoint that is interrupted is not used.
+	if err := c.writeManifest(ctx, next); err != nil {
+		return 0, err
+	}
+	c.m = next
+	if err := c.gc(ctx); err != nil {
+		log.Printf("[batchit checkpoint] error removing unused archives: %s", err)
+	}
+	return len(added), nil
+}
+
+// Restore writes the files of the latest checkpoint to Dir. It returns the number of files.
+func (c *Checkpointer) Restore(ctx context.Context) (int, error) {
+	byArchive := make(map[string]map[string]*File)
+	for rel, f := range c.m.Files {
+		if byArchive[f.Archive] == nil {
+			byArchive[f.Archive] = make(map[string]*File)
+		}
+		byArchive[f.Archive][rel] = f
+	}
+	names := make([]string, 0, len(byArchive))
+	for name := range byArchive {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	n := 0
+	for _, name := range names {
+		k, err := c.extract(ctx, name, byArchive[name])
+		n += k
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// extract writes the files of the archive that are in want.
+func (c *Checkpointer) extract(ctx context.Context, name string, want map[string]*File) (int, error) {
+	out, err := c.svc.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(c.Bucket), Key: aws.String(c.Prefix + name)})
+	if err != nil {
+		return 0, err
+	}
+	defer out.Body.Close()
+	z, err := gzip.NewReader(out.Body)
+	if err != nil {
+		return 0, err
+	}
+	tr := tar.NewReader(z)
+	n := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+		f, ok := want[hdr.Name]
+		if !ok {
+			// replaced by a later checkpoint.
+			continue
+		}
+		rel := filepath.Clean(filepath.FromSlash(hdr.Name))
+		if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) || filepath.IsAbs(rel) {
+			return n, fmt.Errorf("checkpoint: %s in %s is outside of the directory", hdr.Name, name)
+		}
+		path := filepath.Join(c.Dir, rel)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return n, err
+		}
+		os.Remove(path)
+		if hdr.Typeflag == tar.TypeSymlink {
+			if err := os.Symlink(hdr.Linkname, path); err != nil {
+				return n, err
+			}
+			n++
+			continue
+		}
+		w, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode.Perm())
+		if err != nil {
+			return n, err
+		}
+		if _, err := io.Copy(w, tr); err != nil {
+			w.Close()
+			return n, err
+		}
+		if err := w.Close(); err != nil {
+			return n, err
+		}
+		// the time is kept so the next checkpoint does not archive the file again.
+		if err := os.Chtimes(path, f.ModTime, f.ModTime); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
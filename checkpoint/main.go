@@ -0,0 +1,169 @@
+package checkpoint
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/base2genomics/batchit"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+type cliargs struct {
+	Region  string        `arg:"env:AWS_DEFAULT_REGION,help:region for batch setup. see batchit help for the default."`
+	Dir     string        `arg:"required" help:"directory to checkpoint, e.g. the scratch volume."`
+	Dest    string        `arg:"required" help:"S3 prefix for the checkpoints, e.g. s3://bucket/ckpt/jobname."`
+	Every   time.Duration `arg:"help:how often to checkpoint."`
+	Exclude []string      `help:"glob patterns of paths or file names to leave out, e.g. '*.tmp'."`
+	Restore bool          `arg:"help:restore the latest checkpoint to --dir before starting."`
+	Once    bool          `arg:"help:checkpoint once and exit."`
+	Command []string      `arg:"positional,help:command to run after --. it is checkpointed until it exits."`
+}
+
+func (c cliargs) Version() string {
+	return batchit.Version
+}
+
+func (c cliargs) Description() string {
+	return `Checkpoint a directory to S3 periodically so that a long job on a spot queue can resume after its
+instance is reclaimed rather than starting over, e.g.:
+    batchit checkpoint --dir /mnt/scratch --dest s3://bucket/ckpt/jobname --every 30m --restore -- ./run.sh
+Each checkpoint uploads a tar.gz of only the files that changed since the one before and then a manifest of
+where the latest copy of every file is. With --restore, the latest checkpoint is written to --dir first; without
+a command batchit checkpoint then exits so it can be used at the start of a job. With a command, a checkpoint is
+taken every --every until it exits, and its exit code is kept. Without a command, checkpoints are taken until
+batchit checkpoint is sent SIGTERM, when a final checkpoint is taken.`
+}
+
+func snapshot(ctx context.Context, c *Checkpointer) error {
+	t := time.Now()
+	n, err := c.Snapshot(ctx)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		log.Printf("[batchit checkpoint] checkpoint %d of %d changed files to s3://%s/%s in %s", c.Seq(), n, c.Bucket, c.Prefix, time.Since(t).Round(time.Second))
+	}
+	return nil
+}
+
+// run runs the command with a checkpoint every interval and returns its exit code.
+func run(ctx context.Context, c *Checkpointer, command []string, every time.Duration) (int, error) {
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	// the command is expected to save its state on SIGTERM. it is sent on as soon as ctx is
+	// canceled by the signal, which also stops a checkpoint that is running, so that the state
+	// is kept by the final checkpoint once the command exits.
+	stop := context.AfterFunc(ctx, func() { cmd.Process.Signal(syscall.SIGTERM) })
+	defer stop()
+
+	tick := time.NewTicker(every)
+	defer tick.Stop()
+	for {
+		select {
+		case err := <-done:
+			if ee, ok := err.(*exec.ExitError); ok {
+				return ee.ExitCode(), nil
+			}
+			return 0, err
+		case <-tick.C:
+			if ctx.Err() != nil {
+				continue
+			}
+			if err := snapshot(ctx, c); err != nil {
+				log.Printf("[batchit checkpoint] error checkpointing %s: %s", c.Dir, err)
+			}
+		}
+	}
+}
+
+func Main() {
+	cli := &cliargs{Every: 30 * time.Minute}
+	p := batchit.MustParse(cli)
+	if cli.Every <= 0 {
+		p.Fail("--every must be positive")
+	}
+	if !strings.HasPrefix(cli.Dest, "s3://") {
+		p.Fail("expected an S3 prefix like s3://bucket/ckpt/jobname")
+	}
+	if cli.Once && len(cli.Command) > 0 {
+		p.Fail("--once can not be used with a command")
+	}
+	// SIGINT or SIGTERM cancel ctx. the final checkpoint is then taken with a cleanup context.
+	ctx := batchit.Context()
+	cfg, err := batchit.LoadConfig(ctx, cli.Region)
+	if err != nil {
+		log.Fatal(err)
+	}
+	c, err := New(ctx, s3.NewFromConfig(cfg), cli.Dir, cli.Dest)
+	if err != nil {
+		log.Fatal(err)
+	}
+	c.Exclude = cli.Exclude
+
+	if cli.Restore {
+		if c.Seq() == 0 {
+			log.Printf("[batchit checkpoint] no checkpoint found at %s. starting from scratch", cli.Dest)
+		} else {
+			t := time.Now()
+			n, err := c.Restore(ctx)
+			if err != nil {
+				log.Fatalf("[batchit checkpoint] error restoring checkpoint %d: %s", c.Seq(), err)
+			}
+			log.Printf("[batchit checkpoint] restored %d files from checkpoint %d to %s in %s", n, c.Seq(), cli.Dir, time.Since(t).Round(time.Second))
+		}
+		if len(cli.Command) == 0 && !cli.Once {
+			return
+		}
+	}
+
+	if len(cli.Command) > 0 {
+		code, err := run(ctx, c, cli.Command, cli.Every)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[batchit checkpoint] %s\n", err)
+			os.Exit(127)
+		}
+		// a job that failed may be retried so the last state is kept either way.
+		cctx, cancel := batchit.CleanupContext(ctx)
+		defer cancel()
+		if err := snapshot(cctx, c); err != nil {
+			log.Printf("[batchit checkpoint] error checkpointing %s: %s", c.Dir, err)
+		}
+		os.Exit(code)
+	}
+
+	if err := snapshot(ctx, c); err != nil {
+		log.Fatal(err)
+	}
+	if cli.Once {
+		return
+	}
+	tick := time.NewTicker(cli.Every)
+	for {
+		select {
+		case <-ctx.Done():
+			cctx, cancel := batchit.CleanupContext(ctx)
+			defer cancel()
+			if err := snapshot(cctx, c); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case <-tick.C:
+			if err := snapshot(ctx, c); err != nil {
+				log.Printf("[batchit checkpoint] error checkpointing %s: %s", c.Dir, err)
+			}
+		}
+	}
+}
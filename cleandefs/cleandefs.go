@@ -0,0 +1,173 @@
+package cleandefs
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/base2genomics/batchit"
+	"github.com/base2genomics/batchit/logof"
+	"github.com/base2genomics/batchit/submit"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/batch"
+	batchtypes "github.com/aws/aws-sdk-go-v2/service/batch/types"
+)
+
+type cliargs struct {
+	Region     string `arg:"env:AWS_DEFAULT_REGION,help:region for batch setup. see batchit help for the default."`
+	Prefix     string `arg:"help:only consider job definitions whose name starts with this."`
+	KeepLatest int    `arg:"--keep-latest,help:number of the most recent revisions of each job definition to keep."`
+	OlderThan  string `arg:"--older-than,help:only deregister revisions created longer ago than this e.g. 30d. see below for how their age is found."`
+	DryRun     bool   `arg:"help:list the revisions that would be deregistered without deregistering them."`
+}
+
+func (c cliargs) Version() string {
+	return batchit.Version
+}
+
+func (c cliargs) Description() string {
+	return `Deregister old revisions of job definitions, keeping the latest of each.
+Batch does not record when a revision was registered but batchit submit tags the revisions it
+registers with the time. Revision numbers only increase so a revision without the tag is at least
+as old as the next newer revision with it, even one that has been deregistered. With --older-than,
+revisions whose age can not be found this way are kept and listed.`
+}
+
+// Created returns when the definition was registered if that was recorded by batchit.
+func Created(jd *batchtypes.JobDefinition) (time.Time, bool) {
+	v, ok := jd.Tags[submit.CreatedTag]
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	return t, err == nil
+}
+
+// Revisions returns the active and inactive revisions of the job definitions whose names start
+// with prefix. The inactive ones are only used by Stale to find the age of the active ones.
+func Revisions(ctx context.Context, b *batch.Client, prefix string) ([]*batchtypes.JobDefinition, error) {
+	var defs []*batchtypes.JobDefinition
+	pages := batch.NewDescribeJobDefinitionsPaginator(b, &batch.DescribeJobDefinitionsInput{})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return defs, err
+		}
+		for i := range page.JobDefinitions {
+			if jd := &page.JobDefinitions[i]; strings.HasPrefix(aws.ToString(jd.JobDefinitionName), prefix) {
+				defs = append(defs, jd)
+			}
+		}
+	}
+	return defs, nil
+}
+
+// active reports whether jd has not been deregistered.
+func active(jd *batchtypes.JobDefinition) bool {
+	return jd.Status == nil || *jd.Status == "ACTIVE"
+}
+
+// Stale returns the active revisions of each definition other than the latest keep active ones.
+// If cutoff is not zero, only revisions created before it are returned. A revision without
+// the time from Created was created before the next newer revision with it, active or not, as
+// revisions only increase. Those without such a revision are returned as unknown.
+func Stale(defs []*batchtypes.JobDefinition, keep int, cutoff time.Time) (stale, unknown []*batchtypes.JobDefinition) {
+	byName := make(map[string][]*batchtypes.JobDefinition)
+	for _, jd := range defs {
+		byName[*jd.JobDefinitionName] = append(byName[*jd.JobDefinitionName], jd)
+	}
+	for _, revs := range byName {
+		sort.Slice(revs, func(i, j int) bool { return aws.ToInt32(revs[i].Revision) > aws.ToInt32(revs[j].Revision) })
+		// before is the time of the nearest newer revision that has one.
+		var before time.Time
+		kept := 0
+		for _, jd := range revs {
+			if t, ok := Created(jd); ok {
+				before = t
+			}
+			if !active(jd) {
+				continue
+			}
+			if kept < keep {
+				kept++
+				continue
+			}
+			switch {
+			case cutoff.IsZero():
+				stale = append(stale, jd)
+			case before.IsZero():
+				unknown = append(unknown, jd)
+			case before.Before(cutoff):
+				stale = append(stale, jd)
+			}
+		}
+	}
+	byArn := func(s []*batchtypes.JobDefinition) {
+		sort.Slice(s, func(i, j int) bool { return *s[i].JobDefinitionArn < *s[j].JobDefinitionArn })
+	}
+	byArn(stale)
+	byArn(unknown)
+	return stale, unknown
+}
+
+func Main() {
+	cli := &cliargs{KeepLatest: 3}
+	p := batchit.MustParse(cli)
+	if cli.KeepLatest < 0 {
+		p.Fail("--keep-latest must be >= 0")
+	}
+	var cutoff time.Time
+	if cli.OlderThan != "" {
+		d, err := logof.ParseDuration(cli.OlderThan)
+		if err != nil {
+			p.Fail(err.Error())
+		}
+		cutoff = time.Now().Add(-d)
+	}
+	ctx := context.Background()
+	cfg, err := batchit.LoadConfig(ctx, cli.Region)
+	if err != nil {
+		log.Fatal(err)
+	}
+	b := batch.NewFromConfig(cfg)
+
+	defs, err := Revisions(ctx, b, cli.Prefix)
+	if err != nil {
+		log.Fatal(err)
+	}
+	stale, unknown := Stale(defs, cli.KeepLatest, cutoff)
+	for _, jd := range unknown {
+		log.Printf("[batchit clean-defs] keeping %s:%d as when it was registered is not known", *jd.JobDefinitionName, aws.ToInt32(jd.Revision))
+	}
+	failed := 0
+	for _, jd := range stale {
+		name := fmt.Sprintf("%s:%d", *jd.JobDefinitionName, aws.ToInt32(jd.Revision))
+		if cli.DryRun {
+			fmt.Println(name)
+			continue
+		}
+		if _, err := b.DeregisterJobDefinition(ctx, &batch.DeregisterJobDefinitionInput{JobDefinition: jd.JobDefinitionArn}); err != nil {
+			log.Printf("[batchit clean-defs] error deregistering %s: %s", name, err)
+			failed++
+		}
+	}
+	verb := "deregistered"
+	if cli.DryRun {
+		verb = "would deregister"
+	}
+	n := 0
+	for _, jd := range defs {
+		if active(jd) {
+			n++
+		}
+	}
+	log.Printf("[batchit clean-defs] %s %d of %d active revisions", verb, len(stale)-failed, n)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,81 @@
+package cleandefs
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/base2genomics/batchit/submit"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	batchtypes "github.com/aws/aws-sdk-go-v2/service/batch/types"
+)
+
+// rev returns revision r of name. created is the time in its tag if it is not zero.
+func rev(name string, r int32, status string, created time.Time) *batchtypes.JobDefinition {
+	jd := &batchtypes.JobDefinition{JobDefinitionName: aws.String(name), Revision: aws.Int32(r), Status: aws.String(status),
+		JobDefinitionArn: aws.String(fmt.Sprintf("arn:aws:batch:us-east-1:123456789012:job-definition/%s:%02d", name, r))}
+	if !created.IsZero() {
+		jd.Tags = map[string]string{submit.CreatedTag: created.Format(time.RFC3339)}
+	}
+	return jd
+}
+
+func names(defs []*batchtypes.JobDefinition) []string {
+	var out []string
+	for _, jd := range defs {
+		out = append(out, fmt.Sprintf("%s:%d", *jd.JobDefinitionName, *jd.Revision))
+	}
+	return out
+}
+
+func TestStale(t *testing.T) {
+	now := time.Now()
+	old, recent := now.Add(-30*24*time.Hour), now.Add(-time.Hour)
+	cutoff := now.Add(-7 * 24 * time.Hour)
+	var none time.Time
+
+	for _, c := range []struct {
+		name    string
+		defs    []*batchtypes.JobDefinition
+		keep    int
+		cutoff  time.Time
+		stale   []string
+		unknown []string
+	}{
+		{name: "keep latest", keep: 2, defs: []*batchtypes.JobDefinition{
+			rev("a", 1, "ACTIVE", none), rev("a", 2, "ACTIVE", none), rev("a", 3, "ACTIVE", none), rev("b", 1, "ACTIVE", none)},
+			stale: []string{"a:1"}},
+		{name: "keep counts active", keep: 1, defs: []*batchtypes.JobDefinition{
+			rev("a", 1, "ACTIVE", none), rev("a", 2, "ACTIVE", none), rev("a", 3, "INACTIVE", none)},
+			stale: []string{"a:1"}},
+		{name: "tagged", keep: 0, cutoff: cutoff, defs: []*batchtypes.JobDefinition{
+			rev("a", 1, "ACTIVE", old), rev("a", 2, "ACTIVE", recent)},
+			stale: []string{"a:1"}},
+		// submit deregisters what it registers so the time is usually on an inactive revision.
+		{name: "from newer inactive", keep: 0, cutoff: cutoff, defs: []*batchtypes.JobDefinition{
+			rev("a", 1, "ACTIVE", none), rev("a", 2, "ACTIVE", none), rev("a", 3, "INACTIVE", old),
+			rev("a", 4, "ACTIVE", none), rev("a", 5, "INACTIVE", recent)},
+			stale: []string{"a:1", "a:2"}},
+		{name: "nearest newer", keep: 0, cutoff: cutoff, defs: []*batchtypes.JobDefinition{
+			rev("a", 1, "ACTIVE", none), rev("a", 2, "INACTIVE", recent), rev("a", 3, "INACTIVE", old)},
+			stale: nil},
+		{name: "unknown", keep: 1, cutoff: cutoff, defs: []*batchtypes.JobDefinition{
+			rev("a", 1, "ACTIVE", none), rev("a", 2, "ACTIVE", none), rev("a", 3, "ACTIVE", none)},
+			unknown: []string{"a:1", "a:2"}},
+		{name: "no cutoff", keep: 0, defs: []*batchtypes.JobDefinition{
+			rev("a", 1, "ACTIVE", none), rev("a", 2, "INACTIVE", none)},
+			stale: []string{"a:1"}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			stale, unknown := Stale(c.defs, c.keep, c.cutoff)
+			if got := names(stale); !reflect.DeepEqual(got, c.stale) {
+				t.Errorf("expected stale %v. got %v", c.stale, got)
+			}
+			if got := names(unknown); !reflect.DeepEqual(got, c.unknown) {
+				t.Errorf("expected unknown %v. got %v", c.unknown, got)
+			}
+		})
+	}
+}
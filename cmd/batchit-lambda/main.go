@@ -0,0 +1,24 @@
+//go:build lambda
+// +build lambda
+
+// batchit-lambda runs the submission logic of batchit as an AWS Lambda handler. Build it with:
+//
+//	GOOS=linux GOARCH=amd64 go build -tags lambda -o bootstrap ./cmd/batchit-lambda
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/base2genomics/batchit/lambda"
+
+	awslambda "github.com/aws/aws-lambda-go/lambda"
+)
+
+func main() {
+	h, err := lambda.NewHandler(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
+	awslambda.Start(h.Handle)
+}
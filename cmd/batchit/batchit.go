@@ -1,18 +1,66 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"log"
 	"os"
 	"sort"
 	"strconv"
 
 	"github.com/base2genomics/batchit"
+	"github.com/base2genomics/batchit/ami"
+	"github.com/base2genomics/batchit/arraymap"
+	"github.com/base2genomics/batchit/audit"
+	"github.com/base2genomics/batchit/cancel"
+	"github.com/base2genomics/batchit/ce"
+	"github.com/base2genomics/batchit/checkpoint"
+	"github.com/base2genomics/batchit/cleandefs"
+	"github.com/base2genomics/batchit/completion"
+	"github.com/base2genomics/batchit/cost"
+	"github.com/base2genomics/batchit/dag"
+	"github.com/base2genomics/batchit/db"
 	"github.com/base2genomics/batchit/ddv"
+	"github.com/base2genomics/batchit/doctor"
+	"github.com/base2genomics/batchit/drain"
+	"github.com/base2genomics/batchit/events"
+	"github.com/base2genomics/batchit/exec"
 	"github.com/base2genomics/batchit/exsmount"
+	"github.com/base2genomics/batchit/gate"
+	"github.com/base2genomics/batchit/gc"
+	"github.com/base2genomics/batchit/graph"
+	"github.com/base2genomics/batchit/heartbeat"
+	"github.com/base2genomics/batchit/instances"
+	"github.com/base2genomics/batchit/kill"
 	"github.com/base2genomics/batchit/logof"
+	"github.com/base2genomics/batchit/logsexport"
+	"github.com/base2genomics/batchit/ls"
+	"github.com/base2genomics/batchit/metric"
+	"github.com/base2genomics/batchit/mirror"
+	"github.com/base2genomics/batchit/preset"
+	"github.com/base2genomics/batchit/price"
+	"github.com/base2genomics/batchit/profile"
+	"github.com/base2genomics/batchit/queues"
+	"github.com/base2genomics/batchit/quota"
+	"github.com/base2genomics/batchit/report"
+	"github.com/base2genomics/batchit/resubmit"
+	"github.com/base2genomics/batchit/runlocal"
+	"github.com/base2genomics/batchit/s3exists"
 	"github.com/base2genomics/batchit/s3upload"
+	"github.com/base2genomics/batchit/sentinel"
+	"github.com/base2genomics/batchit/spotadvisor"
+	"github.com/base2genomics/batchit/sqsconsume"
+	"github.com/base2genomics/batchit/stage"
+	"github.com/base2genomics/batchit/status"
 	"github.com/base2genomics/batchit/submit"
+	"github.com/base2genomics/batchit/tag"
+	"github.com/base2genomics/batchit/throttle"
+	"github.com/base2genomics/batchit/top"
+	"github.com/base2genomics/batchit/validate"
+	"github.com/base2genomics/batchit/wait"
+	"github.com/base2genomics/batchit/watcher"
+	"github.com/base2genomics/batchit/whoami"
 )
 
 type progPair struct {
@@ -20,14 +68,105 @@ type progPair struct {
 	main func()
 }
 
+// name is the subcommand that is running.
+var name string
+
 var progs = map[string]progPair{
-	"ebsmount":   progPair{"create and mount an EBS volume from an EC2 instance", exsmount.Main},
-	"efsmount":   progPair{"mount an EFS drive from an EC2 instance", exsmount.EFSMain},
-	"localmount": progPair{"RAID and mount local storage", exsmount.LocalMain},
-	"logof":      progPair{"get the log of a given job id", logof.Main},
-	"submit":     progPair{"run a batch command", submit.Main},
-	"ddv":        progPair{"detach and delete a volume by id", ddv.Main},
-	"s3upload":   progPair{"upload local files to matching s3 paths in parallel", s3upload.Main},
+	"ebsmount":     progPair{"create and mount an EBS volume from an EC2 instance", surface(exsmount.Main)},
+	"efsmount":     progPair{"mount an EFS drive from an EC2 instance", surface(exsmount.EFSMain)},
+	"localmount":   progPair{"RAID and mount local storage", surface(exsmount.LocalMain)},
+	"logof":        progPair{"get the log of a given job id", surface(logof.Main)},
+	"submit":       progPair{"run a batch command", surface(submit.Main)},
+	"ddv":          progPair{"detach and delete a volume by id", surface(ddv.Main)},
+	"s3upload":     progPair{"upload local files to matching s3 paths in parallel", surface(s3upload.Main)},
+	"s3exists":     progPair{"check that s3 paths exist and are non-empty", surface(s3exists.Main)},
+	"wait":         progPair{"block until jobs reach a status", surface(wait.Main)},
+	"status":       progPair{"show the status of jobs as a table", surface(status.Main)},
+	"kill":         progPair{"cancel or terminate jobs", surface(kill.Main)},
+	"cancel":       progPair{"cancel queued jobs with a name prefix", surface(cancel.Main)},
+	"resubmit":     progPair{"resubmit a job or the failed children of an array job", surface(resubmit.Main)},
+	"ls":           progPair{"list the jobs in a queue", ls.Main},
+	"queues":       progPair{"show job queues and the number of jobs in each status", queues.Main},
+	"ce":           progPair{"manage compute environments (scale, create)", ce.Main},
+	"clean-defs":   progPair{"deregister old revisions of job definitions", cleandefs.Main},
+	"top":          progPair{"live terminal monitor of a job queue", top.Main},
+	"events":       progPair{"stream batch job state changes as JSON lines", surface(events.Main)},
+	"metric":       progPair{"publish a custom CloudWatch metric from a job", metric.Main},
+	"exec":         progPair{"open a shell in a running job", exec.Main},
+	"cost":         progPair{"estimate the cost of jobs in a queue", cost.Main},
+	"doctor":       progPair{"check an account for common setup problems", doctor.Main},
+	"validate":     progPair{"check pipeline, compute environment and array manifest files", validate.Main},
+	"instances":    progPair{"list the instances of a queue with their free capacity", instances.Main},
+	"drain":        progPair{"stop new jobs from starting on an instance", drain.Main},
+	"watcher":      progPair{"resubmit jobs that fail for transient reasons", surface(watcher.Main)},
+	"sqs-consume":  progPair{"submit a job for each message in an SQS queue", sqsconsume.Main},
+	"spot-advisor": progPair{"recommend spot instance types for a job size", spotadvisor.Main},
+	"quota":        progPair{"show service quotas that limit jobs and their usage", quota.Main},
+	"profile":      progPair{"recommend vCPUs and memory from past jobs", profile.Main},
+	"gc":           progPair{"clean up old job definitions, volumes and uploads", gc.Main},
+	"whoami":       progPair{"show the account, region and defaults that will be used", whoami.Main},
+	"run-local":    progPair{"run a submission in local docker", runlocal.Main},
+	"dag":          progPair{"run a pipeline of dependent jobs and monitor it", dag.Main},
+	"logs-export":  progPair{"archive the logs of a queue's jobs to s3", logsexport.Main},
+	"tag":          progPair{"add tags to a job, its definition and volumes", tag.Main},
+	"report":       progPair{"write a Markdown or HTML report of a set of jobs", report.Main},
+	"db":           progPair{"record and search the history of submitted jobs", db.Main},
+	"graph":        progPair{"draw the dependencies of jobs as a dot or mermaid graph", graph.Main},
+	"ami":          progPair{"build and attach an AMI or launch template with batchit installed", ami.Main},
+	"price":        progPair{"show spot prices and interruption rates for the instance types of a queue", price.Main},
+	"preset":       progPair{"save named sets of submit options for batchit submit --preset", preset.Main},
+	"throttle":     progPair{"submit jobs from JSON lines on STDIN at a limited rate", throttle.Main},
+	"mirror":       progPair{"copy a container image into ECR in one or more regions", mirror.Main},
+	"stage":        progPair{"download S3 objects to local scratch with parallel ranged GETs", stage.Main},
+	"unstage":      progPair{"upload a local directory to S3 with parallel multipart uploads and a manifest", surface(stage.UnstageMain)},
+	"heartbeat":    progPair{"run a command and stop it if it stalls, sending heartbeat metrics", heartbeat.Main},
+	"checkpoint":   progPair{"checkpoint a directory to S3 periodically and restore it", checkpoint.Main},
+	"sentinel":     progPair{"write and check success or failure markers of steps in S3", sentinel.Main},
+	"array-map":    progPair{"print the row of a manifest for the index of an array job", arraymap.Main},
+	"gate":         progPair{"wait until a queue has fewer RUNNABLE jobs or free capacity", surface(gate.Main)},
+	"audit":        progPair{"report who submitted the jobs in a queue from CloudTrail", audit.Main},
+}
+
+// jsonl are the subcommands that write events with --output jsonl.
+var jsonl = map[string]bool{"submit": true, "wait": true, "kill": true, "cancel": true, "ebsmount": true,
+	"ddv": true, "s3upload": true, "logof": true}
+
+// surface adapts a subcommand that returns its error rather than exiting. The error is
+// logged and batchit exits with its code only once the subcommand has returned so that
+// its deferred cleanup, e.g. deleting a volume that was not attached, has run.
+func surface(main func() error) func() {
+	return func() {
+		err := main()
+		batchit.EmitFinished(err)
+		batchit.StopTracing(err)
+		if err != nil {
+			log.Printf("[batchit %s] %s", name, err)
+			os.Exit(batchit.ExitCode(err))
+		}
+	}
+}
+
+func init() {
+	// added here as completion needs the names of the other commands.
+	progs["completion"] = progPair{"write a shell completion script for bash, zsh or fish", func() {
+		helps := pluginHelps()
+		for k, v := range progs {
+			helps[k] = v.help
+		}
+		completion.Main(helps)
+	}}
+}
+
+// pluginHelps returns the help for each plugin on $PATH that does not have the name of a
+// subcommand.
+func pluginHelps() map[string]string {
+	helps := make(map[string]string)
+	for k, path := range batchit.Plugins() {
+		if _, ok := progs[k]; !ok {
+			helps[k] = "plugin at " + path
+		}
+	}
+	return helps
 }
 
 func printProgs() {
@@ -54,21 +193,94 @@ It includes convenience operations so that user-scripts can consist of simple sc
 		fmt.Fprintf(wtr, fmtr, k, progs[k].help)
 
 	}
+	if plugins := pluginHelps(); len(plugins) > 0 {
+		keys = keys[:0]
+		for k := range plugins {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		fmt.Fprintln(wtr, "\nplugins (batchit-<name> on $PATH):")
+		for _, k := range keys {
+			fmt.Fprintf(wtr, fmtr, k, plugins[k])
+		}
+	}
+	wtr.Write([]byte(`
+every subcommand also accepts:
+  --profile NAME       use a profile from the shared AWS config
+  --endpoint-url URL   send requests to a different endpoint, e.g. a local emulator
+  --log-format json    write each log message as a JSON object
+  --output jsonl       write events as JSON lines to stdout from submit, wait, kill, cancel,
+                       ebsmount, ddv, s3upload and logof
+  --ca-bundle FILE     PEM certificates to trust as well as those of the system, e.g. of a proxy
+  --max-attempts N     times to try a request that is throttled or times out (8)
+  --retry-base D       delay before the first retry, doubled for each one (1s)
+  --retry-cap D        longest delay between retries (1m)
+  --retry-jitter F     fraction of each delay that is random (1)
+  --retry-codes CODES  other error codes to retry, e.g. InternalError,ServiceUnavailable
+  --debug-region       log the region that is used and where it came from
+  --no-cache           do not use the account, roles, queues and compute environments kept in
+                       ~/.cache/batchit
+
+the region of a subcommand is taken from --region, then $AWS_REGION or $AWS_DEFAULT_REGION,
+region in the batchit config file, the region of the profile, the instance metadata of the EC2
+instance it runs on and then us-east-1. ebsmount and ddv --mount always use the region of the
+instance.
+`))
 	os.Exit(1)
 
 }
 
 func main() {
 
-	if len(os.Args) < 2 {
-		printProgs()
+	// the global flags can be given before or after the prog name.
+	args, err := batchit.GlobalFlags(os.Args[1:])
+	if err != nil {
+		log.Printf("[batchit] %s", err)
+		os.Exit(batchit.ExitUsage)
 	}
-	var p progPair
-	var ok bool
-	if p, ok = progs[os.Args[1]]; !ok {
+	if len(args) < 1 {
 		printProgs()
 	}
+	name = args[0]
+	p, ok := progs[name]
+	if !ok {
+		// an unknown subcommand is run by the batchit-<name> plugin on $PATH if there is one.
+		path, found := batchit.Plugin(name)
+		if !found {
+			printProgs()
+		}
+		p = progPair{main: surface(func() error {
+			return batchit.RunPlugin(context.Background(), name, path, args[1:])
+		})}
+	}
+	if err := batchit.Configure(name); err != nil {
+		log.Printf("[batchit %s] %s", name, err)
+		os.Exit(batchit.ExitUsage)
+	}
+	if err := batchit.SetLogFormat(batchit.LogFormat); err != nil {
+		log.Printf("[batchit %s] %s", name, err)
+		os.Exit(batchit.ExitUsage)
+	}
+	if err := batchit.SetOutput(batchit.Output); err != nil {
+		log.Printf("[batchit %s] %s", name, err)
+		os.Exit(batchit.ExitUsage)
+	}
+	// plugins get $BATCHIT_OUTPUT and decide for themselves.
+	if _, builtin := progs[name]; builtin && batchit.JSONL() {
+		if !jsonl[name] {
+			log.Printf("[batchit %s] --output jsonl is not supported by %s", name, name)
+			os.Exit(batchit.ExitUsage)
+		}
+		batchit.Emit(batchit.Event{Type: batchit.EventStarted})
+	}
+	// plugins get $OTEL_EXPORTER_OTLP_ENDPOINT and trace themselves as they replace batchit.
+	if _, builtin := progs[name]; builtin {
+		if err := batchit.StartTracing(context.Background()); err != nil {
+			log.Printf("[batchit %s] tracing is off: %s", name, err)
+		}
+	}
 	// remove the prog name from the call
-	os.Args = append(os.Args[:1], os.Args[2:]...)
+	os.Args = append(os.Args[:1], args[1:]...)
 	p.main()
+	batchit.StopTracing(nil)
 }
@@ -0,0 +1,297 @@
+package completion
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/base2genomics/batchit"
+	"github.com/base2genomics/batchit/ls"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/batch"
+	batchtypes "github.com/aws/aws-sdk-go-v2/service/batch/types"
+)
+
+// Command is a subcommand with the flags found in its help.
+type Command struct {
+	Name string
+	Help string
+	// Flags are the long flags, e.g. --queue.
+	Flags []string
+	// JobIds is true if the positional arguments are job ids.
+	JobIds bool
+	Subs   []Command
+}
+
+var (
+	flagRe    = regexp.MustCompile(`(?:^|[\s,])(--[a-z0-9][a-z0-9-]*)`)
+	subRe     = regexp.MustCompile(`^\s+(\S+)\s*: `)
+	jobIdArgs = map[string]bool{"jobid": true, "jobids": true}
+)
+
+// parseHelp fills the flags and sub-commands of c from the output of --help.
+func parseHelp(c *Command, help []byte) {
+	section := ""
+	s := bufio.NewScanner(bytes.NewReader(help))
+	for s.Scan() {
+		line := s.Text()
+		if l := strings.ToLower(strings.TrimSpace(line)); strings.HasSuffix(l, ":") && !strings.HasPrefix(line, " ") {
+			section = l
+			continue
+		}
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case section == "commands:":
+			if m := subRe.FindStringSubmatch(line); m != nil {
+				c.Subs = append(c.Subs, Command{Name: m[1], Help: strings.TrimSpace(line[len(m[0]):])})
+			}
+		case section == "positional arguments:" && strings.HasPrefix(line, "  ") && trimmed != "":
+			if jobIdArgs[strings.ToLower(strings.Fields(trimmed)[0])] {
+				c.JobIds = true
+			}
+		case strings.HasPrefix(trimmed, "-"):
+			for _, m := range flagRe.FindAllStringSubmatch(trimmed, -1) {
+				if m[1] != "--help" && m[1] != "--version" {
+					c.Flags = append(c.Flags, m[1])
+				}
+			}
+		}
+	}
+}
+
+// help returns the output of exe with args and --help.
+func help(exe string, args ...string) []byte {
+	out, _ := exec.Command(exe, append(args, "--help")...).CombinedOutput()
+	return out
+}
+
+// Commands returns the commands of batchit at exe with their flags by running each with --help.
+func Commands(exe string, progs map[string]string) []Command {
+	var names []string
+	for k := range progs {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	cmds := make([]Command, 0, len(names))
+	for _, name := range names {
+		c := Command{Name: name, Help: progs[name]}
+		parseHelp(&c, help(exe, name))
+		for i := range c.Subs {
+			parseHelp(&c.Subs[i], help(exe, name, c.Subs[i].Name))
+		}
+		cmds = append(cmds, c)
+	}
+	return cmds
+}
+
+func names(cmds []Command) string {
+	ns := make([]string, len(cmds))
+	for i, c := range cmds {
+		ns[i] = c.Name
+	}
+	return strings.Join(ns, " ")
+}
+
+// Bash writes a bash completion script for cmds.
+func Bash(w io.Writer, cmds []Command) {
+	fmt.Fprintf(w, `# bash completion for batchit. load with: source <(batchit completion bash)
+_batchit() {
+    local cur=${COMP_WORDS[COMP_CWORD]} prev=${COMP_WORDS[COMP_CWORD-1]}
+    if [[ $COMP_CWORD -eq 1 ]]; then
+        COMPREPLY=($(compgen -W "%s" -- "$cur"))
+        return
+    fi
+    case "$prev" in
+        --queue|--queues)
+            COMPREPLY=($(compgen -W "$(batchit completion queues 2>/dev/null)" -- "$cur"))
+            return
+            ;;
+    esac
+    local key=${COMP_WORDS[1]} flags="" jobids=""
+    case "$key" in
+`, names(cmds))
+	for _, c := range cmds {
+		if len(c.Subs) > 0 {
+			fmt.Fprintf(w, "        %s)\n            if [[ $COMP_CWORD -eq 2 ]]; then\n                COMPREPLY=($(compgen -W \"%s\" -- \"$cur\"))\n                return\n            fi\n            key=\"%s ${COMP_WORDS[2]}\"\n            ;;\n", c.Name, names(c.Subs), c.Name)
+		}
+	}
+	fmt.Fprint(w, "    esac\n    case \"$key\" in\n")
+	var write func(string, Command)
+	write = func(key string, c Command) {
+		fmt.Fprintf(w, "        %q) flags=\"%s\"", key, strings.Join(c.Flags, " "))
+		if c.JobIds {
+			fmt.Fprint(w, "; jobids=1")
+		}
+		fmt.Fprint(w, " ;;\n")
+		for _, s := range c.Subs {
+			write(key+" "+s.Name, s)
+		}
+	}
+	for _, c := range cmds {
+		write(c.Name, c)
+	}
+	fmt.Fprint(w, `    esac
+    if [[ $cur == -* ]]; then
+        COMPREPLY=($(compgen -W "$flags" -- "$cur"))
+    elif [[ -n $jobids ]]; then
+        COMPREPLY=($(compgen -W "$(batchit completion jobs 2>/dev/null)" -- "$cur"))
+    fi
+}
+complete -o default -F _batchit batchit
+`)
+}
+
+// Zsh writes a zsh completion script for cmds. It uses the bash script through bashcompinit.
+func Zsh(w io.Writer, cmds []Command) {
+	fmt.Fprintln(w, "# zsh completion for batchit. load with: source <(batchit completion zsh)")
+	fmt.Fprintln(w, "autoload -U +X bashcompinit && bashcompinit")
+	Bash(w, cmds)
+}
+
+// Fish writes a fish completion script for cmds.
+func Fish(w io.Writer, cmds []Command) {
+	fmt.Fprintln(w, "# fish completion for batchit. load with: batchit completion fish | source")
+	for _, c := range cmds {
+		fmt.Fprintf(w, "complete -c batchit -n __fish_use_subcommand -a %s -d %q\n", c.Name, c.Help)
+		cond := "__fish_seen_subcommand_from " + c.Name
+		flags := append([]string{}, c.Flags...)
+		jobIds := c.JobIds
+		for _, s := range c.Subs {
+			fmt.Fprintf(w, "complete -c batchit -n %q -a %s -d %q\n", cond, s.Name, s.Help)
+			flags = append(flags, s.Flags...)
+			jobIds = jobIds || s.JobIds
+		}
+		seen := make(map[string]bool)
+		for _, f := range flags {
+			if seen[f] {
+				continue
+			}
+			seen[f] = true
+			name := strings.TrimPrefix(f, "--")
+			if name == "queue" || name == "queues" {
+				fmt.Fprintf(w, "complete -c batchit -n %q -l %s -xa '(batchit completion queues 2>/dev/null)'\n", cond, name)
+				continue
+			}
+			fmt.Fprintf(w, "complete -c batchit -n %q -l %s\n", cond, name)
+		}
+		if jobIds {
+			fmt.Fprintf(w, "complete -c batchit -n %q -a '(batchit completion jobs 2>/dev/null)'\n", cond)
+		}
+	}
+}
+
+// Queues returns the names of the job queues.
+func Queues(ctx context.Context, b *batch.Client) ([]string, error) {
+	var qs []string
+	pages := batch.NewDescribeJobQueuesPaginator(b, &batch.DescribeJobQueuesInput{})
+	for pages.HasMorePages() {
+		out, err := pages.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, q := range out.JobQueues {
+			qs = append(qs, aws.ToString(q.JobQueueName))
+		}
+	}
+	sort.Strings(qs)
+	return qs, nil
+}
+
+// activeStatuses are those of jobs offered for completion.
+var activeStatuses = []batchtypes.JobStatus{batchtypes.JobStatusSubmitted, batchtypes.JobStatusPending, batchtypes.JobStatusRunnable,
+	batchtypes.JobStatusStarting, batchtypes.JobStatusRunning}
+
+// JobIds returns the ids of the jobs that have not finished in queue or in every queue if it is empty.
+func JobIds(ctx context.Context, b *batch.Client, queue string) ([]string, error) {
+	queues := []string{queue}
+	if queue == "" {
+		var err error
+		if queues, err = Queues(ctx, b); err != nil {
+			return nil, err
+		}
+	}
+	var ids []string
+	for _, q := range queues {
+		sums, err := ls.List(ctx, b, ls.Query{Queue: q, Statuses: activeStatuses})
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range sums {
+			ids = append(ids, aws.ToString(s.JobId))
+		}
+	}
+	return ids, nil
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, `usage: batchit completion bash|zsh|fish
+
+write a completion script for the shell to stdout, e.g.:
+  source <(batchit completion bash)        # in ~/.bashrc
+  source <(batchit completion zsh)         # in ~/.zshrc
+  batchit completion fish | source         # in ~/.config/fish/config.fish
+
+queues and job ids are completed using the region from the environment, config, profile or instance
+metadata (default us-east-1).`)
+	os.Exit(1)
+}
+
+// Main writes the completion script for the shell in os.Args[1]. progs are the names of the
+// batchit commands with their help. The queues and jobs commands are used by the scripts.
+func Main(progs map[string]string) {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	switch os.Args[1] {
+	case "bash", "zsh", "fish":
+		exe, err := os.Executable()
+		if err != nil {
+			log.Fatal(err)
+		}
+		cmds := Commands(exe, progs)
+		w := bufio.NewWriter(os.Stdout)
+		switch os.Args[1] {
+		case "bash":
+			Bash(w, cmds)
+		case "zsh":
+			Zsh(w, cmds)
+		case "fish":
+			Fish(w, cmds)
+		}
+		if err := w.Flush(); err != nil {
+			log.Fatal(err)
+		}
+	case "queues", "jobs":
+		ctx := context.Background()
+		cfg, err := batchit.LoadConfig(ctx, "")
+		if err != nil {
+			log.Fatal(err)
+		}
+		b := batch.NewFromConfig(cfg)
+		var out []string
+		if os.Args[1] == "queues" {
+			out, err = Queues(ctx, b)
+		} else {
+			queue := ""
+			if len(os.Args) > 2 {
+				queue = os.Args[2]
+			}
+			out, err = JobIds(ctx, b, queue)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(strings.Join(out, "\n"))
+	default:
+		usage()
+	}
+}
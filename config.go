@@ -0,0 +1,276 @@
+package batchit
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	arg "github.com/alexflint/go-arg"
+	scalar "github.com/alexflint/go-scalar"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// ConfigEnvVar is the environment variable that can point to a config file to use instead of
+// the system and user config files.
+const ConfigEnvVar = "BATCHIT_CONFIG"
+
+// SystemConfig is the config file shipped with an AMI or container. The user config file,
+// e.g. ~/.config/batchit/config.yaml, takes precedence over it.
+const SystemConfig = "/etc/batchit/config.yaml"
+
+// DefaultsSection is the section of the config file with defaults for every subcommand.
+const DefaultsSection = "defaults"
+
+// Config holds default flag values from config files. It is keyed by subcommand, e.g. submit,
+// and then by the long name of the flag, e.g. queue. The defaults section applies to every
+// subcommand that has the flag.
+//
+//	defaults:
+//	  region: us-west-2
+//	submit:
+//	  queue: spot-q
+//	  role: pipeline-role
+//	s3upload:
+//	  processes: 8
+type Config map[string]map[string]interface{}
+
+// Command is the subcommand that is running. Its section of the config is used by MustParse.
+var Command string
+
+var defaults Config
+
+// ConfigPaths returns $BATCHIT_CONFIG or the system config file followed by the user config file.
+func ConfigPaths() []string {
+	if p := os.Getenv(ConfigEnvVar); p != "" {
+		return []string{p}
+	}
+	paths := []string{SystemConfig}
+	if dir, err := os.UserConfigDir(); err == nil {
+		paths = append(paths, filepath.Join(dir, "batchit", "config.yaml"))
+	}
+	return paths
+}
+
+// ReadConfig reads the config files at paths. Values in later files take precedence. Missing
+// files are skipped.
+func ReadConfig(paths ...string) (Config, error) {
+	c := Config{}
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		f := Config{}
+		if err := yaml.UnmarshalStrict(data, &f); err != nil {
+			return nil, fmt.Errorf("batchit: reading %s: %s", path, err)
+		}
+		for cmd, flags := range f {
+			if c[cmd] == nil {
+				c[cmd] = make(map[string]interface{}, len(flags))
+			}
+			for k, v := range flags {
+				c[cmd][k] = v
+			}
+		}
+	}
+	return c, nil
+}
+
+// Section returns the defaults for cmd: those of the defaults section overridden by those of cmd.
+func (c Config) Section(cmd string) map[string]interface{} {
+	s := make(map[string]interface{})
+	for _, name := range []string{DefaultsSection, cmd} {
+		for k, v := range c[name] {
+			s[k] = v
+		}
+	}
+	return s
+}
+
+// Configure reads the config files for the subcommand cmd. Profile, EndpointURL, LogFormat and
+// CABundle are set from its profile, endpoint-url, log-format and ca-bundle if they were not
+// given as flags or, for LogFormat and CABundle, in the environment and
+// Retry from the retry flags, their environment variables or the config. DebugRegion is also
+// set if $BATCHIT_DEBUG_REGION is true, NoCache if $BATCHIT_NO_CACHE or no-cache in the config is
+// true and Output from $BATCHIT_OUTPUT if --output was not given.
+// Output is not read from the config as logof has its own output.
+func Configure(cmd string) error {
+	c, err := ReadConfig(ConfigPaths()...)
+	if err != nil {
+		return err
+	}
+	Command, defaults = cmd, c
+	if LogFormat == "" {
+		LogFormat = os.Getenv(LogFormatEnvVar)
+	}
+	if CABundle == "" {
+		CABundle = os.Getenv("AWS_CA_BUNDLE")
+	}
+	if Output == "" {
+		Output = os.Getenv(OutputEnvVar)
+	}
+	if v, err := strconv.ParseBool(os.Getenv(DebugRegionEnvVar)); err == nil && v {
+		DebugRegion = true
+	}
+	if v, err := strconv.ParseBool(os.Getenv(NoCacheEnvVar)); err == nil && v {
+		NoCache = true
+	}
+	s := c.Section(cmd)
+	if v, ok := s["no-cache"]; ok {
+		if b, err := strconv.ParseBool(fmt.Sprint(v)); err == nil && b {
+			NoCache = true
+		}
+	}
+	for k, dst := range map[string]*string{"profile": &Profile, "endpoint-url": &EndpointURL, "log-format": &LogFormat, "ca-bundle": &CABundle} {
+		if v, ok := s[k]; ok && *dst == "" {
+			*dst = fmt.Sprint(v)
+		}
+	}
+	if err := configureHTTP(); err != nil {
+		return err
+	}
+	return configureRetry(s)
+}
+
+// MustParse is arg.MustParse with the defaults of the config files for Command. A value from the
+// config is used only if the flag is not given and its environment variable, if any, is not set.
+func MustParse(dest ...interface{}) *arg.Parser {
+	s := defaults.Section(Command)
+	a := &applied{}
+	for _, d := range dest {
+		if err := a.apply(reflect.ValueOf(d).Elem(), s); err != nil {
+			fmt.Fprintf(os.Stderr, "[batchit %s] %s\n", Command, err)
+			os.Exit(ExitUsage)
+		}
+	}
+	if len(a.args) > 0 {
+		os.Args = append(append([]string{os.Args[0]}, a.args...), os.Args[1:]...)
+	}
+	p := arg.MustParse(dest...)
+	if a.region.IsValid() {
+		resolveFlagRegion(a.region, a.regionFromConfig)
+	}
+	for _, l := range a.lists {
+		// an empty list was neither given as a flag nor set from the environment.
+		if l.field.Len() == 0 {
+			if err := setField(l.field, l.values); err != nil {
+				p.Fail(fmt.Sprintf("config: %s: %s", l.long, err))
+			}
+		}
+	}
+	return p
+}
+
+// applied is what MustParse does with the config for a command. go-arg only accepts a required
+// flag if it is given, so those are args to put before the command line ones. go-arg can not
+// use a list as a default, so lists are set after parsing if they are still empty. The --region
+// field is kept to resolve its source after parsing.
+type applied struct {
+	args             []string
+	lists            []list
+	region           reflect.Value
+	regionFromConfig bool
+}
+
+type list struct {
+	long   string
+	field  reflect.Value
+	values []string
+}
+
+// apply sets the fields of v that have a value in s or adds them to args or lists.
+func (a *applied) apply(v reflect.Value, s map[string]interface{}) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("arg")
+		if tag == "-" {
+			continue
+		}
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			if err := a.apply(v.Field(i), s); err != nil {
+				return err
+			}
+			continue
+		}
+		if field.PkgPath != "" {
+			continue
+		}
+		long, env := strings.ToLower(field.Name), ""
+		var required, positional bool
+		for _, key := range strings.Split(tag, ",") {
+			key = strings.TrimLeft(key, " ")
+			switch {
+			case strings.HasPrefix(key, "--"):
+				long = key[2:]
+			case key == "required":
+				required = true
+			case key == "positional":
+				positional = true
+			case key == "env":
+				env = strings.ToUpper(field.Name)
+			case strings.HasPrefix(key, "env:"):
+				env = key[len("env:"):]
+			}
+		}
+		// only a region that is read from the environment follows the order of LoadConfig.
+		if long == "region" && env != "" && !positional && field.Type.Kind() == reflect.String {
+			a.region = v.Field(i)
+		}
+		value, ok := s[long]
+		if !ok || positional {
+			continue
+		}
+		if env != "" && os.Getenv(env) != "" {
+			continue
+		}
+		var values []string
+		if list, isList := value.([]interface{}); isList {
+			for _, e := range list {
+				values = append(values, fmt.Sprint(e))
+			}
+		} else {
+			values = []string{fmt.Sprint(value)}
+		}
+		switch {
+		case required && len(values) == 1:
+			a.args = append(a.args, "--"+long+"="+values[0])
+		case required:
+			// lists are put first so that the flags after them end them.
+			a.args = append(append([]string{"--" + long}, values...), a.args...)
+		case field.Type.Kind() == reflect.Slice:
+			a.lists = append(a.lists, list{long: long, field: v.Field(i), values: values})
+		default:
+			if err := setField(v.Field(i), values); err != nil {
+				return fmt.Errorf("config: %s: %s", long, err)
+			}
+			a.regionFromConfig = a.regionFromConfig || long == "region"
+		}
+	}
+	return nil
+}
+
+// setField parses values into f as go-arg would from the command line.
+func setField(f reflect.Value, values []string) error {
+	if f.Kind() != reflect.Slice {
+		if len(values) != 1 {
+			return fmt.Errorf("expected a single value")
+		}
+		return scalar.ParseValue(f, values[0])
+	}
+	s := reflect.MakeSlice(f.Type(), len(values), len(values))
+	for i, value := range values {
+		if err := scalar.ParseValue(s.Index(i), value); err != nil {
+			return err
+		}
+	}
+	f.Set(s)
+	return nil
+}
@@ -0,0 +1,385 @@
+package cost
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/base2genomics/batchit"
+	"github.com/base2genomics/batchit/logof"
+	"github.com/base2genomics/batchit/ls"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/batch"
+	batchtypes "github.com/aws/aws-sdk-go-v2/service/batch/types"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	ecstypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
+)
+
+type cliargs struct {
+	Region string   `arg:"env:AWS_DEFAULT_REGION,help:region for batch setup. see batchit help for the default."`
+	Queue  []string `arg:"required,help:job queue(s) to report."`
+	Since  string   `help:"include jobs created within this duration before now, e.g. 12h or 30d."`
+	By     string   `help:"group costs by job, name or queue."`
+	CSV    bool     `arg:"help:print CSV rather than a table."`
+}
+
+func (c cliargs) Version() string {
+	return batchit.Version
+}
+
+func (c cliargs) Description() string {
+	return `Estimate the cost of the jobs in one or more queues.
+The cost of each attempt of a job is its run time multiplied by the hourly price of the instance it ran on and by
+the share of that instance that it requested (the larger of its share of vCPUs and of memory). On-demand prices
+are from the pricing API and spot prices are the mean of the spot price history over the --since window.
+EBS, data transfer and idle capacity are not included.`
+}
+
+// Instance is what determines the price of a container instance.
+type Instance struct {
+	Type, Zone string
+	Spot       bool
+	// CPU (1024 per vCPU) and Memory (MiB) registered with ECS.
+	CPU, Memory int64
+}
+
+// Instances finds and caches the container instances used by the jobs in a queue.
+type Instances struct {
+	b     *batch.Client
+	ecs   *ecs.Client
+	cache map[string]*Instance
+	// clusters maps an ECS cluster to whether its compute environment uses spot.
+	clusters map[string]map[string]bool
+}
+
+// NewInstances returns an empty Instances.
+func NewInstances(cfg aws.Config) *Instances {
+	return &Instances{b: batch.NewFromConfig(cfg), ecs: ecs.NewFromConfig(cfg), cache: make(map[string]*Instance), clusters: make(map[string]map[string]bool)}
+}
+
+func (is *Instances) queueClusters(ctx context.Context, queue string) (map[string]bool, error) {
+	if cl, ok := is.clusters[queue]; ok {
+		return cl, nil
+	}
+	ctx = batchit.Mapping(ctx)
+	qo, err := is.b.DescribeJobQueues(ctx, &batch.DescribeJobQueuesInput{JobQueues: []string{queue}})
+	if err != nil {
+		return nil, err
+	}
+	if len(qo.JobQueues) == 0 {
+		return nil, fmt.Errorf("cost: queue %s not found", queue)
+	}
+	var ces []string
+	for _, o := range qo.JobQueues[0].ComputeEnvironmentOrder {
+		ces = append(ces, aws.ToString(o.ComputeEnvironment))
+	}
+	co, err := is.b.DescribeComputeEnvironments(ctx, &batch.DescribeComputeEnvironmentsInput{ComputeEnvironments: ces})
+	if err != nil {
+		return nil, err
+	}
+	cl := make(map[string]bool)
+	for _, ce := range co.ComputeEnvironments {
+		if ce.EcsClusterArn != nil {
+			cl[*ce.EcsClusterArn] = ce.ComputeResources != nil && ce.ComputeResources.Type == batchtypes.CRTypeSpot
+		}
+	}
+	is.clusters[queue] = cl
+	return cl, nil
+}
+
+func attribute(ci *ecstypes.ContainerInstance, name string) string {
+	for _, a := range ci.Attributes {
+		if aws.ToString(a.Name) == name {
+			return aws.ToString(a.Value)
+		}
+	}
+	return ""
+}
+
+func resource(rs []ecstypes.Resource, name string) int64 {
+	for _, r := range rs {
+		if aws.ToString(r.Name) == name {
+			return int64(r.IntegerValue)
+		}
+	}
+	return 0
+}
+
+// Get returns the container instance with the given ARN that ran a job from queue.
+func (is *Instances) Get(ctx context.Context, queue, arn string) (*Instance, error) {
+	if in, ok := is.cache[arn]; ok {
+		return in, nil
+	}
+	cl, err := is.queueClusters(ctx, queue)
+	if err != nil {
+		return nil, err
+	}
+	for cluster, spot := range cl {
+		eo, err := is.ecs.DescribeContainerInstances(ctx, &ecs.DescribeContainerInstancesInput{Cluster: aws.String(cluster), ContainerInstances: []string{arn}})
+		if err != nil || len(eo.ContainerInstances) == 0 {
+			continue
+		}
+		ci := &eo.ContainerInstances[0]
+		in := &Instance{
+			Type:   attribute(ci, "ecs.instance-type"),
+			Zone:   attribute(ci, "ecs.availability-zone"),
+			Spot:   spot,
+			CPU:    resource(ci.RegisteredResources, "CPU"),
+			Memory: resource(ci.RegisteredResources, "MEMORY"),
+		}
+		is.cache[arn] = in
+		return in, nil
+	}
+	// the instance is gone from the cluster so don't look again.
+	is.cache[arn] = nil
+	return nil, nil
+}
+
+// Requested returns the vCPUs and memory (MiB) requested by j.
+func Requested(j *batchtypes.JobDetail) (vcpus float64, memory int64) {
+	if j.Container == nil {
+		return 0, 0
+	}
+	vcpus, memory = float64(aws.ToInt32(j.Container.Vcpus)), int64(aws.ToInt32(j.Container.Memory))
+	for _, r := range j.Container.ResourceRequirements {
+		switch r.Type {
+		case batchtypes.ResourceTypeVcpu:
+			vcpus, _ = strconv.ParseFloat(aws.ToString(r.Value), 64)
+		case batchtypes.ResourceTypeMemory:
+			memory, _ = strconv.ParseInt(aws.ToString(r.Value), 10, 64)
+		}
+	}
+	return vcpus, memory
+}
+
+// Share is the fraction of in used by a job requesting vcpus and memory.
+func Share(in *Instance, vcpus float64, memory int64) float64 {
+	var s float64
+	if in.CPU > 0 {
+		s = vcpus * 1024 / float64(in.CPU)
+	}
+	if in.Memory > 0 {
+		if m := float64(memory) / float64(in.Memory); m > s {
+			s = m
+		}
+	}
+	if s > 1 {
+		s = 1
+	}
+	return s
+}
+
+// Row is the estimated cost of a job or a group of jobs.
+type Row struct {
+	Key   string
+	Queue string
+	// Instance is the instance type of the last attempt of a job.
+	Instance string
+	Spot     bool
+	Jobs     int
+	Hours    float64
+	Cost     float64
+	// Unpriced is the number of attempts that could not be priced.
+	Unpriced int
+}
+
+type span struct {
+	arn         string
+	start, stop int64
+}
+
+// spans returns the container instance and times of each attempt of j, including one that is running.
+func spans(j *batchtypes.JobDetail, now time.Time) []span {
+	var sp []span
+	for _, a := range j.Attempts {
+		if a.Container != nil && a.Container.ContainerInstanceArn != nil && a.StartedAt != nil && a.StoppedAt != nil {
+			sp = append(sp, span{*a.Container.ContainerInstanceArn, *a.StartedAt, *a.StoppedAt})
+		}
+	}
+	if j.Status == batchtypes.JobStatusRunning && j.Container != nil && j.Container.ContainerInstanceArn != nil {
+		sp = append(sp, span{*j.Container.ContainerInstanceArn, aws.ToInt64(j.StartedAt), now.UnixNano() / int64(time.Millisecond)})
+	}
+	return sp
+}
+
+// JobCost estimates the cost of each attempt of j.
+func JobCost(ctx context.Context, is *Instances, p *Pricer, j *batchtypes.JobDetail, now time.Time) Row {
+	r := Row{Key: aws.ToString(j.JobId), Queue: aws.ToString(j.JobQueue), Jobs: 1}
+	vcpus, memory := Requested(j)
+	for _, s := range spans(j, now) {
+		hours := float64(s.stop-s.start) / float64(time.Hour/time.Millisecond)
+		r.Hours += hours
+		in, err := is.Get(ctx, r.Queue, s.arn)
+		if err != nil || in == nil || in.Type == "" {
+			r.Unpriced++
+			continue
+		}
+		r.Instance, r.Spot = in.Type, in.Spot
+		price, err := p.Hourly(ctx, in)
+		if err != nil {
+			log.Printf("[batchit cost] %s", err)
+			r.Unpriced++
+			continue
+		}
+		r.Cost += hours * Share(in, vcpus, memory) * price
+	}
+	return r
+}
+
+// Group sums rows by job name or queue. names maps a job id to its name.
+func Group(rows []Row, by string, names map[string]string) []Row {
+	sums := make(map[string]*Row)
+	var keys []string
+	for _, r := range rows {
+		key := r.Queue
+		if by == "name" {
+			key = names[r.Key]
+		}
+		g, ok := sums[key]
+		if !ok {
+			g = &Row{Key: key, Queue: r.Queue}
+			sums[key] = g
+			keys = append(keys, key)
+		}
+		if g.Queue != r.Queue {
+			g.Queue = "-"
+		}
+		g.Jobs += r.Jobs
+		g.Hours += r.Hours
+		g.Cost += r.Cost
+		g.Unpriced += r.Unpriced
+	}
+	out := make([]Row, 0, len(keys))
+	for _, k := range keys {
+		out = append(out, *sums[k])
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Cost > out[j].Cost })
+	return out
+}
+
+func (r Row) fields(by string) []string {
+	f := []string{r.Key, r.Queue}
+	if by == "job" {
+		market := "on-demand"
+		if r.Spot {
+			market = "spot"
+		}
+		if r.Instance == "" {
+			market = "-"
+		}
+		instance := r.Instance
+		if instance == "" {
+			instance = "-"
+		}
+		f = append(f, instance, market)
+	} else {
+		f = append(f, strconv.Itoa(r.Jobs))
+	}
+	return append(f, fmt.Sprintf("%.2f", r.Hours), fmt.Sprintf("%.4f", r.Cost), strconv.Itoa(r.Unpriced))
+}
+
+func header(by string) []string {
+	h := []string{strings.ToUpper(by), "QUEUE"}
+	if by == "job" {
+		h = append(h, "INSTANCE", "MARKET")
+	} else {
+		h = append(h, "JOBS")
+	}
+	return append(h, "HOURS", "COST_USD", "UNPRICED")
+}
+
+// Write writes the rows grouped by "job", "name" or "queue" as a table or as CSV.
+func Write(w io.Writer, rows []Row, by string, asCSV bool) error {
+	if asCSV {
+		cw := csv.NewWriter(w)
+		cw.Write(header(by))
+		for _, r := range rows {
+			cw.Write(r.fields(by))
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(header(by), "\t"))
+	for _, r := range rows {
+		fmt.Fprintln(tw, strings.Join(r.fields(by), "\t"))
+	}
+	return tw.Flush()
+}
+
+// jobs returns the details of the jobs in queue created after since. Array jobs are
+// replaced by their children.
+func jobs(ctx context.Context, b *batch.Client, queue string, since time.Time) ([]*batchtypes.JobDetail, error) {
+	sums, err := ls.List(ctx, b, ls.Query{Queue: queue, Statuses: ls.Statuses, Since: since})
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(sums))
+	for i, s := range sums {
+		ids[i] = *s.JobId
+	}
+	details, err := logof.DescribeJobs(ctx, b, ids)
+	if err != nil {
+		return nil, err
+	}
+	return logof.Expand(ctx, b, details)
+}
+
+func Main() {
+	cli := &cliargs{Since: "7d", By: "name"}
+	p := batchit.MustParse(cli)
+	if cli.By != "job" && cli.By != "name" && cli.By != "queue" {
+		p.Fail("--by must be one of job, name or queue")
+	}
+	d, err := logof.ParseDuration(cli.Since)
+	if err != nil {
+		p.Fail(err.Error())
+	}
+	now := time.Now()
+	ctx := context.Background()
+	cfg, err := batchit.LoadConfig(ctx, cli.Region)
+	if err != nil {
+		log.Fatal(err)
+	}
+	b := batch.NewFromConfig(cfg)
+	is := NewInstances(cfg)
+	pricer := NewPricer(cfg, now.Add(-d), now)
+
+	var rows []Row
+	names := make(map[string]string)
+	for _, q := range cli.Queue {
+		js, err := jobs(ctx, b, q, now.Add(-d))
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, j := range js {
+			names[*j.JobId] = aws.ToString(j.JobName)
+			rows = append(rows, JobCost(ctx, is, pricer, j, now))
+		}
+	}
+	var total float64
+	unpriced := 0
+	for _, r := range rows {
+		total += r.Cost
+		unpriced += r.Unpriced
+	}
+	if cli.By != "job" {
+		rows = Group(rows, cli.By, names)
+	}
+	if err := Write(os.Stdout, rows, cli.By, cli.CSV); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("[batchit cost] estimated total: $%.2f", total)
+	if unpriced > 0 {
+		log.Printf("[batchit cost] %d attempts could not be priced because their instance is no longer known to ECS or has no price", unpriced)
+	}
+}
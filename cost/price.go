@@ -0,0 +1,143 @@
+package cost
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/pricing"
+	pricingtypes "github.com/aws/aws-sdk-go-v2/service/pricing/types"
+)
+
+// Pricer looks up and caches the hourly price of instances in a region.
+type Pricer struct {
+	Region string
+	// Start and End bound the spot price history that is averaged.
+	Start, End time.Time
+
+	pricing *pricing.Client
+	ec2     *ec2.Client
+	prices  map[string]float64
+}
+
+// NewPricer returns a Pricer for the region of cfg.
+func NewPricer(cfg aws.Config, start, end time.Time) *Pricer {
+	return &Pricer{
+		Region: cfg.Region,
+		Start:  start,
+		End:    end,
+		// the pricing API is only available in a few regions.
+		pricing: pricing.NewFromConfig(cfg, func(o *pricing.Options) { o.Region = "us-east-1" }),
+		ec2:     ec2.NewFromConfig(cfg),
+		prices:  make(map[string]float64),
+	}
+}
+
+// Hourly returns the price in USD per hour of the instance. Spot instances use the mean
+// spot price in their zone between Start and End.
+func (p *Pricer) Hourly(ctx context.Context, in *Instance) (float64, error) {
+	key := in.Type
+	if in.Spot {
+		key = in.Type + "/" + in.Zone
+	}
+	if price, ok := p.prices[key]; ok {
+		return price, nil
+	}
+	var price float64
+	var err error
+	if in.Spot {
+		price, err = p.spot(ctx, in.Type, in.Zone)
+	} else {
+		price, err = p.onDemand(ctx, in.Type)
+	}
+	if err != nil {
+		return 0, err
+	}
+	p.prices[key] = price
+	return price, nil
+}
+
+func (p *Pricer) spot(ctx context.Context, itype, zone string) (float64, error) {
+	var sum float64
+	var n int
+	pages := ec2.NewDescribeSpotPriceHistoryPaginator(p.ec2, &ec2.DescribeSpotPriceHistoryInput{
+		InstanceTypes:       []ec2types.InstanceType{ec2types.InstanceType(itype)},
+		AvailabilityZone:    aws.String(zone),
+		ProductDescriptions: []string{"Linux/UNIX", "Linux/UNIX (Amazon VPC)"},
+		StartTime:           aws.Time(p.Start),
+		EndTime:             aws.Time(p.End),
+	})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return 0, err
+		}
+		for _, sp := range page.SpotPriceHistory {
+			v, err := strconv.ParseFloat(aws.ToString(sp.SpotPrice), 64)
+			if err != nil {
+				return 0, err
+			}
+			sum += v
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, fmt.Errorf("cost: no spot price history for %s in %s", itype, zone)
+	}
+	return sum / float64(n), nil
+}
+
+func (p *Pricer) onDemand(ctx context.Context, itype string) (float64, error) {
+	match := func(field, value string) pricingtypes.Filter {
+		return pricingtypes.Filter{Type: pricingtypes.FilterTypeTermMatch, Field: aws.String(field), Value: aws.String(value)}
+	}
+	out, err := p.pricing.GetProducts(ctx, &pricing.GetProductsInput{
+		ServiceCode: aws.String("AmazonEC2"),
+		Filters: []pricingtypes.Filter{
+			match("instanceType", itype),
+			match("regionCode", p.Region),
+			match("operatingSystem", "Linux"),
+			match("tenancy", "Shared"),
+			match("preInstalledSw", "NA"),
+			match("capacitystatus", "Used"),
+		},
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, product := range out.PriceList {
+		if price, ok := onDemandPrice(product); ok {
+			return price, nil
+		}
+	}
+	return 0, fmt.Errorf("cost: no on-demand price for %s in %s", itype, p.Region)
+}
+
+func object(v interface{}, key string) map[string]interface{} {
+	m, _ := v.(map[string]interface{})
+	o, _ := m[key].(map[string]interface{})
+	return o
+}
+
+// onDemandPrice extracts the hourly price from a price list entry which looks like:
+// {"terms": {"OnDemand": {"SKU.TERM": {"priceDimensions": {"SKU.TERM.DIM": {"pricePerUnit": {"USD": "0.096"}}}}}}}
+func onDemandPrice(product string) (float64, bool) {
+	var v map[string]interface{}
+	if err := json.Unmarshal([]byte(product), &v); err != nil {
+		return 0, false
+	}
+	for _, term := range object(v["terms"], "OnDemand") {
+		for _, dim := range object(term, "priceDimensions") {
+			usd, _ := object(dim, "pricePerUnit")["USD"].(string)
+			if v, err := strconv.ParseFloat(usd, 64); err == nil {
+				return v, true
+			}
+		}
+	}
+	return 0, false
+}
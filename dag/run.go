@@ -0,0 +1,355 @@
+package dag
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/base2genomics/batchit"
+	"github.com/base2genomics/batchit/logof"
+	"github.com/base2genomics/batchit/pipeline"
+	"github.com/base2genomics/batchit/submit"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/batch"
+	batchtypes "github.com/aws/aws-sdk-go-v2/service/batch/types"
+)
+
+type runArgs struct {
+	Region   string        `arg:"env:AWS_DEFAULT_REGION,help:region for batch setup. see batchit help for the default."`
+	State    string        `arg:"help:run-state file. default is the pipeline file with .state.json in place of its extension."`
+	Resume   bool          `arg:"help:skip jobs that succeeded and keep jobs that are still running in the run-state file."`
+	Watch    bool          `help:"wait for the jobs, cancel the jobs downstream of any that fail and exit 1 unless all succeed."`
+	Interval time.Duration `arg:"help:how often to check the status of the jobs with --watch."`
+	DryRun   bool          `arg:"help:show the jobs that would be submitted without submitting them."`
+	Pipeline string        `arg:"required,positional,help:pipeline YAML file as checked by batchit validate."`
+}
+
+func (c runArgs) Version() string {
+	return batchit.Version
+}
+
+func (c runArgs) Description() string {
+	return `Submit each job of a pipeline after the jobs it depends on, using batch dependencies so that a
+job only starts once its dependencies have succeeded. The job id and status of each job are written to a
+run-state file. With --resume, jobs that succeeded are not submitted again so a pipeline can be restarted
+after a failure is fixed. With --watch, the status of each job is logged as it changes and, when a job
+fails, the jobs downstream of it are cancelled rather than left to fail one by one.`
+}
+
+// Cancelled is the status recorded for a job that was cancelled because a job upstream of it failed.
+const Cancelled = "CANCELLED"
+
+// JobState is the last known state of a job in a run.
+type JobState struct {
+	JobId   string    `json:"job_id,omitempty"`
+	Status  string    `json:"status"`
+	Reason  string    `json:"reason,omitempty"`
+	Updated time.Time `json:"updated"`
+}
+
+// State is the run-state of a pipeline by job name.
+type State struct {
+	Pipeline string               `json:"pipeline"`
+	Region   string               `json:"region"`
+	Jobs     map[string]*JobState `json:"jobs"`
+}
+
+// StatePath returns the default run-state file for a pipeline file.
+func StatePath(pipelinePath string) string {
+	return strings.TrimSuffix(pipelinePath, filepath.Ext(pipelinePath)) + ".state.json"
+}
+
+// ReadState reads a run-state file.
+func ReadState(path string) (*State, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &State{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("dag: %s: %s", path, err)
+	}
+	if s.Jobs == nil {
+		s.Jobs = make(map[string]*JobState)
+	}
+	return s, nil
+}
+
+// Write writes the run-state to path by replacing it so that it is never partly written.
+func (s *State) Write(path string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func finished(status string) bool {
+	return status == string(batchtypes.JobStatusSucceeded) || status == string(batchtypes.JobStatusFailed) || status == Cancelled
+}
+
+// Runner submits and watches the jobs of a pipeline.
+type Runner struct {
+	Pipeline *pipeline.Pipeline
+	State    *State
+	// StatePath is where the state is written after each change.
+	StatePath string
+	DryRun    bool
+
+	cfg aws.Config
+	b   *batch.Client
+}
+
+// NewRunner returns a Runner for p that continues from state.
+func NewRunner(cfg aws.Config, p *pipeline.Pipeline, state *State, statePath string) *Runner {
+	return &Runner{Pipeline: p, State: state, StatePath: statePath, cfg: cfg, b: batch.NewFromConfig(cfg)}
+}
+
+func (r *Runner) set(name string, js *JobState) error {
+	js.Updated = time.Now().UTC()
+	r.State.Jobs[name] = js
+	if r.DryRun {
+		return nil
+	}
+	return r.State.Write(r.StatePath)
+}
+
+// Submit submits each job that has not succeeded and is not still active. A job depends on the
+// batch jobs of its dependencies that have not yet succeeded.
+func (r *Runner) Submit(ctx context.Context) error {
+	jobs, err := r.Pipeline.Order()
+	if err != nil {
+		return err
+	}
+	for _, j := range jobs {
+		if js := r.State.Jobs[j.Name]; js != nil && (js.Status == string(batchtypes.JobStatusSucceeded) || js.JobId != "" && !finished(js.Status)) {
+			log.Printf("[batchit dag] %s is %s as %s. not submitting", j.Name, js.Status, js.JobId)
+			continue
+		}
+		opts := j.Options(r.Pipeline.Dir, r.cfg.Region)
+		var deps []string
+		for _, d := range j.DependsOn {
+			if ds := r.State.Jobs[d]; ds != nil && ds.Status != string(batchtypes.JobStatusSucceeded) && (ds.JobId != "" || r.DryRun) {
+				opts.DependsOn = append(opts.DependsOn, ds.JobId)
+				deps = append(deps, d)
+			}
+		}
+		if r.DryRun {
+			log.Printf("[batchit dag] would submit %s after %v", j.Name, deps)
+			r.set(j.Name, &JobState{Status: string(batchtypes.JobStatusSubmitted)})
+			continue
+		}
+		id, err := submit.Submit(ctx, r.cfg, opts)
+		if err == submit.ErrOutputsExist {
+			log.Printf("[batchit dag] outputs of %s exist. not submitting", j.Name)
+			if err := r.set(j.Name, &JobState{Status: string(batchtypes.JobStatusSucceeded), Reason: "outputs exist"}); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("dag: submitting %s: %s", j.Name, err)
+		}
+		log.Printf("[batchit dag] submitted %s as %s", j.Name, id)
+		if err := r.set(j.Name, &JobState{JobId: id, Status: string(batchtypes.JobStatusSubmitted)}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Refresh updates the status of each unfinished job and returns the names of those that changed.
+func (r *Runner) Refresh(ctx context.Context) ([]string, error) {
+	byId := make(map[string]string)
+	var ids []string
+	for name, js := range r.State.Jobs {
+		if js.JobId != "" && !finished(js.Status) {
+			byId[js.JobId] = name
+			ids = append(ids, js.JobId)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	details, err := logof.DescribeJobs(ctx, r.b, ids)
+	if err != nil {
+		return nil, err
+	}
+	var changed []string
+	for _, d := range details {
+		name := byId[aws.ToString(d.JobId)]
+		js := r.State.Jobs[name]
+		if s := string(d.Status); s != js.Status {
+			changed = append(changed, name)
+			if err := r.set(name, &JobState{JobId: js.JobId, Status: s, Reason: aws.ToString(d.StatusReason)}); err != nil {
+				return nil, err
+			}
+		}
+	}
+	sort.Strings(changed)
+	return changed, nil
+}
+
+// Downstream returns the names of the jobs that depend on name directly or indirectly.
+func (r *Runner) Downstream(name string) []string {
+	seen := make(map[string]bool)
+	var out []string
+	var visit func(string)
+	visit = func(n string) {
+		for _, j := range r.Pipeline.Jobs {
+			for _, d := range j.DependsOn {
+				if d == n && !seen[j.Name] {
+					seen[j.Name] = true
+					out = append(out, j.Name)
+					visit(j.Name)
+				}
+			}
+		}
+	}
+	visit(name)
+	return out
+}
+
+// CancelDownstream cancels the unfinished jobs downstream of the failed job name.
+func (r *Runner) CancelDownstream(ctx context.Context, name string) error {
+	for _, n := range r.Downstream(name) {
+		js := r.State.Jobs[n]
+		if js == nil || js.JobId == "" || finished(js.Status) {
+			continue
+		}
+		reason := fmt.Sprintf("batchit dag: upstream job %s failed", name)
+		if _, err := r.b.CancelJob(ctx, &batch.CancelJobInput{JobId: aws.String(js.JobId), Reason: aws.String(reason)}); err != nil {
+			return err
+		}
+		log.Printf("[batchit dag] cancelled %s (%s) as %s failed", n, js.JobId, name)
+		if err := r.set(n, &JobState{JobId: js.JobId, Status: Cancelled, Reason: reason}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Watch polls until every job has finished, cancelling the jobs downstream of any that fail.
+func (r *Runner) Watch(ctx context.Context, interval time.Duration) error {
+	for {
+		changed, err := r.Refresh(ctx)
+		if err != nil {
+			return err
+		}
+		for _, name := range changed {
+			js := r.State.Jobs[name]
+			log.Printf("[batchit dag] %s (%s) is %s", name, js.JobId, js.Status)
+			if js.Status == string(batchtypes.JobStatusFailed) {
+				if err := r.CancelDownstream(ctx, name); err != nil {
+					return err
+				}
+			}
+		}
+		done := true
+		for _, j := range r.Pipeline.Jobs {
+			if js := r.State.Jobs[j.Name]; js == nil || !finished(js.Status) {
+				done = false
+			}
+		}
+		if done {
+			return nil
+		}
+		time.Sleep(interval)
+	}
+}
+
+// WriteTable writes the state of each job in the order of the pipeline.
+func (r *Runner) WriteTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tJOB ID\tSTATUS\tREASON")
+	for _, j := range r.Pipeline.Jobs {
+		js := r.State.Jobs[j.Name]
+		if js == nil {
+			js = &JobState{Status: "-"}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", j.Name, js.JobId, js.Status, js.Reason)
+	}
+	return tw.Flush()
+}
+
+func RunMain() {
+	cli := &runArgs{Interval: 30 * time.Second}
+	p := batchit.MustParse(cli)
+	if cli.Interval < time.Second {
+		p.Fail("--interval must be at least 1s")
+	}
+	if cli.State == "" {
+		cli.State = StatePath(cli.Pipeline)
+	}
+	pl, err := pipeline.Read(cli.Pipeline)
+	if err != nil {
+		p.Fail(err.Error())
+	}
+	if errs := pl.Check(); len(errs) > 0 {
+		for _, e := range errs {
+			log.Printf("[batchit dag] %s: %s", cli.Pipeline, e)
+		}
+		os.Exit(1)
+	}
+	ctx := context.Background()
+	cfg, err := batchit.LoadConfig(ctx, cli.Region)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cli.Region = cfg.Region
+	state := &State{Pipeline: cli.Pipeline, Region: cli.Region, Jobs: make(map[string]*JobState)}
+	if cli.Resume {
+		if state, err = ReadState(cli.State); err != nil {
+			p.Fail(fmt.Sprintf("--resume: %s", err))
+		}
+		if state.Region != cli.Region {
+			p.Fail(fmt.Sprintf("--resume: the run was in %s, not %s", state.Region, cli.Region))
+		}
+	} else if _, err := os.Stat(cli.State); err == nil && !cli.DryRun {
+		p.Fail(fmt.Sprintf("%s exists. use --resume to continue that run or remove it", cli.State))
+	}
+	r := NewRunner(cfg, pl, state, cli.State)
+	r.DryRun = cli.DryRun
+
+	if cli.Resume {
+		// jobs that were active may have finished since.
+		if _, err := r.Refresh(ctx); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := r.Submit(ctx); err != nil {
+		log.Fatal(err)
+	}
+	if cli.DryRun {
+		return
+	}
+	if cli.Watch {
+		if err := r.Watch(ctx, cli.Interval); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := r.WriteTable(os.Stdout); err != nil {
+		log.Fatal(err)
+	}
+	if cli.Watch {
+		for _, js := range r.State.Jobs {
+			if js.Status != string(batchtypes.JobStatusSucceeded) {
+				os.Exit(1)
+			}
+		}
+	}
+}
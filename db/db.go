@@ -0,0 +1,181 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	batchtypes "github.com/aws/aws-sdk-go-v2/service/batch/types"
+)
+
+// EnvVar names the store that submissions and job states are recorded in, e.g.
+// dynamodb://batchit-jobs or sqlite:///home/me/batchit.db. Nothing is recorded if it is not set.
+const EnvVar = "BATCHIT_DB"
+
+// Record is a submitted job.
+type Record struct {
+	JobId      string            `json:"job_id"`
+	Name       string            `json:"name"`
+	Queue      string            `json:"queue"`
+	Region     string            `json:"region"`
+	Image      string            `json:"image"`
+	ScriptHash string            `json:"script_hash"`
+	Env        map[string]string `json:"env,omitempty"`
+	CPUs       int               `json:"cpus"`
+	Mem        int               `json:"mem"`
+	ArraySize  int64             `json:"array_size,omitempty"`
+	Status     string            `json:"status"`
+	ExitCode   *int64            `json:"exit_code,omitempty"`
+	Reason     string            `json:"reason,omitempty"`
+	Submitted  time.Time         `json:"submitted"`
+	Updated    time.Time         `json:"updated"`
+}
+
+// Finished is true if the job succeeded or failed.
+func (r *Record) Finished() bool {
+	return r.Status == string(batchtypes.JobStatusSucceeded) || r.Status == string(batchtypes.JobStatusFailed)
+}
+
+// Store keeps job records beyond the time that batch keeps jobs.
+type Store interface {
+	// Put adds or replaces a record.
+	Put(ctx context.Context, r *Record) error
+	// SetStatus updates the status of a recorded job. Jobs that were not recorded are ignored.
+	SetStatus(ctx context.Context, jobId, status, reason string, exitCode *int64, at time.Time) error
+	// Records returns the jobs submitted at or after since.
+	Records(ctx context.Context, since time.Time) ([]*Record, error)
+	Close() error
+}
+
+// backends open a store by the scheme of its URL.
+var backends = map[string]func(cfg aws.Config, name string) (Store, error){
+	"dynamodb": openDynamo,
+}
+
+// Open returns the store for url which is dynamodb://<table> or sqlite://<path>. Any other value
+// is taken as the path of a SQLite file.
+func Open(cfg aws.Config, url string) (Store, error) {
+	scheme, name := "sqlite", url
+	if i := strings.Index(url, "://"); i != -1 {
+		scheme, name = url[:i], url[i+3:]
+	}
+	open, ok := backends[scheme]
+	if !ok {
+		if scheme == "sqlite" {
+			return nil, fmt.Errorf("db: this batchit was built without SQLite support. build with -tags sqlite or use dynamodb://<table>")
+		}
+		return nil, fmt.Errorf("db: unknown store %s. expected dynamodb://<table> or sqlite://<path>", url)
+	}
+	if name == "" {
+		return nil, fmt.Errorf("db: no table or path in %s", url)
+	}
+	return open(cfg, name)
+}
+
+// FromEnv opens the store named by $BATCHIT_DB. It returns nil if that is not set.
+func FromEnv(cfg aws.Config) (Store, error) {
+	url := os.Getenv(EnvVar)
+	if url == "" {
+		return nil, nil
+	}
+	return Open(cfg, url)
+}
+
+// Track records a submission in the store named by $BATCHIT_DB if it is set. Errors are logged
+// rather than returned so that tracking never stops a job from being submitted.
+func Track(ctx context.Context, cfg aws.Config, r *Record) {
+	s, err := FromEnv(cfg)
+	if err == nil && s != nil {
+		err = s.Put(ctx, r)
+		s.Close()
+	}
+	if err != nil {
+		log.Printf("[batchit db] error recording %s: %s", r.JobId, err)
+	}
+}
+
+// Observe records the status of jobs in the store named by $BATCHIT_DB if it is set.
+func Observe(ctx context.Context, cfg aws.Config, jobs []*batchtypes.JobDetail) {
+	s, err := FromEnv(cfg)
+	if err != nil {
+		log.Printf("[batchit db] %s", err)
+		return
+	}
+	if s == nil {
+		return
+	}
+	defer s.Close()
+	if err := SetStatuses(ctx, s, jobs); err != nil {
+		log.Printf("[batchit db] error recording status: %s", err)
+	}
+}
+
+// SetStatuses updates the status of each of jobs in s.
+func SetStatuses(ctx context.Context, s Store, jobs []*batchtypes.JobDetail) error {
+	now := time.Now().UTC()
+	for _, j := range jobs {
+		var exitCode *int64
+		if j.Container != nil && j.Container.ExitCode != nil {
+			exitCode = aws.Int64(int64(*j.Container.ExitCode))
+		}
+		if err := s.SetStatus(ctx, aws.ToString(j.JobId), string(j.Status), aws.ToString(j.StatusReason), exitCode, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Query selects records.
+type Query struct {
+	// NameGlob is matched with path.Match.
+	NameGlob string
+	// ScriptHash matches records whose hash starts with it.
+	ScriptHash string
+	Status     string
+	// Env are key=value pairs that must all be in the environment of a job, e.g. sample=SS-1234.
+	Env   map[string]string
+	Since time.Time
+}
+
+// Match is true if r is selected by q.
+func (q Query) Match(r *Record) bool {
+	if q.NameGlob != "" {
+		if ok, _ := path.Match(q.NameGlob, r.Name); !ok {
+			return false
+		}
+	}
+	if q.ScriptHash != "" && !strings.HasPrefix(r.ScriptHash, q.ScriptHash) {
+		return false
+	}
+	if q.Status != "" && q.Status != r.Status {
+		return false
+	}
+	for k, v := range q.Env {
+		if r.Env[k] != v {
+			return false
+		}
+	}
+	return !r.Submitted.Before(q.Since)
+}
+
+// Find returns the records in s selected by q with the most recent first.
+func Find(ctx context.Context, s Store, q Query) ([]*Record, error) {
+	all, err := s.Records(ctx, q.Since)
+	if err != nil {
+		return nil, err
+	}
+	var out []*Record
+	for _, r := range all {
+		if q.Match(r) {
+			out = append(out, r)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Submitted.After(out[j].Submitted) })
+	return out, nil
+}
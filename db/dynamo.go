@@ -0,0 +1,109 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// dynamo keeps records in a DynamoDB table keyed by job_id. Times are RFC3339 strings in UTC so
+// they sort as strings.
+type dynamo struct {
+	svc   *dynamodb.Client
+	table string
+}
+
+// the attributes of an item are named by the json tags of Record.
+func jsonTags(o *attributevalue.EncoderOptions) { o.TagKey = "json" }
+
+func openDynamo(cfg aws.Config, table string) (Store, error) {
+	return &dynamo{svc: dynamodb.NewFromConfig(cfg), table: table}, nil
+}
+
+// CreateTable creates a DynamoDB table for records and waits for it to exist.
+func CreateTable(ctx context.Context, cfg aws.Config, table string) error {
+	svc := dynamodb.NewFromConfig(cfg)
+	_, err := svc.CreateTable(ctx, &dynamodb.CreateTableInput{
+		TableName:            aws.String(table),
+		AttributeDefinitions: []dynamodbtypes.AttributeDefinition{{AttributeName: aws.String("job_id"), AttributeType: dynamodbtypes.ScalarAttributeTypeS}},
+		KeySchema:            []dynamodbtypes.KeySchemaElement{{AttributeName: aws.String("job_id"), KeyType: dynamodbtypes.KeyTypeHash}},
+		BillingMode:          dynamodbtypes.BillingModePayPerRequest,
+	})
+	var inUse *dynamodbtypes.ResourceInUseException
+	if errors.As(err, &inUse) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return dynamodb.NewTableExistsWaiter(svc).Wait(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(table)}, 10*time.Minute)
+}
+
+func (d *dynamo) Put(ctx context.Context, r *Record) error {
+	c := *r
+	c.Submitted, c.Updated = r.Submitted.UTC(), r.Updated.UTC()
+	item, err := attributevalue.MarshalMapWithOptions(&c, jsonTags)
+	if err != nil {
+		return err
+	}
+	_, err = d.svc.PutItem(ctx, &dynamodb.PutItemInput{TableName: aws.String(d.table), Item: item})
+	return err
+}
+
+func (d *dynamo) SetStatus(ctx context.Context, jobId, status, reason string, exitCode *int64, at time.Time) error {
+	values := map[string]dynamodbtypes.AttributeValue{
+		":s": &dynamodbtypes.AttributeValueMemberS{Value: status},
+		":u": &dynamodbtypes.AttributeValueMemberS{Value: at.UTC().Format(time.RFC3339)},
+		":r": &dynamodbtypes.AttributeValueMemberS{Value: reason},
+	}
+	names := map[string]string{"#s": "status", "#u": "updated", "#r": "reason"}
+	expr := "SET #s = :s, #u = :u, #r = :r"
+	if exitCode != nil {
+		names["#e"] = "exit_code"
+		values[":e"] = &dynamodbtypes.AttributeValueMemberN{Value: strconv.FormatInt(*exitCode, 10)}
+		expr += ", #e = :e"
+	}
+	_, err := d.svc.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(d.table),
+		Key:                       map[string]dynamodbtypes.AttributeValue{"job_id": &dynamodbtypes.AttributeValueMemberS{Value: jobId}},
+		UpdateExpression:          aws.String(expr),
+		ConditionExpression:       aws.String("attribute_exists(job_id)"),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	})
+	var failed *dynamodbtypes.ConditionalCheckFailedException
+	if errors.As(err, &failed) {
+		return nil
+	}
+	return err
+}
+
+func (d *dynamo) Records(ctx context.Context, since time.Time) ([]*Record, error) {
+	var out []*Record
+	pages := dynamodb.NewScanPaginator(d.svc, &dynamodb.ScanInput{
+		TableName:                 aws.String(d.table),
+		FilterExpression:          aws.String("submitted >= :since"),
+		ExpressionAttributeValues: map[string]dynamodbtypes.AttributeValue{":since": &dynamodbtypes.AttributeValueMemberS{Value: since.UTC().Format(time.RFC3339)}},
+	})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return out, err
+		}
+		var rs []*Record
+		err = attributevalue.UnmarshalListOfMapsWithOptions(page.Items, &rs, func(o *attributevalue.DecoderOptions) { o.TagKey = "json" })
+		if err != nil {
+			return out, err
+		}
+		out = append(out, rs...)
+	}
+	return out, nil
+}
+
+func (d *dynamo) Close() error { return nil }
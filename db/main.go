@@ -0,0 +1,237 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/base2genomics/batchit"
+	"github.com/base2genomics/batchit/logof"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/batch"
+)
+
+var subs = map[string]struct {
+	help string
+	main func()
+}{
+	"init":  {"create the DynamoDB table or SQLite file for $BATCHIT_DB", InitMain},
+	"query": {"search recorded submissions", QueryMain},
+	"sync":  {"update the status of recorded jobs that have not finished", SyncMain},
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: batchit db <command> [options]\n\ncommands:")
+	var keys []string
+	for k := range subs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(os.Stderr, "  %-8s: %s\n", k, subs[k].help)
+	}
+	fmt.Fprintf(os.Stderr, "\nset $%s to dynamodb://<table> or sqlite://<path> to record jobs from submit, wait and status.\n", EnvVar)
+	os.Exit(1)
+}
+
+// Main dispatches to the job history commands.
+func Main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	s, ok := subs[os.Args[1]]
+	if !ok {
+		usage()
+	}
+	// remove the command name as is done for batchit itself.
+	os.Args = append(os.Args[:1], os.Args[2:]...)
+	s.main()
+}
+
+type storeArgs struct {
+	Region string `arg:"env:AWS_DEFAULT_REGION,help:region of the DynamoDB table"`
+	DB     string `arg:"required,env:BATCHIT_DB,help:store of job records: dynamodb://<table> or sqlite://<path>"`
+}
+
+func (c storeArgs) Version() string {
+	return batchit.Version
+}
+
+func (c storeArgs) config(ctx context.Context) aws.Config {
+	cfg, err := batchit.LoadConfig(ctx, c.Region)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return cfg
+}
+
+type initArgs struct {
+	storeArgs
+}
+
+func (c initArgs) Description() string {
+	return `Create the store for job records. A DynamoDB table is created with on-demand billing and job_id
+as its key. A SQLite file is created with its table.`
+}
+
+func InitMain() {
+	cli := &initArgs{}
+	batchit.MustParse(cli)
+	ctx := context.Background()
+	cfg := cli.config(ctx)
+	var err error
+	if table := strings.TrimPrefix(cli.DB, "dynamodb://"); table != cli.DB {
+		err = CreateTable(ctx, cfg, table)
+	} else {
+		var s Store
+		if s, err = Open(cfg, cli.DB); err == nil {
+			err = s.Close()
+		}
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("[batchit db] %s is ready", cli.DB)
+}
+
+type queryArgs struct {
+	storeArgs
+	Name   string   `help:"name of the jobs. may be a glob, e.g. 'align-*'."`
+	Hash   string   `help:"SHA-256 of the script, or the start of it, as shown by query."`
+	Env    []string `help:"key=value pairs that must be in the environment of the job, e.g. sample=SS-1234."`
+	Status string   `arg:"help:only show jobs with this status."`
+	Since  string   `help:"only show jobs submitted within this time, e.g. 24h or 30d. 0 for all."`
+	Limit  int      `arg:"help:maximum number of jobs to show. 0 for all."`
+	JSON   bool     `arg:"help:write the records as JSON."`
+}
+
+func (c queryArgs) Description() string {
+	return `Search the submissions recorded in $BATCHIT_DB, most recent first. The status is as of the last
+batchit wait, status or db sync for the job.`
+}
+
+// WriteTable writes a line for each record.
+func WriteTable(w io.Writer, rs []*Record) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SUBMITTED\tJOB ID\tNAME\tQUEUE\tSTATUS\tEXIT\tSCRIPT")
+	for _, r := range rs {
+		exit := "-"
+		if r.ExitCode != nil {
+			exit = fmt.Sprint(*r.ExitCode)
+		}
+		hash := r.ScriptHash
+		if len(hash) > 12 {
+			hash = hash[:12]
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", r.Submitted.Format("2006-01-02 15:04"), r.JobId, r.Name, r.Queue, r.Status, exit, hash)
+	}
+	return tw.Flush()
+}
+
+func QueryMain() {
+	cli := &queryArgs{Since: "90d", Limit: 50}
+	p := batchit.MustParse(cli)
+	q := Query{NameGlob: cli.Name, ScriptHash: cli.Hash, Status: strings.ToUpper(cli.Status), Env: make(map[string]string)}
+	for _, kv := range cli.Env {
+		pair := strings.SplitN(kv, "=", 2)
+		if len(pair) != 2 {
+			p.Fail(fmt.Sprintf("expected --env key=value, got %s", kv))
+		}
+		q.Env[pair[0]] = pair[1]
+	}
+	if cli.Since != "0" {
+		d, err := logof.ParseDuration(cli.Since)
+		if err != nil {
+			p.Fail(err.Error())
+		}
+		q.Since = time.Now().Add(-d)
+	}
+	ctx := context.Background()
+	s, err := Open(cli.config(ctx), cli.DB)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer s.Close()
+	rs, err := Find(ctx, s, q)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cli.Limit > 0 && len(rs) > cli.Limit {
+		log.Printf("[batchit db] showing the latest %d of %d jobs", cli.Limit, len(rs))
+		rs = rs[:cli.Limit]
+	}
+	if cli.JSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(rs)
+	} else {
+		err = WriteTable(os.Stdout, rs)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+type syncArgs struct {
+	storeArgs
+	Since string `arg:"help:only update jobs submitted within this time. batch keeps jobs for about 7 days."`
+}
+
+func (c syncArgs) Description() string {
+	return `Update the status and exit code of each recorded job that has not finished from batch, e.g. from
+a daily schedule so that the history is complete for jobs that were never waited on.`
+}
+
+func SyncMain() {
+	cli := &syncArgs{Since: "14d"}
+	p := batchit.MustParse(cli)
+	d, err := logof.ParseDuration(cli.Since)
+	if err != nil {
+		p.Fail(err.Error())
+	}
+	ctx := context.Background()
+	s, err := Open(cli.config(ctx), cli.DB)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer s.Close()
+	rs, err := s.Records(ctx, time.Now().Add(-d))
+	if err != nil {
+		log.Fatal(err)
+	}
+	// jobs are described in the region they were submitted to.
+	byRegion := make(map[string][]string)
+	for _, r := range rs {
+		if !r.Finished() {
+			byRegion[r.Region] = append(byRegion[r.Region], r.JobId)
+		}
+	}
+	updated, missing := 0, 0
+	for region, ids := range byRegion {
+		cfg, err := batchit.LoadConfig(ctx, region)
+		if err != nil {
+			log.Fatal(err)
+		}
+		jobs, err := logof.DescribeJobs(ctx, batch.NewFromConfig(cfg), ids)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := SetStatuses(ctx, s, jobs); err != nil {
+			log.Fatal(err)
+		}
+		updated += len(jobs)
+		missing += len(ids) - len(jobs)
+	}
+	log.Printf("[batchit db] updated %d jobs", updated)
+	if missing > 0 {
+		log.Printf("[batchit db] %d jobs are no longer known to batch", missing)
+	}
+}
@@ -0,0 +1,111 @@
+//go:build sqlite
+// +build sqlite
+
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	// SQLite needs cgo so it is only built with -tags sqlite.
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func init() {
+	backends["sqlite"] = openSQLite
+}
+
+const schema = `CREATE TABLE IF NOT EXISTS jobs (
+	job_id TEXT PRIMARY KEY,
+	name TEXT NOT NULL,
+	queue TEXT NOT NULL,
+	region TEXT NOT NULL,
+	image TEXT NOT NULL,
+	script_hash TEXT NOT NULL,
+	env TEXT NOT NULL,
+	cpus INTEGER NOT NULL,
+	mem INTEGER NOT NULL,
+	array_size INTEGER NOT NULL,
+	status TEXT NOT NULL,
+	exit_code INTEGER,
+	reason TEXT NOT NULL,
+	submitted INTEGER NOT NULL,
+	updated INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS jobs_submitted ON jobs (submitted);`
+
+// sqlite keeps records in a SQLite file. Times are milliseconds since the epoch.
+type sqlite struct {
+	db *sql.DB
+}
+
+func openSQLite(cfg aws.Config, path string) (Store, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqlite{db: db}, nil
+}
+
+func millis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func fromMillis(ms int64) time.Time {
+	return time.Unix(0, ms*int64(time.Millisecond)).UTC()
+}
+
+func (s *sqlite) Put(ctx context.Context, r *Record) error {
+	env, err := json.Marshal(r.Env)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `INSERT OR REPLACE INTO jobs VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		r.JobId, r.Name, r.Queue, r.Region, r.Image, r.ScriptHash, string(env), r.CPUs, r.Mem, r.ArraySize,
+		r.Status, r.ExitCode, r.Reason, millis(r.Submitted), millis(r.Updated))
+	return err
+}
+
+func (s *sqlite) SetStatus(ctx context.Context, jobId, status, reason string, exitCode *int64, at time.Time) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE jobs SET status = ?, reason = ?, exit_code = COALESCE(?, exit_code), updated = ? WHERE job_id = ?`,
+		status, reason, exitCode, millis(at), jobId)
+	return err
+}
+
+func (s *sqlite) Records(ctx context.Context, since time.Time) ([]*Record, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT job_id, name, queue, region, image, script_hash, env, cpus, mem, array_size,
+		status, exit_code, reason, submitted, updated FROM jobs WHERE submitted >= ?`, millis(since))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []*Record
+	for rows.Next() {
+		r := &Record{}
+		var env string
+		var exitCode sql.NullInt64
+		var submitted, updated int64
+		if err := rows.Scan(&r.JobId, &r.Name, &r.Queue, &r.Region, &r.Image, &r.ScriptHash, &env, &r.CPUs, &r.Mem,
+			&r.ArraySize, &r.Status, &exitCode, &r.Reason, &submitted, &updated); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(env), &r.Env); err != nil {
+			return nil, err
+		}
+		if exitCode.Valid {
+			r.ExitCode = &exitCode.Int64
+		}
+		r.Submitted, r.Updated = fromMillis(submitted), fromMillis(updated)
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
+
+func (s *sqlite) Close() error { return s.db.Close() }
@@ -1,107 +1,518 @@
+// Package ddv detaches and deletes EBS volumes as batchit ddv does. Run does what the command
+// does for Args; DetachAndDelete, Snapshot and Stale work on a single region with any EC2API.
 package ddv
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/base2genomics/batchit"
 	"github.com/base2genomics/batchit/exsmount"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-func DetachAndDelete(vid string) error {
-	var svc *ec2.EC2
-	var drsp *ec2.DescribeVolumesOutput
-	var err error
+// Args are the arguments to batchit ddv. Start from DefaultArgs to use them with Run.
+type Args struct {
+	Region          string        `arg:"env:AWS_DEFAULT_REGION,help:region of the volume(s). see batchit help for the default."`
+	AllRegions      bool          `arg:"help:search every region for each volume. this makes many more API calls so only use it if the region is not known."`
+	DryRun          bool          `arg:"--dry-run,help:report the volumes that would be detached and deleted without changing them."`
+	DetachTimeout   time.Duration `arg:"help:how long to wait for a volume to become available after it is detached."`
+	MaxAttempts     int           `arg:"--detach-attempts,help:number of times to try to detach each volume while it is busy. the global --max-attempts is the number of tries of each AWS request."`
+	SnapshotFirst   bool          `arg:"help:snapshot each volume (tagged with the batch job id when run from a job) and wait for it to complete before deleting the volume."`
+	SnapshotTimeout time.Duration `arg:"--snapshot-timeout,help:with --snapshot-first how long to wait for each snapshot to complete. the volume is kept if it does not."`
+	Concurrency     int           `arg:"-j,help:number of volumes to process at once. requests that EC2 throttles slow down all workers."`
+	Purge           bool          `help:"rather than volume ids, find and delete unattached volumes created by ebsmount (named batchit-*) that are older than --olderthan."`
+	OlderThan       time.Duration `help:"with --purge, only delete volumes created longer ago than this."`
+	Instance        string        `help:"with --purge, only delete volumes created from this EC2 instance id."`
+	Queue           string        `help:"with --purge, only delete volumes created from instances currently in the compute environments of this job queue."`
+	Mount           string        `help:"unmount this path and delete the EBS volume(s) mounted there, including each member of a RAID array. for use inside a job that used ebsmount."`
+	VolumeIds       []string      `arg:"positional,help:volume id(s) to detach and delete. use - to read whitespace-separated ids from stdin."`
+}
 
-	for _, region := range []string{"us-east-1", "us-east-2", "us-west-1", "us-west-2", "ap-south-1",
-		"ap-northeast-2",
-		"ap-northeast-1",
-		"ca-central-1",
-		"cn-north-1",
-		"eu-west-1",
-		"eu-west-2",
-		"sa-east-1",
-		"us-gov-west-1",
-		"ap-southeast-1",
-		"ap-southeast-2",
-	} {
-		svc = ec2.New(session.Must(session.NewSession()), &aws.Config{Region: &region})
-		drsp, err = svc.DescribeVolumes(
-			&ec2.DescribeVolumesInput{
-				VolumeIds: []*string{&vid},
-			})
-		if err != nil {
+func (c Args) Version() string {
+	return batchit.Version
+}
+
+func (c Args) Description() string {
+	return `Detach and delete EBS volumes by id.
+Volume ids are read from stdin with "batchit ddv -" so that it can be used in a pipeline.
+The exit status is non-zero if any volume could not be found or deleted.
+Use --mount /path from inside a job to unmount that path and delete the volumes behind it.
+Use --purge to clean up volumes leaked by containers that were killed before they could remove them.
+Use --dry-run to see what would be deleted. This is useful to check cleanup jobs run from cron.
+The region is taken from --region, then $AWS_REGION or $AWS_DEFAULT_REGION, the config, the profile and then the
+instance metadata of this machine. With --mount, it is always the region of this machine.`
+}
+
+// Region returns the region of the EC2 instance this is running on.
+func Region() (string, error) {
+	iid := &exsmount.IID{}
+	if err := iid.Get(); err != nil {
+		return "", err
+	}
+	if iid.Region == "" {
+		return "", fmt.Errorf("ddv: no region found in instance metadata")
+	}
+	return iid.Region, nil
+}
+
+// Regions lists the regions that are enabled for this account. They are those of the partition
+// of the region of svc, so only the regions of GovCloud or China are listed there.
+func Regions(ctx context.Context, svc EC2API) ([]string, error) {
+	rsp, err := svc.DescribeRegions(ctx, &ec2.DescribeRegionsInput{})
+	if err != nil {
+		return nil, err
+	}
+	regions := make([]string, 0, len(rsp.Regions))
+	for _, r := range rsp.Regions {
+		regions = append(regions, *r.RegionName)
+	}
+	return regions, nil
+}
+
+// EC2API is the part of the EC2 client that ddv uses. *ec2.Client implements it as do the
+// in-memory fakes in github.com/base2genomics/batchit/fake.
+type EC2API interface {
+	DescribeRegions(context.Context, *ec2.DescribeRegionsInput, ...func(*ec2.Options)) (*ec2.DescribeRegionsOutput, error)
+	DescribeVolumes(context.Context, *ec2.DescribeVolumesInput, ...func(*ec2.Options)) (*ec2.DescribeVolumesOutput, error)
+	DetachVolume(context.Context, *ec2.DetachVolumeInput, ...func(*ec2.Options)) (*ec2.DetachVolumeOutput, error)
+	DeleteVolume(context.Context, *ec2.DeleteVolumeInput, ...func(*ec2.Options)) (*ec2.DeleteVolumeOutput, error)
+	CreateSnapshot(context.Context, *ec2.CreateSnapshotInput, ...func(*ec2.Options)) (*ec2.CreateSnapshotOutput, error)
+	DescribeSnapshots(context.Context, *ec2.DescribeSnapshotsInput, ...func(*ec2.Options)) (*ec2.DescribeSnapshotsOutput, error)
+}
+
+// Clients returns a client for each of the regions with svc, the client of cfg, for its region.
+// Each client has a single adaptive retryer from batchit.Retry so the workers that share it all
+// slow down when EC2 throttles the requests to its region.
+func Clients(cfg aws.Config, svc EC2API, regions []string) map[string]EC2API {
+	clients := map[string]EC2API{cfg.Region: svc}
+	for _, region := range regions {
+		if _, ok := clients[region]; !ok {
+			region := region
+			clients[region] = ec2.NewFromConfig(cfg, func(o *ec2.Options) { o.Region = region })
+		}
+	}
+	return clients
+}
+
+// Find returns the volume and the client of the region (of those given) that contains it.
+func Find(ctx context.Context, clients map[string]EC2API, vid string, regions []string) (EC2API, *ec2types.Volume, error) {
+	var err error
+	for _, region := range regions {
+		svc := clients[region]
+		var drsp *ec2.DescribeVolumesOutput
+		drsp, err = svc.DescribeVolumes(ctx, &ec2.DescribeVolumesInput{VolumeIds: []string{vid}})
+		if err != nil || len(drsp.Volumes) == 0 {
 			continue
 		}
-		break
+		if len(regions) > 1 {
+			log.Printf("ddv: found volume %s in region: %s", vid, region)
+		}
+		return svc, &drsp.Volumes[0], nil
 	}
-	if drsp == nil {
-		return fmt.Errorf("ddv: volume: %s not found", vid)
+	if err != nil {
+		return nil, nil, err
 	}
+	return nil, nil, batchit.Exit(batchit.ExitNotFound, fmt.Errorf("ddv: volume: %s not found", vid))
+}
+
+// Describe writes a single line with the id, size, state, attachment, age and tags of v.
+func Describe(w io.Writer, v *ec2types.Volume) {
+	attachment := "-"
+	if len(v.Attachments) > 0 {
+		a := v.Attachments[0]
+		attachment = fmt.Sprintf("%s:%s(%s)", aws.ToString(a.InstanceId), aws.ToString(a.Device), a.State)
+	}
+	age := "-"
+	if v.CreateTime != nil {
+		age = time.Since(*v.CreateTime).Truncate(time.Minute).String()
+	}
+	tags := make([]string, 0, len(v.Tags))
+	for _, t := range v.Tags {
+		tags = append(tags, aws.ToString(t.Key)+"="+aws.ToString(t.Value))
+	}
+	sort.Strings(tags)
+	fmt.Fprintf(w, "%s\t%dGB\t%s\t%s\t%s\t%s\n", aws.ToString(v.VolumeId), aws.ToInt32(v.Size),
+		v.State, attachment, age, strings.Join(tags, ","))
+}
+
+// readIds returns the whitespace-separated volume ids in r.
+func readIds(r io.Reader) ([]string, error) {
+	var ids []string
+	s := bufio.NewScanner(r)
+	s.Split(bufio.ScanWords)
+	for s.Scan() {
+		ids = append(ids, s.Text())
+	}
+	return ids, s.Err()
+}
+
+// Options controls the retries and waiting in DetachAndDelete.
+type Options struct {
+	// DetachTimeout is how long to wait for a detached volume to become available.
+	DetachTimeout time.Duration
+	// MaxAttempts is the number of times the detach is tried.
+	MaxAttempts int
+	// Snapshot the volume after it is detached and before it is deleted.
+	Snapshot bool
+	// SnapshotTimeout is how long to wait for the snapshot to complete.
+	SnapshotTimeout time.Duration
+}
+
+// jobTags maps the environment variables set by AWS batch to the tags added to snapshots.
+var jobTags = [][2]string{
+	{"AWS_BATCH_JOB_ID", "batchit-job-id"},
+	{"AWS_BATCH_JOB_ATTEMPT", "batchit-job-attempt"},
+	{"AWS_BATCH_JQ_NAME", "batchit-job-queue"},
+	{"AWS_BATCH_CE_NAME", "batchit-compute-environment"},
+}
+
+// Snapshot creates a snapshot of the volume and waits up to timeout for it to complete. The
+// snapshot is tagged with the batch job metadata if this is run from inside a job. Its id is
+// returned with the error if it was created but did not complete.
+func Snapshot(ctx context.Context, svc EC2API, vid string, timeout time.Duration) (string, error) {
+	tags := []ec2types.Tag{
+		{Key: aws.String("Name"), Value: aws.String("batchit-" + vid)},
+		{Key: aws.String("batchit-volume"), Value: aws.String(vid)},
+	}
+	for _, jt := range jobTags {
+		if v := os.Getenv(jt[0]); v != "" {
+			tags = append(tags, ec2types.Tag{Key: aws.String(jt[1]), Value: aws.String(v)})
+		}
+	}
+	snap, err := svc.CreateSnapshot(ctx, &ec2.CreateSnapshotInput{
+		VolumeId:    aws.String(vid),
+		Description: aws.String(fmt.Sprintf("batchit ddv snapshot of %s", vid)),
+		TagSpecifications: []ec2types.TagSpecification{
+			{ResourceType: ec2types.ResourceTypeSnapshot, Tags: tags},
+		},
+	})
 	if err != nil {
-		return err
+		return "", err
 	}
+	log.Printf("ddv: waiting for snapshot %s of volume %s", *snap.SnapshotId, vid)
+	waiter := ec2.NewSnapshotCompletedWaiter(svc)
+	if err := waiter.Wait(ctx, &ec2.DescribeSnapshotsInput{SnapshotIds: []string{*snap.SnapshotId}}, timeout); err != nil {
+		return *snap.SnapshotId, err
+	}
+	return *snap.SnapshotId, nil
+}
 
-	log.Printf("ddv: found volume for deletion in region: %s", *svc.Config.Region)
+// pollInterval is the time between the checks of the state of a volume.
+const pollInterval = 3 * time.Second
 
+// DefaultOptions are used by the ddv command unless overridden.
+var DefaultOptions = Options{DetachTimeout: 2 * time.Minute, MaxAttempts: 10, SnapshotTimeout: 10 * time.Minute}
+
+// waitAvailable polls until the volume is available or the timeout has passed.
+func waitAvailable(ctx context.Context, svc EC2API, vid string, timeout time.Duration) error {
+	var state ec2types.VolumeState
+	deadline := time.Now().Add(timeout)
+	for {
+		drsp, err := svc.DescribeVolumes(ctx, &ec2.DescribeVolumesInput{VolumeIds: []string{vid}})
+		if err != nil {
+			return err
+		}
+		if len(drsp.Volumes) == 0 {
+			return fmt.Errorf("ddv: volume: %s not found", vid)
+		}
+		state = drsp.Volumes[0].State
+		if state == ec2types.VolumeStateAvailable {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("ddv: volume: %s not available after %s. last state was: %s", vid, timeout, state)
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// DetachAndDelete forcibly detaches the volume (if needed) and deletes it. Each step is emitted
+// as volume.detached, volume.snapshotted and volume.deleted with --output jsonl.
+func DetachAndDelete(ctx context.Context, svc EC2API, vid string, opts Options) error {
+	ctx, span := batchit.StartSpan(ctx, "ddv.detach-and-delete", attribute.String("batchit.volume_id", vid))
+	return batchit.EndSpan(span, detachAndDelete(ctx, svc, vid, opts))
+}
+
+func detachAndDelete(ctx context.Context, svc EC2API, vid string, opts Options) error {
 	dtvi := &ec2.DetachVolumeInput{
 		VolumeId: aws.String(vid),
 		Force:    aws.Bool(true),
 	}
 
-	var v *ec2.VolumeAttachment
-
-	for i := 0; i < 10; i++ {
-		v, err = svc.DetachVolume(dtvi)
-		if err == nil {
-			if err := exsmount.WaitForVolumeStatus(svc, &vid, "available"); err != nil {
-				return err
-			}
+	var err error
+	for i := 0; i < opts.MaxAttempts; i++ {
+		var v *ec2.DetachVolumeOutput
+		v, err = svc.DetachVolume(ctx, dtvi)
+		if err == nil || (v != nil && string(v.State) == "available") {
+			err = waitAvailable(ctx, svc, vid, opts.DetachTimeout)
 			break
 		}
 		if strings.Contains(err.Error(), "is in the 'available' state") {
+			err = nil
 			break
 		}
-		if v != nil && *v.State == "available" {
+		// the client has already retried the request as often as batchit.Retry allows, so
+		// only errors about the state of the volume, e.g. while it is still attaching, are
+		// tried again.
+		if batchit.Retry.Retryable(err) {
 			break
 		}
+		time.Sleep(pollInterval)
+	}
+	if err != nil {
+		return err
+	}
+	batchit.Emit(batchit.Event{Type: batchit.EventVolumeDetached, VolumeId: vid})
+
+	if opts.Snapshot {
+		sid, err := Snapshot(ctx, svc, vid, opts.SnapshotTimeout)
+		if err != nil && sid != "" {
+			return fmt.Errorf("ddv: kept volume %s as its snapshot %s did not complete within %s: %s", vid, sid, opts.SnapshotTimeout, err)
+		}
 		if err != nil {
-			return err
+			return fmt.Errorf("ddv: kept volume %s as its snapshot could not be created: %s", vid, err)
 		}
-		time.Sleep(1 * time.Second)
+		log.Printf("ddv: created snapshot %s of volume %s", sid, vid)
+		batchit.Emit(batchit.Event{Type: batchit.EventVolumeSnapshotted, VolumeId: vid, SnapshotId: sid})
 	}
 
-	if _, err := svc.DeleteVolume(&ec2.DeleteVolumeInput{VolumeId: aws.String(vid)}); err != nil {
-		return err
+	_, err = svc.DeleteVolume(ctx, &ec2.DeleteVolumeInput{VolumeId: aws.String(vid)})
+	if err == nil {
+		batchit.Emit(batchit.Event{Type: batchit.EventVolumeDeleted, VolumeId: vid})
+	}
+	return err
+}
+
+// item is a volume to be deleted. svc and v are set if the volume has already been described.
+type item struct {
+	vid string
+	svc EC2API
+	v   *ec2types.Volume
+}
+
+// purge finds the stale volumes in each region.
+func purge(ctx context.Context, cli *Args, clients map[string]EC2API, regions []string) ([]item, error) {
+	var items []item
+	for _, region := range regions {
+		cfg, err := batchit.LoadConfig(ctx, region)
+		if err != nil {
+			return nil, err
+		}
+		instances := []string{}
+		if cli.Instance != "" {
+			instances = append(instances, cli.Instance)
+		}
+		if cli.Queue != "" {
+			ids, err := QueueInstances(ctx, cfg, cli.Queue)
+			if err != nil {
+				return nil, err
+			}
+			if len(ids) == 0 {
+				log.Printf("ddv: no instances found for queue %s in %s", cli.Queue, region)
+				continue
+			}
+			instances = append(instances, ids...)
+		}
+		svc := clients[region]
+		vols, err := Stale(ctx, svc, cli.OlderThan, instances)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range vols {
+			items = append(items, item{vid: *v.VolumeId, svc: svc, v: v})
+		}
+	}
+	log.Printf("ddv: found %d volumes older than %s to purge", len(items), cli.OlderThan)
+	return items, nil
+}
+
+// DefaultArgs are used by the ddv command unless overridden.
+var DefaultArgs = Args{DetachTimeout: DefaultOptions.DetachTimeout, MaxAttempts: DefaultOptions.MaxAttempts, Concurrency: 4,
+	OlderThan: 24 * time.Hour, SnapshotTimeout: DefaultOptions.SnapshotTimeout}
+
+// Validate returns an error if the arguments can not be used together.
+func (cli *Args) Validate() error {
+	if cli.MaxAttempts < 1 {
+		return errors.New("--detach-attempts must be at least 1")
+	}
+	if cli.Concurrency < 1 {
+		return errors.New("--concurrency must be at least 1")
+	}
+	if cli.SnapshotTimeout <= 0 {
+		return errors.New("--snapshot-timeout must be more than 0")
+	}
+	modes := 0
+	for _, m := range []bool{cli.Purge, cli.Mount != "", len(cli.VolumeIds) > 0} {
+		if m {
+			modes++
+		}
+	}
+	if modes != 1 {
+		return errors.New("specify one of volume ids, --purge or --mount")
+	}
+	if (cli.Instance != "" || cli.Queue != "") && !cli.Purge {
+		return errors.New("--instance and --queue require --purge")
 	}
 	return nil
 }
 
-func Main() {
-	if len(os.Args) < 2 {
-		fmt.Println("usage: ddv [<volume-id> ... ]")
-		os.Exit(1)
+func Main() error {
+	cli := DefaultArgs
+	p := batchit.MustParse(&cli)
+	if err := cli.Validate(); err != nil {
+		p.Fail(err.Error())
+	}
+	return Run(context.Background(), &cli)
+}
+
+// Run detaches and deletes the volumes of cli: those with the ids, with "-" read from stdin, those
+// found with Purge or those mounted at Mount. With DryRun, they are described to stdout instead.
+// The error has ExitPartial if only some of the volumes were deleted.
+func Run(ctx context.Context, cli *Args) error {
+	if err := cli.Validate(); err != nil {
+		return batchit.Exit(batchit.ExitUsage, err)
+	}
+	var vids []string
+	for _, vid := range cli.VolumeIds {
+		if vid != "-" {
+			vids = append(vids, vid)
+			continue
+		}
+		ids, err := readIds(os.Stdin)
+		if err != nil {
+			return err
+		}
+		vids = append(vids, ids...)
+	}
+	if len(vids) == 0 && !cli.Purge && cli.Mount == "" {
+		log.Println("ddv: no volume ids given")
+		return nil
+	}
+	var iid *exsmount.IID
+	if cli.Mount != "" {
+		// the volumes are attached to this instance so its region is used.
+		iid = &exsmount.IID{}
+		if err := iid.Get(); err != nil {
+			return batchit.Exit(batchit.ExitUsage, fmt.Errorf("ddv: --mount must be run on an EC2 instance: %s", err))
+		}
+		cli.Region = iid.Region
+	}
+	cfg, err := batchit.LoadConfig(ctx, cli.Region)
+	if err != nil {
+		return err
+	}
+	cli.Region = cfg.Region
+	svc := ec2.NewFromConfig(cfg)
+	regions := []string{cli.Region}
+	if cli.AllRegions {
+		if regions, err = Regions(ctx, svc); err != nil {
+			return err
+		}
+	}
+	clients := Clients(cfg, svc, regions)
+
+	items := make([]item, 0, len(vids))
+	for _, vid := range vids {
+		items = append(items, item{vid: vid})
 	}
+	if cli.Purge {
+		if items, err = purge(ctx, cli, clients, regions); err != nil {
+			return err
+		}
+	}
+	if cli.Mount != "" {
+		ids, err := Volumes(ctx, svc, iid, cli.Mount)
+		if err != nil {
+			return err
+		}
+		if !cli.DryRun {
+			if err := Unmount(cli.Mount); err != nil {
+				return err
+			}
+		}
+		for _, vid := range ids {
+			items = append(items, item{vid: vid})
+		}
+	}
+
+	if cli.DryRun && !batchit.JSONL() {
+		fmt.Println("#volume\tsize\tstate\tattachment\tage\ttags")
+	}
+	opts := Options{DetachTimeout: cli.DetachTimeout, MaxAttempts: cli.MaxAttempts, Snapshot: cli.SnapshotFirst,
+		SnapshotTimeout: cli.SnapshotTimeout}
+	var failed int
+	// first is the first error which sets the exit code when every volume fails.
+	var first error
+	var mu sync.Mutex
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if first == nil {
+			first = err
+		}
+		failed++
+	}
+	work := make(chan item)
 	wg := &sync.WaitGroup{}
-	for _, vid := range os.Args[1:] {
+	for i := 0; i < cli.Concurrency; i++ {
 		wg.Add(1)
-		go func(vid string) {
-
-			if err := DetachAndDelete(vid); err != nil {
-				log.Println(err)
-			} else {
-				log.Printf("volume %s has been deleted", vid)
+		go func() {
+			defer wg.Done()
+			for it := range work {
+				if it.svc == nil {
+					var err error
+					if it.svc, it.v, err = Find(ctx, clients, it.vid, regions); err != nil {
+						log.Println(err)
+						batchit.Emit(batchit.Event{Type: batchit.EventVolumeDeleted, VolumeId: it.vid, Error: err.Error()})
+						fail(err)
+						continue
+					}
+				}
+				if cli.DryRun {
+					if batchit.JSONL() {
+						batchit.Emit(batchit.Event{Type: batchit.EventVolumeDeleted, VolumeId: it.vid, Status: string(it.v.State), DryRun: true})
+						continue
+					}
+					mu.Lock()
+					Describe(os.Stdout, it.v)
+					mu.Unlock()
+					continue
+				}
+				if err := DetachAndDelete(ctx, it.svc, it.vid, opts); err != nil {
+					log.Printf("ddv: error deleting volume %s: %s", it.vid, err)
+					batchit.Emit(batchit.Event{Type: batchit.EventVolumeDeleted, VolumeId: it.vid, Error: err.Error()})
+					fail(err)
+				} else {
+					log.Printf("volume %s has been deleted", it.vid)
+				}
 			}
-			wg.Done()
-		}(vid)
+		}()
 	}
+	for _, it := range items {
+		work <- it
+	}
+	close(work)
 	wg.Wait()
-	// always has non-zero exit status.
+	if failed > 0 {
+		err := fmt.Errorf("ddv: %d of %d volumes were not deleted", failed, len(items))
+		if failed < len(items) {
+			return batchit.Exit(batchit.ExitPartial, err)
+		}
+		return batchit.Exit(batchit.ExitCode(first), err)
+	}
+	return nil
 }
@@ -0,0 +1,149 @@
+package ddv
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/base2genomics/batchit/exsmount"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// mountDevice returns the device mounted at mountPoint according to /proc/mounts.
+func mountDevice(mountPoint string) (string, error) {
+	f, err := os.Open("/proc/mounts")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	mountPoint = filepath.Clean(mountPoint)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		toks := strings.Fields(s.Text())
+		if len(toks) > 1 && toks[1] == mountPoint {
+			return toks[0], nil
+		}
+	}
+	if err := s.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("ddv: nothing mounted at %s", mountPoint)
+}
+
+// members returns the devices that make up a RAID array (e.g. from ebsmount -n 2) or
+// just the device itself if it is not an md device.
+func members(dev string) ([]string, error) {
+	if p, err := filepath.EvalSymlinks(dev); err == nil {
+		dev = p
+	}
+	base := filepath.Base(dev)
+	if !strings.HasPrefix(base, "md") {
+		return []string{dev}, nil
+	}
+	slaves, err := ioutil.ReadDir(filepath.Join("/sys/block", base, "slaves"))
+	if err != nil {
+		return nil, err
+	}
+	var devs []string
+	for _, s := range slaves {
+		devs = append(devs, "/dev/"+s.Name())
+	}
+	return devs, nil
+}
+
+// normDevice makes device names from the kernel and from EC2 comparable as /dev/sdf
+// may appear as /dev/xvdf.
+func normDevice(dev string) string {
+	dev = strings.TrimPrefix(dev, "/dev/")
+	if strings.HasPrefix(dev, "sd") {
+		dev = "xvd" + dev[2:]
+	}
+	return dev
+}
+
+// volumeId returns the EBS volume id of dev. NVMe devices (on nitro instances) report the
+// volume id as their serial number; otherwise the device is matched to the attachments.
+func volumeId(dev string, attached []ec2types.Volume) (string, error) {
+	base := filepath.Base(dev)
+	if strings.HasPrefix(base, "nvme") {
+		serial, err := ioutil.ReadFile(filepath.Join("/sys/block", base, "device", "serial"))
+		if err == nil {
+			s := strings.TrimSpace(string(serial))
+			if strings.HasPrefix(s, "vol") && !strings.HasPrefix(s, "vol-") {
+				s = "vol-" + s[3:]
+			}
+			return s, nil
+		}
+	}
+	for _, v := range attached {
+		for _, a := range v.Attachments {
+			if normDevice(aws.ToString(a.Device)) == normDevice(dev) {
+				return *v.VolumeId, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("ddv: no volume found attached at %s", dev)
+}
+
+func run(name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	cmd.Stderr, cmd.Stdout = os.Stderr, os.Stderr
+	return cmd.Run()
+}
+
+// Volumes returns the ids of the EBS volumes attached to this instance that back mountPoint.
+// This must be called before Unmount as the md array hides its members once stopped.
+func Volumes(ctx context.Context, svc EC2API, iid *exsmount.IID, mountPoint string) ([]string, error) {
+	dev, err := mountDevice(mountPoint)
+	if err != nil {
+		return nil, err
+	}
+	devs, err := members(dev)
+	if err != nil {
+		return nil, err
+	}
+	drsp, err := svc.DescribeVolumes(ctx, &ec2.DescribeVolumesInput{
+		Filters: []ec2types.Filter{{Name: aws.String("attachment.instance-id"), Values: []string{iid.InstanceId}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var vids []string
+	for _, d := range devs {
+		vid, err := volumeId(d, drsp.Volumes)
+		if err != nil {
+			return nil, err
+		}
+		vids = append(vids, vid)
+	}
+	return vids, nil
+}
+
+// Unmount unmounts mountPoint and stops the RAID array if there is one.
+func Unmount(mountPoint string) error {
+	dev, err := mountDevice(mountPoint)
+	if err != nil {
+		return err
+	}
+	if err := run("umount", mountPoint); err != nil {
+		log.Printf("ddv: umount of %s failed (%s), trying lazy unmount", mountPoint, err)
+		if err := run("umount", "-l", mountPoint); err != nil {
+			return err
+		}
+	}
+	if strings.HasPrefix(filepath.Base(dev), "md") {
+		if err := run("mdadm", "--stop", dev); err != nil {
+			log.Printf("ddv: error stopping %s: %s", dev, err)
+		}
+	}
+	return nil
+}
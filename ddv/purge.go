@@ -0,0 +1,95 @@
+package ddv
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/base2genomics/batchit"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/batch"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+)
+
+// Stale returns the unattached volumes created by ebsmount (named batchit-$instance-id)
+// that are older than age. If instances is not empty, only volumes created from those
+// instances are returned.
+func Stale(ctx context.Context, svc EC2API, age time.Duration, instances []string) ([]*ec2types.Volume, error) {
+	names := []string{"batchit-*"}
+	if len(instances) > 0 {
+		names = names[:0]
+		for _, iid := range instances {
+			names = append(names, "batchit-"+iid+"*")
+		}
+	}
+	dvi := &ec2.DescribeVolumesInput{
+		Filters: []ec2types.Filter{
+			{Name: aws.String("status"), Values: []string{"available"}},
+			{Name: aws.String("tag:Name"), Values: names},
+		},
+	}
+	cutoff := time.Now().Add(-age)
+	var vols []*ec2types.Volume
+	pages := ec2.NewDescribeVolumesPaginator(svc, dvi)
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return vols, err
+		}
+		for i := range page.Volumes {
+			if v := &page.Volumes[i]; v.CreateTime != nil && v.CreateTime.Before(cutoff) {
+				vols = append(vols, v)
+			}
+		}
+	}
+	return vols, nil
+}
+
+// QueueInstances returns the ids of the EC2 instances that are currently in the compute
+// environments of the job queue.
+func QueueInstances(ctx context.Context, cfg aws.Config, queue string) ([]string, error) {
+	b := batch.NewFromConfig(cfg)
+	mctx := batchit.Mapping(ctx)
+	qo, err := b.DescribeJobQueues(mctx, &batch.DescribeJobQueuesInput{JobQueues: []string{queue}})
+	if err != nil {
+		return nil, err
+	}
+	if len(qo.JobQueues) == 0 {
+		return nil, fmt.Errorf("ddv: job queue %s not found", queue)
+	}
+	var ces []string
+	for _, o := range qo.JobQueues[0].ComputeEnvironmentOrder {
+		ces = append(ces, aws.ToString(o.ComputeEnvironment))
+	}
+	co, err := b.DescribeComputeEnvironments(mctx, &batch.DescribeComputeEnvironmentsInput{ComputeEnvironments: ces})
+	if err != nil {
+		return nil, err
+	}
+	ec := ecs.NewFromConfig(cfg)
+	var ids []string
+	for _, ce := range co.ComputeEnvironments {
+		pages := ecs.NewListContainerInstancesPaginator(ec, &ecs.ListContainerInstancesInput{Cluster: ce.EcsClusterArn})
+		for pages.HasMorePages() {
+			lo, err := pages.NextPage(ctx)
+			if err != nil {
+				return nil, err
+			}
+			if len(lo.ContainerInstanceArns) > 0 {
+				do, err := ec.DescribeContainerInstances(ctx, &ecs.DescribeContainerInstancesInput{
+					Cluster:            ce.EcsClusterArn,
+					ContainerInstances: lo.ContainerInstanceArns,
+				})
+				if err != nil {
+					return nil, err
+				}
+				for _, ci := range do.ContainerInstances {
+					ids = append(ids, aws.ToString(ci.Ec2InstanceId))
+				}
+			}
+		}
+	}
+	return ids, nil
+}
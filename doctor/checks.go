@@ -0,0 +1,362 @@
+package doctor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/base2genomics/batchit"
+	"github.com/base2genomics/batchit/quota"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/batch"
+	batchtypes "github.com/aws/aws-sdk-go-v2/service/batch/types"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	ecrtypes "github.com/aws/aws-sdk-go-v2/service/ecr/types"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	iamtypes "github.com/aws/aws-sdk-go-v2/service/iam/types"
+)
+
+// Doctor runs the checks.
+type Doctor struct {
+	cfg aws.Config
+	// pullRole is the instance role found with the queue, used to check ECR permissions.
+	pullRole string
+}
+
+// New returns a Doctor that uses cfg for every check.
+func New(cfg aws.Config) *Doctor {
+	return &Doctor{cfg: cfg}
+}
+
+// hostActions are needed by the ECS agent and by batchit ebsmount and ddv on each instance.
+var hostActions = []string{
+	"ecs:RegisterContainerInstance", "ecs:DiscoverPollEndpoint", "ecs:Poll", "ecs:SubmitTaskStateChange",
+	"logs:CreateLogStream", "logs:PutLogEvents",
+	"ec2:CreateVolume", "ec2:AttachVolume", "ec2:DetachVolume", "ec2:DeleteVolume", "ec2:DescribeVolumes",
+	"ec2:ModifyInstanceAttribute", "ec2:CreateTags",
+}
+
+// pullActions are needed to pull an image from ECR.
+var pullActions = []string{"ecr:GetAuthorizationToken", "ecr:BatchGetImage", "ecr:GetDownloadUrlForLayer", "ecr:BatchCheckLayerAvailability"}
+
+// Queue checks the queue, its compute environments, their instance role and instance metadata settings.
+func (d *Doctor) Queue(ctx context.Context, queue string) []Finding {
+	b := batch.NewFromConfig(d.cfg)
+	qo, err := b.DescribeJobQueues(ctx, &batch.DescribeJobQueuesInput{JobQueues: []string{queue}})
+	if err != nil {
+		return []Finding{fail("", "describing queue %s: %s", queue, err)}
+	}
+	if len(qo.JobQueues) == 0 {
+		return []Finding{fail("check the name and --region or create it with batchit ce create", "queue %s not found", queue)}
+	}
+	q := qo.JobQueues[0]
+	var fs []Finding
+	if q.State != batchtypes.JQStateEnabled || q.Status != batchtypes.JQStatusValid {
+		fs = append(fs, fail("fix the reason above and enable the queue in the Batch console", "queue %s is %s and %s: %s", queue, q.State, q.Status, aws.ToString(q.StatusReason)))
+	} else {
+		fs = append(fs, ok("queue %s is ENABLED and VALID", queue))
+	}
+	var ces []string
+	for _, o := range q.ComputeEnvironmentOrder {
+		ces = append(ces, aws.ToString(o.ComputeEnvironment))
+	}
+	if len(ces) == 0 {
+		return append(fs, fail("add a compute environment to the queue", "queue %s has no compute environments", queue))
+	}
+	co, err := b.DescribeComputeEnvironments(ctx, &batch.DescribeComputeEnvironmentsInput{ComputeEnvironments: ces})
+	if err != nil {
+		return append(fs, fail("", "describing compute environments: %s", err))
+	}
+	for i := range co.ComputeEnvironments {
+		fs = append(fs, d.computeEnvironment(ctx, &co.ComputeEnvironments[i])...)
+	}
+	return fs
+}
+
+func (d *Doctor) computeEnvironment(ctx context.Context, ce *batchtypes.ComputeEnvironmentDetail) []Finding {
+	name := aws.ToString(ce.ComputeEnvironmentName)
+	var fs []Finding
+	if ce.State != batchtypes.CEStateEnabled || ce.Status != batchtypes.CEStatusValid {
+		fs = append(fs, fail("fix the reason above; an INVALID compute environment must usually be recreated", "compute environment %s is %s and %s: %s", name, ce.State, ce.Status, aws.ToString(ce.StatusReason)))
+	} else {
+		fs = append(fs, ok("compute environment %s is ENABLED and VALID", name))
+	}
+	cr := ce.ComputeResources
+	if cr == nil {
+		return append(fs, warn("", "compute environment %s is unmanaged and was not checked further", name))
+	}
+	if aws.ToInt32(cr.MaxvCpus) == 0 {
+		fs = append(fs, fail(fmt.Sprintf("batchit ce scale %s --max N", name), "compute environment %s has maxvCpus of 0 so jobs will stay RUNNABLE", name))
+	}
+	fs = append(fs, d.instanceRole(ctx, name, aws.ToString(cr.InstanceRole))...)
+	if cr.LaunchTemplate != nil {
+		fs = append(fs, d.launchTemplate(ctx, name, cr.LaunchTemplate)...)
+	}
+	return append(fs, d.instances(ctx, name, aws.ToString(ce.EcsClusterArn))...)
+}
+
+// simulate returns the actions in actions that role is not allowed to call on resource ("*" for any).
+func (d *Doctor) simulate(ctx context.Context, roleArn string, actions []string, resource string) ([]string, error) {
+	var denied []string
+	pages := iam.NewSimulatePrincipalPolicyPaginator(iam.NewFromConfig(d.cfg), &iam.SimulatePrincipalPolicyInput{
+		PolicySourceArn: aws.String(roleArn),
+		ActionNames:     actions,
+		ResourceArns:    []string{resource},
+	})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return denied, err
+		}
+		for _, r := range page.EvaluationResults {
+			if r.EvalDecision != iamtypes.PolicyEvaluationDecisionTypeAllowed {
+				denied = append(denied, aws.ToString(r.EvalActionName))
+			}
+		}
+	}
+	return denied, nil
+}
+
+func (d *Doctor) instanceRole(ctx context.Context, ce, profile string) []Finding {
+	// this can be the name or ARN of an instance profile.
+	profile = profile[strings.LastIndex(profile, "/")+1:]
+	po, err := iam.NewFromConfig(d.cfg).GetInstanceProfile(ctx, &iam.GetInstanceProfileInput{InstanceProfileName: aws.String(profile)})
+	if err != nil {
+		return []Finding{fail("create it with the AmazonEC2ContainerServiceforEC2Role policy", "instance profile %s of %s: %s", profile, ce, err)}
+	}
+	if len(po.InstanceProfile.Roles) == 0 {
+		return []Finding{fail("add a role to the instance profile", "instance profile %s of %s has no role", profile, ce)}
+	}
+	role := *po.InstanceProfile.Roles[0].Arn
+	d.pullRole = role
+	denied, err := d.simulate(ctx, role, hostActions, "*")
+	if err != nil {
+		return []Finding{warn("run as a user allowed iam:SimulatePrincipalPolicy", "could not check the permissions of %s: %s", role, err)}
+	}
+	if len(denied) > 0 {
+		return []Finding{fail("attach AmazonEC2ContainerServiceforEC2Role and a policy allowing the ec2 volume actions to "+role,
+			"instance role %s of %s is not allowed: %s", role, ce, strings.Join(denied, ", "))}
+	}
+	return []Finding{ok("instance role %s can run the ECS agent and manage EBS volumes", role)}
+}
+
+// metadata checks the settings that determine whether batchit can read the instance identity
+// from inside a container. It uses IMDSv1 and containers on the bridge network are one hop further away.
+func metadata(what, endpoint, tokens string, hops int32) []Finding {
+	if endpoint == "disabled" {
+		return []Finding{fail("enable the instance metadata endpoint", "%s has the instance metadata endpoint disabled", what)}
+	}
+	var fs []Finding
+	if tokens == "required" {
+		fs = append(fs, fail("set HttpTokens to optional; batchit ebsmount reads instance metadata without a token",
+			"%s requires IMDSv2 tokens", what))
+	}
+	if hops == 1 {
+		fs = append(fs, warn("set HttpPutResponseHopLimit to 2 so that containers can get IMDSv2 tokens", "%s has a metadata hop limit of 1", what))
+	}
+	if len(fs) == 0 {
+		fs = append(fs, ok("%s allows instance metadata from containers", what))
+	}
+	return fs
+}
+
+func (d *Doctor) launchTemplate(ctx context.Context, ce string, lt *batchtypes.LaunchTemplateSpecification) []Finding {
+	version := aws.ToString(lt.Version)
+	if version == "" {
+		version = "$Default"
+	}
+	vo, err := ec2.NewFromConfig(d.cfg).DescribeLaunchTemplateVersions(ctx, &ec2.DescribeLaunchTemplateVersionsInput{
+		LaunchTemplateId:   lt.LaunchTemplateId,
+		LaunchTemplateName: lt.LaunchTemplateName,
+		Versions:           []string{version},
+	})
+	if err != nil || len(vo.LaunchTemplateVersions) == 0 {
+		return []Finding{fail("check the launch template of the compute environment exists", "launch template of %s not found: %v", ce, err)}
+	}
+	v := vo.LaunchTemplateVersions[0]
+	what := fmt.Sprintf("launch template %s (%s)", aws.ToString(v.LaunchTemplateName), version)
+	mo := v.LaunchTemplateData.MetadataOptions
+	if mo == nil {
+		return []Finding{ok("%s uses the default instance metadata settings", what)}
+	}
+	return metadata(what, string(mo.HttpEndpoint), string(mo.HttpTokens), aws.ToInt32(mo.HttpPutResponseHopLimit))
+}
+
+// instances checks the metadata settings of the running instances in a cluster.
+func (d *Doctor) instances(ctx context.Context, ce, cluster string) []Finding {
+	if cluster == "" {
+		return nil
+	}
+	ec := ecs.NewFromConfig(d.cfg)
+	lo, err := ec.ListContainerInstances(ctx, &ecs.ListContainerInstancesInput{Cluster: aws.String(cluster)})
+	if err != nil {
+		return []Finding{warn("", "listing instances of %s: %s", ce, err)}
+	}
+	if len(lo.ContainerInstanceArns) == 0 {
+		return []Finding{ok("compute environment %s has no running instances to check", ce)}
+	}
+	eo, err := ec.DescribeContainerInstances(ctx, &ecs.DescribeContainerInstancesInput{Cluster: aws.String(cluster), ContainerInstances: lo.ContainerInstanceArns})
+	if err != nil {
+		return []Finding{warn("", "describing instances of %s: %s", ce, err)}
+	}
+	var ids []string
+	for _, ci := range eo.ContainerInstances {
+		ids = append(ids, aws.ToString(ci.Ec2InstanceId))
+	}
+	do, err := ec2.NewFromConfig(d.cfg).DescribeInstances(ctx, &ec2.DescribeInstancesInput{InstanceIds: ids})
+	if err != nil {
+		return []Finding{warn("", "describing instances of %s: %s", ce, err)}
+	}
+	var fs []Finding
+	for _, r := range do.Reservations {
+		for _, in := range r.Instances {
+			if mo := in.MetadataOptions; mo != nil {
+				fs = append(fs, metadata("instance "+aws.ToString(in.InstanceId), string(mo.HttpEndpoint), string(mo.HttpTokens), aws.ToInt32(mo.HttpPutResponseHopLimit))...)
+			}
+		}
+	}
+	return fs
+}
+
+// policy is the subset of an IAM policy document needed to check a trust policy.
+type policy struct {
+	Statement statements
+}
+
+type statement struct {
+	Effect    string
+	Action    strs
+	Principal struct{ Service strs }
+}
+
+// statements and strs can be either a single value or an array in a policy.
+type statements []statement
+type strs []string
+
+func (s *statements) UnmarshalJSON(b []byte) error {
+	var one statement
+	if err := json.Unmarshal(b, &one); err == nil {
+		*s = statements{one}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]statement)(s))
+}
+
+func (s *strs) UnmarshalJSON(b []byte) error {
+	var one string
+	if err := json.Unmarshal(b, &one); err == nil {
+		*s = strs{one}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(s))
+}
+
+func (s strs) has(v string) bool {
+	for _, x := range s {
+		if x == v || x == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// Trusts is true if the (URL-encoded) trust policy lets ECS tasks assume the role.
+func Trusts(doc string) (bool, error) {
+	doc, err := url.QueryUnescape(doc)
+	if err != nil {
+		return false, err
+	}
+	var p policy
+	if err := json.Unmarshal([]byte(doc), &p); err != nil {
+		return false, err
+	}
+	for _, s := range p.Statement {
+		if s.Effect == "Allow" && s.Action.has("sts:AssumeRole") && s.Principal.Service.has("ecs-tasks.amazonaws.com") {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// JobRole checks that the job role exists and can be assumed by ECS tasks.
+func (d *Doctor) JobRole(ctx context.Context, role string) []Finding {
+	ro, err := iam.NewFromConfig(d.cfg).GetRole(ctx, &iam.GetRoleInput{RoleName: aws.String(role)})
+	if err != nil {
+		return []Finding{fail("create the role or check the name given to --role", "job role %s: %s", role, err)}
+	}
+	trusted, err := Trusts(aws.ToString(ro.Role.AssumeRolePolicyDocument))
+	if err != nil {
+		return []Finding{warn("", "could not parse the trust policy of %s: %s", role, err)}
+	}
+	if !trusted {
+		return []Finding{fail("add ecs-tasks.amazonaws.com as a trusted service of the role", "job role %s can not be assumed by ECS tasks", role)}
+	}
+	return []Finding{ok("job role %s can be assumed by ECS tasks", role)}
+}
+
+var ecrImage = regexp.MustCompile(`^(\d+)\.dkr\.ecr\.([a-z0-9-]+)\.amazonaws\.com(?:\.cn)?/([^:@]+)(?::([^@]+))?(?:@(.+))?$`)
+
+// Image checks that an ECR image exists and that the instance role can pull it.
+func (d *Doctor) Image(ctx context.Context, image string) []Finding {
+	m := ecrImage.FindStringSubmatch(image)
+	if m == nil {
+		return []Finding{ok("image %s is not in ECR; instances must be able to reach its registry", image)}
+	}
+	account, region, repo, tag, digest := m[1], m[2], m[3], m[4], m[5]
+	id := &ecrtypes.ImageIdentifier{}
+	if digest != "" {
+		id.ImageDigest = aws.String(digest)
+	} else {
+		if tag == "" {
+			tag = "latest"
+		}
+		id.ImageTag = aws.String(tag)
+	}
+	var fs []Finding
+	svc := ecr.NewFromConfig(d.cfg, func(o *ecr.Options) { o.Region = region })
+	do, err := svc.DescribeImages(ctx, &ecr.DescribeImagesInput{RegistryId: aws.String(account), RepositoryName: aws.String(repo), ImageIds: []ecrtypes.ImageIdentifier{*id}})
+	if err != nil || len(do.ImageDetails) == 0 {
+		fs = append(fs, fail("push the image or check the tag", "image %s not found: %v", image, err))
+	} else {
+		fs = append(fs, ok("image %s exists", image))
+	}
+	if d.pullRole == "" {
+		return fs
+	}
+	resource := batchit.ARN("ecr", region, account, "repository/"+repo)
+	denied, err := d.simulate(ctx, d.pullRole, pullActions, resource)
+	if err != nil {
+		return append(fs, warn("run as a user allowed iam:SimulatePrincipalPolicy", "could not check that %s can pull %s: %s", d.pullRole, image, err))
+	}
+	if len(denied) > 0 {
+		return append(fs, fail("attach AmazonEC2ContainerRegistryReadOnly to "+d.pullRole+" or allow it in the repository policy",
+			"instance role %s is not allowed to pull %s: %s", d.pullRole, image, strings.Join(denied, ", ")))
+	}
+	return append(fs, ok("instance role %s can pull %s", d.pullRole, image))
+}
+
+// EBSQuota compares the storage used by each volume type with the account quota.
+func (d *Doctor) EBSQuota(ctx context.Context) []Finding {
+	us, err := quota.New(d.cfg).EBS(ctx)
+	if err != nil {
+		return []Finding{warn("run as a user allowed ec2:DescribeVolumes and servicequotas:ListServiceQuotas", "could not get EBS quotas: %s", err)}
+	}
+	var fs []Finding
+	for _, u := range us {
+		if u.Unit != "GiB" {
+			continue
+		}
+		if u.Fraction() > 0.9 {
+			fs = append(fs, warn("request a quota increase in the Service Quotas console", "%s uses %.0f of %.0f GiB allowed", u.Quota, u.Used, u.Limit))
+		} else {
+			fs = append(fs, ok("%s uses %.0f of %.0f GiB allowed", u.Quota, u.Used, u.Limit))
+		}
+	}
+	return fs
+}
@@ -0,0 +1,112 @@
+package doctor
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/base2genomics/batchit"
+
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+type cliargs struct {
+	Region string `arg:"env:AWS_DEFAULT_REGION,help:region for batch setup. see batchit help for the default."`
+	Queue  string `arg:"help:job queue to check along with its compute environments and their instances."`
+	Role   string `help:"job role to check, as used with batchit submit --role."`
+	Image  string `help:"docker image to check, as used with batchit submit --image."`
+}
+
+func (c cliargs) Version() string {
+	return batchit.Version
+}
+
+func (c cliargs) Description() string {
+	return `Check that an account is set up to run batchit jobs and print what to fix.
+This checks the queue and its compute environments, the permissions of the ECS instance role, the trust policy
+of the job role, that an ECR image exists and can be pulled, the headroom in the EBS storage quotas and the
+instance metadata settings that batchit ebsmount relies on. Only read-only calls are made.
+The exit code is 1 if any check fails.`
+}
+
+// Level is the severity of a Finding.
+type Level string
+
+const (
+	OK   Level = "OK"
+	Warn Level = "WARN"
+	Fail Level = "FAIL"
+)
+
+// Finding is the result of a single check.
+type Finding struct {
+	Level   Level
+	Message string
+	// Fix says what to do about a warning or failure.
+	Fix string
+}
+
+func ok(format string, args ...interface{}) Finding {
+	return Finding{Level: OK, Message: fmt.Sprintf(format, args...)}
+}
+
+func warn(fix string, format string, args ...interface{}) Finding {
+	return Finding{Level: Warn, Message: fmt.Sprintf(format, args...), Fix: fix}
+}
+
+func fail(fix string, format string, args ...interface{}) Finding {
+	return Finding{Level: Fail, Message: fmt.Sprintf(format, args...), Fix: fix}
+}
+
+// Write writes the findings and returns the number that failed.
+func Write(w io.Writer, findings []Finding) int {
+	failed := 0
+	for _, f := range findings {
+		fmt.Fprintf(w, "[%-4s] %s\n", f.Level, f.Message)
+		if f.Fix != "" {
+			fmt.Fprintf(w, "       fix: %s\n", f.Fix)
+		}
+		if f.Level == Fail {
+			failed++
+		}
+	}
+	return failed
+}
+
+func Main() {
+	cli := &cliargs{}
+	batchit.MustParse(cli)
+	// a check must fail with credentials or resources that stopped working since the last run.
+	ctx := batchit.Fresh(context.Background())
+	cfg, err := batchit.LoadConfig(ctx, cli.Region)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cli.Region = cfg.Region
+
+	id, err := sts.NewFromConfig(cfg).GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		Write(os.Stdout, []Finding{fail("configure credentials with aws configure or $AWS_PROFILE", "no usable AWS credentials: %s", err)})
+		os.Exit(1)
+	}
+	findings := []Finding{ok("using account %s as %s in %s", *id.Account, *id.Arn, cli.Region)}
+	d := New(cfg)
+	if cli.Queue != "" {
+		findings = append(findings, d.Queue(ctx, cli.Queue)...)
+	}
+	if cli.Role != "" {
+		findings = append(findings, d.JobRole(ctx, cli.Role)...)
+	}
+	if cli.Image != "" {
+		findings = append(findings, d.Image(ctx, cli.Image)...)
+	}
+	findings = append(findings, d.EBSQuota(ctx)...)
+	if cli.Queue == "" {
+		log.Println("[batchit doctor] use --queue to also check a queue, its instance role and instance metadata settings")
+	}
+	if Write(os.Stdout, findings) > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,198 @@
+package drain
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/base2genomics/batchit"
+	"github.com/base2genomics/batchit/instances"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/batch"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	ecstypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
+)
+
+type cliargs struct {
+	Region      string        `arg:"env:AWS_DEFAULT_REGION,help:region for batch setup. see batchit help for the default."`
+	Queue       string        `arg:"help:only search the compute environments of this queue for the instances. default is every ECS cluster."`
+	Wait        bool          `arg:"help:wait until the running tasks on each instance have finished."`
+	Terminate   bool          `arg:"help:terminate each instance once its tasks have finished. implies --wait."`
+	Timeout     time.Duration `arg:"help:give up waiting after this long. 0 waits forever."`
+	DryRun      bool          `arg:"help:show the instances that would be drained without changing anything."`
+	InstanceIds []string      `arg:"required,positional,help:EC2 instance id(s) to drain."`
+}
+
+func (c cliargs) Version() string {
+	return batchit.Version
+}
+
+func (c cliargs) Description() string {
+	return `Set ECS container instances to DRAINING so that no new jobs are placed on them while running jobs
+are left to finish. With --terminate, each instance is terminated once it is idle and Batch will launch a
+replacement if there is work for it.`
+}
+
+// Target is a container instance to drain.
+type Target struct {
+	Cluster           string
+	ContainerInstance *ecstypes.ContainerInstance
+}
+
+// clusters returns the ECS clusters of the queue or every cluster in the region.
+func clusters(ctx context.Context, cfg aws.Config, queue string) ([]string, error) {
+	var out []string
+	if queue != "" {
+		ces, err := instances.ComputeEnvironments(ctx, batch.NewFromConfig(cfg), queue)
+		if err != nil {
+			return nil, err
+		}
+		for _, ce := range ces {
+			if ce.EcsClusterArn != nil {
+				out = append(out, *ce.EcsClusterArn)
+			}
+		}
+		return out, nil
+	}
+	pages := ecs.NewListClustersPaginator(ecs.NewFromConfig(cfg), &ecs.ListClustersInput{})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return out, err
+		}
+		out = append(out, page.ClusterArns...)
+	}
+	return out, nil
+}
+
+// Find returns the container instance for each EC2 instance id.
+func Find(ctx context.Context, ec *ecs.Client, clusters []string, ids []string) (map[string]Target, error) {
+	want := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		want[id] = true
+	}
+	found := make(map[string]Target)
+	for _, cl := range clusters {
+		cis, err := instances.ContainerInstances(ctx, ec, cl)
+		if err != nil {
+			return nil, err
+		}
+		for _, ci := range cis {
+			if id := aws.ToString(ci.Ec2InstanceId); want[id] {
+				found[id] = Target{Cluster: cl, ContainerInstance: ci}
+			}
+		}
+		if len(found) == len(want) {
+			break
+		}
+	}
+	return found, nil
+}
+
+// Drain sets the container instance to DRAINING.
+func Drain(ctx context.Context, ec *ecs.Client, t Target) error {
+	_, err := ec.UpdateContainerInstancesState(ctx, &ecs.UpdateContainerInstancesStateInput{
+		Cluster:            aws.String(t.Cluster),
+		ContainerInstances: []string{aws.ToString(t.ContainerInstance.ContainerInstanceArn)},
+		Status:             ecstypes.ContainerInstanceStatusDraining,
+	})
+	return err
+}
+
+// WaitIdle polls until the container instance has no running or pending tasks. A timeout of 0 waits forever.
+func WaitIdle(ctx context.Context, ec *ecs.Client, t Target, interval, timeout time.Duration) error {
+	start := time.Now()
+	for {
+		eo, err := ec.DescribeContainerInstances(ctx, &ecs.DescribeContainerInstancesInput{
+			Cluster:            aws.String(t.Cluster),
+			ContainerInstances: []string{aws.ToString(t.ContainerInstance.ContainerInstanceArn)},
+		})
+		if err != nil {
+			return err
+		}
+		if len(eo.ContainerInstances) == 0 {
+			return nil
+		}
+		ci := eo.ContainerInstances[0]
+		n := ci.RunningTasksCount + ci.PendingTasksCount
+		if n == 0 {
+			return nil
+		}
+		if timeout > 0 && time.Since(start) > timeout {
+			return fmt.Errorf("drain: %s still has %d tasks after %s", aws.ToString(ci.Ec2InstanceId), n, timeout)
+		}
+		time.Sleep(interval)
+	}
+}
+
+func Main() {
+	cli := &cliargs{}
+	batchit.MustParse(cli)
+	if cli.Terminate {
+		cli.Wait = true
+	}
+	ctx := context.Background()
+	cfg, err := batchit.LoadConfig(ctx, cli.Region)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ec := ecs.NewFromConfig(cfg)
+
+	cls, err := clusters(ctx, cfg, cli.Queue)
+	if err != nil {
+		log.Fatal(err)
+	}
+	targets, err := Find(ctx, ec, cls, cli.InstanceIds)
+	if err != nil {
+		log.Fatal(err)
+	}
+	failed := 0
+	var drained []string
+	for _, id := range cli.InstanceIds {
+		t, ok := targets[id]
+		if !ok {
+			log.Printf("[batchit drain] %s is not a container instance in any cluster searched", id)
+			failed++
+			continue
+		}
+		ci := t.ContainerInstance
+		if cli.DryRun {
+			log.Printf("[batchit drain] would drain %s in %s which is %s with %d running tasks", id, t.Cluster, aws.ToString(ci.Status), ci.RunningTasksCount)
+			continue
+		}
+		if err := Drain(ctx, ec, t); err != nil {
+			log.Printf("[batchit drain] error draining %s: %s", id, err)
+			failed++
+			continue
+		}
+		log.Printf("[batchit drain] %s is DRAINING with %d running tasks", id, ci.RunningTasksCount)
+		drained = append(drained, id)
+	}
+	if cli.Wait && !cli.DryRun {
+		svc := ec2.NewFromConfig(cfg)
+		for _, id := range drained {
+			if err := WaitIdle(ctx, ec, targets[id], 15*time.Second, cli.Timeout); err != nil {
+				log.Printf("[batchit drain] %s", err)
+				failed++
+				continue
+			}
+			log.Printf("[batchit drain] %s has no running tasks", id)
+			if !cli.Terminate {
+				continue
+			}
+			if _, err := svc.TerminateInstances(ctx, &ec2.TerminateInstancesInput{InstanceIds: []string{id}}); err != nil {
+				log.Printf("[batchit drain] error terminating %s: %s", id, err)
+				failed++
+				continue
+			}
+			log.Printf("[batchit drain] terminated %s", id)
+		}
+	}
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,71 @@
+package batchit
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/aws/smithy-go"
+)
+
+// Codes that batchit exits with when a subcommand returns an error.
+const (
+	// ExitError is any error that is not one of the below.
+	ExitError = 1
+	// ExitTimeout is a wait that gave up before what it waited for happened. It is not set by
+	// ExitCode.
+	ExitTimeout = 2
+	// ExitAWS is a request to AWS that failed, e.g. for permissions or throttling.
+	ExitAWS = 3
+	// ExitNotFound is a job, volume, queue or object that does not exist.
+	ExitNotFound = 4
+	// ExitPartial is some of the work failing, e.g. some of the files not being uploaded.
+	ExitPartial = 5
+	// ExitInterrupted is a subcommand stopped by SIGINT or SIGTERM, as a shell reports SIGINT.
+	ExitInterrupted = 130
+	// ExitUsage is bad arguments. It is what go-arg exits with from MustParse and Fail.
+	ExitUsage = 255
+)
+
+// Error is an error with the code that batchit should exit with.
+type Error struct {
+	Code int
+	Err  error
+}
+
+func (e *Error) Error() string { return e.Err.Error() }
+
+func (e *Error) Unwrap() error { return e.Err }
+
+// Exit returns err with the code that batchit should exit with. It returns nil if err is nil.
+func Exit(code int, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Code: code, Err: err}
+}
+
+// ExitCode returns the code to exit with for err. Any error after an interrupt is
+// ExitInterrupted. Errors from Exit use their code, errors from AWS use ExitNotFound if the
+// service reported that something does not exist and ExitAWS otherwise. Anything else is
+// ExitError.
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if Interrupted() {
+		return ExitInterrupted
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	var aerr smithy.APIError
+	if errors.As(err, &aerr) {
+		code := aerr.ErrorCode()
+		if strings.Contains(code, "NotFound") || strings.HasPrefix(code, "NoSuch") {
+			return ExitNotFound
+		}
+		return ExitAWS
+	}
+	return ExitError
+}
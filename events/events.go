@@ -0,0 +1,250 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/base2genomics/batchit"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/batch"
+	"github.com/aws/aws-sdk-go-v2/service/eventbridge"
+	eventbridgetypes "github.com/aws/aws-sdk-go-v2/service/eventbridge/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+type cliargs struct {
+	Region string `arg:"env:AWS_DEFAULT_REGION,help:region for batch setup. see batchit help for the default."`
+	Queue  string `arg:"help:only stream events for jobs in this job queue. default is all queues."`
+	SQSURL string `arg:"help:consume events from this existing SQS queue rather than creating a rule and queue."`
+	Name   string `arg:"help:name of the EventBridge rule and SQS queue that are created. default is batchit-events[-$queue]."`
+	Keep   bool   `arg:"help:don't delete the rule and SQS queue on exit so that another run can resume with --sqsurl."`
+}
+
+func (c cliargs) Version() string {
+	return batchit.Version
+}
+
+func (c cliargs) Description() string {
+	return `Stream batch "Job State Change" events as JSON lines.
+An EventBridge rule is created that sends the events to a new SQS queue which is read until
+interrupted. The rule and queue are deleted on exit unless --keep is given.`
+}
+
+// Stream is an SQS queue that receives batch job state changes from an EventBridge rule.
+type Stream struct {
+	URL  string
+	Rule string
+
+	sqs *sqs.Client
+	eb  *eventbridge.Client
+}
+
+// Pattern returns the EventBridge pattern that matches state changes of jobs in queueArn
+// or in any queue if it is empty. If statuses are given, only changes to those are matched.
+func Pattern(queueArn string, statuses ...string) string {
+	p := map[string]interface{}{
+		"source":      []string{"aws.batch"},
+		"detail-type": []string{"Batch Job State Change"},
+	}
+	detail := make(map[string][]string)
+	if queueArn != "" {
+		detail["jobQueue"] = []string{queueArn}
+	}
+	if len(statuses) > 0 {
+		detail["status"] = statuses
+	}
+	if len(detail) > 0 {
+		p["detail"] = detail
+	}
+	b, _ := json.Marshal(p)
+	return string(b)
+}
+
+func policy(queueArn, ruleArn string) string {
+	return fmt.Sprintf(`{"Version":"2012-10-17","Statement":[{"Effect":"Allow","Principal":{"Service":"events.amazonaws.com"},`+
+		`"Action":"sqs:SendMessage","Resource":%q,"Condition":{"ArnEquals":{"aws:SourceArn":%q}}}]}`, queueArn, ruleArn)
+}
+
+// Setup creates an SQS queue and an EventBridge rule, both called name, that sends it the
+// job state changes matched by pattern.
+func Setup(ctx context.Context, cfg aws.Config, name, pattern string) (*Stream, error) {
+	s := &Stream{Rule: name, sqs: sqs.NewFromConfig(cfg), eb: eventbridge.NewFromConfig(cfg)}
+	co, err := s.sqs.CreateQueue(ctx, &sqs.CreateQueueInput{QueueName: aws.String(name)})
+	if err != nil {
+		return nil, err
+	}
+	s.URL = *co.QueueUrl
+	ao, err := s.sqs.GetQueueAttributes(ctx, &sqs.GetQueueAttributesInput{
+		QueueUrl:       co.QueueUrl,
+		AttributeNames: []sqstypes.QueueAttributeName{sqstypes.QueueAttributeNameQueueArn},
+	})
+	if err != nil {
+		return s, err
+	}
+	queueArn := ao.Attributes[string(sqstypes.QueueAttributeNameQueueArn)]
+
+	ro, err := s.eb.PutRule(ctx, &eventbridge.PutRuleInput{
+		Name:         aws.String(name),
+		EventPattern: aws.String(pattern),
+		State:        eventbridgetypes.RuleStateEnabled,
+		Description:  aws.String("batch job state changes for batchit events"),
+	})
+	if err != nil {
+		return s, err
+	}
+	if _, err := s.sqs.SetQueueAttributes(ctx, &sqs.SetQueueAttributesInput{
+		QueueUrl:   co.QueueUrl,
+		Attributes: map[string]string{string(sqstypes.QueueAttributeNamePolicy): policy(queueArn, *ro.RuleArn)},
+	}); err != nil {
+		return s, err
+	}
+	to, err := s.eb.PutTargets(ctx, &eventbridge.PutTargetsInput{
+		Rule:    aws.String(name),
+		Targets: []eventbridgetypes.Target{{Id: aws.String("batchit"), Arn: aws.String(queueArn)}},
+	})
+	if err != nil {
+		return s, err
+	}
+	if to.FailedEntryCount > 0 {
+		return s, fmt.Errorf("events: unable to add %s as target of rule %s", queueArn, name)
+	}
+	return s, nil
+}
+
+// Open returns a Stream that reads from an existing SQS queue.
+func Open(cfg aws.Config, url string) *Stream {
+	return &Stream{URL: url, sqs: sqs.NewFromConfig(cfg)}
+}
+
+// Close deletes the rule and queue made by Setup.
+func (s *Stream) Close(ctx context.Context) error {
+	var err error
+	if s.Rule != "" && s.eb != nil {
+		if _, err = s.eb.RemoveTargets(ctx, &eventbridge.RemoveTargetsInput{Rule: aws.String(s.Rule), Ids: []string{"batchit"}}); err == nil {
+			_, err = s.eb.DeleteRule(ctx, &eventbridge.DeleteRuleInput{Name: aws.String(s.Rule)})
+		}
+	}
+	if s.URL != "" {
+		if _, qerr := s.sqs.DeleteQueue(ctx, &sqs.DeleteQueueInput{QueueUrl: aws.String(s.URL)}); err == nil {
+			err = qerr
+		}
+	}
+	return err
+}
+
+// Next waits for the next batch of events (for up to 20 seconds) and calls fn with the body of
+// each. Events are deleted from the queue once fn returns without error.
+func (s *Stream) Next(ctx context.Context, fn func(body []byte) error) error {
+	ro, err := s.sqs.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+		QueueUrl:            aws.String(s.URL),
+		MaxNumberOfMessages: 10,
+		WaitTimeSeconds:     20,
+	})
+	if err != nil {
+		return err
+	}
+	for _, m := range ro.Messages {
+		if err := fn([]byte(aws.ToString(m.Body))); err != nil {
+			return err
+		}
+		if _, err := s.sqs.DeleteMessage(ctx, &sqs.DeleteMessageInput{QueueUrl: aws.String(s.URL), ReceiptHandle: m.ReceiptHandle}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Source is where Watch reads events from: the existing SQS queue at URL or else a new rule and
+// queue called Name for the events matched by Pattern. Those are deleted when Watch returns
+// unless Keep is true.
+type Source struct {
+	URL     string
+	Name    string
+	Pattern string
+	Keep    bool
+}
+
+// Watch calls fn with the body of each event from src until ctx is canceled or there is an error.
+// The rule and queue it creates are deleted with a cleanup context however it returns, unless
+// src.Keep is true, as are those left by a Setup that failed part way. It returns nil once ctx
+// is canceled.
+func Watch(ctx context.Context, cfg aws.Config, src Source, fn func(body []byte) error) error {
+	s := Open(cfg, src.URL)
+	if src.URL == "" {
+		var err error
+		s, err = Setup(ctx, cfg, src.Name, src.Pattern)
+		if s != nil && (err != nil || !src.Keep) {
+			defer func() {
+				cctx, cancel := batchit.CleanupContext(ctx)
+				defer cancel()
+				log.Printf("[batchit %s] removing rule and queue %s", batchit.Command, src.Name)
+				if err := s.Close(cctx); err != nil {
+					log.Printf("[batchit %s] %s", batchit.Command, err)
+				}
+			}()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	log.Printf("[batchit %s] streaming events from %s", batchit.Command, s.URL)
+	for ctx.Err() == nil {
+		if err := s.Next(ctx, fn); err != nil && ctx.Err() == nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeLine writes the event as a single line of JSON.
+func writeLine(w io.Writer, body []byte) error {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, body); err != nil {
+		// not JSON; write it as is.
+		buf.Reset()
+		buf.Write(bytes.TrimSpace(body))
+	}
+	buf.WriteByte('\n')
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func Main() error {
+	cli := &cliargs{}
+	batchit.MustParse(cli)
+	ctx := batchit.Context()
+	cfg, err := batchit.LoadConfig(ctx, cli.Region)
+	if err != nil {
+		return err
+	}
+
+	src := Source{URL: cli.SQSURL, Name: cli.Name, Keep: cli.Keep}
+	if cli.SQSURL == "" {
+		var queueArn string
+		if cli.Queue != "" {
+			qo, err := batch.NewFromConfig(cfg).DescribeJobQueues(batchit.Mapping(ctx), &batch.DescribeJobQueuesInput{JobQueues: []string{cli.Queue}})
+			if err != nil {
+				return err
+			}
+			if len(qo.JobQueues) == 0 {
+				return batchit.Exit(batchit.ExitNotFound, fmt.Errorf("job queue %s not found", cli.Queue))
+			}
+			queueArn = *qo.JobQueues[0].JobQueueArn
+		}
+		if src.Name == "" {
+			src.Name = "batchit-events"
+			if cli.Queue != "" {
+				src.Name += "-" + cli.Queue
+			}
+		}
+		src.Pattern = Pattern(queueArn)
+	}
+	return Watch(ctx, cfg, src, func(body []byte) error { return writeLine(os.Stdout, body) })
+}
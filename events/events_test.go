@@ -0,0 +1,27 @@
+package events
+
+import "testing"
+
+func TestPattern(t *testing.T) {
+	const arn = "arn:aws:batch:us-east-1:123456789012:job-queue/q"
+	for _, c := range []struct {
+		name     string
+		queueArn string
+		statuses []string
+		pattern  string
+	}{
+		{name: "all", pattern: `{"detail-type":["Batch Job State Change"],"source":["aws.batch"]}`},
+		{name: "queue", queueArn: arn,
+			pattern: `{"detail":{"jobQueue":["` + arn + `"]},"detail-type":["Batch Job State Change"],"source":["aws.batch"]}`},
+		{name: "statuses", statuses: []string{"FAILED", "SUCCEEDED"},
+			pattern: `{"detail":{"status":["FAILED","SUCCEEDED"]},"detail-type":["Batch Job State Change"],"source":["aws.batch"]}`},
+		{name: "queue and statuses", queueArn: arn, statuses: []string{"FAILED"},
+			pattern: `{"detail":{"jobQueue":["` + arn + `"],"status":["FAILED"]},"detail-type":["Batch Job State Change"],"source":["aws.batch"]}`},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if got := Pattern(c.queueArn, c.statuses...); got != c.pattern {
+				t.Errorf("expected %s. got %s", c.pattern, got)
+			}
+		})
+	}
+}
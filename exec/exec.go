@@ -0,0 +1,250 @@
+package exec
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	osexec "os/exec"
+	"strings"
+
+	"github.com/base2genomics/batchit"
+	"github.com/base2genomics/batchit/logof"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/batch"
+	batchtypes "github.com/aws/aws-sdk-go-v2/service/batch/types"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/smithy-go"
+)
+
+type cliargs struct {
+	Region    string   `arg:"env:AWS_DEFAULT_REGION,help:region for batch setup. see batchit help for the default."`
+	Container string   `arg:"help:name of the container in the task. default is the first."`
+	NoECSExec bool     `arg:"help:skip ECS Exec and go straight to an SSM session on the host."`
+	JobId     string   `arg:"required,positional,help:id of the running job."`
+	Command   []string `arg:"positional,help:command to run in the container after --. default is /bin/bash."`
+}
+
+func (c cliargs) Version() string {
+	return batchit.Version
+}
+
+func (c cliargs) Description() string {
+	return `Open an interactive session in the container of a running job, e.g.:
+
+    batchit exec $jobid
+    batchit exec $jobid -- top -c
+
+ECS Exec is used if it is enabled for the task. Otherwise, an SSM session is started on the host and the command
+is run with docker exec. Either way, the session-manager-plugin must be installed and the instance role must allow SSM.`
+}
+
+// Target is where a job is running.
+type Target struct {
+	Cluster   string
+	Task      string
+	Container string
+	// RuntimeId is the docker id of the container.
+	RuntimeId  string
+	InstanceId string
+}
+
+// Cluster returns the ECS cluster that ran j. Newer task ARNs include the cluster name,
+// otherwise the clusters of the compute environments of the queue are checked.
+func Cluster(ctx context.Context, cfg aws.Config, b *batch.Client, j *batchtypes.JobDetail) (string, error) {
+	// arn:aws:ecs:region:account:task/cluster/id
+	if parts := strings.Split(aws.ToString(j.Container.TaskArn), "/"); len(parts) == 3 {
+		return parts[1], nil
+	}
+	// the clusters of a queue rarely change so they may come from the cache.
+	qo, err := b.DescribeJobQueues(batchit.Mapping(ctx), &batch.DescribeJobQueuesInput{JobQueues: []string{aws.ToString(j.JobQueue)}})
+	if err != nil {
+		return "", err
+	}
+	if len(qo.JobQueues) == 0 {
+		return "", fmt.Errorf("exec: queue %s not found", aws.ToString(j.JobQueue))
+	}
+	var ces []string
+	for _, o := range qo.JobQueues[0].ComputeEnvironmentOrder {
+		ces = append(ces, aws.ToString(o.ComputeEnvironment))
+	}
+	co, err := b.DescribeComputeEnvironments(batchit.Mapping(ctx), &batch.DescribeComputeEnvironmentsInput{ComputeEnvironments: ces})
+	if err != nil {
+		return "", err
+	}
+	ec := ecs.NewFromConfig(cfg)
+	for _, ce := range co.ComputeEnvironments {
+		to, err := ec.DescribeTasks(ctx, &ecs.DescribeTasksInput{Cluster: ce.EcsClusterArn, Tasks: []string{*j.Container.TaskArn}})
+		if err == nil && len(to.Tasks) > 0 {
+			return *ce.EcsClusterArn, nil
+		}
+	}
+	return "", fmt.Errorf("exec: cluster for task %s not found", aws.ToString(j.Container.TaskArn))
+}
+
+// Find returns the task, container and instance of the running job j.
+func Find(ctx context.Context, cfg aws.Config, b *batch.Client, j *batchtypes.JobDetail, container string) (*Target, error) {
+	if j.Status != batchtypes.JobStatusRunning {
+		return nil, fmt.Errorf("exec: job %s is %s, not RUNNING", aws.ToString(j.JobId), j.Status)
+	}
+	if j.Container == nil || j.Container.TaskArn == nil {
+		return nil, fmt.Errorf("exec: job %s has no container task", aws.ToString(j.JobId))
+	}
+	cluster, err := Cluster(ctx, cfg, b, j)
+	if err != nil {
+		return nil, err
+	}
+	ec := ecs.NewFromConfig(cfg)
+	to, err := ec.DescribeTasks(ctx, &ecs.DescribeTasksInput{Cluster: aws.String(cluster), Tasks: []string{*j.Container.TaskArn}})
+	if err != nil {
+		return nil, err
+	}
+	if len(to.Tasks) == 0 || len(to.Tasks[0].Containers) == 0 {
+		return nil, fmt.Errorf("exec: task %s not found", *j.Container.TaskArn)
+	}
+	task := to.Tasks[0]
+	c := &task.Containers[0]
+	if container != "" {
+		c = nil
+		for i := range task.Containers {
+			if aws.ToString(task.Containers[i].Name) == container {
+				c = &task.Containers[i]
+			}
+		}
+		if c == nil {
+			return nil, fmt.Errorf("exec: no container named %s in task %s", container, *task.TaskArn)
+		}
+	}
+	t := &Target{Cluster: cluster, Task: *task.TaskArn, Container: aws.ToString(c.Name), RuntimeId: aws.ToString(c.RuntimeId)}
+
+	eo, err := ec.DescribeContainerInstances(ctx, &ecs.DescribeContainerInstancesInput{
+		Cluster:            aws.String(cluster),
+		ContainerInstances: []string{aws.ToString(task.ContainerInstanceArn)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(eo.ContainerInstances) > 0 {
+		t.InstanceId = aws.ToString(eo.ContainerInstances[0].Ec2InstanceId)
+	}
+	return t, nil
+}
+
+// ecsTarget is the session target the plugin expects for ECS Exec.
+func (t *Target) ecsTarget() string {
+	cluster := t.Cluster[strings.LastIndex(t.Cluster, "/")+1:]
+	task := t.Task[strings.LastIndex(t.Task, "/")+1:]
+	return fmt.Sprintf("ecs:%s_%s_%s", cluster, task, t.RuntimeId)
+}
+
+// plugin hands a started session to the session-manager-plugin which connects the terminal to it.
+func plugin(region string, session, params interface{}, endpoint string) error {
+	sj, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	pj, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	cmd := osexec.Command("session-manager-plugin", string(sj), region, "StartSession", "", string(pj), endpoint)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	return cmd.Run()
+}
+
+// ECSExec opens an ECS Exec session running command in the container.
+func ECSExec(ctx context.Context, cfg aws.Config, region string, t *Target, command string) error {
+	eo, err := ecs.NewFromConfig(cfg).ExecuteCommand(ctx, &ecs.ExecuteCommandInput{
+		Cluster:     aws.String(t.Cluster),
+		Task:        aws.String(t.Task),
+		Container:   aws.String(t.Container),
+		Command:     aws.String(command),
+		Interactive: true,
+	})
+	if err != nil {
+		return err
+	}
+	return plugin(region, eo.Session, map[string]string{"Target": t.ecsTarget()}, "https://"+batchit.Endpoint("ecs", region))
+}
+
+// HostExec opens an SSM session on the instance running the job and runs command in the
+// container with docker exec.
+func HostExec(ctx context.Context, cfg aws.Config, region string, t *Target, command string) error {
+	if t.InstanceId == "" || t.RuntimeId == "" {
+		return fmt.Errorf("exec: instance or container id unknown for task %s", t.Task)
+	}
+	ssi := &ssm.StartSessionInput{
+		Target:       aws.String(t.InstanceId),
+		DocumentName: aws.String("AWS-StartInteractiveCommand"),
+		Parameters: map[string][]string{
+			"command": {fmt.Sprintf("sudo docker exec -it %s %s", t.RuntimeId, command)},
+		},
+	}
+	so, err := ssm.NewFromConfig(cfg).StartSession(ctx, ssi)
+	if err != nil {
+		return err
+	}
+	return plugin(region, so, ssi, "https://"+batchit.Endpoint("ssm", region))
+}
+
+// shellJoin quotes args so that they survive the shell used by each kind of session.
+func shellJoin(args []string) string {
+	q := make([]string, len(args))
+	for i, a := range args {
+		if a == "" || strings.ContainsAny(a, " \t\n'\"\\$`;&|<>*?()[]{}~#!") {
+			a = "'" + strings.Replace(a, "'", `'"'"'`, -1) + "'"
+		}
+		q[i] = a
+	}
+	return strings.Join(q, " ")
+}
+
+func Main() {
+	cli := &cliargs{}
+	batchit.MustParse(cli)
+	if _, err := osexec.LookPath("session-manager-plugin"); err != nil {
+		log.Fatal("[batchit exec] session-manager-plugin not found in $PATH. see: https://docs.aws.amazon.com/systems-manager/latest/userguide/session-manager-working-with-install-plugin.html")
+	}
+	command := "/bin/bash"
+	if len(cli.Command) > 0 {
+		command = shellJoin(cli.Command)
+	}
+	ctx := context.Background()
+	cfg, err := batchit.LoadConfig(ctx, cli.Region)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cli.Region = cfg.Region
+	b := batch.NewFromConfig(cfg)
+
+	jobs, err := logof.DescribeJobs(ctx, b, []string{cli.JobId})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(jobs) == 0 {
+		log.Fatalf("[batchit exec] job %s not found in %s", cli.JobId, cli.Region)
+	}
+	t, err := Find(ctx, cfg, b, jobs[0], cli.Container)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !cli.NoECSExec {
+		err = ECSExec(ctx, cfg, cli.Region, t, command)
+		var aerr smithy.APIError
+		if !errors.As(err, &aerr) || aerr.ErrorCode() != "InvalidParameterException" {
+			if err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+		// batch does not enable ECS Exec on its tasks so this is the usual case.
+		log.Printf("[batchit exec] ECS Exec is not enabled for %s. connecting through %s", t.Task, t.InstanceId)
+	}
+	if err := HostExec(ctx, cfg, cli.Region, t, command); err != nil {
+		log.Fatal(err)
+	}
+}
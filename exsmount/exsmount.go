@@ -1,27 +1,31 @@
+// Package exsmount creates EBS volumes, attaches them to this EC2 instance and mounts them,
+// RAID-0'd if there are several, as batchit ebsmount does. Mount does all of it; Attach can be
+// used with any EC2API and Devices. It also mounts local (MountLocal) and EFS (EFSMount) storage.
 package exsmount
 
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"math/rand"
-	"net/http"
 	"os"
 	"os/exec"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/base2genomics/batchit"
 
-	arg "github.com/alexflint/go-arg"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // IID holds the attributes from the instance identity document
@@ -37,8 +41,50 @@ func init() {
 	rand.Seed(time.Now().Unix())
 }
 
+// EC2API is the part of the EC2 client that ebsmount uses. *ec2.Client implements it as do the
+// in-memory fakes in github.com/base2genomics/batchit/fake.
+type EC2API interface {
+	CreateVolume(context.Context, *ec2.CreateVolumeInput, ...func(*ec2.Options)) (*ec2.CreateVolumeOutput, error)
+	AttachVolume(context.Context, *ec2.AttachVolumeInput, ...func(*ec2.Options)) (*ec2.AttachVolumeOutput, error)
+	DeleteVolume(context.Context, *ec2.DeleteVolumeInput, ...func(*ec2.Options)) (*ec2.DeleteVolumeOutput, error)
+	DescribeVolumes(context.Context, *ec2.DescribeVolumesInput, ...func(*ec2.Options)) (*ec2.DescribeVolumesOutput, error)
+	ModifyInstanceAttribute(context.Context, *ec2.ModifyInstanceAttributeInput, ...func(*ec2.Options)) (*ec2.ModifyInstanceAttributeOutput, error)
+}
+
+// Devices finds device nodes to attach volumes at and waits for attached volumes to appear.
+type Devices interface {
+	// Next returns the offset in suffixChars and the path of the first free device with prefix
+	// or -1 if there is none. pi is the attempt with the prefix, see HostDevices.
+	Next(prefix string, pi int, suffixChars string) (int, string)
+	// Wait reports whether device appeared.
+	Wait(device string) bool
+}
+
+type hostDevices struct{}
+
+func (hostDevices) Next(prefix string, pi int, suffixChars string) (int, string) {
+	return findNextDevNode(prefix, pi, suffixChars)
+}
+
+func (hostDevices) Wait(device string) bool { return waitForDevice(device) }
+
+// HostDevices are the devices in /dev of this machine. With /dev/sd, the first attempt (pi 0) uses
+// whole devices like /dev/sdf and later ones partitions like /dev/sdf1.
+var HostDevices Devices = hostDevices{}
+
+// sleep is used for the waits between EC2 requests so that tests can skip them.
+var sleep = time.Sleep
+
+// imdsTimeout is for requests to the instance metadata service which
+// will not respond when we are not on EC2.
+const imdsTimeout = 3 * time.Second
+
 func (i *IID) Get() error {
-	rsp, err := http.Get("http://169.254.169.254/latest/dynamic/instance-identity/document")
+	imds, err := batchit.HTTPClient(imdsTimeout)
+	if err != nil {
+		return err
+	}
+	rsp, err := imds.Get("http://169.254.169.254/latest/dynamic/instance-identity/document")
 	if err != nil {
 		return err
 	}
@@ -46,6 +92,7 @@ func (i *IID) Get() error {
 	return d.Decode(i)
 }
 
+// Args are the arguments to batchit ebsmount. Start from DefaultArgs to use them with Mount.
 type Args struct {
 	Size       int64  `arg:"-s,help:size in GB of desired EBS volume"`
 	MountPoint string `arg:"-m,required,help:directory on which to mount the EBS volume"`
@@ -73,12 +120,13 @@ func (l LocalArgs) Description() string {
 	return "RAID-0, mkfs and mount a series of drives."
 }
 
-func mountedDevices() map[string]bool {
+func mountedDevices() (map[string]bool, error) {
 	devices := make(map[string]bool)
 	f, err := os.Open("/proc/mounts")
 	if err != nil {
-		return devices
+		return devices, nil
 	}
+	defer f.Close()
 	r := bufio.NewReader(f)
 	for {
 		line, err := r.ReadString('\n')
@@ -86,7 +134,7 @@ func mountedDevices() map[string]bool {
 			break
 		}
 		if err != nil {
-			panic(err)
+			return nil, errors.Wrap(err, "error reading /proc/mounts")
 		}
 		dev := strings.Fields(line)[0]
 		devices[dev] = true
@@ -102,7 +150,7 @@ func mountedDevices() map[string]bool {
 
 	}
 
-	return devices
+	return devices, nil
 }
 
 func contains(haystack []string, needle string) bool {
@@ -116,7 +164,10 @@ func contains(haystack []string, needle string) bool {
 
 // MountLocal RAID-0's all devices onto a single mount-point.
 func MountLocal(deviceCandidates []string, mountBase string) ([]string, error) {
-	inUse := mountedDevices()
+	inUse, err := mountedDevices()
+	if err != nil {
+		return nil, err
+	}
 	var devices []string
 	for _, dev := range deviceCandidates {
 		sub := dev[:len(dev)-1]
@@ -212,7 +263,9 @@ func mkfs(fstype, attachDevice string) error {
 	return nil
 }
 
-func Create(svc *ec2.EC2, iid *IID, size int64, typ string, iops int64, is ...int) (*ec2.Volume, error) {
+// Create creates a volume in the zone of the instance and waits until it is available. A volume
+// that does not become available is returned with the error so that it can be deleted.
+func Create(ctx context.Context, svc EC2API, iid *IID, size int64, typ string, iops int64, is ...int) (*ec2.CreateVolumeOutput, error) {
 	suf := ""
 	if len(is) > 0 {
 		suf = fmt.Sprintf("-%d", is[0])
@@ -220,48 +273,66 @@ func Create(svc *ec2.EC2, iid *IID, size int64, typ string, iops int64, is ...in
 
 	cvi := &ec2.CreateVolumeInput{
 		AvailabilityZone: aws.String(iid.AvailabilityZone),
-		Size:             aws.Int64(size), //GB
-		VolumeType:       aws.String(typ),
-		TagSpecifications: []*ec2.TagSpecification{
-			&ec2.TagSpecification{
-				ResourceType: aws.String("volume"),
-				Tags:         []*ec2.Tag{&ec2.Tag{Key: aws.String("Name"), Value: aws.String(fmt.Sprintf("batchit-%s%s", iid.InstanceId, suf))}},
+		Size:             aws.Int32(int32(size)), //GB
+		VolumeType:       ec2types.VolumeType(typ),
+		TagSpecifications: []ec2types.TagSpecification{
+			{
+				ResourceType: ec2types.ResourceTypeVolume,
+				Tags:         []ec2types.Tag{{Key: aws.String("Name"), Value: aws.String(fmt.Sprintf("batchit-%s%s", iid.InstanceId, suf))}},
 			},
 		},
 	}
 	if typ == "io1" {
-		cvi.Iops = aws.Int64(iops)
+		cvi.Iops = aws.Int32(int32(iops))
 	}
 
-	rsp, err := svc.CreateVolume(cvi)
+	rsp, err := svc.CreateVolume(ctx, cvi)
 	if err != nil {
 		return nil, err
 	}
-	if err := WaitForVolumeStatus(svc, rsp.VolumeId, "available"); err != nil {
-		return nil, err
+	if err := WaitForVolumeStatus(ctx, svc, rsp.VolumeId, ec2types.VolumeStateAvailable); err != nil {
+		return rsp, err
 	}
 	return rsp, nil
 }
 
 type EFSArgs struct {
 	MountOptions string `arg:"-o,help:options to send to mount command"`
-	EFS          string `arg:"positional,required,help:efs DNS and mount path (e.g.fs-XXXXXX.efs.us-east-1.amazonaws.com:/mnt/efs/)"`
+	EFS          string `arg:"positional,required,help:efs DNS and mount path (e.g.fs-XXXXXX.efs.us-east-1.amazonaws.com:/mnt/efs/) or just fs-XXXXXX:/mnt/efs/ for a file system in the region of this instance"`
 	MountPoint   string `arg:"positional,required,help:local directory on which to mount the EBS volume"`
 }
 
 // EFSMain mounts and EFS drive
-func EFSMain() {
+func EFSMain() error {
 	cli := &EFSArgs{MountPoint: "/mount/efs/"}
-	arg.MustParse(cli)
+	batchit.MustParse(cli)
 
-	if err := EFSMount(cli.EFS, cli.MountPoint, cli.MountOptions); err != nil {
-		panic(err)
-	}
+	return EFSMount(cli.EFS, cli.MountPoint, cli.MountOptions)
+}
+
+var efsId = regexp.MustCompile(`^fs-[0-9a-f]+$`)
+
+// EFSHost returns the DNS name of the EFS file system with id in region. It is in the domain of
+// the partition of region, e.g. fs-XXXXXX.efs.cn-north-1.amazonaws.com.cn in China.
+func EFSHost(id, region string) string {
+	return id + "." + batchit.Endpoint("efs", region)
 }
 
 // EFSMount will mount the EFS drive to the requested mount-point.
 // the efs argument looks like: fs-XXXXXX.efs.us-east-1.amazonaws.com:/mnt/efs/
+// or fs-XXXXXX:/mnt/efs/ for a file system in the region of this instance.
 func EFSMount(efs string, mountPoint string, mountOpts string) error {
+	host, path, found := strings.Cut(efs, ":")
+	if !found {
+		return fmt.Errorf("EFS string must end with path within the mount e.g. :/")
+	}
+	if efsId.MatchString(host) {
+		iid := &IID{}
+		if err := iid.Get(); err != nil {
+			return errors.Wrap(err, "an EFS id without a DNS name must be mounted from an EC2 instance")
+		}
+		efs = EFSHost(host, iid.Region) + ":" + path
+	}
 	if err := makeDir(mountPoint); err != nil {
 		return err
 	}
@@ -269,9 +340,6 @@ func EFSMount(efs string, mountPoint string, mountOpts string) error {
 	if mountOpts != "" {
 		opts += "," + mountOpts
 	}
-	if !strings.Contains(efs, ":") {
-		return fmt.Errorf("EFS string must end with path within the mount e.g. :/")
-	}
 	// https://docs.aws.amazon.com/efs/latest/ug/mounting-fs-mount-cmd-general.html
 	cmd := exec.Command("mount", "-t", "nfs4", "-o", opts, efs, mountPoint)
 	cmd.Stderr, cmd.Stdout = os.Stderr, os.Stderr
@@ -281,21 +349,83 @@ func EFSMount(efs string, mountPoint string, mountOpts string) error {
 // http://docs.aws.amazon.com/AWSEC2/latest/UserGuide/device_naming.html
 const letters = "bcdefghijklmnopqrstuvwxyz"
 
-func CreateAttach(cli *Args) ([]string, error) {
+// CreateAttach creates the volumes of cli, attaches them to this instance and returns their devices.
+func CreateAttach(ctx context.Context, cli *Args) ([]string, error) {
+	_, devices, _, err := createAttach(ctx, cli)
+	return devices, err
+}
+
+// createAttach is CreateAttach that also returns the client and the volumes for release.
+func createAttach(ctx context.Context, cli *Args) (EC2API, []string, []string, error) {
 	iid := &IID{}
 	if err := iid.Get(); err != nil {
-		return nil, err
+		return nil, nil, nil, err
 	}
-	sess, err := session.NewSession()
+	// unlike other subcommands, the region is always that of this instance as volumes can only be
+	// attached in its availability zone.
+	cfg, err := batchit.LoadConfig(ctx, iid.Region)
 	if err != nil {
-		return nil, errors.Wrap(err, "error creating session")
+		return nil, nil, nil, errors.Wrap(err, "error loading aws config")
+	}
+	svc := ec2.NewFromConfig(cfg)
+	devices, volumes, err := Attach(ctx, svc, HostDevices, iid, cli)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if !batchit.JSONL() {
+		fmt.Println(strings.Join(volumes, " "))
+	}
+	if err = makeDir(cli.MountPoint); err != nil {
+		return nil, nil, nil, err
+	}
+	return svc, devices, volumes, nil
+}
+
+// detacher is the part of the EC2 client beyond EC2API that release uses.
+type detacher interface {
+	DetachVolume(context.Context, *ec2.DetachVolumeInput, ...func(*ec2.Options)) (*ec2.DetachVolumeOutput, error)
+}
+
+// release detaches and deletes volumes that were attached but not mounted when batchit is
+// interrupted so that they are not left on the instance. Each is emitted as volume.detached and
+// volume.deleted with --output jsonl.
+func release(ctx context.Context, svc EC2API, volumes []string) {
+	d, ok := svc.(detacher)
+	if !ok {
+		return
+	}
+	ctx, cancel := batchit.CleanupContext(ctx)
+	defer cancel()
+	for _, vid := range volumes {
+		log.Printf("[batchit ebsmount] interrupted. detaching and deleting volume %s", vid)
+		_, err := d.DetachVolume(ctx, &ec2.DetachVolumeInput{VolumeId: aws.String(vid), Force: aws.Bool(true)})
+		if err == nil {
+			batchit.Emit(batchit.Event{Type: batchit.EventVolumeDetached, VolumeId: vid})
+			err = WaitForVolumeStatus(ctx, svc, aws.String(vid), ec2types.VolumeStateAvailable)
+		}
+		if err == nil {
+			_, err = svc.DeleteVolume(ctx, &ec2.DeleteVolumeInput{VolumeId: aws.String(vid)})
+		}
+		if err != nil {
+			log.Printf("[batchit ebsmount] error releasing volume %s: %s", vid, err)
+			continue
+		}
+		batchit.Emit(batchit.Event{Type: batchit.EventVolumeDeleted, VolumeId: vid})
 	}
+}
+
+// Attach creates the volumes of cli and attaches them to the instance of iid at free devices,
+// retrying with other devices when jobs on the same instance race for one. It returns the
+// devices and the volume ids. A volume that could not be attached is deleted, as are those that
+// were if batchit is interrupted before all are. Each volume is emitted as volume.created and
+// volume.attached with --output jsonl.
+func Attach(ctx context.Context, svc EC2API, devs Devices, iid *IID, cli *Args) ([]string, []string, error) {
 	if cli.VolumeType == "io1" {
 		if cli.Iops == 0 {
 			cli.Iops = 45 * cli.Size
 		}
 		if cli.Iops < 100 || cli.Iops > 20000 {
-			return nil, fmt.Errorf("ebsmount: Iops must be between 100 and 20000")
+			return nil, nil, fmt.Errorf("ebsmount: Iops must be between 100 and 20000")
 		}
 		if cli.Iops > 50*cli.Size {
 			log.Printf("ebsmount: setting IOPs must be <= 50 times size")
@@ -308,41 +438,49 @@ func CreateAttach(cli *Args) ([]string, error) {
 
 	var devices []string
 	var volumes []string
-	svc := ec2.New(sess, &aws.Config{Region: aws.String(iid.Region)})
+	// the volumes that were attached are released if batchit is interrupted before the rest are.
+	done := false
+	defer func() {
+		if !done && batchit.Interrupted() {
+			release(ctx, svc, volumes)
+		}
+	}()
 
 	cli.Size = int64(float64(cli.Size)/float64(cli.N) + 0.5)
 	for i := 0; i < cli.N; i++ {
 		log.Println("batchit: creating EBS volume:", i)
 
-		var rsp *ec2.Volume
-		if rsp, err = Create(svc, iid, cli.Size, cli.VolumeType, cli.Iops, i); err != nil {
-			if strings.Contains(err.Error(), "RequestLimitExceeded") {
-				time.Sleep(time.Duration(10+rand.Intn(90)) * time.Second)
-				var err2 error
-				if rsp, err2 = Create(svc, iid, cli.Size, cli.VolumeType, cli.Iops, i); err2 != nil {
-					log.Println("WARNING: this usually means you need to space out job submissions")
-					return nil, errors.Wrap(err, "error creating volume")
-				}
-
-			} else {
-				return nil, errors.Wrap(err, "error creating volume")
-			}
-		}
+		cctx, span := batchit.StartSpan(ctx, "ebsmount.create-volume", attribute.Int64("batchit.size_gb", cli.Size),
+			attribute.String("batchit.volume_type", cli.VolumeType))
+		// throttled requests are retried by the client. Create is not retried as a whole as that
+		// would create another volume when only the wait for the first one failed.
+		rsp, err := Create(cctx, svc, iid, cli.Size, cli.VolumeType, cli.Iops, i)
 		attached := false
-
-		defer func() {
-			if !attached {
-				log.Println("batchit: unsuccessful EBS volume attachment, deleting volume")
-				_, err := svc.DeleteVolume(&ec2.DeleteVolumeInput{VolumeId: rsp.VolumeId})
-				if err != nil {
-					log.Println(err)
+		if rsp != nil {
+			defer func() {
+				if !attached {
+					log.Println("batchit: unsuccessful EBS volume attachment, deleting volume")
+					ctx, cancel := batchit.CleanupContext(ctx)
+					defer cancel()
+					_, err := svc.DeleteVolume(ctx, &ec2.DeleteVolumeInput{VolumeId: rsp.VolumeId})
+					if err != nil {
+						log.Println(err)
+					}
 				}
+			}()
+		}
+		if err = batchit.EndSpan(span, err); err != nil {
+			if strings.Contains(err.Error(), "RequestLimitExceeded") {
+				log.Println("WARNING: this usually means you need to space out job submissions")
 			}
-		}()
-		time.Sleep(3 * time.Second) // sleep to avoid doing too many requests.
+			return nil, nil, errors.Wrap(err, "error creating volume")
+		}
+		batchit.Emit(batchit.Event{Type: batchit.EventVolumeCreated, VolumeId: *rsp.VolumeId, Region: iid.Region, Bytes: cli.Size << 30})
+		sleep(3 * time.Second) // sleep to avoid doing too many requests.
 
 		// http://docs.aws.amazon.com/AWSEC2/latest/UserGuide/device_naming.html
 		// http://docs.aws.amazon.com/AWSEC2/latest/UserGuide/volume_limits.html
+		actx, span := batchit.StartSpan(ctx, "ebsmount.attach-volume", attribute.String("batchit.volume_id", *rsp.VolumeId))
 		var attachDevice string
 		for pi, prefix := range []string{"/dev/sd", "/dev/sd", "/dev/xvd"} {
 			if attached {
@@ -351,7 +489,7 @@ func CreateAttach(cli *Args) ([]string, error) {
 
 			var koff, off int // these help so we don't retry the same dev multiple times
 			for k := int64(0); k < 7 && int(k)+koff < len(letters); k++ {
-				off, attachDevice = findNextDevNode(prefix, pi, letters[int(k)+koff:len(letters)])
+				off, attachDevice = devs.Next(prefix, pi, letters[int(k)+koff:len(letters)])
 				if off == -1 {
 					break
 				}
@@ -362,7 +500,7 @@ func CreateAttach(cli *Args) ([]string, error) {
 					koff += rand.Intn(5)
 				}
 
-				if _, err := svc.AttachVolume(&ec2.AttachVolumeInput{
+				if _, err := svc.AttachVolume(actx, &ec2.AttachVolumeInput{
 					InstanceId: aws.String(iid.InstanceId),
 					VolumeId:   rsp.VolumeId,
 					Device:     aws.String(attachDevice),
@@ -374,65 +512,63 @@ func CreateAttach(cli *Args) ([]string, error) {
 						break
 					}
 					if strings.Contains(err.Error(), "is already in use") {
-						time.Sleep((time.Duration(3 * (k + rand.Int63n(2*k+1)))) * time.Second)
+						sleep(batchit.Retry.Delay(int(k) + 1))
 						continue
 					}
 
-					return nil, errors.Wrap(err, "error attaching device")
+					return nil, nil, batchit.EndSpan(span, errors.Wrap(err, "error attaching device"))
 				}
 
 				volumes = append(volumes, *rsp.VolumeId)
 
-				if err := WaitForVolumeStatus(svc, rsp.VolumeId, "in-use"); err != nil {
-					return nil, err
+				if err := WaitForVolumeStatus(actx, svc, rsp.VolumeId, ec2types.VolumeStateInUse); err != nil {
+					return nil, nil, batchit.EndSpan(span, err)
 				}
 
-				if !waitForDevice(attachDevice) {
-					return nil, err
+				if !devs.Wait(attachDevice) {
+					return nil, nil, batchit.EndSpan(span, fmt.Errorf("ebsmount: device %s did not appear after attaching %s", attachDevice, *rsp.VolumeId))
 				}
 				devices = append(devices, attachDevice)
 				attached = true
+				batchit.Emit(batchit.Event{Type: batchit.EventVolumeAttached, VolumeId: *rsp.VolumeId, Device: attachDevice})
 				break
 			}
 		}
 		if !attached {
-			return nil, fmt.Errorf("ebsmount: unable to attach device")
+			return nil, nil, batchit.EndSpan(span, fmt.Errorf("ebsmount: unable to attach device"))
 		}
+		span.SetAttributes(attribute.String("batchit.device", attachDevice))
+		batchit.EndSpan(span, nil)
 
 		if !cli.Keep {
-			if err := DeleteOnTermination(svc, iid.InstanceId, *rsp.VolumeId, attachDevice); err != nil {
-				return nil, errors.Wrap(err, "error setting delete on termination")
+			if err := DeleteOnTermination(ctx, svc, iid.InstanceId, *rsp.VolumeId, attachDevice); err != nil {
+				return nil, nil, errors.Wrap(err, "error setting delete on termination")
 			}
 		}
 
 	}
-
-	fmt.Println(strings.Join(volumes, " "))
-	if err = makeDir(cli.MountPoint); err != nil {
-		return nil, err
-	}
-
-	return devices, nil
+	done = true
+	return devices, volumes, nil
 }
 
-func DeleteOnTermination(svc *ec2.EC2, instanceId string, volumeId string, attachDevice string) error {
+func DeleteOnTermination(ctx context.Context, svc EC2API, instanceId string, volumeId string, attachDevice string) error {
 	// set delete on termination
 	var ad *string
 	ad = &attachDevice
 	log.Println("ebsmount: setting to delete on termination")
 	moi := &ec2.ModifyInstanceAttributeInput{
 		InstanceId: aws.String(instanceId),
-		BlockDeviceMappings: []*ec2.InstanceBlockDeviceMappingSpecification{
-			&ec2.InstanceBlockDeviceMappingSpecification{
+		BlockDeviceMappings: []ec2types.InstanceBlockDeviceMappingSpecification{
+			{
 				// TODO: see if attachDevice is required
 				DeviceName: ad,
-				Ebs: &ec2.EbsInstanceBlockDeviceSpecification{
+				Ebs: &ec2types.EbsInstanceBlockDeviceSpecification{
 					DeleteOnTermination: aws.Bool(true),
 					VolumeId:            aws.String(volumeId),
 				},
 			}},
 	}
-	_, err := svc.ModifyInstanceAttribute(moi)
+	_, err := svc.ModifyInstanceAttribute(ctx, moi)
 	return errors.Wrap(err, "error setting delete on termination")
 }
 
@@ -467,35 +603,70 @@ func makeDir(path string) error {
 	return nil
 }
 
-func LocalMain() {
+func LocalMain() error {
 	cli := &LocalArgs{MountPrefix: "/mount/local/"}
-	arg.MustParse(cli)
+	batchit.MustParse(cli)
 
-	if _, err := MountLocal(cli.Devices, cli.MountPrefix); err != nil {
-		panic(err)
+	_, err := MountLocal(cli.Devices, cli.MountPrefix)
+	return err
+}
+
+// DefaultArgs are used by the ebsmount command unless overridden.
+var DefaultArgs = Args{
+	Size:       200,
+	VolumeType: "gp2",
+	FSType:     "ext4",
+	N:          1,
+}
+
+// Validate returns an error if the volume type or number of volumes is not supported.
+func (cli *Args) Validate() error {
+	if cli.VolumeType != "st1" && cli.VolumeType != "gp2" && cli.VolumeType != "sc1" && cli.VolumeType != "io1" && cli.VolumeType != "standard" {
+		return fmt.Errorf("volume type must be one of st1/gp2/sc1/io1")
+	}
+	if cli.N > 16 || cli.N < 1 {
+		return fmt.Errorf("number of volumes should be between 1 and 16")
 	}
+	return nil
 }
 
-func Main() {
-	cli := &Args{
-		Size:       200,
-		VolumeType: "gp2",
-		FSType:     "ext4",
-		N:          1,
+func Main() error {
+	cli := DefaultArgs
+	p := batchit.MustParse(&cli)
+	if err := cli.Validate(); err != nil {
+		p.Fail(err.Error())
 	}
-	if p := arg.MustParse(cli); cli.VolumeType != "st1" && cli.VolumeType != "gp2" && cli.VolumeType != "sc1" && cli.VolumeType != "io1" && cli.VolumeType != "standard" {
-		p.Fail("volume type must be one of st1/gp2/sc1/io1")
-	} else if cli.N > 16 || cli.N < 1 {
-		p.Fail("number of volumes should be between 1 and 16")
+	devices, err := Mount(batchit.Context(), &cli)
+	if err != nil {
+		return err
 	}
+	for _, d := range devices {
+		batchit.Emit(batchit.Event{Type: batchit.EventVolumeMounted, Device: d, Path: cli.MountPoint})
+	}
+	fmt.Fprintf(os.Stderr, "mounted %d EBS drives to %s\n", len(devices), cli.MountPoint)
+	return nil
+}
 
-	devices, err := CreateAttach(cli)
+// Mount creates the volumes of cli, attaches them to this instance and mounts them, as a RAID-0
+// if there are several, at cli.MountPoint. It returns the devices that were mounted. If ctx is
+// from batchit.Context and batchit is interrupted before they are mounted, the volumes are
+// detached and deleted.
+func Mount(ctx context.Context, cli *Args) ([]string, error) {
+	if err := cli.Validate(); err != nil {
+		return nil, batchit.Exit(batchit.ExitUsage, err)
+	}
+	svc, devices, volumes, err := createAttach(ctx, cli)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	if devices, err := MountLocal(devices, cli.MountPoint); err != nil {
-		panic(err)
+	_, span := batchit.StartSpan(ctx, "ebsmount.mount", attribute.String("batchit.mount_point", cli.MountPoint))
+	devices, err = MountLocal(devices, cli.MountPoint)
+	if err = batchit.EndSpan(span, err); err != nil {
+		if batchit.Interrupted() {
+			release(ctx, svc, volumes)
+		}
+		return nil, err
 	} else if cli.VolumeType == "st1" || cli.VolumeType == "sc1" {
 		// https://aws.amazon.com/blogs/aws/amazon-ebs-update-new-cold-storage-and-throughput-options/
 		for _, d := range devices {
@@ -506,7 +677,7 @@ func Main() {
 			}
 		}
 	}
-	fmt.Fprintf(os.Stderr, "mounted %d EBS drives to %s\n", len(devices), cli.MountPoint)
+	return devices, nil
 }
 
 func findNextDevNode(prefix string, pi int, suffixChars string) (int, string) {
@@ -550,7 +721,8 @@ func findNextDevNode(prefix string, pi int, suffixChars string) (int, string) {
 			}
 		}
 	}
-	panic(fmt.Errorf("no available device found with prefix: %s", prefix))
+	// no free device with this prefix so the caller moves on to the next one.
+	return -1, ""
 }
 
 func waitForDevice(device string) bool {
@@ -565,28 +737,28 @@ func waitForDevice(device string) bool {
 	return false
 }
 
-func WaitForVolumeStatus(svc *ec2.EC2, volumeId *string, status string) error {
-	var xstatus string
-	time.Sleep(5 * time.Second)
+func WaitForVolumeStatus(ctx context.Context, svc EC2API, volumeId *string, status ec2types.VolumeState) error {
+	var xstatus ec2types.VolumeState
+	sleep(5 * time.Second)
 
 	for i := 0; i < 30; i++ {
-		drsp, err := svc.DescribeVolumes(
+		drsp, err := svc.DescribeVolumes(ctx,
 			&ec2.DescribeVolumesInput{
-				VolumeIds: []*string{volumeId},
+				VolumeIds: []string{*volumeId},
 			})
 		if err != nil {
 			return errors.Wrapf(err, "error waiting for volume: %s status: %s", *volumeId, status)
 		}
 		if len(drsp.Volumes) == 0 {
-			panic(fmt.Sprintf("volume: %s not found", *volumeId))
+			return batchit.Exit(batchit.ExitNotFound, fmt.Errorf("volume: %s not found", *volumeId))
 		}
-		xstatus = *drsp.Volumes[0].State
+		xstatus = drsp.Volumes[0].State
 		if xstatus == status {
 			return nil
 		}
-		time.Sleep(4 * time.Second)
+		sleep(4 * time.Second)
 		if i > 10 {
-			time.Sleep(time.Duration(i) * time.Second)
+			sleep(time.Duration(i) * time.Second)
 		}
 	}
 	return fmt.Errorf("never found volume: %s with status: %s. last was: %s", *volumeId, status, xstatus)
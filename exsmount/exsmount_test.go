@@ -0,0 +1,144 @@
+package exsmount
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/base2genomics/batchit/fake"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// failWait is an EC2 whose volumes never become available.
+type failWait struct {
+	*fake.EC2
+}
+
+func (f failWait) DescribeVolumes(ctx context.Context, in *ec2.DescribeVolumesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeVolumesOutput, error) {
+	return nil, fake.APIError("InternalError", "An internal error has occurred.")
+}
+
+// failAttach is an EC2 whose next attaches fail with errs.
+type failAttach struct {
+	*fake.EC2
+	errs []error
+}
+
+func (f *failAttach) AttachVolume(ctx context.Context, in *ec2.AttachVolumeInput, optFns ...func(*ec2.Options)) (*ec2.AttachVolumeOutput, error) {
+	if len(f.errs) > 0 {
+		err := f.errs[0]
+		if f.errs = f.errs[1:]; err != nil {
+			return nil, err
+		}
+	}
+	return f.EC2.AttachVolume(ctx, in, optFns...)
+}
+
+func TestAttach(t *testing.T) {
+	var slept []time.Duration
+	sleep = func(d time.Duration) { slept = append(slept, d) }
+	defer func() { sleep = time.Sleep }()
+
+	iid := &IID{AvailabilityZone: "us-east-1a", InstanceId: "i-00000001", Region: "us-east-1"}
+	// other is attached to the instance by another job but its device has not appeared yet.
+	other := &ec2types.Volume{VolumeId: aws.String("vol-other"), State: ec2types.VolumeStateInUse,
+		Attachments: []ec2types.VolumeAttachment{{Device: aws.String("/dev/sdb"), InstanceId: aws.String(iid.InstanceId)}}}
+	all := map[string]bool{}
+	for _, prefix := range []string{"/dev/sd", "/dev/xvd"} {
+		for _, l := range letters {
+			all[prefix+string(l)] = true
+		}
+	}
+
+	for _, c := range []struct {
+		name  string
+		n     int
+		used  map[string]bool
+		other bool
+		fail  error
+		wait  bool
+		// attach are the errors of the first attaches. nil attaches the volume.
+		attach  []error
+		devices []string
+		// retries is the number of waits after a device was in use.
+		retries int
+		// volumes is the number of volumes left in EC2 including other.
+		volumes int
+	}{
+		{name: "free", n: 1, devices: []string{"/dev/sdb"}, volumes: 1},
+		{name: "used device", n: 1, used: map[string]bool{"/dev/sdb": true}, devices: []string{"/dev/sdc"}, volumes: 1},
+		{name: "raid", n: 2, devices: []string{"/dev/sdb", "/dev/sdc"}, volumes: 2},
+		{name: "attached by another job", n: 1, other: true, devices: []string{"/dev/sdc"}, retries: 1, volumes: 2},
+		{name: "no free device", n: 1, used: all, volumes: 0},
+		{name: "create fails", n: 1, fail: fake.APIError("RequestLimitExceeded", "Request limit exceeded."), volumes: 0},
+		{name: "wait fails", n: 1, wait: true, volumes: 0},
+		{name: "attach throttled", n: 1, attach: []error{fake.APIError("RequestLimitExceeded", "Request limit exceeded.")}, volumes: 0},
+		{name: "attach fails", n: 1, attach: []error{fake.APIError("IncorrectState", "vol-00000001 is not 'available'.")}, volumes: 0},
+		{name: "raid attach fails", n: 2, attach: []error{nil, fake.APIError("IncorrectState", "vol-00000002 is not 'available'.")}, volumes: 1},
+		{name: "device in use", n: 1, attach: []error{fake.APIError("InvalidParameterValue", "Attachment point /dev/sdb is already in use")},
+			devices: []string{"/dev/sdc"}, retries: 1, volumes: 1},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			slept = nil
+			f := fake.NewEC2(iid.Region)
+			if c.other {
+				f.Volumes[*other.VolumeId] = other
+			}
+			if c.fail != nil {
+				f.FailNext(1, c.fail)
+			}
+			var svc EC2API = f
+			if c.wait {
+				svc = failWait{f}
+			}
+			if c.attach != nil {
+				svc = &failAttach{f, c.attach}
+			}
+			used := map[string]bool{}
+			for d := range c.used {
+				used[d] = true
+			}
+			cli := &Args{Size: 100, VolumeType: "gp2", N: c.n}
+			devices, volumes, err := Attach(context.Background(), svc, &fake.Devices{Used: used}, iid, cli)
+
+			if c.devices == nil {
+				if err == nil {
+					t.Fatalf("expected an error. got devices %v", devices)
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(devices, c.devices) {
+					t.Errorf("expected devices %v. got %v", c.devices, devices)
+				}
+				if len(volumes) != c.n {
+					t.Errorf("expected %d volumes. got %v", c.n, volumes)
+				}
+				for _, v := range volumes {
+					if !f.DeleteOnTermination[v] {
+						t.Errorf("expected %s to be deleted on termination", v)
+					}
+				}
+			}
+			if len(f.Volumes) != c.volumes {
+				t.Errorf("expected %d volumes to be left. got %d", c.volumes, len(f.Volumes))
+			}
+			retries := 0
+			for _, d := range slept {
+				// the waits for the state of a volume are at least 3 seconds and those before
+				// retrying a device in use are shorter.
+				if d < 3*time.Second {
+					retries++
+				}
+			}
+			if retries != c.retries {
+				t.Errorf("expected %d retries. got %d (%v)", c.retries, retries, slept)
+			}
+		})
+	}
+}
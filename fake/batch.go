@@ -0,0 +1,301 @@
+package fake
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/base2genomics/batchit"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/batch"
+	batchtypes "github.com/aws/aws-sdk-go-v2/service/batch/types"
+)
+
+// Batch is an in-memory Batch with job definitions and jobs. Submitted jobs stay SUBMITTED until
+// a test changes them with SetStatus. It implements submit.BatchAPI and logof.BatchAPI.
+// Queues and ComputeEnvironments are only those that a test adds.
+type Batch struct {
+	Errors
+	// Region is used in the ARNs of job definitions and jobs.
+	Region string
+
+	mu sync.Mutex
+	// Definitions are the registered job definitions keyed by name:revision.
+	Definitions map[string]*batch.RegisterJobDefinitionInput
+	// Deregistered are the job definitions that have been deregistered keyed by name:revision.
+	Deregistered map[string]bool
+	// Jobs are the submitted jobs keyed by id. The children of an array job are keyed by id:index.
+	Jobs map[string]*batchtypes.JobDetail
+	// Queues are the job queues keyed by name.
+	Queues map[string]*batchtypes.JobQueueDetail
+	// ComputeEnvironments are the compute environments keyed by name.
+	ComputeEnvironments map[string]*batchtypes.ComputeEnvironmentDetail
+
+	revisions map[string]int32
+	n         int
+}
+
+// NewBatch returns a Batch without jobs in region.
+func NewBatch(region string) *Batch {
+	return &Batch{
+		Region:              region,
+		Definitions:         make(map[string]*batch.RegisterJobDefinitionInput),
+		Deregistered:        make(map[string]bool),
+		Jobs:                make(map[string]*batchtypes.JobDetail),
+		Queues:              make(map[string]*batchtypes.JobQueueDetail),
+		ComputeEnvironments: make(map[string]*batchtypes.ComputeEnvironmentDetail),
+		revisions:           make(map[string]int32),
+	}
+}
+
+func (f *Batch) arn(kind, name string) *string {
+	return aws.String(batchit.ARN("batch", f.Region, Account, kind+"/"+name))
+}
+
+func (f *Batch) RegisterJobDefinition(ctx context.Context, in *batch.RegisterJobDefinitionInput, optFns ...func(*batch.Options)) (*batch.RegisterJobDefinitionOutput, error) {
+	if err := f.fail(); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	name := aws.ToString(in.JobDefinitionName)
+	if name == "" {
+		return nil, APIError("ClientException", "jobDefinitionName is required")
+	}
+	f.revisions[name]++
+	rev := f.revisions[name]
+	key := fmt.Sprintf("%s:%d", name, rev)
+	f.Definitions[key] = in
+	return &batch.RegisterJobDefinitionOutput{JobDefinitionArn: f.arn("job-definition", key), JobDefinitionName: in.JobDefinitionName, Revision: aws.Int32(rev)}, nil
+}
+
+func (f *Batch) DeregisterJobDefinition(ctx context.Context, in *batch.DeregisterJobDefinitionInput, optFns ...func(*batch.Options)) (*batch.DeregisterJobDefinitionOutput, error) {
+	if err := f.fail(); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := aws.ToString(in.JobDefinition)
+	if i := strings.Index(key, "job-definition/"); i >= 0 {
+		key = key[i+len("job-definition/"):]
+	}
+	if _, ok := f.Definitions[key]; !ok {
+		return nil, APIError("ClientException", "job definition %s does not exist", key)
+	}
+	f.Deregistered[key] = true
+	return &batch.DeregisterJobDefinitionOutput{}, nil
+}
+
+// definition returns the key of the job definition with name, name:revision or an ARN. Only a
+// name uses the latest active revision.
+func (f *Batch) definition(def string) (string, bool) {
+	if i := strings.Index(def, "job-definition/"); i >= 0 {
+		def = def[i+len("job-definition/"):]
+	}
+	if _, ok := f.Definitions[def]; ok {
+		return def, true
+	}
+	for rev := f.revisions[def]; rev > 0; rev-- {
+		key := fmt.Sprintf("%s:%d", def, rev)
+		if !f.Deregistered[key] {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// SubmitJob adds a SUBMITTED job and, for an array job, its children.
+func (f *Batch) SubmitJob(ctx context.Context, in *batch.SubmitJobInput, optFns ...func(*batch.Options)) (*batch.SubmitJobOutput, error) {
+	if err := f.fail(); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	def, ok := f.definition(aws.ToString(in.JobDefinition))
+	if !ok {
+		return nil, APIError("ClientException", "Job definition %s not found", aws.ToString(in.JobDefinition))
+	}
+	f.n++
+	id := fmt.Sprintf("%08x-0000-4000-8000-%012x", f.n, f.n)
+	now := time.Now().UnixNano() / 1e6
+	j := &batchtypes.JobDetail{
+		JobId:         aws.String(id),
+		JobArn:        f.arn("job", id),
+		JobName:       in.JobName,
+		JobQueue:      in.JobQueue,
+		JobDefinition: f.arn("job-definition", def),
+		Status:        batchtypes.JobStatusSubmitted,
+		CreatedAt:     aws.Int64(now),
+		DependsOn:     in.DependsOn,
+		Parameters:    in.Parameters,
+		RetryStrategy: in.RetryStrategy,
+		Tags:          in.Tags,
+		Timeout:       in.Timeout,
+	}
+	if cp := f.Definitions[def].ContainerProperties; cp != nil {
+		j.Container = &batchtypes.ContainerDetail{Command: cp.Command, Environment: cp.Environment, Image: cp.Image,
+			JobRoleArn: cp.JobRoleArn, ResourceRequirements: cp.ResourceRequirements, Volumes: cp.Volumes, MountPoints: cp.MountPoints}
+		if o := in.ContainerOverrides; o != nil {
+			if o.Command != nil {
+				j.Container.Command = o.Command
+			}
+			j.Container.Environment = append(j.Container.Environment, o.Environment...)
+		}
+	}
+	f.Jobs[id] = j
+	if in.ArrayProperties != nil && aws.ToInt32(in.ArrayProperties.Size) > 0 {
+		size := aws.ToInt32(in.ArrayProperties.Size)
+		j.ArrayProperties = &batchtypes.ArrayPropertiesDetail{Size: aws.Int32(size)}
+		for i := int32(0); i < size; i++ {
+			kid := *j
+			kid.JobId = aws.String(fmt.Sprintf("%s:%d", id, i))
+			kid.JobArn = f.arn("job", *kid.JobId)
+			kid.ArrayProperties = &batchtypes.ArrayPropertiesDetail{Index: aws.Int32(i)}
+			f.Jobs[*kid.JobId] = &kid
+		}
+	}
+	return &batch.SubmitJobOutput{JobId: j.JobId, JobName: j.JobName, JobArn: j.JobArn}, nil
+}
+
+// SetStatus sets the status of the job with id and its children. Jobs that are started or stopped
+// get the time.
+func (f *Batch) SetStatus(id string, status batchtypes.JobStatus) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := aws.Int64(time.Now().UnixNano() / 1e6)
+	for key, j := range f.Jobs {
+		if key != id && !strings.HasPrefix(key, id+":") {
+			continue
+		}
+		j.Status = status
+		switch status {
+		case batchtypes.JobStatusRunning:
+			j.StartedAt = now
+		case batchtypes.JobStatusSucceeded, batchtypes.JobStatusFailed:
+			if j.StartedAt == nil {
+				j.StartedAt = now
+			}
+			j.StoppedAt = now
+		}
+	}
+}
+
+// DescribeJobs returns the jobs that exist. Like Batch, unknown ids are left out.
+func (f *Batch) DescribeJobs(ctx context.Context, in *batch.DescribeJobsInput, optFns ...func(*batch.Options)) (*batch.DescribeJobsOutput, error) {
+	if err := f.fail(); err != nil {
+		return nil, err
+	}
+	if len(in.Jobs) > 100 {
+		return nil, APIError("ClientException", "a maximum of 100 jobs may be described at once")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := &batch.DescribeJobsOutput{}
+	for _, id := range in.Jobs {
+		if j, ok := f.Jobs[id]; ok {
+			out.Jobs = append(out.Jobs, *j)
+		}
+	}
+	return out, nil
+}
+
+// ListJobs returns the jobs in a single page. The queue, status, array job id and a JOB_NAME
+// filter, which may end with *, are supported. Like Batch, only RUNNING jobs are listed if
+// there is no status or filter.
+func (f *Batch) ListJobs(ctx context.Context, in *batch.ListJobsInput, optFns ...func(*batch.Options)) (*batch.ListJobsOutput, error) {
+	if err := f.fail(); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	status := in.JobStatus
+	if status == "" && len(in.Filters) == 0 {
+		status = batchtypes.JobStatusRunning
+	}
+	out := &batch.ListJobsOutput{}
+	for key, j := range f.Jobs {
+		if in.ArrayJobId != nil {
+			if !strings.HasPrefix(key, *in.ArrayJobId+":") {
+				continue
+			}
+		} else if strings.Contains(key, ":") {
+			continue
+		}
+		if in.JobQueue != nil && *in.JobQueue != aws.ToString(j.JobQueue) {
+			continue
+		}
+		if status != "" && j.Status != status {
+			continue
+		}
+		if !nameMatches(j, in.Filters) {
+			continue
+		}
+		out.JobSummaryList = append(out.JobSummaryList, batchtypes.JobSummary{
+			JobId: j.JobId, JobName: j.JobName, JobArn: j.JobArn, JobDefinition: j.JobDefinition, CreatedAt: j.CreatedAt,
+			StartedAt: j.StartedAt, StoppedAt: j.StoppedAt, Status: j.Status, StatusReason: j.StatusReason,
+		})
+	}
+	return out, nil
+}
+
+// DescribeJobQueues returns the queues with the names or ARNs given or all of them.
+func (f *Batch) DescribeJobQueues(ctx context.Context, in *batch.DescribeJobQueuesInput, optFns ...func(*batch.Options)) (*batch.DescribeJobQueuesOutput, error) {
+	if err := f.fail(); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := &batch.DescribeJobQueuesOutput{}
+	for name, q := range f.Queues {
+		if len(in.JobQueues) == 0 || named(in.JobQueues, name, aws.ToString(q.JobQueueArn)) {
+			out.JobQueues = append(out.JobQueues, *q)
+		}
+	}
+	return out, nil
+}
+
+// DescribeComputeEnvironments returns the compute environments with the names or ARNs given or
+// all of them.
+func (f *Batch) DescribeComputeEnvironments(ctx context.Context, in *batch.DescribeComputeEnvironmentsInput, optFns ...func(*batch.Options)) (*batch.DescribeComputeEnvironmentsOutput, error) {
+	if err := f.fail(); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := &batch.DescribeComputeEnvironmentsOutput{}
+	for name, ce := range f.ComputeEnvironments {
+		if len(in.ComputeEnvironments) == 0 || named(in.ComputeEnvironments, name, aws.ToString(ce.ComputeEnvironmentArn)) {
+			out.ComputeEnvironments = append(out.ComputeEnvironments, *ce)
+		}
+	}
+	return out, nil
+}
+
+// named reports whether the name or ARN of a resource is in names.
+func named(names []string, name, arn string) bool {
+	for _, n := range names {
+		if n == name || (arn != "" && n == arn) {
+			return true
+		}
+	}
+	return false
+}
+
+func nameMatches(j *batchtypes.JobDetail, filters []batchtypes.KeyValuesPair) bool {
+	for _, flt := range filters {
+		if aws.ToString(flt.Name) != "JOB_NAME" {
+			continue
+		}
+		for _, v := range flt.Values {
+			if m, _ := path.Match(v, aws.ToString(j.JobName)); m {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
@@ -0,0 +1,309 @@
+package fake
+
+import (
+	"context"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// EC2 is an in-memory EC2 with volumes and snapshots. Volumes are available as soon as they
+// are created, attached as soon as they are attached and snapshots complete immediately.
+// It implements the EC2API of exsmount and ddv.
+type EC2 struct {
+	Errors
+	// Region is returned by DescribeRegions with Regions.
+	Region  string
+	Regions []string
+
+	mu        sync.Mutex
+	Volumes   map[string]*ec2types.Volume
+	Snapshots map[string]*ec2types.Snapshot
+	// DeleteOnTermination has the volumes that were set to be deleted with their instance.
+	DeleteOnTermination map[string]bool
+	ids                 ids
+}
+
+// NewEC2 returns an EC2 without volumes in region.
+func NewEC2(region string) *EC2 {
+	return &EC2{
+		Region:              region,
+		Volumes:             make(map[string]*ec2types.Volume),
+		Snapshots:           make(map[string]*ec2types.Snapshot),
+		DeleteOnTermination: make(map[string]bool),
+	}
+}
+
+func (f *EC2) CreateVolume(ctx context.Context, in *ec2.CreateVolumeInput, optFns ...func(*ec2.Options)) (*ec2.CreateVolumeOutput, error) {
+	if err := f.fail(); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	v := &ec2types.Volume{
+		VolumeId:         aws.String(f.ids.next("vol-")),
+		AvailabilityZone: in.AvailabilityZone,
+		CreateTime:       aws.Time(time.Now()),
+		Iops:             in.Iops,
+		Size:             in.Size,
+		State:            ec2types.VolumeStateAvailable,
+		VolumeType:       in.VolumeType,
+	}
+	for _, ts := range in.TagSpecifications {
+		v.Tags = append(v.Tags, ts.Tags...)
+	}
+	f.Volumes[*v.VolumeId] = v
+	return &ec2.CreateVolumeOutput{VolumeId: v.VolumeId, AvailabilityZone: v.AvailabilityZone, CreateTime: v.CreateTime,
+		Iops: v.Iops, Size: v.Size, State: v.State, Tags: v.Tags, VolumeType: v.VolumeType}, nil
+}
+
+func (f *EC2) volume(id *string) (*ec2types.Volume, error) {
+	v, ok := f.Volumes[aws.ToString(id)]
+	if !ok {
+		return nil, APIError("InvalidVolume.NotFound", "The volume '%s' does not exist.", aws.ToString(id))
+	}
+	return v, nil
+}
+
+// AttachVolume attaches the volume. Like EC2, it fails if another volume is attached to the
+// instance at the device.
+func (f *EC2) AttachVolume(ctx context.Context, in *ec2.AttachVolumeInput, optFns ...func(*ec2.Options)) (*ec2.AttachVolumeOutput, error) {
+	if err := f.fail(); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	v, err := f.volume(in.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	if v.State != ec2types.VolumeStateAvailable {
+		return nil, APIError("IncorrectState", "vol-%s is not 'available'.", aws.ToString(in.VolumeId))
+	}
+	for _, o := range f.Volumes {
+		for _, a := range o.Attachments {
+			if aws.ToString(a.InstanceId) == aws.ToString(in.InstanceId) && aws.ToString(a.Device) == aws.ToString(in.Device) {
+				return nil, APIError("InvalidParameterValue", "Attachment point %s is already in use", aws.ToString(in.Device))
+			}
+		}
+	}
+	a := ec2types.VolumeAttachment{
+		AttachTime: aws.Time(time.Now()),
+		Device:     in.Device,
+		InstanceId: in.InstanceId,
+		State:      ec2types.VolumeAttachmentStateAttached,
+		VolumeId:   in.VolumeId,
+	}
+	v.Attachments = []ec2types.VolumeAttachment{a}
+	v.State = ec2types.VolumeStateInUse
+	return &ec2.AttachVolumeOutput{AttachTime: a.AttachTime, Device: a.Device, InstanceId: a.InstanceId, State: a.State, VolumeId: a.VolumeId}, nil
+}
+
+func (f *EC2) DetachVolume(ctx context.Context, in *ec2.DetachVolumeInput, optFns ...func(*ec2.Options)) (*ec2.DetachVolumeOutput, error) {
+	if err := f.fail(); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	v, err := f.volume(in.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	if v.State == ec2types.VolumeStateAvailable {
+		return nil, APIError("IncorrectState", "Volume '%s' is in the 'available' state.", aws.ToString(in.VolumeId))
+	}
+	a := v.Attachments[0]
+	v.Attachments, v.State = nil, ec2types.VolumeStateAvailable
+	return &ec2.DetachVolumeOutput{Device: a.Device, InstanceId: a.InstanceId, State: ec2types.VolumeAttachmentStateDetached, VolumeId: a.VolumeId}, nil
+}
+
+func (f *EC2) DeleteVolume(ctx context.Context, in *ec2.DeleteVolumeInput, optFns ...func(*ec2.Options)) (*ec2.DeleteVolumeOutput, error) {
+	if err := f.fail(); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	v, err := f.volume(in.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	if v.State == ec2types.VolumeStateInUse {
+		return nil, APIError("VolumeInUse", "Volume %s is currently attached to %s", aws.ToString(in.VolumeId), aws.ToString(v.Attachments[0].InstanceId))
+	}
+	delete(f.Volumes, *v.VolumeId)
+	return &ec2.DeleteVolumeOutput{}, nil
+}
+
+// match reports whether v passes the filters. The filters that batchit uses are supported:
+// status, attachment.instance-id, attachment.device and tag:<key> with * wildcards.
+func match(v *ec2types.Volume, filters []ec2types.Filter) bool {
+	for _, flt := range filters {
+		var have []string
+		name := aws.ToString(flt.Name)
+		switch {
+		case name == "status":
+			have = []string{string(v.State)}
+		case name == "attachment.instance-id":
+			for _, a := range v.Attachments {
+				have = append(have, aws.ToString(a.InstanceId))
+			}
+		case name == "attachment.device":
+			for _, a := range v.Attachments {
+				have = append(have, aws.ToString(a.Device))
+			}
+		case strings.HasPrefix(name, "tag:"):
+			for _, t := range v.Tags {
+				if aws.ToString(t.Key) == name[len("tag:"):] {
+					have = append(have, aws.ToString(t.Value))
+				}
+			}
+		}
+		ok := false
+		for _, want := range flt.Values {
+			for _, h := range have {
+				if m, _ := path.Match(want, h); m {
+					ok = true
+				}
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// DescribeVolumes returns the volumes with the ids or that match the filters in a single page.
+// Like EC2, asking for an id that does not exist is an error.
+func (f *EC2) DescribeVolumes(ctx context.Context, in *ec2.DescribeVolumesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeVolumesOutput, error) {
+	if err := f.fail(); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := &ec2.DescribeVolumesOutput{}
+	if len(in.VolumeIds) > 0 {
+		for _, id := range in.VolumeIds {
+			v, err := f.volume(aws.String(id))
+			if err != nil {
+				return nil, err
+			}
+			if match(v, in.Filters) {
+				out.Volumes = append(out.Volumes, *v)
+			}
+		}
+		return out, nil
+	}
+	for _, v := range f.Volumes {
+		if match(v, in.Filters) {
+			out.Volumes = append(out.Volumes, *v)
+		}
+	}
+	return out, nil
+}
+
+// ModifyInstanceAttribute records the volumes that are set to be deleted on termination.
+func (f *EC2) ModifyInstanceAttribute(ctx context.Context, in *ec2.ModifyInstanceAttributeInput, optFns ...func(*ec2.Options)) (*ec2.ModifyInstanceAttributeOutput, error) {
+	if err := f.fail(); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, m := range in.BlockDeviceMappings {
+		if m.Ebs != nil {
+			f.DeleteOnTermination[aws.ToString(m.Ebs.VolumeId)] = aws.ToBool(m.Ebs.DeleteOnTermination)
+		}
+	}
+	return &ec2.ModifyInstanceAttributeOutput{}, nil
+}
+
+func (f *EC2) CreateSnapshot(ctx context.Context, in *ec2.CreateSnapshotInput, optFns ...func(*ec2.Options)) (*ec2.CreateSnapshotOutput, error) {
+	if err := f.fail(); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	v, err := f.volume(in.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	s := &ec2types.Snapshot{
+		Description: in.Description,
+		SnapshotId:  aws.String(f.ids.next("snap-")),
+		StartTime:   aws.Time(time.Now()),
+		State:       ec2types.SnapshotStateCompleted,
+		VolumeId:    in.VolumeId,
+		VolumeSize:  v.Size,
+	}
+	for _, ts := range in.TagSpecifications {
+		s.Tags = append(s.Tags, ts.Tags...)
+	}
+	f.Snapshots[*s.SnapshotId] = s
+	return &ec2.CreateSnapshotOutput{Description: s.Description, SnapshotId: s.SnapshotId, StartTime: s.StartTime,
+		State: s.State, Tags: s.Tags, VolumeId: s.VolumeId, VolumeSize: s.VolumeSize}, nil
+}
+
+func (f *EC2) DescribeSnapshots(ctx context.Context, in *ec2.DescribeSnapshotsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeSnapshotsOutput, error) {
+	if err := f.fail(); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := &ec2.DescribeSnapshotsOutput{}
+	for _, id := range in.SnapshotIds {
+		s, ok := f.Snapshots[id]
+		if !ok {
+			return nil, APIError("InvalidSnapshot.NotFound", "The snapshot '%s' does not exist.", id)
+		}
+		out.Snapshots = append(out.Snapshots, *s)
+	}
+	return out, nil
+}
+
+// DescribeRegions returns Region and Regions.
+func (f *EC2) DescribeRegions(ctx context.Context, in *ec2.DescribeRegionsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeRegionsOutput, error) {
+	if err := f.fail(); err != nil {
+		return nil, err
+	}
+	out := &ec2.DescribeRegionsOutput{}
+	for _, r := range append([]string{f.Region}, f.Regions...) {
+		out.Regions = append(out.Regions, ec2types.Region{RegionName: aws.String(r)})
+	}
+	return out, nil
+}
+
+// Devices is a host without any devices. Attached volumes appear at their device at once.
+// It implements exsmount.Devices.
+type Devices struct {
+	mu sync.Mutex
+	// Used are the devices that exist, e.g. from other jobs on the same host.
+	Used map[string]bool
+}
+
+// Next returns the first device with prefix and a suffix in suffixChars that is not used.
+func (d *Devices) Next(prefix string, pi int, suffixChars string) (int, string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i, s := range suffixChars {
+		if dev := prefix + string(s); !d.Used[dev] {
+			return i, dev
+		}
+	}
+	return -1, ""
+}
+
+// Wait marks device as used.
+func (d *Devices) Wait(device string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.Used == nil {
+		d.Used = make(map[string]bool)
+	}
+	d.Used[device] = true
+	return true
+}
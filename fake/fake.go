@@ -0,0 +1,64 @@
+// Package fake has in-memory versions of the AWS clients that batchit uses so that code
+// using batchit can be tested without an account. Each fake keeps its state in exported
+// fields that a test can set up and inspect, and returns errors with the same codes as AWS,
+// e.g. NoSuchKey, so that batchit.ExitCode and error handling behave as they would with AWS.
+//
+// The fakes are safe for concurrent use. They do not model eventual consistency or
+// throttling; use FailNext to make the next requests to a fake fail, e.g. with
+// APIError("RequestLimitExceeded", "Request limit exceeded.").
+package fake
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/aws/smithy-go"
+)
+
+// APIError returns an error like those returned by AWS for code.
+func APIError(code, format string, args ...interface{}) error {
+	return &smithy.GenericAPIError{Code: code, Message: fmt.Sprintf(format, args...), Fault: smithy.FaultClient}
+}
+
+// ids makes ids like AWS does for a kind of resource, e.g. vol-00000001.
+type ids struct {
+	mu sync.Mutex
+	n  int
+}
+
+func (i *ids) next(prefix string) string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.n++
+	return fmt.Sprintf("%s%08x", prefix, i.n)
+}
+
+// Errors makes the next calls of a fake fail. It is embedded in each fake.
+type Errors struct {
+	mu sync.Mutex
+	// Err, if not nil, is returned by the next N calls, or every call if N is 0.
+	Err error
+	N   int
+}
+
+// FailNext makes the next n calls fail with err.
+func (e *Errors) FailNext(n int, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.Err, e.N = err, n
+}
+
+func (e *Errors) fail() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.Err == nil {
+		return nil
+	}
+	err := e.Err
+	if e.N > 0 {
+		if e.N--; e.N == 0 {
+			e.Err = nil
+		}
+	}
+	return err
+}
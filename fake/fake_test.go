@@ -0,0 +1,27 @@
+package fake_test
+
+import (
+	"github.com/base2genomics/batchit/arraymap"
+	"github.com/base2genomics/batchit/ddv"
+	"github.com/base2genomics/batchit/exsmount"
+	"github.com/base2genomics/batchit/fake"
+	"github.com/base2genomics/batchit/logof"
+	"github.com/base2genomics/batchit/submit"
+
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+)
+
+// the fakes must keep implementing the interfaces that they stand in for.
+var (
+	_ submit.BatchAPI         = (*fake.Batch)(nil)
+	_ submit.IAMAPI           = (*fake.IAM)(nil)
+	_ submit.STSAPI           = (*fake.STS)(nil)
+	_ submit.S3API            = (*fake.S3)(nil)
+	_ logof.BatchAPI          = (*fake.Batch)(nil)
+	_ logof.LogsAPI           = (*fake.Logs)(nil)
+	_ exsmount.EC2API         = (*fake.EC2)(nil)
+	_ exsmount.Devices        = (*fake.Devices)(nil)
+	_ ddv.EC2API              = (*fake.EC2)(nil)
+	_ arraymap.GetObjectAPI   = (*fake.S3)(nil)
+	_ manager.UploadAPIClient = (*fake.S3)(nil)
+)
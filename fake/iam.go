@@ -0,0 +1,70 @@
+package fake
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	iamtypes "github.com/aws/aws-sdk-go-v2/service/iam/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// Account is the account id used by the fakes.
+const Account = "123456789012"
+
+// IAM is an in-memory IAM with roles. It implements submit.IAMAPI.
+type IAM struct {
+	Errors
+
+	mu sync.Mutex
+	// Roles are keyed by name.
+	Roles map[string]*iamtypes.Role
+}
+
+// NewIAM returns an IAM with the roles names.
+func NewIAM(names ...string) *IAM {
+	f := &IAM{Roles: make(map[string]*iamtypes.Role)}
+	for _, name := range names {
+		f.Roles[name] = &iamtypes.Role{
+			RoleName: aws.String(name),
+			RoleId:   aws.String("AROA" + name),
+			Arn:      aws.String(fmt.Sprintf("arn:aws:iam::%s:role/%s", Account, name)),
+			Path:     aws.String("/"),
+		}
+	}
+	return f
+}
+
+// GetRole returns the role. Like IAM, a missing role is NoSuchEntity.
+func (f *IAM) GetRole(ctx context.Context, in *iam.GetRoleInput, optFns ...func(*iam.Options)) (*iam.GetRoleOutput, error) {
+	if err := f.fail(); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	r, ok := f.Roles[aws.ToString(in.RoleName)]
+	if !ok {
+		return nil, &iamtypes.NoSuchEntityException{Message: aws.String(fmt.Sprintf("The role with name %s cannot be found.", aws.ToString(in.RoleName)))}
+	}
+	return &iam.GetRoleOutput{Role: r}, nil
+}
+
+// STS returns the identity of a user in Account. It implements submit.STSAPI.
+type STS struct {
+	Errors
+	// User is the name in the ARN of the caller.
+	User string
+}
+
+func (f *STS) GetCallerIdentity(ctx context.Context, in *sts.GetCallerIdentityInput, optFns ...func(*sts.Options)) (*sts.GetCallerIdentityOutput, error) {
+	if err := f.fail(); err != nil {
+		return nil, err
+	}
+	return &sts.GetCallerIdentityOutput{
+		Account: aws.String(Account),
+		Arn:     aws.String(fmt.Sprintf("arn:aws:iam::%s:user/%s", Account, f.User)),
+		UserId:  aws.String("AIDA" + f.User),
+	}, nil
+}
@@ -0,0 +1,121 @@
+package fake
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	logtypes "github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+)
+
+// Logs is an in-memory CloudWatch Logs with a single log group. It implements logof.LogsAPI.
+type Logs struct {
+	Errors
+
+	mu sync.Mutex
+	// Streams are the events of each log stream in the order of their timestamps.
+	Streams map[string][]logtypes.OutputLogEvent
+}
+
+// NewLogs returns Logs without streams.
+func NewLogs() *Logs {
+	return &Logs{Streams: make(map[string][]logtypes.OutputLogEvent)}
+}
+
+// Put adds the messages to stream with timestamps (ms) from start, one ms apart.
+func (f *Logs) Put(stream string, start int64, messages ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, m := range messages {
+		t := aws.Int64(start + int64(i))
+		f.Streams[stream] = append(f.Streams[stream], logtypes.OutputLogEvent{Message: aws.String(m), Timestamp: t, IngestionTime: t})
+	}
+}
+
+func (f *Logs) DescribeLogStreams(ctx context.Context, in *cloudwatchlogs.DescribeLogStreamsInput, optFns ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.DescribeLogStreamsOutput, error) {
+	if err := f.fail(); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := &cloudwatchlogs.DescribeLogStreamsOutput{}
+	for name, events := range f.Streams {
+		if !strings.HasPrefix(name, aws.ToString(in.LogStreamNamePrefix)) {
+			continue
+		}
+		s := logtypes.LogStream{LogStreamName: aws.String(name)}
+		if len(events) > 0 {
+			s.FirstEventTimestamp, s.LastEventTimestamp = events[0].Timestamp, events[len(events)-1].Timestamp
+			s.LastIngestionTime = events[len(events)-1].IngestionTime
+		}
+		out.LogStreams = append(out.LogStreams, s)
+	}
+	sort.Slice(out.LogStreams, func(i, j int) bool {
+		return *out.LogStreams[i].LogStreamName < *out.LogStreams[j].LogStreamName
+	})
+	return out, nil
+}
+
+func inRange(t, start, end *int64) bool {
+	return (start == nil || aws.ToInt64(t) >= *start) && (end == nil || aws.ToInt64(t) < *end)
+}
+
+// GetLogEvents returns the events of the stream in a single page. Like CloudWatch Logs, the
+// forward token of the last page is the token that was given.
+func (f *Logs) GetLogEvents(ctx context.Context, in *cloudwatchlogs.GetLogEventsInput, optFns ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.GetLogEventsOutput, error) {
+	if err := f.fail(); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	events, ok := f.Streams[aws.ToString(in.LogStreamName)]
+	if !ok {
+		return nil, APIError("ResourceNotFoundException", "The specified log stream does not exist.")
+	}
+	token := fmt.Sprintf("f/%s/%d", aws.ToString(in.LogStreamName), len(events))
+	out := &cloudwatchlogs.GetLogEventsOutput{NextForwardToken: aws.String(token), NextBackwardToken: aws.String("b/0")}
+	if aws.ToString(in.NextToken) == token {
+		return out, nil
+	}
+	for _, e := range events {
+		if inRange(e.Timestamp, in.StartTime, in.EndTime) {
+			out.Events = append(out.Events, e)
+		}
+	}
+	return out, nil
+}
+
+// FilterLogEvents returns the events of the streams in a single page. A filter pattern is
+// matched as a plain substring of the message.
+func (f *Logs) FilterLogEvents(ctx context.Context, in *cloudwatchlogs.FilterLogEventsInput, optFns ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.FilterLogEventsOutput, error) {
+	if err := f.fail(); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	names := in.LogStreamNames
+	if len(names) == 0 {
+		for name := range f.Streams {
+			if strings.HasPrefix(name, aws.ToString(in.LogStreamNamePrefix)) {
+				names = append(names, name)
+			}
+		}
+	}
+	out := &cloudwatchlogs.FilterLogEventsOutput{}
+	for _, name := range names {
+		for i, e := range f.Streams[name] {
+			if !inRange(e.Timestamp, in.StartTime, in.EndTime) || !strings.Contains(aws.ToString(e.Message), aws.ToString(in.FilterPattern)) {
+				continue
+			}
+			out.Events = append(out.Events, logtypes.FilteredLogEvent{EventId: aws.String(fmt.Sprintf("%s/%d", name, i)),
+				LogStreamName: aws.String(name), Message: e.Message, Timestamp: e.Timestamp, IngestionTime: e.IngestionTime})
+		}
+		out.SearchedLogStreams = append(out.SearchedLogStreams, logtypes.SearchedLogStream{LogStreamName: aws.String(name), SearchedCompletely: aws.Bool(true)})
+	}
+	sort.SliceStable(out.Events, func(i, j int) bool { return *out.Events[i].Timestamp < *out.Events[j].Timestamp })
+	return out, nil
+}
@@ -0,0 +1,180 @@
+package fake
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// S3 is an in-memory S3 for single and multipart uploads. It implements submit.S3API and the
+// manager.UploadAPIClient used by s3upload.
+type S3 struct {
+	Errors
+
+	mu sync.Mutex
+	// Objects are the contents of the objects keyed by bucket/key.
+	Objects map[string][]byte
+	// Tagging is the URL-encoded tag set of the objects that were uploaded with one.
+	Tagging map[string]string
+	uploads map[string]*multipart
+	ids     ids
+}
+
+type multipart struct {
+	key     string
+	tagging *string
+	parts   map[int32][]byte
+}
+
+// NewS3 returns an S3 without objects.
+func NewS3() *S3 {
+	return &S3{Objects: make(map[string][]byte), Tagging: make(map[string]string), uploads: make(map[string]*multipart)}
+}
+
+func key(bucket, k *string) string {
+	return aws.ToString(bucket) + "/" + aws.ToString(k)
+}
+
+func etag(data []byte) *string {
+	return aws.String(fmt.Sprintf(`"%x"`, md5.Sum(data)))
+}
+
+// HeadObject returns the size of the object. Like S3, a missing object is NotFound.
+func (f *S3) HeadObject(ctx context.Context, in *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	if err := f.fail(); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	data, ok := f.Objects[key(in.Bucket, in.Key)]
+	if !ok {
+		return nil, &s3types.NotFound{Message: aws.String("Not Found")}
+	}
+	return &s3.HeadObjectOutput{ContentLength: aws.Int64(int64(len(data))), ETag: etag(data), LastModified: aws.Time(time.Now())}, nil
+}
+
+func (f *S3) GetObject(ctx context.Context, in *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	if err := f.fail(); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	data, ok := f.Objects[key(in.Bucket, in.Key)]
+	if !ok {
+		return nil, &s3types.NoSuchKey{Message: aws.String("The specified key does not exist.")}
+	}
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(bytes.NewReader(data)), ContentLength: aws.Int64(int64(len(data))), ETag: etag(data)}, nil
+}
+
+func read(r io.Reader) ([]byte, error) {
+	if r == nil {
+		return nil, nil
+	}
+	return ioutil.ReadAll(r)
+}
+
+func (f *S3) PutObject(ctx context.Context, in *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	if err := f.fail(); err != nil {
+		return nil, err
+	}
+	data, err := read(in.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	k := key(in.Bucket, in.Key)
+	f.Objects[k] = data
+	if in.Tagging != nil {
+		f.Tagging[k] = *in.Tagging
+	}
+	return &s3.PutObjectOutput{ETag: etag(data)}, nil
+}
+
+func (f *S3) CreateMultipartUpload(ctx context.Context, in *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+	if err := f.fail(); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := f.ids.next("upload-")
+	f.uploads[id] = &multipart{key: key(in.Bucket, in.Key), tagging: in.Tagging, parts: make(map[int32][]byte)}
+	return &s3.CreateMultipartUploadOutput{Bucket: in.Bucket, Key: in.Key, UploadId: aws.String(id)}, nil
+}
+
+func (f *S3) upload(id *string) (*multipart, error) {
+	u, ok := f.uploads[aws.ToString(id)]
+	if !ok {
+		return nil, &s3types.NoSuchUpload{Message: aws.String("The specified upload does not exist.")}
+	}
+	return u, nil
+}
+
+func (f *S3) UploadPart(ctx context.Context, in *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+	if err := f.fail(); err != nil {
+		return nil, err
+	}
+	data, err := read(in.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	u, err := f.upload(in.UploadId)
+	if err != nil {
+		return nil, err
+	}
+	u.parts[aws.ToInt32(in.PartNumber)] = data
+	return &s3.UploadPartOutput{ETag: etag(data)}, nil
+}
+
+// CompleteMultipartUpload joins the parts in the order of their numbers.
+func (f *S3) CompleteMultipartUpload(ctx context.Context, in *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+	if err := f.fail(); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	u, err := f.upload(in.UploadId)
+	if err != nil {
+		return nil, err
+	}
+	nums := make([]int, 0, len(u.parts))
+	for n := range u.parts {
+		nums = append(nums, int(n))
+	}
+	sort.Ints(nums)
+	var data []byte
+	for _, n := range nums {
+		data = append(data, u.parts[int32(n)]...)
+	}
+	f.Objects[u.key] = data
+	if u.tagging != nil {
+		f.Tagging[u.key] = *u.tagging
+	}
+	delete(f.uploads, *in.UploadId)
+	return &s3.CompleteMultipartUploadOutput{Bucket: in.Bucket, Key: in.Key, ETag: etag(data)}, nil
+}
+
+func (f *S3) AbortMultipartUpload(ctx context.Context, in *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
+	if err := f.fail(); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, err := f.upload(in.UploadId); err != nil {
+		return nil, err
+	}
+	delete(f.uploads, *in.UploadId)
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
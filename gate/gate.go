@@ -0,0 +1,160 @@
+package gate
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/base2genomics/batchit"
+	"github.com/base2genomics/batchit/price"
+	"github.com/base2genomics/batchit/queues"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/batch"
+	batchtypes "github.com/aws/aws-sdk-go-v2/service/batch/types"
+)
+
+type cliargs struct {
+	Region       string        `arg:"env:AWS_DEFAULT_REGION,help:region for batch setup. see batchit help for the default."`
+	Queue        string        `arg:"-q,required,help:job queue to check."`
+	MaxRunnable  int64         `arg:"--max-runnable,help:open the gate when the queue has fewer than this many RUNNABLE jobs."`
+	MinFreeVCPUs int64         `arg:"--min-free-vcpus,help:open the gate when the compute environments of the queue can add at least this many vCPUs."`
+	Timeout      time.Duration `help:"give up after this long, e.g. 6h. 0 to wait forever."`
+	Check        time.Duration `arg:"help:how often to check the queue."`
+}
+
+func (c cliargs) Version() string {
+	return batchit.Version
+}
+
+func (c cliargs) Description() string {
+	return `Wait until a queue has room for more jobs, e.g. between the waves of a large campaign so that the
+scheduler stays responsive:
+    batchit gate --queue big-q --max-runnable 5000 --timeout 6h && batchit submit ...
+The gate opens when the queue has fewer RUNNABLE jobs than --max-runnable or when the enabled compute
+environments of the queue can scale up by at least --min-free-vcpus. batchit gate exits with 0 when the gate opens
+and with 2 if --timeout passes first as batchit wait does.`
+}
+
+// Gate checks whether a queue has room for more jobs.
+type Gate struct {
+	Queue        string
+	MaxRunnable  int64
+	MinFreeVCPUs int64
+
+	b *batch.Client
+}
+
+// New returns a Gate for queue.
+func New(b *batch.Client, queue string, maxRunnable, minFreeVCPUs int64) *Gate {
+	return &Gate{b: b, Queue: queue, MaxRunnable: maxRunnable, MinFreeVCPUs: minFreeVCPUs}
+}
+
+// FreeVCPUs returns the number of vCPUs that the enabled compute environments of the queue can
+// still add. The compute environments are described each time as their capacity changes while
+// Wait polls.
+func FreeVCPUs(ctx context.Context, b *batch.Client, queue string) (int64, error) {
+	ces, err := price.Environments(batchit.Fresh(ctx), b, queue)
+	if err != nil {
+		return 0, err
+	}
+	var free int64
+	for _, ce := range ces {
+		cr := ce.ComputeResources
+		if cr == nil || ce.State != batchtypes.CEStateEnabled {
+			continue
+		}
+		if n := int64(aws.ToInt32(cr.MaxvCpus) - aws.ToInt32(cr.DesiredvCpus)); n > 0 {
+			free += n
+		}
+	}
+	return free, nil
+}
+
+// Open returns true if the queue has room and a description of why or why not.
+func (g *Gate) Open(ctx context.Context) (bool, string, error) {
+	var runnable, free int64
+	var err error
+	if g.MaxRunnable > 0 {
+		if runnable, err = queues.Count(ctx, g.b, g.Queue, batchtypes.JobStatusRunnable); err != nil {
+			return false, "", err
+		}
+		if runnable < g.MaxRunnable {
+			return true, fmt.Sprintf("%d RUNNABLE jobs", runnable), nil
+		}
+	}
+	if g.MinFreeVCPUs > 0 {
+		if free, err = FreeVCPUs(ctx, g.b, g.Queue); err != nil {
+			return false, "", err
+		}
+		if free >= g.MinFreeVCPUs {
+			return true, fmt.Sprintf("room for %d more vCPUs", free), nil
+		}
+	}
+	switch {
+	case g.MaxRunnable > 0 && g.MinFreeVCPUs > 0:
+		return false, fmt.Sprintf("%d RUNNABLE jobs and room for %d more vCPUs", runnable, free), nil
+	case g.MaxRunnable > 0:
+		return false, fmt.Sprintf("%d RUNNABLE jobs", runnable), nil
+	}
+	return false, fmt.Sprintf("room for %d more vCPUs", free), nil
+}
+
+// Wait checks the queue every interval until it has room or timeout passes, in which case it
+// returns false. A timeout of 0 waits forever.
+func (g *Gate) Wait(ctx context.Context, interval, timeout time.Duration) (bool, error) {
+	start := time.Now()
+	last := ""
+	for {
+		open, why, err := g.Open(ctx)
+		if err != nil {
+			return false, err
+		}
+		if open {
+			log.Printf("[batchit gate] %s has %s. open after %s", g.Queue, why, time.Since(start).Round(time.Second))
+			return true, nil
+		}
+		if why != last {
+			log.Printf("[batchit gate] %s has %s. waiting", g.Queue, why)
+			last = why
+		}
+		sleep := interval
+		if timeout > 0 {
+			left := timeout - time.Since(start)
+			if left <= 0 {
+				log.Printf("[batchit gate] %s still has %s after %s. giving up", g.Queue, why, timeout)
+				return false, nil
+			}
+			// check once more at the deadline.
+			if left < sleep {
+				sleep = left
+			}
+		}
+		time.Sleep(sleep)
+	}
+}
+
+func Main() error {
+	cli := &cliargs{Check: time.Minute}
+	p := batchit.MustParse(cli)
+	if cli.MaxRunnable <= 0 && cli.MinFreeVCPUs <= 0 {
+		p.Fail("at least one of --max-runnable or --min-free-vcpus is required")
+	}
+	if cli.Check <= 0 || cli.Timeout < 0 {
+		p.Fail("--check must be positive and --timeout must not be negative")
+	}
+	ctx := context.Background()
+	cfg, err := batchit.LoadConfig(ctx, cli.Region)
+	if err != nil {
+		return err
+	}
+	open, err := New(batch.NewFromConfig(cfg), cli.Queue, cli.MaxRunnable, cli.MinFreeVCPUs).Wait(ctx, cli.Check, cli.Timeout)
+	if err != nil {
+		return err
+	}
+	if !open {
+		return batchit.Exit(batchit.ExitTimeout, fmt.Errorf("%s did not open within %s", cli.Queue, cli.Timeout))
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package gc
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/base2genomics/batchit"
+	"github.com/base2genomics/batchit/cleandefs"
+	"github.com/base2genomics/batchit/ddv"
+	"github.com/base2genomics/batchit/logof"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/batch"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+type cliargs struct {
+	Region     string   `arg:"env:AWS_DEFAULT_REGION,help:region for batch setup. see batchit help for the default."`
+	OlderThan  string   `arg:"--older-than" help:"only clean up things created longer ago than this, e.g. 7d."`
+	KeepLatest int      `arg:"--keep-latest,help:number of the most recent revisions of each job definition to keep."`
+	Prefix     string   `arg:"help:only consider job definitions whose name starts with this."`
+	S3Prefix   []string `arg:"help:abort multipart uploads under these s3://bucket/prefix paths."`
+	Skip       []string `help:"parts to skip: defs, volumes or uploads."`
+	DryRun     bool     `arg:"--dry-run,help:list what would be cleaned up without changing anything."`
+}
+
+func (c cliargs) Version() string {
+	return batchit.Version
+}
+
+func (c cliargs) Description() string {
+	return `Clean up what batchit leaves behind in one pass so that it can be run from cron:
+old revisions of job definitions (as with batchit clean-defs), unattached EBS volumes created by batchit
+ebsmount (named batchit-*) whose job was killed before the volume was deleted, and incomplete multipart
+uploads (e.g. from an interrupted batchit s3upload) under each --s3prefix.
+Only things older than --older-than are removed. The age of job definitions is found as with clean-defs.`
+}
+
+// Uploads returns the multipart uploads under s3path that were started before cutoff.
+func Uploads(ctx context.Context, svc *s3.Client, s3path string, cutoff time.Time) ([]*s3types.MultipartUpload, error) {
+	bucket, prefix := splitPath(s3path)
+	var out []*s3types.MultipartUpload
+	in := &s3.ListMultipartUploadsInput{Bucket: aws.String(bucket), Prefix: aws.String(prefix)}
+	// there is no paginator for ListMultipartUploads so follow the markers.
+	for {
+		page, err := svc.ListMultipartUploads(ctx, in)
+		if err != nil {
+			return out, err
+		}
+		for i := range page.Uploads {
+			if u := &page.Uploads[i]; u.Initiated != nil && u.Initiated.Before(cutoff) {
+				out = append(out, u)
+			}
+		}
+		if !aws.ToBool(page.IsTruncated) {
+			return out, nil
+		}
+		in.KeyMarker, in.UploadIdMarker = page.NextKeyMarker, page.NextUploadIdMarker
+	}
+}
+
+func splitPath(s3path string) (bucket, prefix string) {
+	bk := strings.SplitN(strings.TrimPrefix(s3path, "s3://"), "/", 2)
+	if len(bk) != 2 {
+		return bk[0], ""
+	}
+	return bk[0], bk[1]
+}
+
+// collector counts what was cleaned up and what failed.
+type collector struct {
+	dryRun          bool
+	cleaned, failed int
+}
+
+// do logs what would be done if this is a dry run and otherwise does it.
+func (c *collector) do(what string, fn func() error) {
+	if c.dryRun {
+		log.Printf("[batchit gc] would %s", what)
+		c.cleaned++
+		return
+	}
+	if err := fn(); err != nil {
+		log.Printf("[batchit gc] error trying to %s: %s", what, err)
+		c.failed++
+		return
+	}
+	log.Printf("[batchit gc] %s", what)
+	c.cleaned++
+}
+
+func Main() {
+	cli := &cliargs{OlderThan: "7d", KeepLatest: 3}
+	p := batchit.MustParse(cli)
+	d, err := logof.ParseDuration(cli.OlderThan)
+	if err != nil {
+		p.Fail(err.Error())
+	}
+	skip := make(map[string]bool)
+	for _, s := range cli.Skip {
+		if s != "defs" && s != "volumes" && s != "uploads" {
+			p.Fail("--skip must be defs, volumes or uploads")
+		}
+		skip[s] = true
+	}
+	for _, s := range cli.S3Prefix {
+		if !strings.HasPrefix(s, "s3://") {
+			p.Fail(fmt.Sprintf("--s3prefix must start with s3://, got %s", s))
+		}
+	}
+	cutoff := time.Now().Add(-d)
+	ctx := context.Background()
+	cfg, err := batchit.LoadConfig(ctx, cli.Region)
+	if err != nil {
+		log.Fatal(err)
+	}
+	c := &collector{dryRun: cli.DryRun}
+
+	if !skip["defs"] {
+		b := batch.NewFromConfig(cfg)
+		defs, err := cleandefs.Revisions(ctx, b, cli.Prefix)
+		if err != nil {
+			log.Printf("[batchit gc] error listing job definitions: %s", err)
+			c.failed++
+		}
+		stale, unknown := cleandefs.Stale(defs, cli.KeepLatest, cutoff)
+		for _, jd := range unknown {
+			log.Printf("[batchit gc] keeping %s:%d as when it was registered is not known", *jd.JobDefinitionName, aws.ToInt32(jd.Revision))
+		}
+		for _, jd := range stale {
+			c.do(fmt.Sprintf("deregister %s:%d", *jd.JobDefinitionName, aws.ToInt32(jd.Revision)), func() error {
+				_, err := b.DeregisterJobDefinition(ctx, &batch.DeregisterJobDefinitionInput{JobDefinition: jd.JobDefinitionArn})
+				return err
+			})
+		}
+	}
+	if !skip["volumes"] {
+		svc := ec2.NewFromConfig(cfg)
+		vols, err := ddv.Stale(ctx, svc, d, nil)
+		if err != nil {
+			log.Printf("[batchit gc] error listing volumes: %s", err)
+			c.failed++
+		}
+		opts := ddv.DefaultOptions
+		for _, v := range vols {
+			c.do(fmt.Sprintf("delete volume %s (%dGB, created %s)", *v.VolumeId, aws.ToInt32(v.Size), v.CreateTime.Format(time.RFC3339)), func() error {
+				return ddv.DetachAndDelete(ctx, svc, *v.VolumeId, opts)
+			})
+		}
+	}
+	if !skip["uploads"] {
+		svc := s3.NewFromConfig(cfg)
+		for _, s3path := range cli.S3Prefix {
+			ups, err := Uploads(ctx, svc, s3path, cutoff)
+			if err != nil {
+				log.Printf("[batchit gc] error listing multipart uploads under %s: %s", s3path, err)
+				c.failed++
+				continue
+			}
+			bucket, _ := splitPath(s3path)
+			for _, u := range ups {
+				c.do(fmt.Sprintf("abort upload of s3://%s/%s started %s", bucket, *u.Key, u.Initiated.Format(time.RFC3339)), func() error {
+					_, err := svc.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{Bucket: aws.String(bucket), Key: u.Key, UploadId: u.UploadId})
+					return err
+				})
+			}
+		}
+	}
+	verb := "cleaned up"
+	if cli.DryRun {
+		verb = "would clean up"
+	}
+	log.Printf("[batchit gc] %s %d items with %d errors", verb, c.cleaned, c.failed)
+	if c.failed > 0 {
+		os.Exit(1)
+	}
+}
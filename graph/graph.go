@@ -0,0 +1,237 @@
+package graph
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/base2genomics/batchit"
+	"github.com/base2genomics/batchit/dag"
+	"github.com/base2genomics/batchit/logof"
+	"github.com/base2genomics/batchit/pipeline"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/batch"
+	batchtypes "github.com/aws/aws-sdk-go-v2/service/batch/types"
+)
+
+type cliargs struct {
+	Region   string   `arg:"env:AWS_DEFAULT_REGION,help:region for batch setup. see batchit help for the default."`
+	Pipeline string   `arg:"help:pipeline YAML file to draw instead of jobs. statuses are from its batchit dag run-state file if there is one."`
+	State    string   `arg:"help:run-state file for --pipeline. default is as for batchit dag run."`
+	Format   string   `arg:"help:dot for Graphviz or mermaid."`
+	JobIds   []string `arg:"positional,help:job id(s) to draw with the jobs they depend on."`
+}
+
+func (c cliargs) Version() string {
+	return batchit.Version
+}
+
+func (c cliargs) Description() string {
+	return `Draw the dependencies of jobs as a Graphviz (dot) or Mermaid graph with each job colored by its
+status, e.g. to see where a pipeline is stuck. The jobs that each job depends on are found with
+DescribeJobs so giving the last job of a pipeline draws all of it. e.g.:
+  batchit graph $jobid | dot -Tsvg > pipeline.svg`
+}
+
+// Node is a job in the graph.
+type Node struct {
+	Id     string
+	Name   string
+	Status string
+}
+
+// Edge is a dependency of To on From.
+type Edge struct {
+	From, To string
+	// Type is the array dependency type, e.g. N_TO_N, if any.
+	Type string
+}
+
+// Graph is a set of jobs and their dependencies.
+type Graph struct {
+	Nodes []Node
+	Edges []Edge
+}
+
+// colors are the fill of nodes by status.
+var colors = map[string]string{
+	string(batchtypes.JobStatusSubmitted): "#eeeeee",
+	string(batchtypes.JobStatusPending):   "#dddddd",
+	string(batchtypes.JobStatusRunnable):  "#fff2a8",
+	string(batchtypes.JobStatusStarting):  "#cfe8ff",
+	string(batchtypes.JobStatusRunning):   "#8cc8ff",
+	string(batchtypes.JobStatusSucceeded): "#a8e6a1",
+	string(batchtypes.JobStatusFailed):    "#f4a09c",
+	dag.Cancelled:                         "#c8c8c8",
+}
+
+func color(status string) string {
+	if c, ok := colors[status]; ok {
+		return c
+	}
+	return "#ffffff"
+}
+
+// FromJobs returns the graph of jobs ids and every job they depend on directly or indirectly.
+func FromJobs(ctx context.Context, b *batch.Client, ids []string) (*Graph, error) {
+	g := &Graph{}
+	seen := make(map[string]bool)
+	for len(ids) > 0 {
+		var todo []string
+		for _, id := range ids {
+			if !seen[id] {
+				seen[id] = true
+				todo = append(todo, id)
+			}
+		}
+		jobs, err := logof.DescribeJobs(ctx, b, todo)
+		if err != nil {
+			return nil, err
+		}
+		ids = nil
+		for _, j := range jobs {
+			g.Nodes = append(g.Nodes, Node{Id: *j.JobId, Name: aws.ToString(j.JobName), Status: string(j.Status)})
+			for _, d := range j.DependsOn {
+				g.Edges = append(g.Edges, Edge{From: aws.ToString(d.JobId), To: *j.JobId, Type: string(d.Type)})
+				ids = append(ids, aws.ToString(d.JobId))
+			}
+		}
+	}
+	return g, nil
+}
+
+// FromPipeline returns the graph of the jobs in p with their status from state if it is not nil.
+func FromPipeline(p *pipeline.Pipeline, state *dag.State) *Graph {
+	g := &Graph{}
+	for _, j := range p.Jobs {
+		n := Node{Id: j.Name, Name: j.Name}
+		if state != nil {
+			if js := state.Jobs[j.Name]; js != nil {
+				n.Status = js.Status
+			}
+		}
+		g.Nodes = append(g.Nodes, n)
+		for _, d := range j.DependsOn {
+			g.Edges = append(g.Edges, Edge{From: d, To: j.Name})
+		}
+	}
+	return g
+}
+
+func (n Node) label() string {
+	if n.Status == "" {
+		return n.Name
+	}
+	return n.Name + "\n" + n.Status
+}
+
+// WriteDot writes g in the Graphviz dot language.
+func (g *Graph) WriteDot(w io.Writer) error {
+	fmt.Fprintln(w, "digraph batchit {")
+	fmt.Fprintln(w, "  rankdir=LR;")
+	fmt.Fprintln(w, `  node [shape=box, style="rounded,filled", fontname="Helvetica"];`)
+	for _, n := range g.Nodes {
+		fmt.Fprintf(w, "  %q [label=%q, fillcolor=%q, tooltip=%q];\n", n.Id, n.label(), color(n.Status), n.Id)
+	}
+	for _, e := range g.Edges {
+		if e.Type != "" {
+			fmt.Fprintf(w, "  %q -> %q [label=%q];\n", e.From, e.To, e.Type)
+		} else {
+			fmt.Fprintf(w, "  %q -> %q;\n", e.From, e.To)
+		}
+	}
+	_, err := fmt.Fprintln(w, "}")
+	return err
+}
+
+// WriteMermaid writes g as a Mermaid flowchart.
+func (g *Graph) WriteMermaid(w io.Writer) error {
+	// job ids are not valid mermaid ids so each node is numbered.
+	ids := make(map[string]string, len(g.Nodes))
+	fmt.Fprintln(w, "flowchart LR")
+	for i, n := range g.Nodes {
+		ids[n.Id] = fmt.Sprintf("n%d", i)
+		label := strings.Replace(strings.Replace(n.label(), `"`, "#quot;", -1), "\n", "<br/>", -1)
+		fmt.Fprintf(w, "  %s[\"%s\"]\n", ids[n.Id], label)
+	}
+	for _, e := range g.Edges {
+		from, ok := ids[e.From]
+		if !ok {
+			// a dependency that batch no longer knows about.
+			continue
+		}
+		if e.Type != "" {
+			fmt.Fprintf(w, "  %s -->|%s| %s\n", from, e.Type, ids[e.To])
+		} else {
+			fmt.Fprintf(w, "  %s --> %s\n", from, ids[e.To])
+		}
+	}
+	statuses := make([]string, 0, len(colors))
+	for s := range colors {
+		statuses = append(statuses, s)
+	}
+	sort.Strings(statuses)
+	for _, s := range statuses {
+		fmt.Fprintf(w, "  classDef %s fill:%s\n", s, colors[s])
+	}
+	for _, n := range g.Nodes {
+		if n.Status != "" {
+			fmt.Fprintf(w, "  class %s %s\n", ids[n.Id], n.Status)
+		}
+	}
+	return nil
+}
+
+func Main() {
+	cli := &cliargs{Format: "dot"}
+	p := batchit.MustParse(cli)
+	if cli.Format != "dot" && cli.Format != "mermaid" {
+		p.Fail("--format must be dot or mermaid")
+	}
+	if (cli.Pipeline == "") == (len(cli.JobIds) == 0) {
+		p.Fail("specify either job ids or --pipeline")
+	}
+
+	var g *Graph
+	if cli.Pipeline != "" {
+		pl, err := pipeline.Read(cli.Pipeline)
+		if err != nil {
+			p.Fail(err.Error())
+		}
+		if cli.State == "" {
+			cli.State = dag.StatePath(cli.Pipeline)
+		}
+		state, err := dag.ReadState(cli.State)
+		if err != nil && !os.IsNotExist(err) {
+			log.Fatal(err)
+		}
+		g = FromPipeline(pl, state)
+	} else {
+		ctx := context.Background()
+		cfg, err := batchit.LoadConfig(ctx, cli.Region)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cli.Region = cfg.Region
+		if g, err = FromJobs(ctx, batch.NewFromConfig(cfg), cli.JobIds); err != nil {
+			log.Fatal(err)
+		}
+		if len(g.Nodes) == 0 {
+			log.Fatalf("[batchit graph] no jobs found in %s", cli.Region)
+		}
+	}
+	var err error
+	if cli.Format == "mermaid" {
+		err = g.WriteMermaid(os.Stdout)
+	} else {
+		err = g.WriteDot(os.Stdout)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,229 @@
+package heartbeat
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/base2genomics/batchit"
+	"github.com/base2genomics/batchit/metric"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	cloudwatchtypes "github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+)
+
+type cliargs struct {
+	Region     string        `arg:"env:AWS_DEFAULT_REGION,help:region for batch setup. see batchit help for the default."`
+	Interval   time.Duration `arg:"help:how often to check for activity and send the heartbeat metric."`
+	StallAfter time.Duration `arg:"--stall-after,help:the command has stalled if it has had no activity for this long."`
+	Watch      []string      `help:"directories whose file system is checked for growth, e.g. the scratch volume. default is $TMPDIR if it is set."`
+	Namespace  string        `arg:"help:CloudWatch namespace of the metrics."`
+	FlagOnly   bool          `arg:"help:only log and send the Stalled metric when the command stalls rather than stopping it."`
+	NoMetrics  bool          `arg:"help:do not send metrics to CloudWatch."`
+	Command    []string      `arg:"required,positional,help:command to run after --."`
+}
+
+func (c cliargs) Version() string {
+	return batchit.Version
+}
+
+func (c cliargs) Description() string {
+	return `Run a command and stop it if it stalls, e.g. on a hung NFS mount or a deadlocked tool, rather than
+letting it run until the job times out:
+    batchit heartbeat --interval 60s --stall-after 30m -- bwa mem ref.fa r1.fq r2.fq
+The command is active while it writes to STDOUT or STDERR or while the file systems of --watch grow. A Heartbeat
+metric and the SecondsIdle since the last activity are sent to CloudWatch each interval with the JobId and
+JobQueue dimensions so that alarms can be set on them. When the command stalls, a Stalled metric is sent and it
+is sent SIGTERM and then SIGKILL. batchit heartbeat exits with the exit code of the command or 124 if it stalled.`
+}
+
+// StalledExitCode is the exit code when the command was stopped because it stalled, as for timeout(1).
+const StalledExitCode = 124
+
+// activity records when the command last did something.
+type activity struct {
+	mu   sync.Mutex
+	last time.Time
+}
+
+func (a *activity) touch() {
+	a.mu.Lock()
+	a.last = time.Now()
+	a.mu.Unlock()
+}
+
+func (a *activity) idle() time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return time.Since(a.last)
+}
+
+// activeWriter marks activity for each write to w.
+type activeWriter struct {
+	w io.Writer
+	a *activity
+}
+
+func (aw activeWriter) Write(p []byte) (int, error) {
+	aw.a.touch()
+	return aw.w.Write(p)
+}
+
+// Monitor checks a command for activity.
+type Monitor struct {
+	// Watch are directories whose file systems are checked for growth.
+	Watch []string
+	// Send is called each interval with the seconds since the last activity. It may be nil.
+	Send func(name string, value float64)
+
+	act  activity
+	used map[string]uint64
+}
+
+// NewMonitor returns a Monitor that considers the command active from now.
+func NewMonitor(watch []string) *Monitor {
+	m := &Monitor{Watch: watch, used: make(map[string]uint64)}
+	m.act.touch()
+	m.check()
+	return m
+}
+
+// check marks activity if any of the watched file systems have grown since the last check.
+func (m *Monitor) check() {
+	for _, dir := range m.Watch {
+		u, err := usedBytes(dir)
+		if err != nil {
+			log.Printf("[batchit heartbeat] error checking %s: %s", dir, err)
+			continue
+		}
+		if prev, ok := m.used[dir]; ok && u > prev {
+			m.act.touch()
+		}
+		m.used[dir] = u
+	}
+}
+
+// Idle checks the watched file systems and returns the time since the last activity.
+func (m *Monitor) Idle() time.Duration {
+	m.check()
+	return m.act.idle()
+}
+
+func (m *Monitor) send(name string, value float64) {
+	if m.Send != nil {
+		m.Send(name, value)
+	}
+}
+
+// Run runs cmd with its output copied to STDOUT and STDERR until it exits or it has had no
+// activity for stallAfter. It returns the exit code of the command and whether it stalled.
+func (m *Monitor) Run(cmd *exec.Cmd, interval, stallAfter time.Duration, flagOnly bool) (int, bool, error) {
+	cmd.Stdout = activeWriter{os.Stdout, &m.act}
+	cmd.Stderr = activeWriter{os.Stderr, &m.act}
+	cmd.Stdin = os.Stdin
+	newGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return 0, false, err
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	// batch sends SIGTERM when a job is terminated. pass it on.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	stalled, flagged := false, false
+	for {
+		select {
+		case err := <-done:
+			if err == nil {
+				return 0, stalled, nil
+			}
+			if ee, ok := err.(*exec.ExitError); ok {
+				return exitCode(ee), stalled, nil
+			}
+			return 0, stalled, err
+		case s := <-sigs:
+			signalGroup(cmd, s)
+		case <-tick.C:
+			idle := m.Idle()
+			m.send("Heartbeat", 1)
+			m.send("SecondsIdle", idle.Seconds())
+			if idle < stallAfter {
+				flagged = false
+				continue
+			}
+			if flagOnly {
+				if !flagged {
+					log.Printf("[batchit heartbeat] no activity from %s for %s", cmd.Path, idle.Round(time.Second))
+					m.send("Stalled", 1)
+					flagged = true
+				}
+				continue
+			}
+			if !stalled {
+				log.Printf("[batchit heartbeat] no activity from %s for %s. stopping it", cmd.Path, idle.Round(time.Second))
+				m.send("Stalled", 1)
+				stalled = true
+				signalGroup(cmd, syscall.SIGTERM)
+				// some tools ignore SIGTERM, and processes blocked on a hung mount only go with SIGKILL.
+				time.AfterFunc(30*time.Second, func() { signalGroup(cmd, syscall.SIGKILL) })
+			}
+		}
+	}
+}
+
+func Main() {
+	cli := &cliargs{Interval: time.Minute, StallAfter: 30 * time.Minute, Namespace: "batchit"}
+	p := batchit.MustParse(cli)
+	if cli.Interval <= 0 || cli.StallAfter < cli.Interval {
+		p.Fail("--interval must be positive and --stall-after must be at least --interval")
+	}
+	if len(cli.Watch) == 0 && os.Getenv("TMPDIR") != "" {
+		cli.Watch = []string{os.Getenv("TMPDIR")}
+	}
+	m := NewMonitor(cli.Watch)
+	if !cli.NoMetrics {
+		dims, err := metric.Dimensions(nil, true)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ctx := context.Background()
+		cfg, err := batchit.LoadConfig(ctx, cli.Region)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cw := cloudwatch.NewFromConfig(cfg)
+		failed := false
+		m.Send = func(name string, value float64) {
+			unit := cloudwatchtypes.StandardUnitCount
+			if name == "SecondsIdle" {
+				unit = cloudwatchtypes.StandardUnitSeconds
+			}
+			// the command keeps running without metrics, e.g. if the job role can not put them.
+			if err := metric.Put(ctx, cw, cli.Namespace, name, value, unit, dims); err != nil && !failed {
+				log.Printf("[batchit heartbeat] error sending metrics: %s", err)
+				failed = true
+			}
+		}
+	}
+	code, stalled, err := m.Run(exec.Command(cli.Command[0], cli.Command[1:]...), cli.Interval, cli.StallAfter, cli.FlagOnly)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[batchit heartbeat] %s\n", err)
+		os.Exit(127)
+	}
+	if stalled {
+		os.Exit(StalledExitCode)
+	}
+	os.Exit(code)
+}
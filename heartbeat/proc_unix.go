@@ -0,0 +1,43 @@
+//go:build !windows
+// +build !windows
+
+package heartbeat
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// newGroup starts the command in its own process group so that signals reach its children.
+func newGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+func signalGroup(cmd *exec.Cmd, s os.Signal) {
+	if cmd.Process == nil {
+		return
+	}
+	if sig, ok := s.(syscall.Signal); ok {
+		syscall.Kill(-cmd.Process.Pid, sig)
+		return
+	}
+	cmd.Process.Signal(s)
+}
+
+// exitCode returns the exit code of the command or 128+signal as the shell does.
+func exitCode(ee *exec.ExitError) int {
+	if ws, ok := ee.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return 128 + int(ws.Signal())
+	}
+	return ee.ExitCode()
+}
+
+// usedBytes returns the bytes used on the file system of dir.
+func usedBytes(dir string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return (st.Blocks - st.Bfree) * uint64(st.Bsize), nil
+}
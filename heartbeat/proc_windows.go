@@ -0,0 +1,23 @@
+package heartbeat
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+)
+
+func newGroup(cmd *exec.Cmd) {}
+
+func signalGroup(cmd *exec.Cmd, s os.Signal) {
+	if cmd.Process != nil {
+		cmd.Process.Kill()
+	}
+}
+
+func exitCode(ee *exec.ExitError) int {
+	return ee.ExitCode()
+}
+
+func usedBytes(dir string) (uint64, error) {
+	return 0, errors.New("heartbeat: --watch is not supported on windows")
+}
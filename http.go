@@ -0,0 +1,85 @@
+package batchit
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+)
+
+// CABundle is a PEM file with certificates to trust in addition to those of the system, e.g. that
+// of a proxy which intercepts TLS. It is set from the --ca-bundle flag that every subcommand
+// accepts, $AWS_CA_BUNDLE or the config and is used by LoadConfig and HTTPClient.
+var CABundle string
+
+var roots struct {
+	once sync.Once
+	pool *x509.CertPool
+	err  error
+}
+
+// rootCAs returns the certificates of the system with those of CABundle or nil to use the system
+// ones as they are.
+func rootCAs() (*x509.CertPool, error) {
+	if CABundle == "" {
+		return nil, nil
+	}
+	roots.once.Do(func() {
+		pem, err := os.ReadFile(CABundle)
+		if err != nil {
+			roots.err = fmt.Errorf("batchit: --ca-bundle: %w", err)
+			return
+		}
+		if roots.pool, err = x509.SystemCertPool(); err != nil {
+			roots.pool = x509.NewCertPool()
+		}
+		if !roots.pool.AppendCertsFromPEM(pem) {
+			roots.err = fmt.Errorf("batchit: --ca-bundle: no certificates found in %s", CABundle)
+		}
+	})
+	return roots.pool, roots.err
+}
+
+// configureHTTP checks that CABundle can be used so that a bad path is a usage error.
+func configureHTTP() error {
+	_, err := rootCAs()
+	return err
+}
+
+// awsHTTPClient returns the client for LoadConfig. The transport of the SDK already uses the proxy
+// from the environment, so only CABundle is added to it.
+func awsHTTPClient() (aws.HTTPClient, error) {
+	pool, err := rootCAs()
+	if err != nil || pool == nil {
+		return nil, err
+	}
+	return awshttp.NewBuildableClient().WithTransportOptions(func(tr *http.Transport) {
+		if tr.TLSClientConfig == nil {
+			tr.TLSClientConfig = &tls.Config{}
+		}
+		tr.TLSClientConfig.RootCAs = pool
+	}), nil
+}
+
+// HTTPClient returns a client with timeout for the requests that batchit makes itself, such as
+// to the instance metadata service. As for the AWS clients, requests go through the proxy in
+// $HTTPS_PROXY or $HTTP_PROXY unless the host is in $NO_PROXY and CABundle is trusted. On EC2
+// behind a proxy, $NO_PROXY should include 169.254.169.254 for the instance metadata.
+func HTTPClient(timeout time.Duration) (*http.Client, error) {
+	pool, err := rootCAs()
+	if err != nil {
+		return nil, err
+	}
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.Proxy = http.ProxyFromEnvironment
+	if pool != nil {
+		tr.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return &http.Client{Timeout: timeout, Transport: tr}, nil
+}
@@ -0,0 +1,240 @@
+package instances
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/base2genomics/batchit"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/batch"
+	batchtypes "github.com/aws/aws-sdk-go-v2/service/batch/types"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	ecstypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
+)
+
+type cliargs struct {
+	Region string `arg:"env:AWS_DEFAULT_REGION,help:region for batch setup. see batchit help for the default."`
+	Queue  string `arg:"required,help:job queue whose compute environments are shown."`
+	JSON   bool   `arg:"help:print a JSON array rather than a table."`
+}
+
+func (c cliargs) Version() string {
+	return batchit.Version
+}
+
+func (c cliargs) Description() string {
+	return `List the instances in the compute environments of a queue with their type, zone, market, number of
+running tasks and the vCPUs and memory that are still free. This shows why jobs are RUNNABLE but not starting.`
+}
+
+// Instance is a container instance in a compute environment.
+type Instance struct {
+	ComputeEnvironment   string    `json:"compute_environment"`
+	Cluster              string    `json:"cluster"`
+	ContainerInstanceArn string    `json:"container_instance_arn"`
+	InstanceId           string    `json:"instance_id"`
+	InstanceType         string    `json:"instance_type"`
+	Zone                 string    `json:"zone"`
+	Spot                 bool      `json:"spot"`
+	Status               string    `json:"status"`
+	AgentConnected       bool      `json:"agent_connected"`
+	RunningTasks         int64     `json:"running_tasks"`
+	PendingTasks         int64     `json:"pending_tasks"`
+	VCPUs                float64   `json:"vcpus"`
+	FreeVCPUs            float64   `json:"free_vcpus"`
+	Memory               int64     `json:"memory"`
+	FreeMemory           int64     `json:"free_memory"`
+	LaunchTime           time.Time `json:"launch_time"`
+}
+
+// ComputeEnvironments returns the compute environments of a queue in order.
+func ComputeEnvironments(ctx context.Context, b *batch.Client, queue string) ([]*batchtypes.ComputeEnvironmentDetail, error) {
+	// only the clusters are used, which may come from the cache.
+	ctx = batchit.Mapping(ctx)
+	qo, err := b.DescribeJobQueues(ctx, &batch.DescribeJobQueuesInput{JobQueues: []string{queue}})
+	if err != nil {
+		return nil, err
+	}
+	if len(qo.JobQueues) == 0 {
+		return nil, fmt.Errorf("instances: queue %s not found", queue)
+	}
+	var ces []string
+	for _, o := range qo.JobQueues[0].ComputeEnvironmentOrder {
+		ces = append(ces, aws.ToString(o.ComputeEnvironment))
+	}
+	co, err := b.DescribeComputeEnvironments(ctx, &batch.DescribeComputeEnvironmentsInput{ComputeEnvironments: ces})
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*batchtypes.ComputeEnvironmentDetail, len(co.ComputeEnvironments))
+	for i := range co.ComputeEnvironments {
+		out[i] = &co.ComputeEnvironments[i]
+	}
+	return out, nil
+}
+
+// ContainerInstances returns every container instance in an ECS cluster.
+func ContainerInstances(ctx context.Context, ec *ecs.Client, cluster string) ([]*ecstypes.ContainerInstance, error) {
+	var arns []string
+	pages := ecs.NewListContainerInstancesPaginator(ec, &ecs.ListContainerInstancesInput{Cluster: aws.String(cluster)})
+	for pages.HasMorePages() {
+		lo, err := pages.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		arns = append(arns, lo.ContainerInstanceArns...)
+	}
+	var cis []*ecstypes.ContainerInstance
+	// at most 100 can be described at once.
+	for i := 0; i < len(arns); i += 100 {
+		j := i + 100
+		if j > len(arns) {
+			j = len(arns)
+		}
+		eo, err := ec.DescribeContainerInstances(ctx, &ecs.DescribeContainerInstancesInput{Cluster: aws.String(cluster), ContainerInstances: arns[i:j]})
+		if err != nil {
+			return nil, err
+		}
+		for k := range eo.ContainerInstances {
+			cis = append(cis, &eo.ContainerInstances[k])
+		}
+	}
+	return cis, nil
+}
+
+func resource(rs []ecstypes.Resource, name string) int64 {
+	for _, r := range rs {
+		if aws.ToString(r.Name) == name {
+			return int64(r.IntegerValue)
+		}
+	}
+	return 0
+}
+
+// List returns the instances in the compute environments of queue.
+func List(ctx context.Context, cfg aws.Config, queue string) ([]Instance, error) {
+	ces, err := ComputeEnvironments(ctx, batch.NewFromConfig(cfg), queue)
+	if err != nil {
+		return nil, err
+	}
+	ec := ecs.NewFromConfig(cfg)
+	var out []Instance
+	byId := make(map[string]int)
+	var ids []string
+	for _, ce := range ces {
+		if ce.EcsClusterArn == nil {
+			continue
+		}
+		cis, err := ContainerInstances(ctx, ec, *ce.EcsClusterArn)
+		if err != nil {
+			return nil, err
+		}
+		for _, ci := range cis {
+			in := Instance{
+				ComputeEnvironment:   aws.ToString(ce.ComputeEnvironmentName),
+				Cluster:              *ce.EcsClusterArn,
+				ContainerInstanceArn: aws.ToString(ci.ContainerInstanceArn),
+				InstanceId:           aws.ToString(ci.Ec2InstanceId),
+				Status:               aws.ToString(ci.Status),
+				AgentConnected:       ci.AgentConnected,
+				RunningTasks:         int64(ci.RunningTasksCount),
+				PendingTasks:         int64(ci.PendingTasksCount),
+				VCPUs:                float64(resource(ci.RegisteredResources, "CPU")) / 1024,
+				FreeVCPUs:            float64(resource(ci.RemainingResources, "CPU")) / 1024,
+				Memory:               resource(ci.RegisteredResources, "MEMORY"),
+				FreeMemory:           resource(ci.RemainingResources, "MEMORY"),
+			}
+			byId[in.InstanceId] = len(out)
+			ids = append(ids, aws.ToString(ci.Ec2InstanceId))
+			out = append(out, in)
+		}
+	}
+	if len(ids) == 0 {
+		return out, nil
+	}
+	pages := ec2.NewDescribeInstancesPaginator(ec2.NewFromConfig(cfg), &ec2.DescribeInstancesInput{InstanceIds: ids})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return out, err
+		}
+		for _, r := range page.Reservations {
+			for _, ei := range r.Instances {
+				in := &out[byId[aws.ToString(ei.InstanceId)]]
+				in.InstanceType = string(ei.InstanceType)
+				in.Spot = ei.InstanceLifecycle == ec2types.InstanceLifecycleTypeSpot
+				in.LaunchTime = aws.ToTime(ei.LaunchTime)
+				if ei.Placement != nil {
+					in.Zone = aws.ToString(ei.Placement.AvailabilityZone)
+				}
+			}
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].LaunchTime.Before(out[j].LaunchTime) })
+	return out, nil
+}
+
+// WriteTable writes the instances as aligned columns.
+func WriteTable(w io.Writer, ins []Instance) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "INSTANCE\tTYPE\tZONE\tMARKET\tCOMPUTE ENV\tSTATUS\tTASKS\tVCPUS FREE\tMEMORY FREE\tUP")
+	for _, in := range ins {
+		market := "on-demand"
+		if in.Spot {
+			market = "spot"
+		}
+		status := in.Status
+		if !in.AgentConnected {
+			status += " (agent disconnected)"
+		}
+		tasks := fmt.Sprint(in.RunningTasks)
+		if in.PendingTasks > 0 {
+			tasks += fmt.Sprintf("+%d", in.PendingTasks)
+		}
+		up := "-"
+		if !in.LaunchTime.IsZero() {
+			up = time.Since(in.LaunchTime).Round(time.Minute).String()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%g/%g\t%d/%d\t%s\n", in.InstanceId, in.InstanceType, in.Zone, market,
+			in.ComputeEnvironment, status, tasks, in.FreeVCPUs, in.VCPUs, in.FreeMemory, in.Memory, up)
+	}
+	return tw.Flush()
+}
+
+func Main() {
+	cli := &cliargs{}
+	batchit.MustParse(cli)
+	ctx := context.Background()
+	cfg, err := batchit.LoadConfig(ctx, cli.Region)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ins, err := List(ctx, cfg, cli.Queue)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cli.JSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(ins)
+	} else {
+		err = WriteTable(os.Stdout, ins)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(ins) == 0 {
+		log.Printf("[batchit instances] no instances are running for %s", cli.Queue)
+	}
+}
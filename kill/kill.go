@@ -0,0 +1,148 @@
+package kill
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+
+	"github.com/base2genomics/batchit"
+	"github.com/base2genomics/batchit/logof"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/batch"
+	batchtypes "github.com/aws/aws-sdk-go-v2/service/batch/types"
+)
+
+type cliargs struct {
+	Region   string   `arg:"env:AWS_DEFAULT_REGION,help:region for batch setup. see batchit help for the default."`
+	Reason   string   `arg:"help:reason recorded with the job (visible in the console and DescribeJobs)."`
+	Children bool     `help:"for an array job, also kill each unfinished child rather than relying on batch to do so."`
+	Name     string   `arg:"help:kill all unfinished jobs with this name (requires --queue)."`
+	Queue    string   `arg:"help:job queue to search with --name."`
+	DryRun   bool     `arg:"help:report the jobs that would be killed without killing them."`
+	JobIds   []string `arg:"positional,help:job id(s) to kill."`
+}
+
+func (c cliargs) Version() string {
+	return batchit.Version
+}
+
+func (c cliargs) Description() string {
+	return `Stop jobs. Jobs that have not started are cancelled and jobs that are starting or running are terminated.
+Finished jobs are skipped.`
+}
+
+// Action returns the call needed to stop a job with the given status:
+// "cancel", "terminate" or "" if the job is already finished.
+func Action(status batchtypes.JobStatus) string {
+	switch status {
+	case batchtypes.JobStatusSubmitted, batchtypes.JobStatusPending, batchtypes.JobStatusRunnable:
+		return "cancel"
+	case batchtypes.JobStatusStarting, batchtypes.JobStatusRunning:
+		return "terminate"
+	}
+	return ""
+}
+
+// Kill cancels or terminates j according to its status and returns the action taken.
+func Kill(ctx context.Context, b *batch.Client, j *batchtypes.JobDetail, reason string) (string, error) {
+	action := Action(j.Status)
+	var err error
+	switch action {
+	case "cancel":
+		_, err = b.CancelJob(ctx, &batch.CancelJobInput{JobId: j.JobId, Reason: aws.String(reason)})
+	case "terminate":
+		_, err = b.TerminateJob(ctx, &batch.TerminateJobInput{JobId: j.JobId, Reason: aws.String(reason)})
+	}
+	return action, err
+}
+
+func Main() error {
+	cli := &cliargs{Reason: "killed by batchit"}
+	p := batchit.MustParse(cli)
+	if cli.Name != "" && cli.Queue == "" {
+		p.Fail("--name requires --queue")
+	}
+	if (cli.Name == "") == (len(cli.JobIds) == 0) {
+		p.Fail("specify either job ids or --name")
+	}
+	ctx := context.Background()
+	cfg, err := batchit.LoadConfig(ctx, cli.Region)
+	if err != nil {
+		return err
+	}
+	b := batch.NewFromConfig(cfg)
+
+	if cli.Name != "" {
+		ids, err := logof.JobsByName(ctx, b, cli.Queue, cli.Name, math.MaxInt32)
+		if err != nil {
+			return err
+		}
+		cli.JobIds = ids
+	}
+	jobs, err := logof.DescribeJobs(ctx, b, cli.JobIds)
+	if err != nil {
+		return err
+	}
+	// killed is the number of jobs that were killed and first is the first error which sets the
+	// exit code when none were.
+	failed, killed := 0, 0
+	var first error
+	if len(jobs) < len(cli.JobIds) {
+		log.Printf("[batchit kill] only found %d of %d jobs", len(jobs), len(cli.JobIds))
+		failed += len(cli.JobIds) - len(jobs)
+		first = batchit.Exit(batchit.ExitNotFound, fmt.Errorf("kill: only found %d of %d jobs", len(jobs), len(cli.JobIds)))
+	}
+	if cli.Children {
+		for _, j := range jobs {
+			if !logof.IsArrayParent(j) {
+				continue
+			}
+			kids, err := logof.Children(ctx, b, j)
+			if err != nil {
+				return err
+			}
+			jobs = append(jobs, kids...)
+		}
+	}
+
+	for _, j := range jobs {
+		action := Action(j.Status)
+		if action == "" {
+			if cli.Name == "" {
+				log.Printf("[batchit kill] %s is already %s", *j.JobId, j.Status)
+			}
+			continue
+		}
+		e := batchit.Event{Type: batchit.EventJobCancelled, JobId: *j.JobId, JobName: aws.ToString(j.JobName), Queue: cli.Queue, DryRun: cli.DryRun}
+		if action == "terminate" {
+			e.Type = batchit.EventJobTerminated
+		}
+		if cli.DryRun {
+			log.Printf("[batchit kill] would %s %s (%s) which is %s", action, *j.JobId, aws.ToString(j.JobName), j.Status)
+			batchit.Emit(e)
+			continue
+		}
+		if _, err := Kill(ctx, b, j, cli.Reason); err != nil {
+			log.Printf("[batchit kill] error with %s: %s", *j.JobId, err)
+			e.Error = err.Error()
+			batchit.Emit(e)
+			if failed++; first == nil {
+				first = err
+			}
+			continue
+		}
+		log.Printf("[batchit kill] %s %s (%s)", action, *j.JobId, aws.ToString(j.JobName))
+		batchit.Emit(e)
+		killed++
+	}
+	if failed > 0 {
+		err := fmt.Errorf("kill: %d jobs could not be found or killed", failed)
+		if killed > 0 {
+			return batchit.Exit(batchit.ExitPartial, err)
+		}
+		return batchit.Exit(batchit.ExitCode(first), err)
+	}
+	return nil
+}
@@ -0,0 +1,222 @@
+package lambda
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/base2genomics/batchit"
+	"github.com/base2genomics/batchit/pipeline"
+	"github.com/base2genomics/batchit/sqsconsume"
+	"github.com/base2genomics/batchit/submit"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// TemplateEnv is the environment variable with the path of the job template in the function package.
+const TemplateEnv = "BATCHIT_TEMPLATE"
+
+// Response lists the jobs submitted for an event.
+type Response struct {
+	JobIds []string `json:"job_ids"`
+	// Skipped is the number of jobs not submitted because their outputs exist.
+	Skipped int `json:"skipped,omitempty"`
+	// BatchItemFailures are the SQS messages for which no job was submitted. With
+	// ReportBatchItemFailures set on the event source mapping only these are received again.
+	BatchItemFailures []BatchItemFailure `json:"batchItemFailures"`
+}
+
+// BatchItemFailure is an SQS message in the partial batch response of Lambda.
+type BatchItemFailure struct {
+	ItemIdentifier string `json:"itemIdentifier"`
+}
+
+// event holds the fields of the events that are handled: S3 notifications and SQS messages
+// (which have Records) and S3 events from EventBridge (which have detail).
+type event struct {
+	Records []struct {
+		EventSource string `json:"eventSource"`
+		MessageId   string `json:"messageId"`
+		Body        string `json:"body"`
+		S3          struct {
+			Bucket struct {
+				Name string `json:"name"`
+			} `json:"bucket"`
+			Object struct {
+				Key string `json:"key"`
+			} `json:"object"`
+		} `json:"s3"`
+	} `json:"Records"`
+	Source string `json:"source"`
+	Detail struct {
+		Bucket struct {
+			Name string `json:"name"`
+		} `json:"bucket"`
+		Object struct {
+			Key string `json:"key"`
+		} `json:"object"`
+	} `json:"detail"`
+}
+
+// S3Fields returns the fields for an object: bucket, key, url (s3://bucket/key), basename and
+// stem (basename without any extensions, e.g. NA12878 for NA12878.R1.fq.gz).
+func S3Fields(bucket, key string) map[string]string {
+	base := path.Base(key)
+	stem := base
+	if i := strings.Index(stem, "."); i > 0 {
+		stem = stem[:i]
+	}
+	return map[string]string{"bucket": bucket, "key": key, "url": "s3://" + bucket + "/" + key, "basename": base, "stem": stem}
+}
+
+// item is the fields of a job to submit and the id of the SQS message they are from, if any. err
+// is set if the fields could not be read from the record.
+type item struct {
+	fields    map[string]string
+	messageId string
+	err       error
+}
+
+// Fields returns the fields of each job to submit for the event. An event that is not from S3 or SQS
+// must be a JSON object of strings as for batchit sqs-consume.
+func Fields(raw []byte) ([]map[string]string, error) {
+	items, err := items(raw)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]map[string]string, 0, len(items))
+	for _, it := range items {
+		if it.err != nil {
+			return nil, it.err
+		}
+		out = append(out, it.fields)
+	}
+	return out, nil
+}
+
+// items returns an item for each record of the event.
+func items(raw []byte) ([]item, error) {
+	var e event
+	if err := json.Unmarshal(raw, &e); err != nil {
+		return nil, err
+	}
+	var out []item
+	for _, r := range e.Records {
+		switch r.EventSource {
+		case "aws:s3":
+			// keys in notifications are URL encoded.
+			key, err := url.QueryUnescape(r.S3.Object.Key)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, item{fields: S3Fields(r.S3.Bucket.Name, key)})
+		case "aws:sqs":
+			it := item{messageId: r.MessageId}
+			if err := json.Unmarshal([]byte(r.Body), &it.fields); err != nil {
+				it.err = fmt.Errorf("lambda: SQS message %s must be a JSON object of strings: %s", r.MessageId, err)
+			}
+			out = append(out, it)
+		default:
+			return nil, fmt.Errorf("lambda: unsupported event source: %s", r.EventSource)
+		}
+	}
+	if len(e.Records) > 0 {
+		return out, nil
+	}
+	if e.Source == "aws.s3" {
+		return []item{{fields: S3Fields(e.Detail.Bucket.Name, e.Detail.Object.Key)}}, nil
+	}
+	var f map[string]string
+	if err := json.Unmarshal(raw, &f); err != nil {
+		return nil, fmt.Errorf("lambda: event must be from S3 or SQS or be a JSON object of strings: %s", err)
+	}
+	return []item{{fields: f}}, nil
+}
+
+// Handler submits a job from a template for each event.
+type Handler struct {
+	Template pipeline.Job
+	// Dir is the directory of the template which scripts are relative to.
+	Dir string
+	cfg aws.Config
+}
+
+// NewHandler reads the template from $BATCHIT_TEMPLATE. The region is from $AWS_REGION which is
+// set by Lambda.
+func NewHandler(ctx context.Context) (*Handler, error) {
+	tp := os.Getenv(TemplateEnv)
+	if tp == "" {
+		return nil, fmt.Errorf("lambda: $%s must be the path of a job template", TemplateEnv)
+	}
+	tmpl, err := pipeline.ReadJob(tp)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := batchit.LoadConfig(ctx, os.Getenv("AWS_REGION"))
+	if err != nil {
+		return nil, err
+	}
+	return &Handler{Template: *tmpl, Dir: filepath.Dir(tp), cfg: cfg}, nil
+}
+
+// Handle submits a job for each S3 object or message in the event. It goes on after an error so
+// that the jobs of the other records are not submitted again when the event is retried. SQS
+// messages that fail are listed in BatchItemFailures so that only those are received again. Any
+// other failure is returned as an error after every record has been tried so that Lambda retries
+// the event.
+func (h *Handler) Handle(ctx context.Context, raw json.RawMessage) (Response, error) {
+	resp := Response{BatchItemFailures: []BatchItemFailure{}}
+	items, err := items(raw)
+	if err != nil {
+		return resp, err
+	}
+	var failed int
+	// first is the first error of a record that is not an SQS message.
+	var first error
+	for _, it := range items {
+		err := it.err
+		if err == nil {
+			var id string
+			if id, err = h.submit(ctx, it.fields); err == submit.ErrOutputsExist {
+				resp.Skipped++
+				continue
+			}
+			if err == nil {
+				resp.JobIds = append(resp.JobIds, id)
+				continue
+			}
+		}
+		log.Printf("[batchit lambda] %s", err)
+		if it.messageId != "" {
+			resp.BatchItemFailures = append(resp.BatchItemFailures, BatchItemFailure{ItemIdentifier: it.messageId})
+			continue
+		}
+		if failed++; first == nil {
+			first = err
+		}
+	}
+	if failed > 0 {
+		return resp, fmt.Errorf("lambda: %d of %d jobs were not submitted. first error: %s", failed, len(items), first)
+	}
+	return resp, nil
+}
+
+// submit submits the job of the template filled with fields.
+func (h *Handler) submit(ctx context.Context, fields map[string]string) (string, error) {
+	j := sqsconsume.Fill(h.Template, fields)
+	id, err := submit.Submit(ctx, h.cfg, j.Options(h.Dir, h.cfg.Region))
+	if err == submit.ErrOutputsExist {
+		return "", err
+	}
+	if err != nil {
+		return "", fmt.Errorf("lambda: submitting %s: %s", j.Name, err)
+	}
+	log.Printf("[batchit lambda] submitted %s as %s", j.Name, id)
+	return id, nil
+}
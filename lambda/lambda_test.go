@@ -0,0 +1,100 @@
+package lambda
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestS3Fields(t *testing.T) {
+	for _, c := range []struct {
+		key            string
+		basename, stem string
+	}{
+		{"in/NA12878.R1.fq.gz", "NA12878.R1.fq.gz", "NA12878"},
+		{"NA12878.bam", "NA12878.bam", "NA12878"},
+		{"in/NA12878", "NA12878", "NA12878"},
+		// a leading dot is not an extension.
+		{"in/.hidden", ".hidden", ".hidden"},
+	} {
+		f := S3Fields("b", c.key)
+		want := map[string]string{"bucket": "b", "key": c.key, "url": "s3://b/" + c.key, "basename": c.basename, "stem": c.stem}
+		if !reflect.DeepEqual(f, want) {
+			t.Errorf("%s: expected %v. got %v", c.key, want, f)
+		}
+	}
+}
+
+func TestItems(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		event string
+		// keys are the key field of each item or, for SQS, the sample field.
+		keys []string
+		// messageIds are the SQS message ids of the items.
+		messageIds []string
+		// bad are the indexes of the items that could not be read.
+		bad []int
+		// ok is false if the event could not be read at all.
+		ok bool
+	}{
+		{name: "s3 notification", ok: true, keys: []string{"in/a b.bam", "in/c.bam"}, messageIds: []string{"", ""},
+			event: `{"Records":[{"eventSource":"aws:s3","s3":{"bucket":{"name":"b"},"object":{"key":"in/a+b.bam"}}},` +
+				`{"eventSource":"aws:s3","s3":{"bucket":{"name":"b"},"object":{"key":"in/c.bam"}}}]}`},
+		{name: "eventbridge", ok: true, keys: []string{"in/a b.bam"}, messageIds: []string{""},
+			event: `{"source":"aws.s3","detail":{"bucket":{"name":"b"},"object":{"key":"in/a b.bam"}}}`},
+		{name: "sqs", ok: true, keys: []string{"NA12878", "NA12891"}, messageIds: []string{"m1", "m2"},
+			event: `{"Records":[{"eventSource":"aws:sqs","messageId":"m1","body":"{\"sample\":\"NA12878\"}"},` +
+				`{"eventSource":"aws:sqs","messageId":"m2","body":"{\"sample\":\"NA12891\"}"}]}`},
+		{name: "sqs bad body", ok: true, keys: []string{"", "NA12891"}, messageIds: []string{"m1", "m2"}, bad: []int{0},
+			event: `{"Records":[{"eventSource":"aws:sqs","messageId":"m1","body":"not json"},` +
+				`{"eventSource":"aws:sqs","messageId":"m2","body":"{\"sample\":\"NA12891\"}"}]}`},
+		{name: "object", ok: true, keys: []string{"NA12878"}, messageIds: []string{""}, event: `{"sample":"NA12878"}`},
+		{name: "unsupported source", event: `{"Records":[{"eventSource":"aws:dynamodb"}]}`},
+		{name: "bad s3 key", event: `{"Records":[{"eventSource":"aws:s3","s3":{"bucket":{"name":"b"},"object":{"key":"in/%zz"}}}]}`},
+		{name: "not an object of strings", event: `{"sample":1}`},
+		{name: "not json", event: `sample`},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			its, err := items([]byte(c.event))
+			if !c.ok {
+				if err == nil {
+					t.Fatalf("expected an error. got %v", its)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var keys, messageIds []string
+			var bad []int
+			for i, it := range its {
+				key := it.fields["key"]
+				if it.messageId != "" || key == "" {
+					key = it.fields["sample"]
+				}
+				keys = append(keys, key)
+				messageIds = append(messageIds, it.messageId)
+				if it.err != nil {
+					bad = append(bad, i)
+				}
+			}
+			if !reflect.DeepEqual(keys, c.keys) {
+				t.Errorf("expected keys %v. got %v", c.keys, keys)
+			}
+			if !reflect.DeepEqual(messageIds, c.messageIds) {
+				t.Errorf("expected message ids %v. got %v", c.messageIds, messageIds)
+			}
+			if !reflect.DeepEqual(bad, c.bad) {
+				t.Errorf("expected bad items %v. got %v", c.bad, bad)
+			}
+			fields, err := Fields([]byte(c.event))
+			if c.bad != nil {
+				if err == nil {
+					t.Errorf("expected Fields to fail. got %v", fields)
+				}
+			} else if err != nil || len(fields) != len(its) {
+				t.Errorf("expected %d fields. got %v and %v", len(its), fields, err)
+			}
+		})
+	}
+}
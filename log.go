@@ -0,0 +1,101 @@
+package batchit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogFormatEnvVar is the environment variable with the log format to use if --log-format is not given.
+const LogFormatEnvVar = "BATCHIT_LOG_FORMAT"
+
+// LogFormat is text or json. It is set from the --log-format flag that every subcommand accepts,
+// $BATCHIT_LOG_FORMAT or the config. It is text if empty.
+var LogFormat string
+
+// SetLogFormat sets the output of the standard logger for format. With json, each line is written
+// as a LogRecord so that the logs of many jobs can be indexed.
+func SetLogFormat(format string) error {
+	switch format {
+	case "", "text":
+		return nil
+	case "json":
+		log.SetFlags(0)
+		log.SetPrefix("")
+		log.SetOutput(&jsonLog{w: os.Stderr})
+		return nil
+	}
+	return fmt.Errorf("batchit: --log-format must be text or json. got %s", format)
+}
+
+// LogRecord is a line logged with --log-format json.
+type LogRecord struct {
+	Time       time.Time `json:"time"`
+	Level      string    `json:"level"`
+	Subcommand string    `json:"subcommand"`
+	Message    string    `json:"message"`
+	JobId      string    `json:"job_id,omitempty"`
+	VolumeId   string    `json:"volume_id,omitempty"`
+}
+
+var (
+	logPrefix = regexp.MustCompile(`^\[batchit ([^\]]+)\] `)
+	jobId     = regexp.MustCompile(`\b[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}(:[0-9]+)?\b`)
+	volumeId  = regexp.MustCompile(`\bvol-[0-9a-f]{8,17}\b`)
+)
+
+// Level guesses the level of a log message as the standard logger does not have them.
+func Level(msg string) string {
+	m := strings.ToLower(msg)
+	// a retry is expected to succeed even if the message has the error.
+	for _, s := range []string{"warning", "skipping", "retrying"} {
+		if strings.Contains(m, s) {
+			return "warn"
+		}
+	}
+	for _, s := range []string{"error", "fail", "unable", "couldn't", "can't", "not found"} {
+		if strings.Contains(m, s) {
+			return "error"
+		}
+	}
+	return "info"
+}
+
+// NewLogRecord returns the record for a message from the standard logger. The subcommand is taken from
+// the [batchit <subcommand>] prefix if it has one and the first job and volume ids are added as fields.
+func NewLogRecord(msg string) LogRecord {
+	r := LogRecord{Time: time.Now().UTC(), Subcommand: Command, Message: strings.TrimRight(msg, "\n")}
+	if m := logPrefix.FindStringSubmatch(r.Message); m != nil {
+		r.Subcommand, r.Message = m[1], r.Message[len(m[0]):]
+	}
+	r.Level = Level(r.Message)
+	r.JobId = jobId.FindString(r.Message)
+	r.VolumeId = volumeId.FindString(r.Message)
+	return r
+}
+
+// jsonLog writes each message from the standard logger as a LogRecord. The logger calls Write
+// once for each message.
+type jsonLog struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (j *jsonLog) Write(p []byte) (int, error) {
+	data, err := json.Marshal(NewLogRecord(string(p)))
+	if err != nil {
+		return 0, err
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, err := j.w.Write(append(data, '\n')); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
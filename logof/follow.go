@@ -0,0 +1,200 @@
+package logof
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/base2genomics/batchit"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	batchtypes "github.com/aws/aws-sdk-go-v2/service/batch/types"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+)
+
+// maxStreams is the number of log streams accepted by a single FilterLogEvents call.
+const maxStreams = 100
+
+// overlap is how far back (ms) each poll looks to catch events that were ingested late.
+const overlap = 10000
+
+var palette = []string{"\x1b[31m", "\x1b[32m", "\x1b[33m", "\x1b[34m", "\x1b[35m", "\x1b[36m",
+	"\x1b[91m", "\x1b[92m", "\x1b[93m", "\x1b[94m", "\x1b[95m", "\x1b[96m"}
+
+// follower tracks a single job while its log is followed.
+type follower struct {
+	label   string
+	jobId   string
+	jobName string
+	color   string
+	status  batchtypes.JobStatus
+	stream  string
+	// origin is when the job started, for relative timestamps.
+	origin int64
+	// finished is set once the job has stopped and its log has been read after that.
+	finished bool
+	stopped  bool
+	// buf holds the log until the job finishes with --failuresonly. events does so with
+	// --output jsonl.
+	buf    bytes.Buffer
+	events []batchit.Event
+}
+
+func terminal(status batchtypes.JobStatus) bool {
+	return status == batchtypes.JobStatusSucceeded || status == batchtypes.JobStatusFailed
+}
+
+// follow polls the jobs in ts, printing new log events from all of them interleaved as they
+// arrive, until every job has finished. With --failuresonly, only the logs of jobs that
+// fail are printed, once they fail. A job that is in ts more than once, e.g. as it was given
+// twice, is followed once. With --output jsonl and no --out, each line is emitted as job.log and
+// each job as job.status once it has finished.
+func follow(ctx context.Context, b BatchAPI, cloud LogsAPI, ts []target, w io.Writer, cli *Args) error {
+	var fs []*follower
+	var ids []string
+	byStream := make(map[string]*follower)
+	byId := make(map[string]*follower, len(ts))
+	for _, t := range ts {
+		if byId[t.jobId] != nil {
+			continue
+		}
+		f := &follower{label: t.label, jobId: t.jobId, jobName: t.jobName, color: palette[len(fs)%len(palette)]}
+		fs = append(fs, f)
+		ids = append(ids, t.jobId)
+		byId[t.jobId] = f
+	}
+
+	var since int64
+	if start, _, err := cli.window(); err != nil {
+		return err
+	} else if start != nil {
+		since = *start
+	}
+	seen := make(map[string]int64)
+	jsonl := batchit.JSONL() && cli.Out == ""
+
+	for {
+		jobs, err := DescribeJobs(ctx, b, ids)
+		if err != nil {
+			return err
+		}
+		found := make(map[string]bool, len(jobs))
+		for _, j := range jobs {
+			found[*j.JobId] = true
+		}
+		for _, f := range fs {
+			if !found[f.jobId] && !f.finished {
+				log.Printf("[batchit] job %s not found", f.jobId)
+				f.finished = true
+			}
+		}
+		for _, j := range jobs {
+			f := byId[*j.JobId]
+			if f == nil || f.finished {
+				continue
+			}
+			// a job that stopped in the previous poll has now had its remaining events read.
+			if f.stopped {
+				f.finished = true
+				if cli.FailuresOnly && f.status == batchtypes.JobStatusFailed {
+					w.Write(f.buf.Bytes())
+					for _, e := range f.events {
+						batchit.Emit(e)
+					}
+				}
+				if jsonl {
+					emitStatus(j)
+				}
+				continue
+			}
+			f.status = j.Status
+			if f.stream == "" && j.Container != nil && j.Container.LogStreamName != nil {
+				f.stream = *j.Container.LogStreamName
+				f.origin = aws.ToInt64(j.StartedAt)
+				byStream[f.stream] = f
+			}
+			if terminal(f.status) {
+				f.stopped = true
+			}
+		}
+
+		var active []string
+		for _, f := range fs {
+			if f.stream != "" && !f.finished {
+				active = append(active, f.stream)
+			}
+		}
+		latest := since
+		for i := 0; i < len(active); i += maxStreams {
+			j := i + maxStreams
+			if j > len(active) {
+				j = len(active)
+			}
+			fli := &cloudwatchlogs.FilterLogEventsInput{
+				LogGroupName:   aws.String(LogGroup),
+				LogStreamNames: active[i:j],
+				StartTime:      aws.Int64(since),
+			}
+			if cli.Filter != "" {
+				fli.FilterPattern = aws.String(filterPattern(cli.Filter))
+			}
+			pages := cloudwatchlogs.NewFilterLogEventsPaginator(cloud, fli)
+			for pages.HasMorePages() {
+				page, err := pages.NextPage(ctx)
+				if err != nil {
+					return err
+				}
+				for _, ev := range page.Events {
+					if _, ok := seen[*ev.EventId]; ok {
+						continue
+					}
+					seen[*ev.EventId] = *ev.Timestamp
+					if *ev.Timestamp > latest {
+						latest = *ev.Timestamp
+					}
+					f := byStream[aws.ToString(ev.LogStreamName)]
+					if f == nil {
+						continue
+					}
+					if jsonl {
+						e := batchit.Event{Type: batchit.EventJobLog, Time: fromMillis(ev.Timestamp).UTC(), JobId: f.jobId,
+							JobName: f.jobName, Stream: f.stream, Message: aws.ToString(ev.Message)}
+						if cli.FailuresOnly {
+							f.events = append(f.events, e)
+						} else {
+							batchit.Emit(e)
+						}
+						continue
+					}
+					line := fmt.Sprintf("%s%s%s %s%s\n", f.color, f.label, colorReset,
+						(&eventWriter{cli: cli, origin: f.origin}).timestamp(*ev.Timestamp), *ev.Message)
+					if cli.FailuresOnly {
+						f.buf.WriteString(line)
+					} else {
+						io.WriteString(w, line)
+					}
+				}
+			}
+		}
+		if latest-overlap > since {
+			since = latest - overlap
+			for id, ts := range seen {
+				if ts < since {
+					delete(seen, id)
+				}
+			}
+		}
+
+		done := true
+		for _, f := range fs {
+			done = done && f.finished
+		}
+		if done {
+			return nil
+		}
+		time.Sleep(cli.Interval)
+	}
+}
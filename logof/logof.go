@@ -1,68 +1,876 @@
+// Package logof finds AWS Batch jobs and reads their CloudWatch logs as batchit logof does. Run
+// does what the command does for Args; DescribeJobs, JobsByName, Expand and WriteLog can be used
+// with any BatchAPI and LogsAPI.
 package logof
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"regexp"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/batch"
-	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/base2genomics/batchit"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/batch"
+	batchtypes "github.com/aws/aws-sdk-go-v2/service/batch/types"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
 )
 
-func LogOf(jobId string, region string) int {
-	input := batch.DescribeJobsInput{Jobs: []*string{aws.String(jobId)}}
-	cfg := aws.NewConfig().WithRegion(region)
-	sess := session.Must(session.NewSession(cfg))
-	b := batch.New(sess, cfg)
-	output, err := b.DescribeJobs(&input)
+// Args are the arguments to batchit logof. Start from DefaultArgs to use them with Run.
+type Args struct {
+	Region       string        `arg:"env:AWS_DEFAULT_REGION,help:region for batch setup. see batchit help for the default."`
+	Since        string        `help:"only show events newer than this duration before now, e.g. 30m, 6h or 2d."`
+	Start        string        `help:"only show events at or after this time (RFC3339, e.g. 2018-03-01T15:04:05Z)."`
+	End          string        `arg:"help:only show events before this time (RFC3339)."`
+	Filter       string        `arg:"help:only show events matching this CloudWatch filter pattern (applied server-side). 'A|B' is shorthand for events containing A or B."`
+	Output       string        `help:"output format. 'text' or 'json' (one object per line with timestamp, ingestion_time, stream and message)."`
+	Attempt      int           `arg:"help:show the log of this attempt (starting at 1) rather than the latest."`
+	AllAttempts  bool          `help:"show the log of every attempt, labeled with the attempt number."`
+	Timestamps   string        `help:"timestamp format for text output. 'ansic', 'iso' (RFC3339 in UTC), 'relative' (since the job started) or 'none' for raw messages."`
+	Color        bool          `arg:"help:highlight ERROR lines in red and WARN lines in yellow."`
+	Out          string        `arg:"help:write the log to this local path or s3://bucket/key rather than stdout."`
+	Gzip         bool          `arg:"help:gzip the output of --out. this is the default if --out ends with .gz"`
+	Backend      string        `arg:"help:how events are retrieved. 'get' pages through GetLogEvents. 'filter' uses FilterLogEvents which has higher throughput. 'parallel' splits the stream into time ranges fetched concurrently with FilterLogEvents."`
+	Shards       int           `arg:"help:number of time ranges fetched concurrently with --backend parallel."`
+	StatusOnly   bool          `help:"print only the final status, exit code, reason, instance type and runtime of each job rather than its log."`
+	Timeline     bool          `help:"print when each job was created and each attempt started and stopped, with the time spent waiting and running, rather than its log."`
+	Metrics      string        `help:"rather than the log, output values from lines like 'METRIC name=value ...' as 'csv', 'json' or send them to CloudWatch with 'cloudwatch'."`
+	MetricPrefix string        `arg:"help:marker that starts a line of metrics for --metrics."`
+	Namespace    string        `arg:"help:CloudWatch namespace for --metrics cloudwatch."`
+	Follow       bool          `arg:"-f,help:keep printing new log events until the job(s) finish. for an array job the children are interleaved with colored index prefixes."`
+	FailuresOnly bool          `help:"with --follow, only print the logs of jobs that fail, once they fail."`
+	Interval     time.Duration `arg:"help:how often to poll with --follow."`
+	SplitDir     string        `arg:"help:write each log to its own file in this directory rather than stdout. array children are written as $jobid.$index.log"`
+	Name         string        `arg:"help:find the most recent job with this name (requires --queue) rather than specifying job ids."`
+	History      int           `help:"with --name, show the last N jobs with that name, oldest first. combine with --statusonly to compare outcomes."`
+	Queue        string        `arg:"help:job queue to search with --name."`
+	JobIds       []string      `arg:"positional" help:"job id(s) to get the log of. for an array parent, the logs of all children are shown."`
+}
+
+func (c Args) Version() string {
+	return batchit.Version
+}
+
+func (c Args) Description() string {
+	return `Print the CloudWatch log of one or more batch jobs.
+When multiple job ids are given, logs are fetched concurrently and each line is prefixed with the job id.
+When the job is the parent of an array job, the log of each child is shown prefixed with its index,
+or written to a file per child with --splitdir.
+For very large logs, --backend parallel is much faster than the default.
+After the log, a summary of each job's status, exit code, reason, instance type and runtime is written
+to stderr. Use --metrics to extract values from lines like 'METRIC reads=1234 duplicates=0.02' as a
+table or to send them to CloudWatch. Use --statusonly to write only the summary (to stdout) or --timeline to show the time each
+attempt spent waiting in the queue and running.
+Use --follow to watch running jobs. For an array job, the logs of all children are interleaved as they
+arrive, each prefixed with its colored index.
+By default the latest attempt is shown; use --attempt or --allattempts for jobs that were retried.`
+}
+
+// LogGroup is where AWS batch sends container logs.
+const LogGroup = "/aws/batch/job"
+
+// maxDescribe is the maximum number of jobs accepted by a single DescribeJobs call.
+const maxDescribe = 100
+
+// maxFetch limits the number of logs fetched at once.
+const maxFetch = 8
+
+var regionRe = regexp.MustCompile(`^[a-z]{2}(-gov)?-[a-z]+-\d$`)
+
+// BatchAPI is the part of the Batch client that logof uses to find jobs and the compute
+// environments they ran in. *batch.Client implements it as do the in-memory fakes in
+// github.com/base2genomics/batchit/fake.
+type BatchAPI interface {
+	DescribeJobs(context.Context, *batch.DescribeJobsInput, ...func(*batch.Options)) (*batch.DescribeJobsOutput, error)
+	ListJobs(context.Context, *batch.ListJobsInput, ...func(*batch.Options)) (*batch.ListJobsOutput, error)
+	DescribeJobQueues(context.Context, *batch.DescribeJobQueuesInput, ...func(*batch.Options)) (*batch.DescribeJobQueuesOutput, error)
+	DescribeComputeEnvironments(context.Context, *batch.DescribeComputeEnvironmentsInput, ...func(*batch.Options)) (*batch.DescribeComputeEnvironmentsOutput, error)
+}
+
+// LogsAPI is the part of the CloudWatch Logs client that logof uses to read logs.
+type LogsAPI interface {
+	DescribeLogStreams(context.Context, *cloudwatchlogs.DescribeLogStreamsInput, ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.DescribeLogStreamsOutput, error)
+	GetLogEvents(context.Context, *cloudwatchlogs.GetLogEventsInput, ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.GetLogEventsOutput, error)
+	FilterLogEvents(context.Context, *cloudwatchlogs.FilterLogEventsInput, ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.FilterLogEventsOutput, error)
+}
+
+// DescribeJobs returns the details for each of ids, calling DescribeJobs in chunks of 100.
+func DescribeJobs(ctx context.Context, b BatchAPI, ids []string) ([]*batchtypes.JobDetail, error) {
+	var jobs []*batchtypes.JobDetail
+	for i := 0; i < len(ids); i += maxDescribe {
+		j := i + maxDescribe
+		if j > len(ids) {
+			j = len(ids)
+		}
+		output, err := b.DescribeJobs(ctx, &batch.DescribeJobsInput{Jobs: ids[i:j]})
+		if err != nil {
+			return nil, err
+		}
+		for k := range output.Jobs {
+			jobs = append(jobs, &output.Jobs[k])
+		}
+	}
+	return jobs, nil
+}
+
+// WriteLog writes each event in the log stream to w. If label is not empty, it is written
+// at the start of each line.
+func WriteLog(ctx context.Context, cloud LogsAPI, stream *string, label string, w io.Writer) error {
+	return writeLog(ctx, cloud, target{label: label, stream: stream}, w, &Args{Output: "text", Timestamps: "ansic", Backend: "get"})
+}
+
+// ParseDuration extends time.ParseDuration to accept a number of days, e.g. 2d.
+func ParseDuration(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		d, err := strconv.ParseFloat(s[:len(s)-1], 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration: %s", s)
+		}
+		return time.Duration(d * float64(24*time.Hour)), nil
+	}
+	return time.ParseDuration(s)
+}
+
+// millis converts t to milliseconds since the epoch as used by CloudWatch.
+func millis(t time.Time) *int64 {
+	return aws.Int64(t.UnixNano() / int64(time.Millisecond))
+}
+
+// window returns the start and end times (in ms) requested by --since, --start and --end.
+// nil values are unbounded.
+func (c *Args) window() (start, end *int64, err error) {
+	if c.Since != "" {
+		if c.Start != "" {
+			return nil, nil, fmt.Errorf("only one of --since and --start may be given")
+		}
+		d, err := ParseDuration(c.Since)
+		if err != nil {
+			return nil, nil, err
+		}
+		start = millis(time.Now().Add(-d))
+	}
+	if c.Start != "" {
+		t, err := time.Parse(time.RFC3339, c.Start)
+		if err != nil {
+			return nil, nil, err
+		}
+		start = millis(t)
+	}
+	if c.End != "" {
+		t, err := time.Parse(time.RFC3339, c.End)
+		if err != nil {
+			return nil, nil, err
+		}
+		end = millis(t)
+	}
+	return start, end, nil
+}
+
+// filterPattern converts the 'A|B' shorthand to CloudWatch's '?"A" ?"B"' syntax.
+// Other patterns are passed through unchanged.
+func filterPattern(f string) string {
+	if !strings.Contains(f, "|") || strings.ContainsAny(f, `"?{}[]%`) {
+		return f
+	}
+	terms := strings.Split(f, "|")
+	for i, t := range terms {
+		terms[i] = `?"` + strings.TrimSpace(t) + `"`
+	}
+	return strings.Join(terms, " ")
+}
+
+// streamSpan returns the first and last times (in ms) of events in stream. The last
+// ingestion time is used if it is later as the last event time is updated lazily.
+func streamSpan(ctx context.Context, cloud LogsAPI, stream *string) (first, last int64, err error) {
+	ds, err := cloud.DescribeLogStreams(ctx, &cloudwatchlogs.DescribeLogStreamsInput{
+		LogGroupName:        aws.String(LogGroup),
+		LogStreamNamePrefix: stream,
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, ls := range ds.LogStreams {
+		if aws.ToString(ls.LogStreamName) != *stream {
+			continue
+		}
+		first, last = aws.ToInt64(ls.FirstEventTimestamp), aws.ToInt64(ls.LastEventTimestamp)
+		if li := aws.ToInt64(ls.LastIngestionTime); li > last {
+			last = li
+		}
+		return first, last, nil
+	}
+	return 0, 0, fmt.Errorf("log stream %s not found", *stream)
+}
+
+// writeParallel splits the stream into --shards time ranges which are fetched concurrently
+// and then written in order.
+func writeParallel(ctx context.Context, cloud LogsAPI, stream *string, ew *eventWriter, start, end *int64) error {
+	lo, hi, err := streamSpan(ctx, cloud, stream)
 	if err != nil {
-		log.Printf("[batchit] error finding jobs: %s in %s", jobId, region)
-		log.Println(err)
-		os.Exit(1)
+		return err
 	}
-	if len(output.Jobs) == 0 {
-		return 0
+	if start != nil && *start > lo {
+		lo = *start
 	}
-	sort.Slice(output.Jobs, func(i, j int) bool { return *output.Jobs[i].StartedAt < *output.Jobs[j].StartedAt })
-	j := output.Jobs[len(output.Jobs)-1]
-	stream := j.Container.LogStreamName
-	if stream == nil {
-		log.Fatalf("job %s not found. has it started?", jobId)
+	if end != nil && *end < hi {
+		hi = *end
 	}
+	if hi < lo {
+		return nil
+	}
+	n := int64(ew.cli.Shards)
+	if n < 1 {
+		n = 1
+	}
+	step := (hi - lo + n) / n
+	bufs := make([]bytes.Buffer, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := int64(0); i < n; i++ {
+		s := lo + i*step
+		if s > hi {
+			break
+		}
+		e := s + step - 1
+		if e > hi {
+			e = hi
+		}
+		wg.Add(1)
+		go func(i, s, e int64) {
+			defer wg.Done()
+			// FilterLogEvents includes events at both the start and end time.
+			sub := *ew
+			sub.w = &bufs[i]
+			errs[i] = writeFiltered(ctx, cloud, stream, &sub, aws.Int64(s), aws.Int64(e))
+		}(i, s, e)
+	}
+	wg.Wait()
+	for i := range bufs {
+		if errs[i] != nil {
+			return errs[i]
+		}
+		if _, err := ew.w.Write(bufs[i].Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Event is a log event as written by --output json.
+type Event struct {
+	Job           string    `json:"job,omitempty"`
+	Timestamp     time.Time `json:"timestamp"`
+	IngestionTime time.Time `json:"ingestion_time"`
+	Stream        string    `json:"stream"`
+	Message       string    `json:"message"`
+}
+
+func fromMillis(ms *int64) time.Time {
+	v := aws.ToInt64(ms)
+	return time.Unix(v/1000, (v%1000)*int64(time.Millisecond))
+}
+
+// eventWriter formats events from a single log stream.
+type eventWriter struct {
+	w     io.Writer
+	label string
+	cli   *Args
+	// origin is the job start time (ms) that relative timestamps are measured from.
+	origin int64
+
+	jobId   string
+	jobName string
+	metrics *metricSet
+}
+
+const (
+	colorRed    = "\x1b[31m"
+	colorYellow = "\x1b[33m"
+	colorReset  = "\x1b[0m"
+)
+
+// colorize highlights lines that look like errors or warnings.
+func colorize(line string) string {
+	u := strings.ToUpper(line)
+	switch {
+	case strings.Contains(u, "ERROR") || strings.Contains(u, "TRACEBACK") || strings.Contains(u, "FATAL"):
+		return colorRed + line + colorReset
+	case strings.Contains(u, "WARN"):
+		return colorYellow + line + colorReset
+	}
+	return line
+}
+
+func (ew *eventWriter) timestamp(ms int64) string {
+	switch ew.cli.Timestamps {
+	case "none":
+		return ""
+	case "iso":
+		return "[" + fromMillis(&ms).UTC().Format(time.RFC3339) + "] "
+	case "relative":
+		d := time.Duration(ms-ew.origin) * time.Millisecond
+		return "[+" + d.String() + "] "
+	}
+	return "[" + time.Unix(ms/1000, 0).Format(time.ANSIC) + "] "
+}
+
+func (ew *eventWriter) write(stream *string, timestamp, ingestion *int64, message *string) error {
+	if ew.metrics != nil {
+		ew.metrics.parse(ew.jobId, ew.jobName, *timestamp, *message)
+		return nil
+	}
+	if batchit.JSONL() && ew.cli.Out == "" && ew.cli.SplitDir == "" {
+		batchit.Emit(batchit.Event{Type: batchit.EventJobLog, Time: fromMillis(timestamp).UTC(), JobId: ew.jobId,
+			JobName: ew.jobName, Stream: aws.ToString(stream), Message: aws.ToString(message)})
+		return nil
+	}
+	if ew.cli.Output == "json" {
+		b, err := json.Marshal(Event{Job: ew.label, Timestamp: fromMillis(timestamp), IngestionTime: fromMillis(ingestion),
+			Stream: aws.ToString(stream), Message: aws.ToString(message)})
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(ew.w, string(b))
+		return err
+	}
+	prefix := ""
+	if ew.label != "" {
+		prefix = ew.label + " "
+	}
+	line := *message
+	if ew.cli.Color {
+		line = colorize(line)
+	}
+	_, err := fmt.Fprintln(ew.w, prefix+ew.timestamp(*timestamp)+line)
+	return err
+}
 
+func writeLog(ctx context.Context, cloud LogsAPI, t target, w io.Writer, cli *Args) error {
+	start, end, err := cli.window()
+	if err != nil {
+		return err
+	}
+	stream := t.stream
+	ew := &eventWriter{w: w, label: t.label, cli: cli, origin: t.startedAt, jobId: t.jobId, jobName: t.jobName, metrics: t.metrics}
+	switch {
+	case cli.Backend == "parallel":
+		return writeParallel(ctx, cloud, stream, ew, start, end)
+	case cli.Backend == "filter" || cli.Filter != "":
+		return writeFiltered(ctx, cloud, stream, ew, start, end)
+	}
 	gli := &cloudwatchlogs.GetLogEventsInput{
-		LogGroupName:  aws.String("/aws/batch/job"),
+		LogGroupName:  aws.String(LogGroup),
 		LogStreamName: stream,
 		StartFromHead: aws.Bool(true),
+		StartTime:     start,
+		EndTime:       end,
 	}
 
-	cloud := cloudwatchlogs.New(sess, cfg)
-
 	for {
-		ev, err := cloud.GetLogEvents(gli)
+		ev, err := cloud.GetLogEvents(ctx, gli)
 		if err != nil {
-			panic(err)
+			return err
 		}
 		for _, event := range ev.Events {
-			t := time.Unix(*event.Timestamp/1000, 0)
-			fmt.Println("[" + t.Format(time.ANSIC) + "] " + *event.Message)
+			if err := ew.write(stream, event.Timestamp, event.IngestionTime, event.Message); err != nil {
+				return err
+			}
 		}
 		if ev.NextForwardToken == nil || (gli.NextToken != nil && *ev.NextForwardToken == *gli.NextToken) {
 			break
 		}
 		gli.NextToken = ev.NextForwardToken
 	}
-	return 0
+	return nil
+}
+
+// writeFiltered uses FilterLogEvents so that only matching events are sent by CloudWatch.
+func writeFiltered(ctx context.Context, cloud LogsAPI, stream *string, ew *eventWriter, start, end *int64) error {
+	fli := &cloudwatchlogs.FilterLogEventsInput{
+		LogGroupName:   aws.String(LogGroup),
+		LogStreamNames: []string{*stream},
+		StartTime:      start,
+		EndTime:        end,
+	}
+	if ew.cli.Filter != "" {
+		fli.FilterPattern = aws.String(filterPattern(ew.cli.Filter))
+	}
+	for {
+		ev, err := cloud.FilterLogEvents(ctx, fli)
+		if err != nil {
+			return err
+		}
+		for _, event := range ev.Events {
+			if err := ew.write(event.LogStreamName, event.Timestamp, event.IngestionTime, event.Message); err != nil {
+				return err
+			}
+		}
+		if ev.NextToken == nil {
+			break
+		}
+		fli.NextToken = ev.NextToken
+	}
+	return nil
+}
+
+// JobsByName returns the ids of up to n jobs with the given name in queue, most recent first.
+func JobsByName(ctx context.Context, b BatchAPI, queue, name string, n int) ([]string, error) {
+	lji := &batch.ListJobsInput{
+		JobQueue: aws.String(queue),
+		Filters:  []batchtypes.KeyValuesPair{{Name: aws.String("JOB_NAME"), Values: []string{name}}},
+	}
+	var jobs []batchtypes.JobSummary
+	pages := batch.NewListJobsPaginator(b, lji)
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, page.JobSummaryList...)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return aws.ToInt64(jobs[i].CreatedAt) > aws.ToInt64(jobs[j].CreatedAt) })
+	if len(jobs) > n {
+		jobs = jobs[:n]
+	}
+	ids := make([]string, len(jobs))
+	for i, j := range jobs {
+		ids[i] = *j.JobId
+	}
+	return ids, nil
+}
+
+// target is a single log stream to fetch.
+type target struct {
+	label   string
+	jobId   string
+	stream  *string
+	jobName string
+	// startedAt is the start time (ms) of the job or attempt.
+	startedAt int64
+	// metrics collects values from the log rather than writing it when --metrics is used.
+	metrics *metricSet
+	err     error
+}
+
+// IsArrayParent is true for the parent of an array job which has no log stream of its own.
+func IsArrayParent(j *batchtypes.JobDetail) bool {
+	return j.ArrayProperties != nil && j.ArrayProperties.Size != nil && j.ArrayProperties.Index == nil
+}
+
+// Children returns the job details of each child of an array job.
+func Children(ctx context.Context, b BatchAPI, parent *batchtypes.JobDetail) ([]*batchtypes.JobDetail, error) {
+	ids := make([]string, *parent.ArrayProperties.Size)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("%s:%d", *parent.JobId, i)
+	}
+	kids, err := DescribeJobs(ctx, b, ids)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(kids, func(i, j int) bool {
+		return aws.ToInt32(kids[i].ArrayProperties.Index) < aws.ToInt32(kids[j].ArrayProperties.Index)
+	})
+	return kids, nil
 }
 
-func Main() {
-	if len(os.Args) < 3 {
-		fmt.Println("usage: batchit logof JobId region")
-		os.Exit(1)
+// Expand replaces each array parent in jobs by its children.
+func Expand(ctx context.Context, b BatchAPI, jobs []*batchtypes.JobDetail) ([]*batchtypes.JobDetail, error) {
+	var out []*batchtypes.JobDetail
+	for _, j := range jobs {
+		if !IsArrayParent(j) {
+			out = append(out, j)
+			continue
+		}
+		kids, err := Children(ctx, b, j)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, kids...)
+	}
+	return out, nil
+}
+
+// jobTargets returns the log stream(s) of j selected by --attempt and --all-attempts.
+// The latest attempt is used by default.
+func jobTargets(label string, j *batchtypes.JobDetail, cli *Args) []target {
+	if cli.Attempt == 0 && !cli.AllAttempts {
+		if j.Container == nil || j.Container.LogStreamName == nil {
+			return []target{{label: label, jobId: *j.JobId, err: fmt.Errorf("job %s not found. has it started?", *j.JobId)}}
+		}
+		return []target{{label: label, jobId: *j.JobId, jobName: aws.ToString(j.JobName), stream: j.Container.LogStreamName, startedAt: aws.ToInt64(j.StartedAt)}}
+	}
+	if cli.Attempt > len(j.Attempts) {
+		return []target{{label: label, jobId: *j.JobId, err: fmt.Errorf("job %s has %d attempts. attempt %d not found", *j.JobId, len(j.Attempts), cli.Attempt)}}
+	}
+	var ts []target
+	for i, a := range j.Attempts {
+		if cli.Attempt != 0 && i+1 != cli.Attempt {
+			continue
+		}
+		t := target{label: label, jobId: *j.JobId, jobName: aws.ToString(j.JobName), startedAt: aws.ToInt64(a.StartedAt)}
+		if cli.AllAttempts {
+			t.label = fmt.Sprintf("%s#%d", label, i+1)
+		}
+		if a.Container == nil || a.Container.LogStreamName == nil {
+			t.err = fmt.Errorf("no log stream found for job %s attempt %d", *j.JobId, i+1)
+		}
+		if a.Container != nil {
+			t.stream = a.Container.LogStreamName
+		}
+		ts = append(ts, t)
+	}
+	return ts
+}
+
+// targets resolves jobIds to the log streams to fetch. Array parents are expanded to
+// one target per child.
+// The details of each of the jobs that were found are also returned.
+func targets(ctx context.Context, b BatchAPI, cli *Args) ([]target, []*batchtypes.JobDetail, error) {
+	jobIds := cli.JobIds
+	jobs, err := DescribeJobs(ctx, b, jobIds)
+	if err != nil {
+		return nil, nil, err
+	}
+	byId := make(map[string]*batchtypes.JobDetail, len(jobs))
+	for _, j := range jobs {
+		byId[*j.JobId] = j
+	}
+	var ts []target
+	for _, id := range jobIds {
+		j, ok := byId[id]
+		if !ok {
+			ts = append(ts, target{label: id, jobId: id, err: fmt.Errorf("job %s not found in %s", id, cli.Region)})
+			continue
+		}
+		if !IsArrayParent(j) {
+			ts = append(ts, jobTargets(id, j, cli)...)
+			continue
+		}
+		kids, err := Children(ctx, b, j)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, k := range kids {
+			label := strconv.Itoa(int(*k.ArrayProperties.Index))
+			if len(jobIds) > 1 {
+				label = *k.JobId
+			}
+			ts = append(ts, jobTargets(label, k, cli)...)
+		}
+	}
+	return ts, jobs, nil
+}
+
+// Run writes the logs, or with StatusOnly, Timeline or Metrics what they ask for, of the jobs
+// in cli to stdout or cli.Out. A summary of each job is written to stderr. cli is validated first.
+func Run(ctx context.Context, cli *Args) error {
+	if err := cli.Validate(); err != nil {
+		return batchit.Exit(batchit.ExitUsage, err)
+	}
+	cfg, err := batchit.LoadConfig(ctx, cli.Region)
+	if err != nil {
+		return err
+	}
+	cli.Region = cfg.Region
+	b := batch.NewFromConfig(cfg)
+	if cli.Name != "" {
+		n := 1
+		if cli.History > 0 {
+			n = cli.History
+		}
+		ids, err := JobsByName(ctx, b, cli.Queue, cli.Name, n)
+		if err != nil {
+			return fmt.Errorf("logof: error listing jobs named %s in %s: %w", cli.Name, cli.Queue, err)
+		}
+		if len(ids) == 0 {
+			return batchit.Exit(batchit.ExitNotFound, fmt.Errorf("logof: no jobs named %s found in %s", cli.Name, cli.Queue))
+		}
+		// show the jobs chronologically.
+		for i := len(ids) - 1; i >= 0; i-- {
+			cli.JobIds = append(cli.JobIds, ids[i])
+		}
+	}
+	ts, jobs, err := targets(ctx, b, cli)
+	if err != nil {
+		return fmt.Errorf("logof: error finding jobs: %s in %s: %w", cli.JobIds, cli.Region, err)
+	}
+	if cli.StatusOnly || cli.Timeline {
+		out, closeOut, err := openOut(ctx, cfg, cli)
+		if err != nil {
+			return err
+		}
+		for _, j := range jobs {
+			if batchit.JSONL() {
+				emitStatus(j)
+				continue
+			}
+			if cli.Timeline {
+				WriteTimeline(out, j)
+			} else {
+				WriteSummary(ctx, out, cfg, b, j)
+			}
+		}
+		if err := closeOut(); err != nil {
+			return err
+		}
+		if len(jobs) != len(cli.JobIds) {
+			code := batchit.ExitPartial
+			if len(jobs) == 0 {
+				code = batchit.ExitNotFound
+			}
+			return batchit.Exit(code, fmt.Errorf("logof: only found %d of %d jobs", len(jobs), len(cli.JobIds)))
+		}
+		return nil
+	}
+	if cli.SplitDir != "" {
+		if err := os.MkdirAll(cli.SplitDir, 0777); err != nil {
+			return err
+		}
+	}
+
+	out, closeOut, err := openOut(ctx, cfg, cli)
+	if err != nil {
+		return err
+	}
+
+	if cli.Follow {
+		err := follow(ctx, b, cloudwatchlogs.NewFromConfig(cfg), ts, out, cli)
+		if cerr := closeOut(); err == nil {
+			err = cerr
+		}
+		return err
+	}
+
+	var ms *metricSet
+	if cli.Metrics != "" {
+		ms = &metricSet{prefix: cli.MetricPrefix}
+		for i := range ts {
+			ts[i].metrics = ms
+		}
+	}
+
+	cloud := cloudwatchlogs.NewFromConfig(cfg)
+	bufs := make([]bytes.Buffer, len(ts))
+	errs := make([]error, len(ts))
+	sem := make(chan struct{}, maxFetch)
+	var wg sync.WaitGroup
+	for i, t := range ts {
+		if t.err != nil {
+			errs[i] = t.err
+			continue
+		}
+		wg.Add(1)
+		go func(i int, t target) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			if cli.SplitDir != "" {
+				errs[i] = writeFile(ctx, cloud, t, cli)
+				return
+			}
+			// a single log is streamed directly; otherwise buffer so jobs aren't interleaved.
+			if len(ts) == 1 {
+				t.label = ""
+				errs[i] = writeLog(ctx, cloud, t, out, cli)
+				return
+			}
+			errs[i] = writeLog(ctx, cloud, t, &bufs[i], cli)
+		}(i, t)
+	}
+	wg.Wait()
+
+	// first is the first error which sets the exit code when no log could be written.
+	var first error
+	failed := 0
+	for i := range ts {
+		out.Write(bufs[i].Bytes())
+		if errs[i] != nil {
+			log.Println(errs[i])
+			if first == nil {
+				first = errs[i]
+			}
+			failed++
+		}
+	}
+	// the output is still closed and the summaries written if some logs failed.
+	if ms != nil {
+		if err = ms.write(ctx, out, cfg, cli); err != nil {
+			log.Println(err)
+		}
+	}
+	if cerr := closeOut(); err == nil {
+		err = cerr
+	}
+	for _, j := range jobs {
+		WriteSummary(ctx, os.Stderr, cfg, b, j)
+		emitStatus(j)
+	}
+	switch {
+	case failed == len(ts) && failed > 0:
+		return batchit.Exit(batchit.ExitCode(first), fmt.Errorf("logof: none of the %d logs were written", failed))
+	case failed > 0:
+		return batchit.Exit(batchit.ExitPartial, fmt.Errorf("logof: %d of %d logs were not written", failed, len(ts)))
+	}
+	return err
+}
+
+// openOut returns the writer for --out (stdout by default) and a function that must be
+// called to flush and close it.
+func openOut(ctx context.Context, cfg aws.Config, cli *Args) (io.Writer, func() error, error) {
+	if cli.Out == "" {
+		return os.Stdout, func() error { return nil }, nil
+	}
+	var w io.WriteCloser
+	var wait func() error
+	if strings.HasPrefix(cli.Out, "s3://") {
+		bk := strings.SplitN(cli.Out[5:], "/", 2)
+		if len(bk) != 2 {
+			return nil, nil, fmt.Errorf("expected --out of the form s3://bucket/key, got %s", cli.Out)
+		}
+		pr, pw := io.Pipe()
+		done := make(chan error, 1)
+		go func() {
+			_, err := manager.NewUploader(s3.NewFromConfig(cfg)).Upload(ctx, &s3.PutObjectInput{
+				Bucket: aws.String(bk[0]),
+				Key:    aws.String(bk[1]),
+				Body:   pr,
+			})
+			pr.CloseWithError(err)
+			done <- err
+		}()
+		w, wait = pw, func() error { return <-done }
+	} else {
+		f, err := os.Create(cli.Out)
+		if err != nil {
+			return nil, nil, err
+		}
+		w, wait = f, func() error { return nil }
+	}
+	if !cli.Gzip && !strings.HasSuffix(cli.Out, ".gz") {
+		return w, func() error {
+			if err := w.Close(); err != nil {
+				return err
+			}
+			return wait()
+		}, nil
+	}
+	z := gzip.NewWriter(w)
+	return z, func() error {
+		if err := z.Close(); err != nil {
+			w.Close()
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		return wait()
+	}, nil
+}
+
+// writeFile writes the log for t to a file in --splitdir named for its job id.
+func writeFile(ctx context.Context, cloud LogsAPI, t target, cli *Args) error {
+	name := strings.Replace(t.jobId, ":", ".", -1)
+	if i := strings.LastIndex(t.label, "#"); i != -1 {
+		name += ".attempt" + t.label[i+1:]
+	}
+	f, err := os.Create(filepath.Join(cli.SplitDir, name+".log"))
+	if err != nil {
+		return err
+	}
+	t.label = ""
+	if err := writeLog(ctx, cloud, t, f, cli); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// LogOf prints the log of a single job.
+func LogOf(ctx context.Context, jobId string, region string) error {
+	cli := DefaultArgs
+	cli.Region, cli.JobIds = region, []string{jobId}
+	return Run(ctx, &cli)
+}
+
+// DefaultArgs are used by the logof command unless overridden.
+var DefaultArgs = Args{Output: "text", Timestamps: "ansic", Backend: "get", Shards: 8,
+	MetricPrefix: "METRIC", Namespace: "batchit", Interval: 5 * time.Second}
+
+// Validate returns an error if the arguments can not be used together.
+func (cli *Args) Validate() error {
+	if _, _, err := cli.window(); err != nil {
+		return err
+	}
+	if cli.Name == "" && len(cli.JobIds) == 0 {
+		return errors.New("specify job id(s) or --name")
+	}
+	if cli.History != 0 && cli.Name == "" {
+		return errors.New("--history requires --name")
+	}
+	if cli.Name != "" && cli.Queue == "" {
+		return errors.New("--name requires --queue")
+	}
+	if cli.Attempt < 0 {
+		return errors.New("--attempt must be >= 1")
+	}
+	if cli.Output != "text" && cli.Output != "json" {
+		return errors.New("--output must be 'text' or 'json'")
+	}
+	if cli.Timestamps != "ansic" && cli.Timestamps != "iso" && cli.Timestamps != "relative" && cli.Timestamps != "none" {
+		return errors.New("--timestamps must be one of 'ansic', 'iso', 'relative' or 'none'")
+	}
+	if cli.Backend != "get" && cli.Backend != "filter" && cli.Backend != "parallel" {
+		return errors.New("--backend must be one of 'get', 'filter' or 'parallel'")
+	}
+	if cli.Metrics != "" && cli.Metrics != "csv" && cli.Metrics != "json" && cli.Metrics != "cloudwatch" {
+		return errors.New("--metrics must be one of 'csv', 'json' or 'cloudwatch'")
+	}
+	if cli.Metrics != "" && cli.SplitDir != "" {
+		return errors.New("--metrics can not be used with --splitdir")
+	}
+	if cli.Follow && (cli.SplitDir != "" || cli.Metrics != "" || cli.Output == "json") {
+		return errors.New("--follow can not be used with --splitdir, --metrics or --output json")
+	}
+	// a job is followed by its latest attempt.
+	if cli.Follow && (cli.AllAttempts || cli.Attempt != 0) {
+		return errors.New("--follow can not be used with --attempt or --allattempts")
+	}
+	if cli.FailuresOnly && !cli.Follow {
+		return errors.New("--failuresonly requires --follow")
+	}
+	if cli.Out != "" && cli.SplitDir != "" {
+		return errors.New("only one of --out and --splitdir may be given")
+	}
+	if batchit.JSONL() && (cli.Metrics != "" || cli.Timeline) {
+		return errors.New("--output jsonl can not be used with --metrics or --timeline")
+	}
+	return nil
+}
+
+func Main() error {
+	cli := DefaultArgs
+	p := batchit.MustParse(&cli)
+	// support the original `logof JobId region` usage.
+	if n := len(cli.JobIds); n > 1 && regionRe.MatchString(cli.JobIds[n-1]) {
+		cli.Region, cli.JobIds = cli.JobIds[n-1], cli.JobIds[:n-1]
+	}
+	if err := cli.Validate(); err != nil {
+		p.Fail(err.Error())
 	}
-	os.Exit(LogOf(os.Args[1], os.Args[2]))
+	return Run(batchit.Context(), &cli)
 }
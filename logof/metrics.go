@@ -0,0 +1,129 @@
+package logof
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	cloudwatchtypes "github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+)
+
+// Metric is a value parsed from a log line like "METRIC reads=1234 duplicates=0.02".
+type Metric struct {
+	Job       string    `json:"job"`
+	JobName   string    `json:"job_name"`
+	Timestamp time.Time `json:"timestamp"`
+	Name      string    `json:"name"`
+	Value     float64   `json:"value"`
+}
+
+// metricSet collects metrics from concurrently fetched logs.
+type metricSet struct {
+	prefix  string
+	mu      sync.Mutex
+	metrics []Metric
+}
+
+// parse adds any name=value pairs following the prefix in message. Values that are
+// not numbers are ignored.
+func (ms *metricSet) parse(job, jobName string, timestamp int64, message string) {
+	i := strings.Index(message, ms.prefix+" ")
+	if i == -1 {
+		return
+	}
+	var found []Metric
+	for _, kv := range strings.Fields(message[i+len(ms.prefix)+1:]) {
+		pair := strings.SplitN(kv, "=", 2)
+		if len(pair) != 2 {
+			continue
+		}
+		v, err := strconv.ParseFloat(pair[1], 64)
+		if err != nil {
+			continue
+		}
+		found = append(found, Metric{Job: job, JobName: jobName, Timestamp: fromMillis(&timestamp), Name: pair[0], Value: v})
+	}
+	ms.mu.Lock()
+	ms.metrics = append(ms.metrics, found...)
+	ms.mu.Unlock()
+}
+
+func (ms *metricSet) sorted() []Metric {
+	sort.SliceStable(ms.metrics, func(i, j int) bool {
+		if ms.metrics[i].Job != ms.metrics[j].Job {
+			return ms.metrics[i].Job < ms.metrics[j].Job
+		}
+		return ms.metrics[i].Timestamp.Before(ms.metrics[j].Timestamp)
+	})
+	return ms.metrics
+}
+
+func (ms *metricSet) writeCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"job", "job_name", "timestamp", "name", "value"})
+	for _, m := range ms.sorted() {
+		cw.Write([]string{m.Job, m.JobName, m.Timestamp.UTC().Format(time.RFC3339), m.Name, strconv.FormatFloat(m.Value, 'g', -1, 64)})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func (ms *metricSet) writeJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(ms.sorted())
+}
+
+// maxMetricData is the number of values sent in each PutMetricData call.
+const maxMetricData = 20
+
+// put sends the metrics to CloudWatch under namespace with the job name as a dimension.
+func (ms *metricSet) put(ctx context.Context, cfg aws.Config, namespace string) error {
+	cw := cloudwatch.NewFromConfig(cfg)
+	metrics := ms.sorted()
+	for i := 0; i < len(metrics); i += maxMetricData {
+		j := i + maxMetricData
+		if j > len(metrics) {
+			j = len(metrics)
+		}
+		var data []cloudwatchtypes.MetricDatum
+		for _, m := range metrics[i:j] {
+			data = append(data, cloudwatchtypes.MetricDatum{
+				MetricName: aws.String(m.Name),
+				Value:      aws.Float64(m.Value),
+				Timestamp:  aws.Time(m.Timestamp),
+				Dimensions: []cloudwatchtypes.Dimension{{Name: aws.String("JobName"), Value: aws.String(m.JobName)}},
+			})
+		}
+		if _, err := cw.PutMetricData(ctx, &cloudwatch.PutMetricDataInput{Namespace: aws.String(namespace), MetricData: data}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// write outputs the metrics in the format requested by --metrics.
+func (ms *metricSet) write(ctx context.Context, w io.Writer, cfg aws.Config, cli *Args) error {
+	switch cli.Metrics {
+	case "csv":
+		return ms.writeCSV(w)
+	case "json":
+		return ms.writeJSON(w)
+	case "cloudwatch":
+		if err := ms.put(ctx, cfg, cli.Namespace); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "sent %d metrics to CloudWatch namespace %s\n", len(ms.metrics), cli.Namespace)
+		return nil
+	}
+	return fmt.Errorf("unknown metrics format: %s", cli.Metrics)
+}
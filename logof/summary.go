@@ -0,0 +1,162 @@
+package logof
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/base2genomics/batchit"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/batch"
+	batchtypes "github.com/aws/aws-sdk-go-v2/service/batch/types"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+)
+
+// InstanceType returns the EC2 instance type that ran the job. It returns an empty string if
+// that can not be determined, e.g. if the instance has since been terminated.
+func InstanceType(ctx context.Context, cfg aws.Config, b BatchAPI, j *batchtypes.JobDetail) string {
+	iid := InstanceId(ctx, cfg, b, j)
+	if iid == "" {
+		return ""
+	}
+	do, err := ec2.NewFromConfig(cfg).DescribeInstances(ctx, &ec2.DescribeInstancesInput{InstanceIds: []string{iid}})
+	if err != nil || len(do.Reservations) == 0 || len(do.Reservations[0].Instances) == 0 {
+		return ""
+	}
+	return string(do.Reservations[0].Instances[0].InstanceType)
+}
+
+// InstanceId returns the id of the EC2 instance that ran the job. It returns an empty string if
+// that can not be determined, e.g. if the container instance has since been deregistered.
+func InstanceId(ctx context.Context, cfg aws.Config, b BatchAPI, j *batchtypes.JobDetail) string {
+	if j.Container == nil || j.Container.ContainerInstanceArn == nil || j.JobQueue == nil {
+		return ""
+	}
+	qo, err := b.DescribeJobQueues(batchit.Mapping(ctx), &batch.DescribeJobQueuesInput{JobQueues: []string{*j.JobQueue}})
+	if err != nil || len(qo.JobQueues) == 0 {
+		return ""
+	}
+	var ces []string
+	for _, o := range qo.JobQueues[0].ComputeEnvironmentOrder {
+		ces = append(ces, aws.ToString(o.ComputeEnvironment))
+	}
+	co, err := b.DescribeComputeEnvironments(batchit.Mapping(ctx), &batch.DescribeComputeEnvironmentsInput{ComputeEnvironments: ces})
+	if err != nil {
+		return ""
+	}
+	ec := ecs.NewFromConfig(cfg)
+	for _, ce := range co.ComputeEnvironments {
+		eo, err := ec.DescribeContainerInstances(ctx, &ecs.DescribeContainerInstancesInput{
+			Cluster:            ce.EcsClusterArn,
+			ContainerInstances: []string{*j.Container.ContainerInstanceArn},
+		})
+		if err != nil || len(eo.ContainerInstances) == 0 {
+			continue
+		}
+		return aws.ToString(eo.ContainerInstances[0].Ec2InstanceId)
+	}
+	return ""
+}
+
+// ArraySummary returns the number of children of an array job in each state, e.g.
+// "RUNNING=2 SUCCEEDED=3". It is empty for other jobs.
+func ArraySummary(j *batchtypes.JobDetail) string {
+	if j.ArrayProperties == nil {
+		return ""
+	}
+	var states []string
+	for k, v := range j.ArrayProperties.StatusSummary {
+		if v > 0 {
+			states = append(states, fmt.Sprintf("%s=%d", k, v))
+		}
+	}
+	sort.Strings(states)
+	return strings.Join(states, " ")
+}
+
+// runtime returns the time between the start and end (or now if it's still running).
+func runtime(started, stopped *int64) time.Duration {
+	if started == nil {
+		return 0
+	}
+	end := time.Now()
+	if stopped != nil {
+		end = fromMillis(stopped)
+	}
+	return end.Sub(fromMillis(started)).Round(time.Second)
+}
+
+// WriteSummary writes the final status, exit code, reasons, instance type and runtime of j.
+func WriteSummary(ctx context.Context, w io.Writer, cfg aws.Config, b BatchAPI, j *batchtypes.JobDetail) {
+	fmt.Fprintf(w, "job: %s (%s)\n", aws.ToString(j.JobId), aws.ToString(j.JobName))
+	fmt.Fprintf(w, "  status: %s\n", j.Status)
+	if j.StatusReason != nil {
+		fmt.Fprintf(w, "  status reason: %s\n", *j.StatusReason)
+	}
+	if IsArrayParent(j) {
+		fmt.Fprintf(w, "  array size: %d %s\n", aws.ToInt32(j.ArrayProperties.Size), ArraySummary(j))
+	}
+	if j.Container != nil {
+		if j.Container.ExitCode != nil {
+			fmt.Fprintf(w, "  exit code: %d\n", *j.Container.ExitCode)
+		}
+		if j.Container.Reason != nil {
+			fmt.Fprintf(w, "  container reason: %s\n", *j.Container.Reason)
+		}
+	}
+	if it := InstanceType(ctx, cfg, b, j); it != "" {
+		fmt.Fprintf(w, "  instance type: %s\n", it)
+	}
+	if j.StartedAt != nil {
+		fmt.Fprintf(w, "  runtime: %s\n", runtime(j.StartedAt, j.StoppedAt))
+	}
+}
+
+// emitStatus emits the status of j as job.status with --output jsonl.
+func emitStatus(j *batchtypes.JobDetail) {
+	batchit.Emit(batchit.Event{Type: batchit.EventJobStatus, JobId: aws.ToString(j.JobId), JobName: aws.ToString(j.JobName),
+		Queue: aws.ToString(j.JobQueue), Status: string(j.Status), Message: aws.ToString(j.StatusReason)})
+}
+
+func fmtMillis(ms *int64) string {
+	if ms == nil {
+		return "-"
+	}
+	return fromMillis(ms).UTC().Format(time.RFC3339)
+}
+
+// WriteTimeline writes when j was created and when each attempt started and stopped so that
+// time waiting in the queue can be distinguished from run time.
+func WriteTimeline(w io.Writer, j *batchtypes.JobDetail) {
+	fmt.Fprintf(w, "job: %s (%s) %s\n", aws.ToString(j.JobId), aws.ToString(j.JobName), j.Status)
+	fmt.Fprintf(w, "  created:   %s\n", fmtMillis(j.CreatedAt))
+	// attempts are only recorded once they finish so include a running attempt from the job itself.
+	type span struct{ start, stop *int64 }
+	var spans []span
+	for _, a := range j.Attempts {
+		spans = append(spans, span{a.StartedAt, a.StoppedAt})
+	}
+	if j.StartedAt != nil && j.StoppedAt == nil {
+		spans = append(spans, span{j.StartedAt, nil})
+	}
+	if len(spans) == 0 {
+		fmt.Fprintf(w, "  not started. waiting for %s\n", runtime(j.CreatedAt, nil))
+		return
+	}
+	prev := j.CreatedAt
+	for i, s := range spans {
+		fmt.Fprintf(w, "  attempt %d: %s -> %s\n", i+1, fmtMillis(s.start), fmtMillis(s.stop))
+		fmt.Fprintf(w, "    waited: %s\n", runtime(prev, s.start))
+		fmt.Fprintf(w, "    ran:    %s\n", runtime(s.start, s.stop))
+		prev = s.stop
+	}
+	if j.StoppedAt != nil {
+		fmt.Fprintf(w, "  stopped:   %s\n", fmtMillis(j.StoppedAt))
+		fmt.Fprintf(w, "  total:     %s\n", runtime(j.CreatedAt, j.StoppedAt))
+	}
+}
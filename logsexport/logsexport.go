@@ -0,0 +1,215 @@
+package logsexport
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/base2genomics/batchit"
+	"github.com/base2genomics/batchit/logof"
+	"github.com/base2genomics/batchit/ls"
+	"github.com/base2genomics/batchit/submit"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/batch"
+	batchtypes "github.com/aws/aws-sdk-go-v2/service/batch/types"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+type cliargs struct {
+	Region      string `arg:"env:AWS_DEFAULT_REGION,help:region for batch setup. see batchit help for the default."`
+	Queue       string `arg:"required,help:queue of the jobs to export."`
+	Dest        string `arg:"required" help:"s3 path under which to write the logs, e.g. s3://bucket/logs/"`
+	Since       string `help:"export jobs created within this time, e.g. 24h or 7d."`
+	Name        string `help:"only export jobs with this name. may be a glob, e.g. 'align-*'."`
+	Concurrency int    `arg:"help:number of logs to export at once."`
+	Overwrite   bool   `arg:"help:export logs that already exist under --dest."`
+	DryRun      bool   `arg:"help:show the logs that would be exported without exporting them."`
+}
+
+func (c cliargs) Version() string {
+	return batchit.Version
+}
+
+func (c cliargs) Description() string {
+	return `Archive the CloudWatch logs of the jobs in a queue to S3. Each attempt of each job that has
+finished (SUCCEEDED or FAILED) is written, gzipped, to
+  <dest>/<queue>/<yyyy-mm-dd>/<job name>/<job id>.attempt<n>.log.gz
+where the date is when the job was created. Logs that exist under --dest are not exported again
+unless --overwrite is given so this can be run on a schedule.`
+}
+
+// Log is a log stream to export.
+type Log struct {
+	JobId   string
+	JobName string
+	Status  string
+	Attempt int
+	Stream  string
+	Key     string
+}
+
+// Key returns the key under prefix for an attempt of j.
+func Key(prefix, queue string, j *batchtypes.JobDetail, attempt int) string {
+	created := time.Unix(0, aws.ToInt64(j.CreatedAt)*int64(time.Millisecond)).UTC()
+	id := strings.Replace(aws.ToString(j.JobId), ":", ".", -1)
+	return fmt.Sprintf("%s%s/%s/%s/%s.attempt%d.log.gz", prefix, queue, created.Format("2006-01-02"), aws.ToString(j.JobName), id, attempt)
+}
+
+// Logs returns the log stream of each attempt of jobs with the key under prefix to write it to.
+// Attempts that did not start a container have no log and are skipped.
+func Logs(prefix, queue string, jobs []*batchtypes.JobDetail) []Log {
+	var out []Log
+	for _, j := range jobs {
+		for i, a := range j.Attempts {
+			if a.Container == nil || a.Container.LogStreamName == nil {
+				continue
+			}
+			out = append(out, Log{
+				JobId:   aws.ToString(j.JobId),
+				JobName: aws.ToString(j.JobName),
+				Status:  string(j.Status),
+				Attempt: i + 1,
+				Stream:  *a.Container.LogStreamName,
+				Key:     Key(prefix, queue, j, i+1),
+			})
+		}
+	}
+	return out
+}
+
+// Export writes the gzipped log to the key in bucket.
+func Export(ctx context.Context, cloud *cloudwatchlogs.Client, up *manager.Uploader, bucket string, l Log) error {
+	pr, pw := io.Pipe()
+	go func() {
+		z := gzip.NewWriter(pw)
+		err := logof.WriteLog(ctx, cloud, aws.String(l.Stream), "", z)
+		if cerr := z.Close(); err == nil {
+			err = cerr
+		}
+		pw.CloseWithError(err)
+	}()
+	_, err := up.Upload(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(l.Key),
+		Body:        pr,
+		ContentType: aws.String("application/gzip"),
+		Metadata: map[string]string{
+			"job-id":     l.JobId,
+			"job-name":   l.JobName,
+			"job-status": l.Status,
+			"log-stream": l.Stream,
+		},
+	})
+	pr.CloseWithError(err)
+	return err
+}
+
+func Main() {
+	cli := &cliargs{Since: "24h", Concurrency: 8}
+	p := batchit.MustParse(cli)
+	if !strings.HasPrefix(cli.Dest, "s3://") {
+		p.Fail("--dest must be an s3 path, e.g. s3://bucket/logs/")
+	}
+	if cli.Concurrency < 1 {
+		p.Fail("--concurrency must be at least 1")
+	}
+	d, err := logof.ParseDuration(cli.Since)
+	if err != nil {
+		p.Fail(err.Error())
+	}
+	bk := strings.SplitN(strings.TrimPrefix(cli.Dest, "s3://"), "/", 2)
+	bucket, prefix := bk[0], ""
+	if len(bk) == 2 && bk[1] != "" {
+		prefix = strings.TrimSuffix(bk[1], "/") + "/"
+	}
+
+	ctx := context.Background()
+	cfg, err := batchit.LoadConfig(ctx, cli.Region)
+	if err != nil {
+		log.Fatal(err)
+	}
+	b := batch.NewFromConfig(cfg)
+
+	sums, err := ls.List(ctx, b, ls.Query{Queue: cli.Queue, Statuses: []batchtypes.JobStatus{batchtypes.JobStatusSucceeded, batchtypes.JobStatusFailed},
+		Since: time.Now().Add(-d), NameGlob: cli.Name})
+	if err != nil {
+		log.Fatal(err)
+	}
+	ids := make([]string, len(sums))
+	for i, s := range sums {
+		ids[i] = *s.JobId
+	}
+	jobs, err := logof.DescribeJobs(ctx, b, ids)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if jobs, err = logof.Expand(ctx, b, jobs); err != nil {
+		log.Fatal(err)
+	}
+	logs := Logs(prefix, cli.Queue, jobs)
+	log.Printf("[batchit logs-export] found %d logs from %d jobs in %s in the last %s", len(logs), len(jobs), cli.Queue, cli.Since)
+
+	cloud := cloudwatchlogs.NewFromConfig(cfg)
+	s3o := s3.NewFromConfig(cfg)
+	up := manager.NewUploader(s3o)
+	errs := make([]error, len(logs))
+	skipped := make([]bool, len(logs))
+	sem := make(chan struct{}, cli.Concurrency)
+	var wg sync.WaitGroup
+	for i, l := range logs {
+		wg.Add(1)
+		go func(i int, l Log) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			path := "s3://" + bucket + "/" + l.Key
+			if !cli.Overwrite {
+				if _, err := submit.HeadOutput(ctx, s3o, path); err == nil {
+					skipped[i] = true
+					return
+				} else if err != submit.NotFound {
+					errs[i] = err
+					return
+				}
+			}
+			if cli.DryRun {
+				log.Printf("[batchit logs-export] would export %s to %s", l.Stream, path)
+				return
+			}
+			if errs[i] = Export(ctx, cloud, up, bucket, l); errs[i] != nil {
+				errs[i] = fmt.Errorf("error exporting %s to %s: %s", l.Stream, path, errs[i])
+			}
+		}(i, l)
+	}
+	wg.Wait()
+
+	var exported, exists, failed int
+	for i := range logs {
+		switch {
+		case errs[i] != nil:
+			log.Println(errs[i])
+			failed++
+		case skipped[i]:
+			exists++
+		default:
+			exported++
+		}
+	}
+	verb := "exported"
+	if cli.DryRun {
+		verb = "would export"
+	}
+	log.Printf("[batchit logs-export] %s %d logs. %d already existed. %d failed", verb, exported, exists, failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
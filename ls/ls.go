@@ -0,0 +1,207 @@
+package ls
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/base2genomics/batchit"
+	"github.com/base2genomics/batchit/logof"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/batch"
+	batchtypes "github.com/aws/aws-sdk-go-v2/service/batch/types"
+)
+
+type cliargs struct {
+	Region   string `arg:"env:AWS_DEFAULT_REGION,help:region for batch setup. see batchit help for the default."`
+	Queue    string `arg:"required,help:job queue to list."`
+	Status   string `help:"comma-separated statuses to list, e.g. RUNNING,FAILED. default is all."`
+	Since    string `help:"only list jobs created within this duration before now, e.g. 30m, 6h or 2d."`
+	NameGlob string `arg:"--name-glob,help:only list jobs with names matching this shell pattern such as 'align-*'."`
+	JSON     bool   `arg:"help:print a JSON array rather than a table."`
+}
+
+func (c cliargs) Version() string {
+	return batchit.Version
+}
+
+func (c cliargs) Description() string {
+	return `List the jobs in a queue, most recent first.`
+}
+
+// Statuses are all of the states of a job in the order they are passed through.
+var Statuses = []batchtypes.JobStatus{batchtypes.JobStatusSubmitted, batchtypes.JobStatusPending, batchtypes.JobStatusRunnable,
+	batchtypes.JobStatusStarting, batchtypes.JobStatusRunning, batchtypes.JobStatusSucceeded, batchtypes.JobStatusFailed}
+
+// StatusNames returns Statuses as strings.
+func StatusNames() []string {
+	names := make([]string, len(Statuses))
+	for i, s := range Statuses {
+		names[i] = string(s)
+	}
+	return names
+}
+
+// Query selects jobs in a queue.
+type Query struct {
+	Queue    string
+	Statuses []batchtypes.JobStatus
+	// Since excludes jobs created before it if it is not zero.
+	Since time.Time
+	// NameGlob is matched with path.Match.
+	NameGlob string
+}
+
+func (q Query) match(j *batchtypes.JobSummary) bool {
+	if !q.Since.IsZero() && aws.ToInt64(j.CreatedAt) < q.Since.UnixNano()/int64(time.Millisecond) {
+		return false
+	}
+	if q.NameGlob != "" {
+		if ok, _ := path.Match(q.NameGlob, aws.ToString(j.JobName)); !ok {
+			return false
+		}
+	}
+	for _, s := range q.Statuses {
+		if s == j.Status {
+			return true
+		}
+	}
+	return false
+}
+
+// prefix returns the literal start of a glob pattern.
+func prefix(glob string) string {
+	if i := strings.IndexAny(glob, `*?[\`); i >= 0 {
+		return glob[:i]
+	}
+	return glob
+}
+
+// List returns the jobs matching q, most recent first.
+func List(ctx context.Context, b *batch.Client, q Query) ([]*batchtypes.JobSummary, error) {
+	var jobs []*batchtypes.JobSummary
+	collect := func(lji *batch.ListJobsInput) error {
+		pages := batch.NewListJobsPaginator(b, lji)
+		for pages.HasMorePages() {
+			page, err := pages.NextPage(ctx)
+			if err != nil {
+				return err
+			}
+			for i := range page.JobSummaryList {
+				if j := &page.JobSummaryList[i]; q.match(j) {
+					jobs = append(jobs, j)
+				}
+			}
+		}
+		return nil
+	}
+	if p := prefix(q.NameGlob); p != "" {
+		// with a filter, jobs of every status are returned so a single listing is needed.
+		lji := &batch.ListJobsInput{
+			JobQueue: aws.String(q.Queue),
+			Filters:  []batchtypes.KeyValuesPair{{Name: aws.String("JOB_NAME"), Values: []string{p + "*"}}},
+		}
+		if err := collect(lji); err != nil {
+			return nil, err
+		}
+	} else {
+		for _, s := range q.Statuses {
+			if err := collect(&batch.ListJobsInput{JobQueue: aws.String(q.Queue), JobStatus: s}); err != nil {
+				return nil, err
+			}
+		}
+	}
+	sort.SliceStable(jobs, func(i, j int) bool { return aws.ToInt64(jobs[i].CreatedAt) > aws.ToInt64(jobs[j].CreatedAt) })
+	return jobs, nil
+}
+
+func fmtMillis(ms *int64) string {
+	if ms == nil {
+		return "-"
+	}
+	return time.Unix(0, *ms*int64(time.Millisecond)).UTC().Format("2006-01-02 15:04:05")
+}
+
+// WriteTable writes the jobs as aligned columns.
+func WriteTable(w io.Writer, jobs []*batchtypes.JobSummary) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "JOB ID\tNAME\tSTATUS\tEXIT\tCREATED\tSTARTED\tSTOPPED\tREASON")
+	for _, j := range jobs {
+		exit, reason := "-", aws.ToString(j.StatusReason)
+		if j.Container != nil {
+			if j.Container.ExitCode != nil {
+				exit = fmt.Sprint(*j.Container.ExitCode)
+			}
+			if reason == "" {
+				reason = aws.ToString(j.Container.Reason)
+			}
+		}
+		if reason == "" {
+			reason = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", *j.JobId, aws.ToString(j.JobName), j.Status, exit,
+			fmtMillis(j.CreatedAt), fmtMillis(j.StartedAt), fmtMillis(j.StoppedAt), reason)
+	}
+	return tw.Flush()
+}
+
+func Main() {
+	cli := &cliargs{}
+	p := batchit.MustParse(cli)
+	q := Query{Queue: cli.Queue, Statuses: Statuses, NameGlob: cli.NameGlob}
+	if cli.Status != "" {
+		q.Statuses = nil
+		for _, s := range strings.Split(strings.ToUpper(cli.Status), ",") {
+			found := false
+			for _, v := range Statuses {
+				found = found || batchtypes.JobStatus(s) == v
+			}
+			if !found {
+				p.Fail(fmt.Sprintf("unknown status: %s. must be one of %s", s, strings.Join(StatusNames(), ",")))
+			}
+			q.Statuses = append(q.Statuses, batchtypes.JobStatus(s))
+		}
+	}
+	if cli.NameGlob != "" {
+		if _, err := path.Match(cli.NameGlob, ""); err != nil {
+			p.Fail(fmt.Sprintf("invalid --name-glob: %s", err))
+		}
+	}
+	if cli.Since != "" {
+		d, err := logof.ParseDuration(cli.Since)
+		if err != nil {
+			p.Fail(err.Error())
+		}
+		q.Since = time.Now().Add(-d)
+	}
+	ctx := context.Background()
+	cfg, err := batchit.LoadConfig(ctx, cli.Region)
+	if err != nil {
+		log.Fatal(err)
+	}
+	b := batch.NewFromConfig(cfg)
+
+	jobs, err := List(ctx, b, q)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cli.JSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(jobs)
+	} else {
+		err = WriteTable(os.Stdout, jobs)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,110 @@
+package metric
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/base2genomics/batchit"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	cloudwatchtypes "github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+)
+
+type putArgs struct {
+	Region    string   `arg:"env:AWS_DEFAULT_REGION,help:region for batch setup. see batchit help for the default."`
+	Namespace string   `arg:"help:CloudWatch namespace of the metric."`
+	Name      string   `arg:"required,help:name of the metric."`
+	Value     float64  `arg:"required,help:value of the metric."`
+	Unit      string   `help:"CloudWatch unit of the value, e.g. Count, Seconds, Bytes or Percent."`
+	Dim       []string `arg:"help:extra dimension(s) of the form name=value."`
+	NoJobDims bool     `arg:"help:don't add the JobId and JobQueue dimensions that are added when run inside a batch job."`
+}
+
+func (p putArgs) Version() string {
+	return batchit.Version
+}
+
+func (p putArgs) Description() string {
+	return `Publish a single value to CloudWatch from inside a job, e.g.:
+
+    batchit metric put --namespace Pipelines --name reads_processed --value 123 --dim sample=NA12878
+
+When run in a batch job, the JobId and JobQueue are added as dimensions.`
+}
+
+// jobDims maps the environment variables set by batch to dimension names.
+var jobDims = [][2]string{
+	{"AWS_BATCH_JOB_ID", "JobId"},
+	{"AWS_BATCH_JQ_NAME", "JobQueue"},
+}
+
+// Dimensions parses name=value pairs and adds the batch job dimensions if jobs is true.
+func Dimensions(pairs []string, jobs bool) ([]cloudwatchtypes.Dimension, error) {
+	var dims []cloudwatchtypes.Dimension
+	for _, p := range pairs {
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("metric: expected dimension of the form name=value, got: %s", p)
+		}
+		dims = append(dims, cloudwatchtypes.Dimension{Name: aws.String(kv[0]), Value: aws.String(kv[1])})
+	}
+	if jobs {
+		for _, jd := range jobDims {
+			if v := os.Getenv(jd[0]); v != "" {
+				dims = append(dims, cloudwatchtypes.Dimension{Name: aws.String(jd[1]), Value: aws.String(v)})
+			}
+		}
+	}
+	// CloudWatch allows at most 30 dimensions per metric.
+	if len(dims) > 30 {
+		return nil, fmt.Errorf("metric: at most 30 dimensions are allowed, got %d", len(dims))
+	}
+	return dims, nil
+}
+
+// Put sends a single value to CloudWatch.
+func Put(ctx context.Context, cw *cloudwatch.Client, namespace, name string, value float64, unit cloudwatchtypes.StandardUnit, dims []cloudwatchtypes.Dimension) error {
+	_, err := cw.PutMetricData(ctx, &cloudwatch.PutMetricDataInput{
+		Namespace: aws.String(namespace),
+		MetricData: []cloudwatchtypes.MetricDatum{{
+			MetricName: aws.String(name),
+			Value:      aws.Float64(value),
+			Unit:       unit,
+			Timestamp:  aws.Time(time.Now()),
+			Dimensions: dims,
+		}},
+	})
+	return err
+}
+
+// PutMain publishes a metric.
+func PutMain() {
+	cli := &putArgs{Namespace: "batchit", Unit: string(cloudwatchtypes.StandardUnitNone)}
+	p := batchit.MustParse(cli)
+	dims, err := Dimensions(cli.Dim, !cli.NoJobDims)
+	if err != nil {
+		p.Fail(err.Error())
+	}
+	ctx := context.Background()
+	cfg, err := batchit.LoadConfig(ctx, cli.Region)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := Put(ctx, cloudwatch.NewFromConfig(cfg), cli.Namespace, cli.Name, cli.Value, cloudwatchtypes.StandardUnit(cli.Unit), dims); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func Main() {
+	if len(os.Args) < 2 || os.Args[1] != "put" {
+		fmt.Fprintln(os.Stderr, "usage: batchit metric put --name NAME --value VALUE [options]")
+		os.Exit(1)
+	}
+	os.Args = append(os.Args[:1], os.Args[2:]...)
+	PutMain()
+}
@@ -0,0 +1,223 @@
+package mirror
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"github.com/base2genomics/batchit"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	ecrtypes "github.com/aws/aws-sdk-go-v2/service/ecr/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+type cliargs struct {
+	Region     string   `arg:"env:AWS_DEFAULT_REGION,help:region to mirror to if --regions is not given"`
+	Regions    []string `help:"regions to mirror to, e.g. us-east-1,us-west-2."`
+	Repository string   `help:"name of the ECR repository. default is the path of the image, e.g. biocontainers/bwa."`
+	Tag        string   `arg:"help:tag in ECR. default is the tag of the image."`
+	Platform   string   `arg:"help:platform to pull. batch instances are linux/amd64 unless they are graviton (linux/arm64)."`
+	Force      bool     `arg:"help:push even if the tag is already in the repository."`
+	Image      string   `arg:"required,positional" help:"image to copy, e.g. docker.io/biocontainers/bwa:v0.7.17."`
+}
+
+func (c cliargs) Version() string {
+	return batchit.Version
+}
+
+func (c cliargs) Description() string {
+	return `Copy a container image into ECR in each region where jobs use it, creating the repository if needed.
+Pulls from Docker Hub by batch instances are slow across regions and rate-limited. This uses the docker CLI
+and logs in to ECR. Logging in to the source registry, if it needs it, is left to the user. The ECR image of
+each region is written to STDOUT for use with batchit submit --image.`
+}
+
+var ecrHost = regexp.MustCompile(`^(\d{12})\.dkr\.ecr\.([a-z0-9-]+)\.amazonaws\.com(\.cn)?$`)
+
+// Split returns the registry, repository and tag or digest of an image reference. The registry
+// is empty for Docker Hub.
+func Split(image string) (registry, repo, ref string) {
+	repo = image
+	if i := strings.Index(repo, "/"); i != -1 {
+		// the first part is a registry if it looks like a host.
+		if first := repo[:i]; strings.ContainsAny(first, ".:") || first == "localhost" {
+			registry, repo = first, repo[i+1:]
+		}
+	}
+	if registry == "docker.io" || registry == "registry.hub.docker.com" || registry == "index.docker.io" {
+		registry = ""
+	}
+	if i := strings.Index(repo, "@"); i != -1 {
+		return registry, repo[:i], repo[i:]
+	}
+	if i := strings.LastIndex(repo, ":"); i != -1 {
+		return registry, repo[:i], repo[i+1:]
+	}
+	return registry, repo, "latest"
+}
+
+// docker runs the docker CLI with its output on stderr so that STDOUT only has the images.
+func docker(stdin string, args ...string) error {
+	cmd := exec.Command("docker", args...)
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	if stdin != "" {
+		cmd.Stdin = strings.NewReader(stdin)
+	}
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("mirror: docker %s: %s", args[0], err)
+	}
+	return nil
+}
+
+// Login logs the docker CLI in to the ECR registry of svc and returns the registry host.
+func Login(ctx context.Context, svc *ecr.Client) (string, error) {
+	out, err := svc.GetAuthorizationToken(ctx, &ecr.GetAuthorizationTokenInput{})
+	if err != nil {
+		return "", err
+	}
+	if len(out.AuthorizationData) == 0 {
+		return "", fmt.Errorf("mirror: no ECR authorization data")
+	}
+	ad := out.AuthorizationData[0]
+	token, err := base64.StdEncoding.DecodeString(aws.ToString(ad.AuthorizationToken))
+	if err != nil {
+		return "", err
+	}
+	// the token is user:password and the user is always AWS.
+	pair := strings.SplitN(string(token), ":", 2)
+	if len(pair) != 2 {
+		return "", fmt.Errorf("mirror: unexpected ECR authorization token")
+	}
+	endpoint := aws.ToString(ad.ProxyEndpoint)
+	if err := docker(pair[1], "login", "--username", pair[0], "--password-stdin", endpoint); err != nil {
+		return "", err
+	}
+	return strings.TrimPrefix(endpoint, "https://"), nil
+}
+
+// EnsureRepository creates the repository if it does not exist. It returns true if tag is
+// already in the repository.
+func EnsureRepository(ctx context.Context, svc *ecr.Client, repo, tag, source string) (bool, error) {
+	_, err := svc.DescribeImages(ctx, &ecr.DescribeImagesInput{
+		RepositoryName: aws.String(repo),
+		ImageIds:       []ecrtypes.ImageIdentifier{{ImageTag: aws.String(tag)}},
+	})
+	if err == nil {
+		return true, nil
+	}
+	var notFound *ecrtypes.ImageNotFoundException
+	if errors.As(err, &notFound) {
+		return false, nil
+	}
+	var noRepo *ecrtypes.RepositoryNotFoundException
+	if !errors.As(err, &noRepo) {
+		return false, err
+	}
+	_, err = svc.CreateRepository(ctx, &ecr.CreateRepositoryInput{
+		RepositoryName: aws.String(repo),
+		Tags:           []ecrtypes.Tag{{Key: aws.String("batchit-mirror-source"), Value: aws.String(source)}},
+	})
+	var exists *ecrtypes.RepositoryAlreadyExistsException
+	if err == nil {
+		log.Printf("[batchit mirror] created repository %s", repo)
+	} else if errors.As(err, &exists) {
+		// created by another mirror since it was described.
+		err = nil
+	}
+	return false, err
+}
+
+func Main() {
+	cli := &cliargs{Platform: "linux/amd64"}
+	p := batchit.MustParse(cli)
+	var regions []string
+	for _, r := range cli.Regions {
+		for _, s := range strings.Split(r, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				regions = append(regions, s)
+			}
+		}
+	}
+	registry, repo, ref := Split(cli.Image)
+	tag := cli.Tag
+	if tag == "" {
+		if strings.HasPrefix(ref, "@") {
+			p.Fail("--tag is required to mirror an image given by digest")
+		}
+		tag = ref
+	}
+	// official images on Docker Hub are in library/.
+	repo = strings.TrimPrefix(repo, "library/")
+	if cli.Repository != "" {
+		repo = cli.Repository
+	}
+
+	ctx := context.Background()
+	cfg, err := batchit.LoadConfig(ctx, cli.Region)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(regions) == 0 {
+		regions = []string{cfg.Region}
+	}
+	inRegion := func(region string) func(*ecr.Options) {
+		return func(o *ecr.Options) { o.Region = region }
+	}
+	// an image in ECR in another region or account needs a login to pull.
+	if m := ecrHost.FindStringSubmatch(registry); m != nil {
+		if _, err := Login(ctx, ecr.NewFromConfig(cfg, inRegion(m[2]))); err != nil {
+			log.Fatal(err)
+		}
+	}
+	pull := []string{"pull"}
+	if cli.Platform != "" {
+		pull = append(pull, "--platform", cli.Platform)
+	}
+	pull = append(pull, cli.Image)
+	pulled := false
+
+	user, err := sts.NewFromConfig(cfg).GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, region := range regions {
+		svc := ecr.NewFromConfig(cfg, inRegion(region))
+		exists, err := EnsureRepository(ctx, svc, repo, tag, cli.Image)
+		if err != nil {
+			log.Fatal(err)
+		}
+		target := fmt.Sprintf("%s/%s:%s", batchit.ECRRegistry(*user.Account, region), repo, tag)
+		if exists && !cli.Force {
+			log.Printf("[batchit mirror] %s exists. use --force to push it again", target)
+			fmt.Println(target)
+			continue
+		}
+		if !pulled {
+			if err := docker("", pull...); err != nil {
+				log.Fatal(err)
+			}
+			pulled = true
+		}
+		host, err := Login(ctx, svc)
+		if err != nil {
+			log.Fatal(err)
+		}
+		target = fmt.Sprintf("%s/%s:%s", host, repo, tag)
+		if err := docker("", "tag", cli.Image, target); err != nil {
+			log.Fatal(err)
+		}
+		if err := docker("", "push", target); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("[batchit mirror] pushed %s", target)
+		fmt.Println(target)
+	}
+}
@@ -0,0 +1,119 @@
+package batchit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// OutputEnvVar is the environment variable with the output format to use if --output is not given.
+const OutputEnvVar = "BATCHIT_OUTPUT"
+
+// Output is text or jsonl. It is set from the --output flag that every subcommand accepts or
+// $BATCHIT_OUTPUT. It is text if empty. With jsonl, the subcommands that support
+// it write an Event to stdout for each step instead of their usual output.
+var Output string
+
+// JSONL is true if Output is jsonl.
+func JSONL() bool {
+	return Output == "jsonl"
+}
+
+// SetOutput checks format for --output.
+func SetOutput(format string) error {
+	switch format {
+	case "", "text", "jsonl":
+		return nil
+	}
+	return fmt.Errorf("batchit: --output must be text or jsonl. got %s", format)
+}
+
+// The types of Event. Each is about the resource in its name.
+const (
+	EventStarted  = "command.started"
+	EventFinished = "command.finished"
+
+	EventJobSubmitted  = "job.submitted"
+	EventJobStatus     = "job.status"
+	EventJobCancelled  = "job.cancelled"
+	EventJobTerminated = "job.terminated"
+	EventJobLog        = "job.log"
+
+	EventVolumeCreated     = "volume.created"
+	EventVolumeAttached    = "volume.attached"
+	EventVolumeMounted     = "volume.mounted"
+	EventVolumeDetached    = "volume.detached"
+	EventVolumeSnapshotted = "volume.snapshotted"
+	EventVolumeDeleted     = "volume.deleted"
+
+	EventObjectUploaded = "object.uploaded"
+	EventObjectSkipped  = "object.skipped"
+)
+
+// Event is a line written to stdout with --output jsonl. Fields that do not apply to its Type are
+// left out. Fields and types may be added, but those here keep their names and meanings.
+//
+// Time is when the event happened; for job.log it is the timestamp of the log line.
+type Event struct {
+	Time       time.Time `json:"time"`
+	Type       string    `json:"type"`
+	Subcommand string    `json:"subcommand"`
+	JobId      string    `json:"job_id,omitempty"`
+	JobName    string    `json:"job_name,omitempty"`
+	Queue      string    `json:"queue,omitempty"`
+	Status     string    `json:"status,omitempty"`
+	VolumeId   string    `json:"volume_id,omitempty"`
+	SnapshotId string    `json:"snapshot_id,omitempty"`
+	Device     string    `json:"device,omitempty"`
+	// Stream is the CloudWatch log stream of job.log.
+	Stream string `json:"stream,omitempty"`
+	// Path is a local path, such as a mount point or file, or an s3:// URL.
+	Path    string `json:"path,omitempty"`
+	Region  string `json:"region,omitempty"`
+	Bytes   int64  `json:"bytes,omitempty"`
+	Message string `json:"message,omitempty"`
+	// DryRun is true for what would have been done with --dry-run or --dryrun.
+	DryRun bool   `json:"dry_run,omitempty"`
+	Error  string `json:"error,omitempty"`
+	// ExitCode is only set for command.finished.
+	ExitCode *int `json:"exit_code,omitempty"`
+}
+
+var events = struct {
+	sync.Mutex
+	w io.Writer
+}{w: os.Stdout}
+
+// Emit writes e as a line of JSON to stdout with --output jsonl and does nothing otherwise. Time
+// and Subcommand are set if they are empty. It is safe to call from many goroutines.
+func Emit(e Event) {
+	if !JSONL() {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	if e.Subcommand == "" {
+		e.Subcommand = Command
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	events.Lock()
+	defer events.Unlock()
+	events.w.Write(append(b, '\n'))
+}
+
+// EmitFinished emits command.finished with the exit code for err and its message.
+func EmitFinished(err error) {
+	code := ExitCode(err)
+	e := Event{Type: EventFinished, ExitCode: &code}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	Emit(e)
+}
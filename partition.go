@@ -0,0 +1,48 @@
+package batchit
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The partitions that batchit works in. Each has its own accounts, regions and endpoints.
+const (
+	PartitionAWS   = "aws"
+	PartitionChina = "aws-cn"
+	PartitionGov   = "aws-us-gov"
+)
+
+// Partition returns the partition of region, e.g. aws-us-gov for us-gov-west-1.
+func Partition(region string) string {
+	switch {
+	case strings.HasPrefix(region, "cn-"):
+		return PartitionChina
+	case strings.HasPrefix(region, "us-gov-"):
+		return PartitionGov
+	}
+	return PartitionAWS
+}
+
+// DNSSuffix returns the domain of the endpoints in the partition of region. It is amazonaws.com
+// except in China, where it is amazonaws.com.cn.
+func DNSSuffix(region string) string {
+	if Partition(region) == PartitionChina {
+		return "amazonaws.com.cn"
+	}
+	return "amazonaws.com"
+}
+
+// Endpoint returns the host of service in region, e.g. ecs.cn-north-1.amazonaws.com.cn.
+func Endpoint(service, region string) string {
+	return fmt.Sprintf("%s.%s.%s", service, region, DNSSuffix(region))
+}
+
+// ECRRegistry returns the host of the ECR registry of account in region.
+func ECRRegistry(account, region string) string {
+	return fmt.Sprintf("%s.dkr.%s", account, Endpoint("ecr", region))
+}
+
+// ARN returns the ARN of resource, e.g. repository/name, in the partition of region.
+func ARN(service, region, account, resource string) string {
+	return fmt.Sprintf("arn:%s:%s:%s:%s:%s", Partition(region), service, region, account, resource)
+}
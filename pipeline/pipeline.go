@@ -0,0 +1,281 @@
+package pipeline
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/base2genomics/batchit/submit"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Job is a single job with the same options as batchit submit.
+type Job struct {
+	Name      string            `yaml:"name"`
+	Queue     string            `yaml:"queue"`
+	Role      string            `yaml:"role"`
+	Image     string            `yaml:"image"`
+	Script    string            `yaml:"script"`
+	CPUs      int               `yaml:"cpus"`
+	Mem       int               `yaml:"mem"`
+	ArraySize int64             `yaml:"array_size"`
+	Retries   int64             `yaml:"retries"`
+	Env       map[string]string `yaml:"env"`
+	Volumes   []string          `yaml:"volumes"`
+	Ebs       string            `yaml:"ebs"`
+	// DependsOn are the names of jobs in the pipeline that must succeed first.
+	DependsOn []string `yaml:"depends_on"`
+}
+
+// Pipeline is a set of jobs read from YAML like:
+//
+//	defaults:
+//	  queue: myqueue
+//	  role: myrole
+//	  image: 123456789012.dkr.ecr.us-east-1.amazonaws.com/aligner:1.0
+//	jobs:
+//	  - name: align
+//	    script: align.sh
+//	    cpus: 16
+//	    array_size: 24
+//	  - name: call
+//	    script: call.sh
+//	    depends_on: [align]
+type Pipeline struct {
+	// Defaults fills any field that is not set on a job.
+	Defaults Job   `yaml:"defaults"`
+	Jobs     []Job `yaml:"jobs"`
+	// Dir is the directory of the pipeline file. Scripts are relative to it.
+	Dir string `yaml:"-"`
+}
+
+// Read reads a pipeline and applies its defaults. Use Check to find problems.
+func Read(path string) (*Pipeline, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p := &Pipeline{}
+	if err := yaml.UnmarshalStrict(data, p); err != nil {
+		return nil, fmt.Errorf("pipeline: %s: %s", path, err)
+	}
+	p.Dir = filepath.Dir(path)
+	for i := range p.Jobs {
+		p.Jobs[i].SetDefaults(p.Defaults)
+	}
+	return p, nil
+}
+
+// SetDefaults fills each field of j that is not set from d. Env is merged.
+func (j *Job) SetDefaults(d Job) {
+	if j.Queue == "" {
+		j.Queue = d.Queue
+	}
+	if j.Role == "" {
+		j.Role = d.Role
+	}
+	if j.Image == "" {
+		j.Image = d.Image
+	}
+	if j.CPUs == 0 {
+		j.CPUs = d.CPUs
+	}
+	if j.Mem == 0 {
+		j.Mem = d.Mem
+	}
+	if j.Retries == 0 {
+		j.Retries = d.Retries
+	}
+	if j.Ebs == "" {
+		j.Ebs = d.Ebs
+	}
+	if len(j.Volumes) == 0 {
+		j.Volumes = d.Volumes
+	}
+	for k, v := range d.Env {
+		if j.Env == nil {
+			j.Env = make(map[string]string)
+		}
+		if _, ok := j.Env[k]; !ok {
+			j.Env[k] = v
+		}
+	}
+}
+
+var (
+	validName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]{0,127}$`)
+	validEnv  = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// ScriptPath returns the path of the script of j.
+func (p *Pipeline) ScriptPath(j Job) string {
+	return j.Options(p.Dir, "").Path
+}
+
+// Check returns every problem found with the pipeline without making any AWS calls.
+func (p *Pipeline) Check() []error {
+	var errs []error
+	bad := func(j Job, format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("job %s: %s", j.Name, fmt.Sprintf(format, args...)))
+	}
+	if len(p.Jobs) == 0 {
+		return []error{fmt.Errorf("no jobs")}
+	}
+	names := make(map[string]bool)
+	for i, j := range p.Jobs {
+		if j.Name == "" {
+			errs = append(errs, fmt.Errorf("job %d: name is required", i+1))
+			continue
+		}
+		if !validName.MatchString(j.Name) {
+			bad(j, "name must be up to 128 letters, numbers, hyphens and underscores")
+		}
+		if names[j.Name] {
+			bad(j, "name is used more than once")
+		}
+		names[j.Name] = true
+		for _, f := range [][2]string{{"queue", j.Queue}, {"role", j.Role}, {"image", j.Image}, {"script", j.Script}} {
+			if f[1] == "" {
+				bad(j, "%s is required", f[0])
+			}
+		}
+		if j.Script != "" && !strings.HasPrefix(j.Script, "script:") {
+			if _, err := os.Stat(p.ScriptPath(j)); err != nil {
+				bad(j, "script: %s", err)
+			}
+		}
+		if j.CPUs < 0 || j.Mem < 0 || j.Retries < 0 || j.Retries > 10 {
+			bad(j, "cpus and mem must not be negative and retries must be between 0 and 10")
+		}
+		if j.ArraySize == 1 || j.ArraySize < 0 || j.ArraySize > 10000 {
+			bad(j, "array_size must be between 2 and 10000")
+		}
+		for k := range j.Env {
+			if !validEnv.MatchString(k) {
+				bad(j, "invalid environment variable name: %s", k)
+			}
+		}
+		for _, v := range j.Volumes {
+			if vol, err := submit.ParseVolume(v); err != nil {
+				bad(j, "%s", err)
+			} else if !filepath.IsAbs(vol.Host) || !filepath.IsAbs(vol.Container) {
+				bad(j, "volume %s must be HOST_PATH=CONTAINER_PATH with absolute paths", v)
+			}
+		}
+		if j.Ebs != "" {
+			if parts := strings.Split(j.Ebs, ":"); len(parts) < 2 || len(parts) > 5 || !filepath.IsAbs(parts[0]) {
+				bad(j, "ebs %s must be mount-point:size[:volume-type[:fstype[:iops]]]", j.Ebs)
+			}
+		}
+	}
+	for _, j := range p.Jobs {
+		for _, d := range j.DependsOn {
+			if !names[d] {
+				bad(j, "depends on unknown job %s", d)
+			}
+		}
+	}
+	if len(errs) == 0 {
+		if _, err := p.Order(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// Order returns the jobs so that each comes after the jobs it depends on. It returns an error if
+// the dependencies have a cycle.
+func (p *Pipeline) Order() ([]Job, error) {
+	byName := make(map[string]Job, len(p.Jobs))
+	for _, j := range p.Jobs {
+		byName[j.Name] = j
+	}
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := make(map[string]int)
+	var out []Job
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case visiting:
+			return fmt.Errorf("dependency cycle: %s -> %s", strings.Join(path, " -> "), name)
+		case done:
+			return nil
+		}
+		state[name] = visiting
+		for _, d := range byName[name].DependsOn {
+			if err := visit(d, append(path, name)); err != nil {
+				return err
+			}
+		}
+		state[name] = done
+		out = append(out, byName[name])
+		return nil
+	}
+	for _, j := range p.Jobs {
+		if err := visit(j.Name, nil); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// ReadJob reads a single job from a YAML file with the same fields as a job in a pipeline.
+func ReadJob(path string) (*Job, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	j := &Job{}
+	if err := yaml.UnmarshalStrict(data, j); err != nil {
+		return nil, fmt.Errorf("pipeline: %s: %s", path, err)
+	}
+	return j, nil
+}
+
+// Options returns the arguments to batchit submit for j. Scripts are relative to dir. Defaults
+// are filled in as for the command line.
+func (j Job) Options(dir, region string) *submit.Options {
+	o := &submit.Options{
+		Image:     j.Image,
+		Role:      j.Role,
+		Region:    region,
+		Queue:     j.Queue,
+		ArraySize: j.ArraySize,
+		Retries:   j.Retries,
+		CPUs:      j.CPUs,
+		Mem:       j.Mem,
+		Volumes:   j.Volumes,
+		Ebs:       j.Ebs,
+		JobName:   j.Name,
+		Path:      j.Script,
+	}
+	if !filepath.IsAbs(j.Script) && !strings.HasPrefix(j.Script, "script:") {
+		o.Path = filepath.Join(dir, j.Script)
+	}
+	if o.CPUs == 0 {
+		o.CPUs = 1
+	}
+	if o.Mem == 0 {
+		o.Mem = 1048
+	}
+	if o.Retries == 0 {
+		o.Retries = 1
+	}
+	keys := make([]string, 0, len(j.Env))
+	for k := range j.Env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		o.EnvVars = append(o.EnvVars, k+"="+j.Env[k])
+	}
+	return o
+}
@@ -0,0 +1,164 @@
+package batchit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// PluginPrefix starts the name of an executable on $PATH that is run for an unknown subcommand,
+// e.g. batchit-report-costs for batchit report-costs, as git does.
+const PluginPrefix = "batchit-"
+
+// Plugins returns the path of each plugin on $PATH keyed by its subcommand. As with a shell,
+// the first one found for a name is used.
+func Plugins() map[string]string {
+	plugins := make(map[string]string)
+	for _, dir := range filepath.SplitList(os.Getenv("PATH")) {
+		if dir == "" {
+			dir = "."
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			name := e.Name()
+			if !strings.HasPrefix(name, PluginPrefix) || len(name) == len(PluginPrefix) {
+				continue
+			}
+			cmd := name[len(PluginPrefix):]
+			if _, ok := plugins[cmd]; ok {
+				continue
+			}
+			path := filepath.Join(dir, name)
+			if fi, err := os.Stat(path); err != nil || fi.IsDir() || fi.Mode()&0111 == 0 {
+				continue
+			}
+			plugins[cmd] = path
+		}
+	}
+	return plugins
+}
+
+// Plugin returns the path of the plugin for cmd on $PATH.
+func Plugin(cmd string) (string, bool) {
+	if cmd == "" || strings.ContainsRune(cmd, os.PathSeparator) {
+		return "", false
+	}
+	path, err := exec.LookPath(PluginPrefix + cmd)
+	return path, err == nil
+}
+
+// RunPlugin replaces batchit with the plugin at path for cmd, so that it gets signals and its
+// exit code is that of batchit. args are those after the subcommand with the global flags
+// removed; they are passed to the plugin in the environment from PluginEnv instead. It only
+// returns if the plugin could not be run.
+func RunPlugin(ctx context.Context, cmd, path string, args []string) error {
+	env, err := PluginEnv(ctx, cmd)
+	if err != nil {
+		return Exit(ExitUsage, err)
+	}
+	return fmt.Errorf("batchit: running %s: %w", path, syscall.Exec(path, append([]string{path}, args...), env))
+}
+
+// PluginEnv returns the environment to run the plugin for cmd with. It is the environment of
+// batchit with the global flags and the config resolved for cmd:
+//
+//	BATCHIT_PROFILE, BATCHIT_ENDPOINT_URL and BATCHIT_LOG_FORMAT  from the global flags or config
+//	BATCHIT_REGION                                                the region from LoadConfig
+//	BATCHIT_DEFAULTS                                              the config section for cmd as JSON
+//	BATCHIT_VERSION                                               Version
+//
+// The retry flags are passed as $BATCHIT_MAX_ATTEMPTS and so on, --debug-region as
+// $BATCHIT_DEBUG_REGION, --no-cache as $BATCHIT_NO_CACHE and --output as $BATCHIT_OUTPUT. AWS_PROFILE, AWS_REGION,
+// AWS_ENDPOINT_URL, AWS_CA_BUNDLE and AWS_MAX_ATTEMPTS are also set so that plugins using an AWS
+// SDK or the AWS CLI get the same account and region. Configure must have been called for cmd.
+func PluginEnv(ctx context.Context, cmd string) ([]string, error) {
+	s := defaults.Section(cmd)
+	cfg, err := LoadConfig(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	defs, err := json.Marshal(jsonSection(s))
+	if err != nil {
+		return nil, err
+	}
+	set := map[string]string{
+		"BATCHIT_PROFILE":      Profile,
+		"BATCHIT_ENDPOINT_URL": EndpointURL,
+		LogFormatEnvVar:        LogFormat,
+		"BATCHIT_REGION":       cfg.Region,
+		"BATCHIT_DEFAULTS":     string(defs),
+		"BATCHIT_VERSION":      Version,
+		"AWS_REGION":           cfg.Region,
+	}
+	for flag, v := range retryFlags {
+		if *v != "" {
+			set[retryEnvVar(flag)] = *v
+		}
+	}
+	set["AWS_MAX_ATTEMPTS"] = strconv.Itoa(Retry.MaxAttempts)
+	if Profile != "" {
+		set["AWS_PROFILE"] = Profile
+	}
+	if EndpointURL != "" {
+		set["AWS_ENDPOINT_URL"] = EndpointURL
+	}
+	if DebugRegion {
+		set[DebugRegionEnvVar] = "true"
+	}
+	if NoCache {
+		set[NoCacheEnvVar] = "true"
+	}
+	if CABundle != "" {
+		set["AWS_CA_BUNDLE"] = CABundle
+	}
+	if Output != "" {
+		set[OutputEnvVar] = Output
+	}
+	env := make([]string, 0, len(os.Environ())+len(set))
+	for _, kv := range os.Environ() {
+		if k, _, _ := strings.Cut(kv, "="); set[k] == "" {
+			env = append(env, kv)
+		}
+	}
+	for k, v := range set {
+		if v != "" {
+			env = append(env, k+"="+v)
+		}
+	}
+	return env, nil
+}
+
+// jsonSection converts the nested maps that yaml decodes, which have interface{} keys, so that
+// a config section can be written as JSON.
+func jsonSection(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			m[k] = jsonSection(e)
+		}
+		return m
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			m[fmt.Sprint(k)] = jsonSection(e)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(t))
+		for i, e := range t {
+			l[i] = jsonSection(e)
+		}
+		return l
+	}
+	return v
+}
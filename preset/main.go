@@ -0,0 +1,185 @@
+package preset
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/base2genomics/batchit"
+)
+
+var subs = map[string]struct {
+	help string
+	main func()
+}{
+	"save":   {"save submit options under a name for batchit submit --preset", SaveMain},
+	"list":   {"show the saved presets", ListMain},
+	"delete": {"remove a preset", DeleteMain},
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: batchit preset <command> [options]\n\ncommands:")
+	var keys []string
+	for k := range subs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(os.Stderr, "  %-8s: %s\n", k, subs[k].help)
+	}
+	fmt.Fprintf(os.Stderr, "\npresets are kept in the user config directory unless $%s is set to a file, e.g. one shared by a team.\n", EnvVar)
+	os.Exit(1)
+}
+
+// Main dispatches to the preset commands.
+func Main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	s, ok := subs[os.Args[1]]
+	if !ok {
+		usage()
+	}
+	// remove the command name as is done for batchit itself.
+	os.Args = append(os.Args[:1], os.Args[2:]...)
+	s.main()
+}
+
+type saveArgs struct {
+	Queue   string   `arg:"-q,help:job queue"`
+	Role    string   `arg:"-r,help:existing role name"`
+	Image   string   `arg:"-i,help:image like $acct.dkr.ecr.$region.amazonaws.com/$image:$tag or $image:$tag"`
+	Region  string   `arg:"help:region for batch setup"`
+	CPUs    int      `arg:"-c,help:number of cpus reserved by the job"`
+	Mem     int      `arg:"-m,help:memory (MiB) reserved by the job"`
+	Ebs     string   `arg:"-e" help:"args for ebs mount as for batchit submit, e.g. /mnt/scratch:1000:gp3"`
+	Retries int64    `arg:"help:number of times to retry the job on failure"`
+	Volumes []string `arg:"-o,help:HOST_PATH=CONTAINER_PATH"`
+	EnvVars []string `arg:"-v,help:key-value environment pairs of the form NAME=value"`
+	Name    string   `arg:"required,positional,help:name of the preset."`
+}
+
+func (c saveArgs) Version() string {
+	return batchit.Version
+}
+
+func (c saveArgs) Description() string {
+	return `Save options of batchit submit under a name. They are used with batchit submit --preset <name> and
+options given to submit take precedence over those of the preset. A preset with the same name is replaced.
+e.g.:
+  batchit preset save genomics-large --queue big-q --role pipeline-role --cpus 32 --mem 120000 --ebs /mnt/scratch:1000:gp3`
+}
+
+func SaveMain() {
+	cli := &saveArgs{}
+	batchit.MustParse(cli)
+	path, err := Path()
+	if err != nil {
+		log.Fatal(err)
+	}
+	ps, err := Read(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, ok := ps[cli.Name]; ok {
+		log.Printf("[batchit preset] replacing %s", cli.Name)
+	}
+	ps[cli.Name] = &Preset{Queue: cli.Queue, Role: cli.Role, Image: cli.Image, Region: cli.Region, CPUs: cli.CPUs,
+		Mem: cli.Mem, Ebs: cli.Ebs, Retries: cli.Retries, Volumes: cli.Volumes, EnvVars: cli.EnvVars}
+	if err := ps.Write(path); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("[batchit preset] saved %s to %s", cli.Name, path)
+}
+
+type listArgs struct{}
+
+func (c listArgs) Version() string {
+	return batchit.Version
+}
+
+func (c listArgs) Description() string {
+	return `Show the saved presets and the file they are kept in.`
+}
+
+// WriteTable writes a line for each preset.
+func WriteTable(w io.Writer, ps Presets) error {
+	names := make([]string, 0, len(ps))
+	for n := range ps {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tQUEUE\tROLE\tIMAGE\tCPUS\tMEM\tEBS\tOTHER")
+	for _, n := range names {
+		p := ps[n]
+		var other []string
+		if p.Region != "" {
+			other = append(other, "region="+p.Region)
+		}
+		if p.Retries != 0 {
+			other = append(other, fmt.Sprintf("retries=%d", p.Retries))
+		}
+		for _, v := range p.Volumes {
+			other = append(other, "volume="+v)
+		}
+		other = append(other, p.EnvVars...)
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%d\t%s\t%s\n", n, p.Queue, p.Role, p.Image, p.CPUs, p.Mem, p.Ebs, strings.Join(other, " "))
+	}
+	return tw.Flush()
+}
+
+func ListMain() {
+	cli := &listArgs{}
+	batchit.MustParse(cli)
+	path, err := Path()
+	if err != nil {
+		log.Fatal(err)
+	}
+	ps, err := Read(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("[batchit preset] %d presets in %s", len(ps), path)
+	if err := WriteTable(os.Stdout, ps); err != nil {
+		log.Fatal(err)
+	}
+}
+
+type deleteArgs struct {
+	Names []string `arg:"required,positional,help:name(s) of the presets to remove."`
+}
+
+func (c deleteArgs) Version() string {
+	return batchit.Version
+}
+
+func (c deleteArgs) Description() string {
+	return `Remove presets.`
+}
+
+func DeleteMain() {
+	cli := &deleteArgs{}
+	p := batchit.MustParse(cli)
+	path, err := Path()
+	if err != nil {
+		log.Fatal(err)
+	}
+	ps, err := Read(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, n := range cli.Names {
+		if _, ok := ps[n]; !ok {
+			p.Fail(fmt.Sprintf("%s is not in %s", n, path))
+		}
+		delete(ps, n)
+	}
+	if err := ps.Write(path); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,159 @@
+package preset
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// EnvVar is the environment variable that can point to a presets file to use instead of the one
+// in the user config directory, e.g. a file shared by a team.
+const EnvVar = "BATCHIT_PRESETS"
+
+// Preset is a named set of batchit submit options.
+type Preset struct {
+	Queue   string   `yaml:"queue,omitempty"`
+	Role    string   `yaml:"role,omitempty"`
+	Image   string   `yaml:"image,omitempty"`
+	Region  string   `yaml:"region,omitempty"`
+	CPUs    int      `yaml:"cpus,omitempty"`
+	Mem     int      `yaml:"mem,omitempty"`
+	Ebs     string   `yaml:"ebs,omitempty"`
+	Retries int64    `yaml:"retries,omitempty"`
+	Volumes []string `yaml:"volumes,omitempty"`
+	EnvVars []string `yaml:"env_vars,omitempty"`
+}
+
+// Presets are keyed by name.
+type Presets map[string]*Preset
+
+// Path returns $BATCHIT_PRESETS or presets.yaml in the batchit user config directory,
+// e.g. ~/.config/batchit/presets.yaml.
+func Path() (string, error) {
+	if p := os.Getenv(EnvVar); p != "" {
+		return p, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "batchit", "presets.yaml"), nil
+}
+
+// Read reads the presets at path. A missing file has no presets.
+func Read(path string) (Presets, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return Presets{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	ps := Presets{}
+	if err := yaml.UnmarshalStrict(data, &ps); err != nil {
+		return nil, fmt.Errorf("preset: reading %s: %s", path, err)
+	}
+	return ps, nil
+}
+
+// Write writes the presets to path, creating its directory if needed.
+func (ps Presets) Write(path string) error {
+	data, err := yaml.Marshal(ps)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Get returns the named preset from the presets file.
+func Get(name string) (*Preset, error) {
+	path, err := Path()
+	if err != nil {
+		return nil, err
+	}
+	ps, err := Read(path)
+	if err != nil {
+		return nil, err
+	}
+	p, ok := ps[name]
+	if !ok {
+		return nil, fmt.Errorf("preset: %s is not in %s", name, path)
+	}
+	return p, nil
+}
+
+// Args returns the batchit submit flags that set the options of p.
+func (p *Preset) Args() []string {
+	var args []string
+	add := func(flag, value string) {
+		if value != "" && value != "0" {
+			args = append(args, flag, value)
+		}
+	}
+	add("--queue", p.Queue)
+	add("--role", p.Role)
+	add("--image", p.Image)
+	add("--region", p.Region)
+	add("--cpus", strconv.Itoa(p.CPUs))
+	add("--mem", strconv.Itoa(p.Mem))
+	add("--ebs", p.Ebs)
+	add("--retries", strconv.FormatInt(p.Retries, 10))
+	if len(p.Volumes) > 0 {
+		args = append(append(args, "--volumes"), p.Volumes...)
+	}
+	if len(p.EnvVars) > 0 {
+		args = append(append(args, "--envvars"), p.EnvVars...)
+	}
+	return args
+}
+
+// Expand replaces --preset <name> in the arguments of batchit submit with the flags of the preset.
+// The flags are put first so that those given on the command line take precedence. Lists such as
+// --volumes given on the command line replace those of the preset.
+func Expand(args []string) ([]string, error) {
+	name := ""
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		if a == "--" {
+			rest = append(rest, args[i:]...)
+			break
+		}
+		if strings.HasPrefix(a, "--preset=") {
+			name = a[len("--preset="):]
+			continue
+		}
+		if a == "--preset" {
+			if i+1 == len(args) {
+				return nil, fmt.Errorf("preset: --preset requires a name")
+			}
+			name = args[i+1]
+			i++
+			continue
+		}
+		rest = append(rest, a)
+	}
+	if name == "" {
+		return args, nil
+	}
+	p, err := Get(name)
+	if err != nil {
+		return nil, err
+	}
+	// --preset is kept at the end of the preset flags so that a list flag does not take the
+	// arguments that follow, such as the script.
+	expanded := append(p.Args(), "--preset", name)
+	return append(expanded, rest...), nil
+}
@@ -0,0 +1,410 @@
+package price
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/base2genomics/batchit"
+	"github.com/base2genomics/batchit/cost"
+	"github.com/base2genomics/batchit/spotadvisor"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/batch"
+	batchtypes "github.com/aws/aws-sdk-go-v2/service/batch/types"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+type cliargs struct {
+	Region   string `arg:"env:AWS_DEFAULT_REGION,help:region for batch setup. see batchit help for the default."`
+	Queue    string `arg:"required,help:job queue whose compute environments are shown."`
+	Capacity int64  `arg:"help:also show the spot placement score (1-10) of each zone for this many vCPUs."`
+	JSON     bool   `arg:"help:print a JSON array rather than a table."`
+}
+
+func (c cliargs) Version() string {
+	return batchit.Version
+}
+
+func (c cliargs) Description() string {
+	return `Show the instance types that the compute environments of a queue can start with the current spot
+price in each of their zones, the on-demand price and how often spot instances of the type are interrupted
+(from the AWS Spot Instance Advisor) to help decide whether to submit to a spot queue now or to an
+on-demand queue. Zones are those of the subnets of each compute environment.`
+}
+
+// families are used for the instance types that batch chooses itself. optimal uses the 5th generation
+// families in regions without the 4th.
+var families = map[string][][]string{
+	"optimal":        {{"c4", "m4", "r4"}, {"c5", "m5", "r5"}},
+	"default_x86_64": {{"c4", "m4", "r4"}, {"c5", "m5", "r5"}},
+	"default_arm64":  {{"c6g", "m6g", "r6g"}},
+}
+
+// Row is an instance type of a compute environment.
+type Row struct {
+	ComputeEnvironment string `json:"compute_environment"`
+	// Spot is true if the compute environment starts spot instances.
+	Spot         bool   `json:"spot"`
+	InstanceType string `json:"instance_type"`
+	VCPUs        int64  `json:"vcpus"`
+	Memory       int64  `json:"memory"`
+	// OnDemand is the hourly on-demand price. It is 0 if it could not be found.
+	OnDemand float64 `json:"on_demand"`
+	// MinSpot is the lowest current spot price in Zones. It is 0 if there is no spot price.
+	MinSpot float64 `json:"min_spot"`
+	// Zones is the current spot price in each zone of the compute environment.
+	Zones map[string]float64 `json:"zones"`
+	// Savings is the percent saved over on-demand according to the advisor.
+	Savings      int    `json:"savings"`
+	Interruption string `json:"interruption"`
+	// Rank is the interruption range with 0 the least often interrupted.
+	Rank int `json:"-"`
+}
+
+// Environments returns the compute environments of queue in the order they are used.
+func Environments(ctx context.Context, b *batch.Client, queue string) ([]*batchtypes.ComputeEnvironmentDetail, error) {
+	qo, err := b.DescribeJobQueues(ctx, &batch.DescribeJobQueuesInput{JobQueues: []string{queue}})
+	if err != nil {
+		return nil, err
+	}
+	if len(qo.JobQueues) == 0 {
+		return nil, fmt.Errorf("price: queue %s not found", queue)
+	}
+	order := qo.JobQueues[0].ComputeEnvironmentOrder
+	sort.SliceStable(order, func(i, j int) bool { return aws.ToInt32(order[i].Order) < aws.ToInt32(order[j].Order) })
+	var names []string
+	for _, o := range order {
+		names = append(names, aws.ToString(o.ComputeEnvironment))
+	}
+	co, err := b.DescribeComputeEnvironments(ctx, &batch.DescribeComputeEnvironmentsInput{ComputeEnvironments: names})
+	if err != nil {
+		return nil, err
+	}
+	byArn := make(map[string]*batchtypes.ComputeEnvironmentDetail, len(co.ComputeEnvironments))
+	for i := range co.ComputeEnvironments {
+		ce := &co.ComputeEnvironments[i]
+		byArn[aws.ToString(ce.ComputeEnvironmentArn)] = ce
+		byArn[aws.ToString(ce.ComputeEnvironmentName)] = ce
+	}
+	var out []*batchtypes.ComputeEnvironmentDetail
+	for _, n := range names {
+		if ce, ok := byArn[n]; ok {
+			out = append(out, ce)
+		}
+	}
+	return out, nil
+}
+
+// describeTypes returns a candidate for each instance type matching the filter values.
+func describeTypes(ctx context.Context, svc *ec2.Client, values []string) ([]*spotadvisor.Candidate, error) {
+	var out []*spotadvisor.Candidate
+	pages := ec2.NewDescribeInstanceTypesPaginator(svc, &ec2.DescribeInstanceTypesInput{
+		Filters: []ec2types.Filter{{Name: aws.String("instance-type"), Values: values}},
+	})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return out, err
+		}
+		for _, it := range page.InstanceTypes {
+			c := &spotadvisor.Candidate{InstanceType: string(it.InstanceType), Jobs: 1}
+			if it.VCpuInfo != nil {
+				c.VCPUs = int64(aws.ToInt32(it.VCpuInfo.DefaultVCpus))
+			}
+			if it.MemoryInfo != nil {
+				c.Memory = aws.ToInt64(it.MemoryInfo.SizeInMiB)
+			}
+			out = append(out, c)
+		}
+	}
+	return out, nil
+}
+
+// InstanceTypes expands the instance types of a compute environment, which may be families such as
+// m5 or optimal, to the instance types offered in the region.
+func InstanceTypes(ctx context.Context, svc *ec2.Client, types []string) ([]*spotadvisor.Candidate, error) {
+	var values []string
+	var out []*spotadvisor.Candidate
+	for _, t := range types {
+		if alts, ok := families[t]; ok {
+			for _, fams := range alts {
+				var vs []string
+				for _, f := range fams {
+					vs = append(vs, f+".*")
+				}
+				cands, err := describeTypes(ctx, svc, vs)
+				if err != nil {
+					return nil, err
+				}
+				if len(cands) > 0 {
+					out = append(out, cands...)
+					break
+				}
+			}
+		} else if strings.Contains(t, ".") {
+			values = append(values, t)
+		} else {
+			values = append(values, t+".*")
+		}
+	}
+	if len(values) > 0 {
+		cands, err := describeTypes(ctx, svc, values)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, cands...)
+	}
+	// a type may be listed both by family and by name.
+	seen := make(map[string]bool, len(out))
+	uniq := out[:0]
+	for _, c := range out {
+		if !seen[c.InstanceType] {
+			seen[c.InstanceType] = true
+			uniq = append(uniq, c)
+		}
+	}
+	return uniq, nil
+}
+
+// zones returns the availability zone of each subnet keyed by the zone id, e.g. use1-az1.
+func zones(ctx context.Context, svc *ec2.Client, subnets []string) (map[string]string, error) {
+	out, err := svc.DescribeSubnets(ctx, &ec2.DescribeSubnetsInput{SubnetIds: subnets})
+	if err != nil {
+		return nil, err
+	}
+	zs := make(map[string]string, len(out.Subnets))
+	for _, s := range out.Subnets {
+		zs[aws.ToString(s.AvailabilityZoneId)] = aws.ToString(s.AvailabilityZone)
+	}
+	return zs, nil
+}
+
+// Rows returns a row for each instance type of each managed compute environment in ces.
+// Each row has the spot prices in the zones of the environment and its interruption range from a.
+// The on-demand price is from p. If it can not be found, it is left at 0 and the error is logged.
+func Rows(ctx context.Context, svc *ec2.Client, p *cost.Pricer, a *spotadvisor.Advisor, ces []*batchtypes.ComputeEnvironmentDetail) ([]*Row, error) {
+	var rows []*Row
+	onDemand := true
+	for _, ce := range ces {
+		cr := ce.ComputeResources
+		if cr == nil {
+			log.Printf("[batchit price] skipping unmanaged compute environment %s", aws.ToString(ce.ComputeEnvironmentName))
+			continue
+		}
+		crType := cr.Type
+		if crType == batchtypes.CRTypeFargate || crType == batchtypes.CRTypeFargateSpot {
+			log.Printf("[batchit price] skipping fargate compute environment %s", aws.ToString(ce.ComputeEnvironmentName))
+			continue
+		}
+		cands, err := InstanceTypes(ctx, svc, cr.InstanceTypes)
+		if err != nil {
+			return nil, err
+		}
+		if cands, err = spotadvisor.SetPrices(ctx, svc, cands); err != nil {
+			return nil, err
+		}
+		a.Rank(p.Region, cands)
+		zs, err := zones(ctx, svc, cr.Subnets)
+		if err != nil {
+			return nil, err
+		}
+		inCE := make(map[string]bool, len(zs))
+		for _, z := range zs {
+			inCE[z] = true
+		}
+		for _, c := range cands {
+			r := &Row{
+				ComputeEnvironment: aws.ToString(ce.ComputeEnvironmentName),
+				Spot:               crType == batchtypes.CRTypeSpot,
+				InstanceType:       c.InstanceType,
+				VCPUs:              c.VCPUs,
+				Memory:             c.Memory,
+				Zones:              make(map[string]float64),
+				Savings:            c.Savings,
+				Interruption:       c.Interruption,
+				Rank:               c.Rank,
+			}
+			for z, v := range c.ZonePrices {
+				if !inCE[z] {
+					continue
+				}
+				r.Zones[z] = v
+				if r.MinSpot == 0 || v < r.MinSpot {
+					r.MinSpot = v
+				}
+			}
+			// the pricing API is often not allowed so give up after the first error.
+			if onDemand {
+				if r.OnDemand, err = p.Hourly(ctx, &cost.Instance{Type: c.InstanceType}); err != nil {
+					log.Printf("[batchit price] on-demand prices are not shown: %s", err)
+					onDemand = false
+				}
+			}
+			rows = append(rows, r)
+		}
+	}
+	return rows, nil
+}
+
+// Scores returns the spot placement score of each zone of ce for capacity vCPUs of its instance types.
+func Scores(ctx context.Context, svc *ec2.Client, region string, ce *batchtypes.ComputeEnvironmentDetail, rows []*Row, capacity int64) (map[string]int64, error) {
+	var types []string
+	for _, r := range rows {
+		if r.ComputeEnvironment == aws.ToString(ce.ComputeEnvironmentName) {
+			types = append(types, r.InstanceType)
+		}
+	}
+	if len(types) == 0 {
+		return nil, nil
+	}
+	zs, err := zones(ctx, svc, ce.ComputeResources.Subnets)
+	if err != nil {
+		return nil, err
+	}
+	scores := make(map[string]int64)
+	pages := ec2.NewGetSpotPlacementScoresPaginator(svc, &ec2.GetSpotPlacementScoresInput{
+		InstanceTypes:          types,
+		RegionNames:            []string{region},
+		SingleAvailabilityZone: aws.Bool(true),
+		TargetCapacity:         aws.Int32(int32(capacity)),
+		TargetCapacityUnitType: ec2types.TargetCapacityUnitTypeVcpu,
+	})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return scores, err
+		}
+		for _, s := range page.SpotPlacementScores {
+			// scores are for every zone of the region so keep those of the subnets.
+			if z, ok := zs[aws.ToString(s.AvailabilityZoneId)]; ok {
+				scores[z] = int64(aws.ToInt32(s.Score))
+			}
+		}
+	}
+	return scores, nil
+}
+
+// zoneList formats the zone values using only the zone letter, e.g. a:0.0312 b:0.0330.
+func zoneList(zs map[string]float64, format string) string {
+	keys := make([]string, 0, len(zs))
+	for z := range zs {
+		keys = append(keys, z)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, z := range keys {
+		parts = append(parts, z[len(z)-1:]+":"+fmt.Sprintf(format, zs[z]))
+	}
+	return strings.Join(parts, " ")
+}
+
+func dollars(v float64) string {
+	if v == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.4f", v)
+}
+
+// WriteTable writes the rows as a table.
+func WriteTable(w io.Writer, rows []*Row) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "CE\tTYPE\tVCPUS\tMEMORY\tON-DEMAND $/H\tMIN SPOT $/H\tSAVINGS\tINTERRUPTION\tZONES")
+	for _, r := range rows {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%s\t%s\t%d%%\t%s\t%s\n", r.ComputeEnvironment, r.InstanceType, r.VCPUs, r.Memory,
+			dollars(r.OnDemand), dollars(r.MinSpot), r.Savings, r.Interruption, zoneList(r.Zones, "%.4f"))
+	}
+	return tw.Flush()
+}
+
+// Advice returns a suggestion for jobs submitted to a queue with rows or "" if there is none.
+func Advice(queue string, rows []*Row) string {
+	var spot, often int
+	for _, r := range rows {
+		if !r.Spot {
+			continue
+		}
+		spot++
+		// ranges 0 to 2 are interrupted less than 15% of the time.
+		if r.Rank > 2 {
+			often++
+		}
+	}
+	if spot == 0 {
+		return fmt.Sprintf("%s only starts on-demand instances", queue)
+	}
+	if often*2 > spot {
+		return fmt.Sprintf("%d of the %d spot instance types of %s are interrupted more than 15%% of the time. consider an on-demand queue for long jobs", often, spot, queue)
+	}
+	return ""
+}
+
+func Main() {
+	cli := &cliargs{}
+	p := batchit.MustParse(cli)
+	if cli.Capacity < 0 {
+		p.Fail("--capacity must be positive")
+	}
+	ctx := context.Background()
+	cfg, err := batchit.LoadConfig(ctx, cli.Region)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cli.Region = cfg.Region
+	svc := ec2.NewFromConfig(cfg)
+
+	ces, err := Environments(ctx, batch.NewFromConfig(cfg), cli.Queue)
+	if err != nil {
+		log.Fatal(err)
+	}
+	a, err := spotadvisor.ReadAdvisor()
+	if err != nil {
+		log.Fatal(err)
+	}
+	now := time.Now()
+	rows, err := Rows(ctx, svc, cost.NewPricer(cfg, now, now), a, ces)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(rows) == 0 {
+		log.Fatalf("[batchit price] no instance types found for %s", cli.Queue)
+	}
+
+	if cli.JSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(rows); err != nil {
+			log.Fatal(err)
+		}
+	} else if err := WriteTable(os.Stdout, rows); err != nil {
+		log.Fatal(err)
+	}
+
+	if cli.Capacity > 0 {
+		for _, ce := range ces {
+			if ce.ComputeResources == nil || ce.ComputeResources.Type != batchtypes.CRTypeSpot {
+				continue
+			}
+			scores, err := Scores(ctx, svc, cli.Region, ce, rows, cli.Capacity)
+			if err != nil {
+				log.Fatal(err)
+			}
+			fs := make(map[string]float64, len(scores))
+			for z, s := range scores {
+				fs[z] = float64(s)
+			}
+			log.Printf("[batchit price] placement scores for %d vCPUs in %s: %s", cli.Capacity, aws.ToString(ce.ComputeEnvironmentName), zoneList(fs, "%.0f"))
+		}
+	}
+	if msg := Advice(cli.Queue, rows); msg != "" {
+		log.Printf("[batchit price] %s", msg)
+	}
+}
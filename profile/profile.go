@@ -0,0 +1,259 @@
+package profile
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/base2genomics/batchit"
+	"github.com/base2genomics/batchit/exec"
+	"github.com/base2genomics/batchit/logof"
+	"github.com/base2genomics/batchit/ls"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/batch"
+	batchtypes "github.com/aws/aws-sdk-go-v2/service/batch/types"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+)
+
+type cliargs struct {
+	Region     string  `arg:"env:AWS_DEFAULT_REGION,help:region for batch setup. see batchit help for the default."`
+	Queue      string  `arg:"required,help:job queue that the jobs ran in."`
+	Name       string  `arg:"required" help:"name of the jobs to profile. may be a glob, e.g. 'align-*'."`
+	Since      string  `help:"include jobs created within this duration before now, e.g. 12h or 30d."`
+	Percentile float64 `arg:"help:percentile of the usage of the jobs to size for."`
+	Headroom   float64 `help:"fraction added to the usage, e.g. 0.2 for 20%."`
+	Submit     bool    `arg:"help:print only the --cpus and --mem flags for batchit submit."`
+}
+
+func (c cliargs) Version() string {
+	return batchit.Version
+}
+
+func (c cliargs) Description() string {
+	return `Recommend vCPUs and memory for jobs from the utilization of past jobs with the same name.
+Utilization is read from the ECS Container Insights performance logs, so Container Insights must be enabled
+on the ECS clusters of the compute environments (aws ecs update-cluster-settings --cluster NAME
+--settings name=containerInsights,value=enabled). The memory of each job is its peak and the vCPUs are the
+95th percentile of its samples. The recommendation is the --percentile of these across jobs plus --headroom.`
+}
+
+// PerformanceGroup returns the log group with the Container Insights performance events of a cluster.
+func PerformanceGroup(cluster string) string {
+	// the cluster may be an ARN: arn:aws:ecs:region:account:cluster/name
+	return "/aws/ecs/containerinsights/" + cluster[strings.LastIndex(cluster, "/")+1:] + "/performance"
+}
+
+// Sample is a Container Insights performance event for a task.
+type Sample struct {
+	Timestamp int64 `json:"Timestamp"`
+	// CpuUtilized is in CPU units of which there are 1024 per vCPU.
+	CpuUtilized float64 `json:"CpuUtilized"`
+	// MemoryUtilized is in MiB.
+	MemoryUtilized float64 `json:"MemoryUtilized"`
+}
+
+// Samples returns the performance events of a task between start and end (ms).
+func Samples(ctx context.Context, cloud *cloudwatchlogs.Client, cluster, taskId string, start, end int64) ([]Sample, error) {
+	var out []Sample
+	pages := cloudwatchlogs.NewFilterLogEventsPaginator(cloud, &cloudwatchlogs.FilterLogEventsInput{
+		LogGroupName:  aws.String(PerformanceGroup(cluster)),
+		FilterPattern: aws.String(fmt.Sprintf(`{ $.Type = "Task" && $.TaskId = "%s" }`, taskId)),
+		StartTime:     aws.Int64(start),
+		EndTime:       aws.Int64(end),
+	})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return out, err
+		}
+		for _, ev := range page.Events {
+			var s Sample
+			if err := json.Unmarshal([]byte(aws.ToString(ev.Message)), &s); err != nil {
+				return out, err
+			}
+			out = append(out, s)
+		}
+	}
+	return out, nil
+}
+
+// Usage is the requested and used resources of a job.
+type Usage struct {
+	JobId  string
+	VCPUs  float64
+	Memory int64
+	// UsedVCPUs is the 95th percentile of the samples and UsedMemory (MiB) is the peak.
+	UsedVCPUs  float64
+	UsedMemory float64
+	Samples    int
+}
+
+// Percentile returns the pth percentile (0-100) of vs by the nearest rank. vs is sorted in place.
+func Percentile(vs []float64, p float64) float64 {
+	if len(vs) == 0 {
+		return 0
+	}
+	sort.Float64s(vs)
+	i := int(math.Ceil(p/100*float64(len(vs)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return vs[i]
+}
+
+// JobUsage returns the usage of the last attempt of j. Samples is 0 if there are no performance events.
+func JobUsage(ctx context.Context, cfg aws.Config, b *batch.Client, cloud *cloudwatchlogs.Client, j *batchtypes.JobDetail) (*Usage, error) {
+	u := &Usage{JobId: aws.ToString(j.JobId)}
+	if j.Container == nil || j.Container.TaskArn == nil || j.StartedAt == nil {
+		return u, nil
+	}
+	u.VCPUs, u.Memory = float64(aws.ToInt32(j.Container.Vcpus)), int64(aws.ToInt32(j.Container.Memory))
+	for _, r := range j.Container.ResourceRequirements {
+		switch r.Type {
+		case batchtypes.ResourceTypeVcpu:
+			u.VCPUs, _ = strconv.ParseFloat(aws.ToString(r.Value), 64)
+		case batchtypes.ResourceTypeMemory:
+			u.Memory, _ = strconv.ParseInt(aws.ToString(r.Value), 10, 64)
+		}
+	}
+	cluster, err := exec.Cluster(ctx, cfg, b, j)
+	if err != nil {
+		return nil, err
+	}
+	arn := aws.ToString(j.Container.TaskArn)
+	end := aws.ToInt64(j.StoppedAt)
+	if end == 0 {
+		end = time.Now().UnixNano() / int64(time.Millisecond)
+	}
+	// events are written each minute so allow for the last one after the task stops.
+	ss, err := Samples(ctx, cloud, cluster, arn[strings.LastIndex(arn, "/")+1:], *j.StartedAt, end+2*60*1000)
+	if err != nil {
+		return nil, err
+	}
+	cpus := make([]float64, len(ss))
+	for i, s := range ss {
+		cpus[i] = s.CpuUtilized / 1024
+		u.UsedMemory = math.Max(u.UsedMemory, s.MemoryUtilized)
+	}
+	u.UsedVCPUs = Percentile(cpus, 95)
+	u.Samples = len(ss)
+	return u, nil
+}
+
+// Recommend returns the vCPUs and memory (MiB) that cover the pth percentile of the usage of the
+// jobs with headroom added. Memory is rounded up to a multiple of 256 MiB.
+func Recommend(us []*Usage, p, headroom float64) (vcpus int, memory int) {
+	var cpus, mems []float64
+	for _, u := range us {
+		if u.Samples == 0 {
+			continue
+		}
+		cpus = append(cpus, u.UsedVCPUs)
+		mems = append(mems, u.UsedMemory)
+	}
+	if len(cpus) == 0 {
+		return 0, 0
+	}
+	vcpus = int(math.Ceil(Percentile(cpus, p) * (1 + headroom)))
+	if vcpus < 1 {
+		vcpus = 1
+	}
+	memory = int(math.Ceil(Percentile(mems, p)*(1+headroom)/256)) * 256
+	if memory < 256 {
+		memory = 256
+	}
+	return vcpus, memory
+}
+
+// WriteTable writes the usage of each job as a table.
+func WriteTable(w io.Writer, us []*Usage) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "JOB\tVCPUS\tUSED VCPUS\tMEMORY\tPEAK MEMORY\tSAMPLES")
+	for _, u := range us {
+		if u.Samples == 0 {
+			fmt.Fprintf(tw, "%s\t%g\t-\t%d\t-\t0\n", u.JobId, u.VCPUs, u.Memory)
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%g\t%.2f\t%d\t%.0f\t%d\n", u.JobId, u.VCPUs, u.UsedVCPUs, u.Memory, u.UsedMemory, u.Samples)
+	}
+	return tw.Flush()
+}
+
+func Main() {
+	cli := &cliargs{Since: "30d", Percentile: 95, Headroom: 0.2}
+	p := batchit.MustParse(cli)
+	if cli.Percentile <= 0 || cli.Percentile > 100 {
+		p.Fail("--percentile must be greater than 0 and at most 100")
+	}
+	d, err := logof.ParseDuration(cli.Since)
+	if err != nil {
+		p.Fail(err.Error())
+	}
+	ctx := context.Background()
+	cfg, err := batchit.LoadConfig(ctx, cli.Region)
+	if err != nil {
+		log.Fatal(err)
+	}
+	b := batch.NewFromConfig(cfg)
+	cloud := cloudwatchlogs.NewFromConfig(cfg)
+
+	sums, err := ls.List(ctx, b, ls.Query{Queue: cli.Queue, Statuses: []batchtypes.JobStatus{batchtypes.JobStatusSucceeded}, Since: time.Now().Add(-d), NameGlob: cli.Name})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(sums) == 0 {
+		log.Fatalf("[batchit profile] no jobs named %s succeeded in %s in the last %s", cli.Name, cli.Queue, cli.Since)
+	}
+	ids := make([]string, len(sums))
+	for i, s := range sums {
+		ids[i] = *s.JobId
+	}
+	jobs, err := logof.DescribeJobs(ctx, b, ids)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if jobs, err = logof.Expand(ctx, b, jobs); err != nil {
+		log.Fatal(err)
+	}
+
+	var us []*Usage
+	missing := 0
+	for _, j := range jobs {
+		u, err := JobUsage(ctx, cfg, b, cloud, j)
+		if err != nil {
+			log.Printf("[batchit profile] error getting usage of %s: %s", aws.ToString(j.JobId), err)
+			missing++
+			continue
+		}
+		if u.Samples == 0 {
+			missing++
+		}
+		us = append(us, u)
+	}
+	if !cli.Submit {
+		if err := WriteTable(os.Stdout, us); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if missing > 0 {
+		log.Printf("[batchit profile] %d of %d jobs have no Container Insights data. is it enabled for the cluster?", missing, len(jobs))
+	}
+	vcpus, mem := Recommend(us, cli.Percentile, cli.Headroom)
+	if vcpus == 0 {
+		log.Fatal("[batchit profile] no usage found to make a recommendation")
+	}
+	log.Printf("[batchit profile] recommend %d vCPUs and %d MiB from %d jobs (p%g + %.0f%%)", vcpus, mem, len(jobs)-missing, cli.Percentile, 100*cli.Headroom)
+	if cli.Submit {
+		fmt.Printf("--cpus %d --mem %d\n", vcpus, mem)
+	}
+}
@@ -0,0 +1,155 @@
+package queues
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/base2genomics/batchit"
+	"github.com/base2genomics/batchit/ls"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/batch"
+	batchtypes "github.com/aws/aws-sdk-go-v2/service/batch/types"
+)
+
+type cliargs struct {
+	Region string   `arg:"env:AWS_DEFAULT_REGION,help:region for batch setup. see batchit help for the default."`
+	Active bool     `arg:"help:only count jobs that have not finished. this is much faster for queues with many finished jobs."`
+	JSON   bool     `arg:"help:print a JSON array rather than a table."`
+	Queues []string `arg:"positional,help:names of the queues to show. default is all."`
+}
+
+func (c cliargs) Version() string {
+	return batchit.Version
+}
+
+func (c cliargs) Description() string {
+	return `Show each job queue with its state, compute environments and the number of jobs in each status.`
+}
+
+// Queue summarizes a job queue.
+type Queue struct {
+	Name                string           `json:"name"`
+	State               string           `json:"state"`
+	Status              string           `json:"status"`
+	Priority            int64            `json:"priority"`
+	ComputeEnvironments []string         `json:"compute_environments"`
+	Jobs                map[string]int64 `json:"jobs"`
+}
+
+// Count returns the number of jobs in the queue with the given status.
+func Count(ctx context.Context, b *batch.Client, queue string, status batchtypes.JobStatus) (int64, error) {
+	var n int64
+	pages := batch.NewListJobsPaginator(b, &batch.ListJobsInput{JobQueue: aws.String(queue), JobStatus: status})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return n, err
+		}
+		n += int64(len(page.JobSummaryList))
+	}
+	return n, nil
+}
+
+// Summarize describes the queue and counts its jobs in each of statuses concurrently.
+func Summarize(ctx context.Context, b *batch.Client, q *batchtypes.JobQueueDetail, statuses []batchtypes.JobStatus) (Queue, error) {
+	s := Queue{
+		Name:     aws.ToString(q.JobQueueName),
+		State:    string(q.State),
+		Status:   string(q.Status),
+		Priority: int64(aws.ToInt32(q.Priority)),
+		Jobs:     make(map[string]int64, len(statuses)),
+	}
+	for _, ce := range q.ComputeEnvironmentOrder {
+		// show the name rather than the full ARN.
+		s.ComputeEnvironments = append(s.ComputeEnvironments, path.Base(aws.ToString(ce.ComputeEnvironment)))
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var err error
+	for _, status := range statuses {
+		wg.Add(1)
+		go func(status batchtypes.JobStatus) {
+			defer wg.Done()
+			n, cerr := Count(ctx, b, s.Name, status)
+			mu.Lock()
+			defer mu.Unlock()
+			if cerr != nil {
+				err = cerr
+			}
+			s.Jobs[string(status)] = n
+		}(status)
+	}
+	wg.Wait()
+	return s, err
+}
+
+// WriteTable writes the queues as aligned columns.
+func WriteTable(w io.Writer, qs []Queue, statuses []batchtypes.JobStatus) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprint(tw, "QUEUE\tSTATE\tPRIORITY\tCOMPUTE ENVIRONMENTS")
+	for _, s := range statuses {
+		fmt.Fprintf(tw, "\t%s", s)
+	}
+	fmt.Fprintln(tw)
+	for _, q := range qs {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s", q.Name, q.State, q.Priority, strings.Join(q.ComputeEnvironments, ","))
+		for _, s := range statuses {
+			fmt.Fprintf(tw, "\t%d", q.Jobs[string(s)])
+		}
+		fmt.Fprintln(tw)
+	}
+	return tw.Flush()
+}
+
+func Main() {
+	cli := &cliargs{}
+	batchit.MustParse(cli)
+	ctx := context.Background()
+	cfg, err := batchit.LoadConfig(ctx, cli.Region)
+	if err != nil {
+		log.Fatal(err)
+	}
+	b := batch.NewFromConfig(cfg)
+
+	statuses := ls.Statuses
+	if cli.Active {
+		statuses = statuses[:len(statuses)-2]
+	}
+
+	var details []batchtypes.JobQueueDetail
+	pages := batch.NewDescribeJobQueuesPaginator(b, &batch.DescribeJobQueuesInput{JobQueues: cli.Queues})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+		details = append(details, page.JobQueues...)
+	}
+	qs := make([]Queue, 0, len(details))
+	for i := range details {
+		q, err := Summarize(ctx, b, &details[i], statuses)
+		if err != nil {
+			log.Fatal(err)
+		}
+		qs = append(qs, q)
+	}
+	if cli.JSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(qs)
+	} else {
+		err = WriteTable(os.Stdout, qs, statuses)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,419 @@
+package quota
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/base2genomics/batchit"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/batch"
+	batchtypes "github.com/aws/aws-sdk-go-v2/service/batch/types"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	ecrtypes "github.com/aws/aws-sdk-go-v2/service/ecr/types"
+	"github.com/aws/aws-sdk-go-v2/service/servicequotas"
+)
+
+type cliargs struct {
+	Region    string  `arg:"env:AWS_DEFAULT_REGION,help:region for batch setup. see batchit help for the default."`
+	Threshold float64 `arg:"help:flag quotas whose usage is at least this fraction of the limit."`
+	NoECR     bool    `arg:"help:skip the ECR quotas which need a call for each repository."`
+	JSON      bool    `arg:"help:print a JSON array rather than a table."`
+}
+
+func (c cliargs) Version() string {
+	return batchit.Version
+}
+
+func (c cliargs) Description() string {
+	return `Show the usage and limit of the quotas that most often leave jobs RUNNABLE: the EC2 on-demand and spot
+vCPU quotas of each instance class (compared both with running instances and with the max vCPUs of the
+enabled compute environments that use that class), EBS storage and IOPS for each volume type, and ECR
+repositories and images. EBS has no quota on the number of volumes, so the number of volumes and of
+unattached volumes is shown without a limit. The exit code is 1 if any quota is flagged.`
+}
+
+// Usage is the use of a quota.
+type Usage struct {
+	Service string  `json:"service"`
+	Quota   string  `json:"quota"`
+	Used    float64 `json:"used"`
+	// Limit is 0 if the resource has no quota.
+	Limit float64 `json:"limit"`
+	Unit  string  `json:"unit"`
+}
+
+// Fraction returns the fraction of the limit that is used.
+func (u Usage) Fraction() float64 {
+	if u.Limit == 0 {
+		return 0
+	}
+	return u.Used / u.Limit
+}
+
+// Checker looks up quotas and their usage.
+type Checker struct {
+	cfg    aws.Config
+	sq     *servicequotas.Client
+	quotas map[string]map[string]float64
+}
+
+// New returns a Checker for the region of cfg.
+func New(cfg aws.Config) *Checker {
+	return &Checker{cfg: cfg, sq: servicequotas.NewFromConfig(cfg), quotas: make(map[string]map[string]float64)}
+}
+
+// Quotas returns the value of each quota of a service by name.
+func (c *Checker) Quotas(ctx context.Context, service string) (map[string]float64, error) {
+	if q, ok := c.quotas[service]; ok {
+		return q, nil
+	}
+	q := make(map[string]float64)
+	pages := servicequotas.NewListServiceQuotasPaginator(c.sq, &servicequotas.ListServiceQuotasInput{ServiceCode: aws.String(service)})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, sq := range page.Quotas {
+			q[aws.ToString(sq.QuotaName)] = aws.ToFloat64(sq.Value)
+		}
+	}
+	c.quotas[service] = q
+	return q, nil
+}
+
+// Class returns the name used in the EC2 vCPU quotas for the class of an instance type, e.g.
+// "Standard (A, C, D, H, I, M, R, T, Z)" for m5.xlarge and "G and VT" for g4dn.xlarge.
+// Batch's "optimal" uses C, M and R instances.
+func Class(itype string) string {
+	family := strings.ToLower(itype)
+	for i, r := range family {
+		if r < 'a' || r > 'z' {
+			family = family[:i]
+			break
+		}
+	}
+	switch family {
+	case "inf":
+		return "Inf"
+	case "dl":
+		return "DL"
+	case "trn":
+		return "Trn"
+	case "hpc":
+		return "HPC"
+	case "vt":
+		return "G and VT"
+	case "u":
+		return "High Memory"
+	}
+	if family == "optimal" || family == "" {
+		return "Standard (A, C, D, H, I, M, R, T, Z)"
+	}
+	switch family[0] {
+	case 'g':
+		return "G and VT"
+	case 'p', 'f', 'x':
+		return strings.ToUpper(family[:1])
+	}
+	return "Standard (A, C, D, H, I, M, R, T, Z)"
+}
+
+func onDemandQuota(class string) string {
+	return "Running On-Demand " + class + " instances"
+}
+
+func spotQuota(class string) string {
+	return "All " + class + " Spot Instance Requests"
+}
+
+// vcpus returns the vCPUs of an instance which is what the EC2 quotas count.
+func vcpus(in *ec2types.Instance) int64 {
+	if in.CpuOptions == nil {
+		return 0
+	}
+	return int64(aws.ToInt32(in.CpuOptions.CoreCount)) * int64(aws.ToInt32(in.CpuOptions.ThreadsPerCore))
+}
+
+// EC2 returns the vCPUs of the pending and running instances of each class against the on-demand
+// and spot quotas. The standard class is always included and others only when they are used.
+func (c *Checker) EC2(ctx context.Context) ([]Usage, error) {
+	q, err := c.Quotas(ctx, "ec2")
+	if err != nil {
+		return nil, err
+	}
+	onDemand := make(map[string]int64)
+	spot := make(map[string]int64)
+	pages := ec2.NewDescribeInstancesPaginator(ec2.NewFromConfig(c.cfg), &ec2.DescribeInstancesInput{
+		Filters: []ec2types.Filter{{Name: aws.String("instance-state-name"), Values: []string{"pending", "running"}}},
+	})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range page.Reservations {
+			for i := range r.Instances {
+				in := &r.Instances[i]
+				class := Class(string(in.InstanceType))
+				if in.InstanceLifecycle == ec2types.InstanceLifecycleTypeSpot {
+					spot[class] += vcpus(in)
+				} else {
+					onDemand[class] += vcpus(in)
+				}
+			}
+		}
+	}
+	std := Class("optimal")
+	var out []Usage
+	for _, class := range []string{std, "G and VT", "P", "F", "X", "Inf", "DL", "Trn", "HPC", "High Memory"} {
+		if class == std || onDemand[class] > 0 {
+			out = append(out, Usage{Service: "ec2", Quota: onDemandQuota(class), Used: float64(onDemand[class]), Limit: q[onDemandQuota(class)], Unit: "vCPU"})
+		}
+		if class == std || spot[class] > 0 {
+			out = append(out, Usage{Service: "ec2", Quota: spotQuota(class), Used: float64(spot[class]), Limit: q[spotQuota(class)], Unit: "vCPU"})
+		}
+	}
+	return out, nil
+}
+
+// Batch returns the max vCPUs of the enabled EC2 and spot compute environments of each instance
+// class against the EC2 quota for that class. A compute environment is counted in the class of its
+// first instance type. If the total is above the quota, Batch can't scale out as far as allowed.
+func (c *Checker) Batch(ctx context.Context) ([]Usage, error) {
+	q, err := c.Quotas(ctx, "ec2")
+	if err != nil {
+		return nil, err
+	}
+	type key struct {
+		class  string
+		market batchtypes.CRType
+	}
+	max := make(map[key]int64)
+	var keys []key
+	pages := batch.NewDescribeComputeEnvironmentsPaginator(batch.NewFromConfig(c.cfg), &batch.DescribeComputeEnvironmentsInput{})
+	for pages.HasMorePages() {
+		// the limits are compared with the current maximum vCPUs of the compute environments.
+		page, err := pages.NextPage(batchit.Fresh(ctx))
+		if err != nil {
+			return nil, err
+		}
+		for _, ce := range page.ComputeEnvironments {
+			cr := ce.ComputeResources
+			if cr == nil || ce.State != batchtypes.CEStateEnabled {
+				continue
+			}
+			market := cr.Type
+			if market != batchtypes.CRTypeEc2 && market != batchtypes.CRTypeSpot {
+				// fargate has its own quotas.
+				continue
+			}
+			class := Class("optimal")
+			if len(cr.InstanceTypes) > 0 {
+				class = Class(cr.InstanceTypes[0])
+			}
+			k := key{class, market}
+			if _, ok := max[k]; !ok {
+				keys = append(keys, k)
+			}
+			max[k] += int64(aws.ToInt32(cr.MaxvCpus))
+		}
+	}
+	var out []Usage
+	for _, k := range keys {
+		name := onDemandQuota(k.class)
+		if k.market == batchtypes.CRTypeSpot {
+			name = spotQuota(k.class)
+		}
+		out = append(out, Usage{Service: "batch", Quota: "max vCPUs of " + string(k.market) + " compute environments vs " + name, Used: float64(max[k]), Limit: q[name], Unit: "vCPU"})
+	}
+	return out, nil
+}
+
+// find returns the value of the first quota by name that has prefix and contains s.
+func find(q map[string]float64, prefix, s string) (float64, bool) {
+	names := make([]string, 0, len(q))
+	for name := range q {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if strings.HasPrefix(name, prefix) && strings.Contains(name, s) {
+			return q[name], true
+		}
+	}
+	return 0, false
+}
+
+// VolumeTypes are the EBS volume types with storage quotas. batchit ebsmount uses gp2 by default.
+var VolumeTypes = []string{"gp2", "gp3", "st1", "sc1", "io1", "io2"}
+
+// EBS returns the storage used by each volume type against its quota. gp2 and gp3 are always
+// included and other types only when they are used. The provisioned IOPS of io1 and io2 and the
+// number of volumes are also included.
+func (c *Checker) EBS(ctx context.Context) ([]Usage, error) {
+	q, err := c.Quotas(ctx, "ebs")
+	if err != nil {
+		return nil, err
+	}
+	size := make(map[string]int64)
+	iops := make(map[string]int64)
+	var n, unattached int64
+	pages := ec2.NewDescribeVolumesPaginator(ec2.NewFromConfig(c.cfg), &ec2.DescribeVolumesInput{})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range page.Volumes {
+			t := string(v.VolumeType)
+			size[t] += int64(aws.ToInt32(v.Size))
+			iops[t] += int64(aws.ToInt32(v.Iops))
+			n++
+			if v.State == ec2types.VolumeStateAvailable {
+				unattached++
+			}
+		}
+	}
+	var out []Usage
+	for _, t := range VolumeTypes {
+		if size[t] == 0 && t != "gp2" && t != "gp3" {
+			continue
+		}
+		// quotas are named e.g. "Storage for General Purpose SSD (gp2) volumes, in TiB".
+		if v, ok := find(q, "Storage for ", "("+t+")"); ok {
+			out = append(out, Usage{Service: "ebs", Quota: t + " storage", Used: float64(size[t]), Limit: v * 1024, Unit: "GiB"})
+		}
+		if v, ok := find(q, "IOPS for ", "("+t+")"); ok && (t == "io1" || t == "io2") {
+			out = append(out, Usage{Service: "ebs", Quota: t + " IOPS", Used: float64(iops[t]), Limit: v, Unit: "IOPS"})
+		}
+	}
+	out = append(out, Usage{Service: "ebs", Quota: "volumes", Used: float64(n), Unit: "volumes"},
+		Usage{Service: "ebs", Quota: "unattached volumes", Used: float64(unattached), Unit: "volumes"})
+	return out, nil
+}
+
+// ECR returns the number of repositories and the most images in any repository against their quotas.
+func (c *Checker) ECR(ctx context.Context) ([]Usage, error) {
+	q, err := c.Quotas(ctx, "ecr")
+	if err != nil {
+		return nil, err
+	}
+	svc := ecr.NewFromConfig(c.cfg)
+	var repos []ecrtypes.Repository
+	pages := ecr.NewDescribeRepositoriesPaginator(svc, &ecr.DescribeRepositoriesInput{})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		repos = append(repos, page.Repositories...)
+	}
+	var most int
+	var biggest string
+	for _, r := range repos {
+		n := 0
+		images := ecr.NewListImagesPaginator(svc, &ecr.ListImagesInput{RepositoryName: r.RepositoryName})
+		for images.HasMorePages() {
+			page, err := images.NextPage(ctx)
+			if err != nil {
+				return nil, err
+			}
+			n += len(page.ImageIds)
+		}
+		if n > most {
+			most, biggest = n, aws.ToString(r.RepositoryName)
+		}
+	}
+	var out []Usage
+	if v, ok := find(q, "Registered repositories", ""); ok {
+		out = append(out, Usage{Service: "ecr", Quota: "repositories", Used: float64(len(repos)), Limit: v, Unit: "repositories"})
+	}
+	if v, ok := find(q, "Images per repository", ""); ok {
+		out = append(out, Usage{Service: "ecr", Quota: "images in " + biggest, Used: float64(most), Limit: v, Unit: "images"})
+	}
+	return out, nil
+}
+
+// Flagged returns the usages that are at least threshold of their limit.
+func Flagged(us []Usage, threshold float64) []Usage {
+	var out []Usage
+	for _, u := range us {
+		if u.Limit > 0 && u.Fraction() >= threshold {
+			out = append(out, u)
+		}
+	}
+	return out
+}
+
+// WriteTable writes the usages as a table with a ! next to those at least threshold of their limit.
+func WriteTable(w io.Writer, us []Usage, threshold float64) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "\tSERVICE\tQUOTA\tUSED\tLIMIT\tUSE%")
+	for _, u := range us {
+		flag, limit, pct := "", "-", "-"
+		if u.Limit > 0 {
+			limit = fmt.Sprintf("%.0f", u.Limit)
+			pct = fmt.Sprintf("%.0f%%", 100*u.Fraction())
+			if u.Fraction() >= threshold {
+				flag = "!"
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%.0f %s\t%s\t%s\n", flag, u.Service, u.Quota, u.Used, u.Unit, limit, pct)
+	}
+	return tw.Flush()
+}
+
+func Main() {
+	cli := &cliargs{Threshold: 0.8}
+	p := batchit.MustParse(cli)
+	if cli.Threshold <= 0 || cli.Threshold > 1 {
+		p.Fail("--threshold must be greater than 0 and at most 1")
+	}
+	ctx := context.Background()
+	cfg, err := batchit.LoadConfig(ctx, cli.Region)
+	if err != nil {
+		log.Fatal(err)
+	}
+	c := New(cfg)
+
+	checks := []struct {
+		name string
+		f    func(context.Context) ([]Usage, error)
+	}{{"ec2", c.EC2}, {"batch", c.Batch}, {"ebs", c.EBS}, {"ecr", c.ECR}}
+	var us []Usage
+	for _, ch := range checks {
+		if ch.name == "ecr" && cli.NoECR {
+			continue
+		}
+		u, err := ch.f(ctx)
+		if err != nil {
+			// report what can be found even if some calls aren't allowed.
+			log.Printf("[batchit quota] error getting %s quotas: %s", ch.name, err)
+			continue
+		}
+		us = append(us, u...)
+	}
+	if cli.JSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(us); err != nil {
+			log.Fatal(err)
+		}
+	} else if err := WriteTable(os.Stdout, us, cli.Threshold); err != nil {
+		log.Fatal(err)
+	}
+	if len(Flagged(us, cli.Threshold)) > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,159 @@
+package batchit
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+)
+
+// The sources of a region as given by RegionSource, in the order that LoadConfig tries them.
+const (
+	RegionFromFlag       = "--region"
+	RegionFromArgument   = "argument"
+	RegionFromEnv        = "$AWS_REGION"
+	RegionFromDefaultEnv = "$AWS_DEFAULT_REGION"
+	RegionFromConfig     = "config file"
+	RegionFromProfile    = "profile"
+	RegionFromInstance   = "instance metadata"
+	RegionFromDefault    = "default"
+)
+
+// DebugRegionEnvVar is the environment variable that sets DebugRegion if --debug-region is not given.
+const DebugRegionEnvVar = "BATCHIT_DEBUG_REGION"
+
+// DebugRegion is set from the --debug-region flag that every subcommand accepts or
+// $BATCHIT_DEBUG_REGION. LoadConfig then logs each region and where it came from.
+var DebugRegion bool
+
+// instanceTimeout is how long to wait for the instance metadata service. Off EC2, the request
+// only ends with the timeout so it is short.
+const instanceTimeout = time.Second
+
+// flagRegion is the --region of the subcommand and its source after MustParse.
+var flagRegion struct {
+	region, source string
+}
+
+// regionSource is added to the ConfigSources of the config from LoadConfig.
+type regionSource string
+
+// RegionSource returns where the region of cfg from LoadConfig came from, e.g. $AWS_REGION.
+func RegionSource(cfg aws.Config) string {
+	for _, s := range cfg.ConfigSources {
+		if r, ok := s.(regionSource); ok {
+			return string(r)
+		}
+	}
+	return ""
+}
+
+// envRegion returns the region from $AWS_REGION or $AWS_DEFAULT_REGION. As for the AWS CLI
+// and SDKs, $AWS_REGION is used first.
+func envRegion() (string, string) {
+	if r := os.Getenv("AWS_REGION"); r != "" {
+		return r, RegionFromEnv
+	}
+	if r := os.Getenv("AWS_DEFAULT_REGION"); r != "" {
+		return r, RegionFromDefaultEnv
+	}
+	return "", ""
+}
+
+// explicitRegion returns region and its source if it was given by the subcommand, or else the
+// region from the environment or the config file. The region of a subcommand that is from its
+// --region flag has the source of the flag from MustParse.
+func explicitRegion(region string) (string, string) {
+	if region != "" {
+		if region == flagRegion.region {
+			return region, flagRegion.source
+		}
+		return region, RegionFromArgument
+	}
+	if r, source := envRegion(); r != "" {
+		return r, source
+	}
+	if v, ok := defaults.Section(Command)["region"]; ok {
+		return fmt.Sprint(v), RegionFromConfig
+	}
+	return "", ""
+}
+
+// profileName is the profile that LoadConfig uses.
+func profileName() string {
+	if Profile != "" {
+		return Profile
+	}
+	if p := os.Getenv("AWS_PROFILE"); p != "" {
+		return p
+	}
+	return "default"
+}
+
+var instance struct {
+	once   sync.Once
+	region string
+}
+
+// instanceRegion returns the region of the EC2 instance this is running on from the instance
+// metadata service or "" if it is not on EC2 or $AWS_EC2_METADATA_DISABLED is true. It is only
+// requested once.
+func instanceRegion(ctx context.Context, cfg aws.Config) string {
+	instance.once.Do(func() {
+		ctx, cancel := context.WithTimeout(ctx, instanceTimeout)
+		defer cancel()
+		svc := imds.NewFromConfig(cfg, func(o *imds.Options) { o.Retryer = aws.NopRetryer{} })
+		if out, err := svc.GetRegion(ctx, &imds.GetRegionInput{}); err == nil {
+			instance.region = out.Region
+		}
+	})
+	return instance.region
+}
+
+// resolveFlagRegion sets the --region field of a subcommand after parsing so that it follows
+// the order of LoadConfig: the flag, $AWS_REGION, $AWS_DEFAULT_REGION and then the config file.
+// go-arg only knows the one environment variable in the tag of the field. fromConfig is true if
+// the field was set from the config file.
+func resolveFlagRegion(f reflect.Value, fromConfig bool) {
+	source := ""
+	switch {
+	case argGiven(os.Args[1:], "--region"):
+		source = RegionFromFlag
+	case os.Getenv("AWS_REGION") != "" || os.Getenv("AWS_DEFAULT_REGION") != "":
+		var region string
+		region, source = envRegion()
+		f.SetString(region)
+	case fromConfig && f.String() != "":
+		source = RegionFromConfig
+	}
+	if source != "" {
+		flagRegion.region, flagRegion.source = f.String(), source
+	}
+}
+
+// argGiven is true if flag is in args before any --.
+func argGiven(args []string, flag string) bool {
+	for _, a := range args {
+		if a == "--" {
+			return false
+		}
+		if a == flag || strings.HasPrefix(a, flag+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+// logRegion logs the region of a config and its source with --debug-region.
+func logRegion(region, source string) {
+	if DebugRegion {
+		log.Printf("[batchit %s] region %s from %s", Command, region, source)
+	}
+}
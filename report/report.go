@@ -0,0 +1,328 @@
+package report
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	htemplate "html/template"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/base2genomics/batchit"
+	"github.com/base2genomics/batchit/cost"
+	"github.com/base2genomics/batchit/logof"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/batch"
+	batchtypes "github.com/aws/aws-sdk-go-v2/service/batch/types"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+)
+
+type cliargs struct {
+	Region string   `arg:"env:AWS_DEFAULT_REGION,help:region for batch setup. see batchit help for the default."`
+	Jobs   string   `arg:"help:file of whitespace-separated job ids to report on. use - for stdin."`
+	Out    string   `arg:"help:file to write. HTML if it ends in .html and Markdown otherwise. default is Markdown to stdout."`
+	Title  string   `arg:"help:title of the report."`
+	Tail   int64    `arg:"help:number of lines of the log of each failed job to include."`
+	JobIds []string `arg:"positional,help:job id(s) to report on in addition to those in --jobs."`
+}
+
+func (c cliargs) Version() string {
+	return batchit.Version
+}
+
+func (c cliargs) Description() string {
+	return `Write a report of a set of jobs, e.g. the jobs of a pipeline run, that can be shared for sign-off.
+It has the status, exit code, runtime, requested vCPUs and memory, instance type and estimated cost of each
+job (array jobs are expanded to their children) with the end of the log of each job that failed.
+Costs are estimated as for batchit cost.`
+}
+
+// Entry is a job in the report.
+type Entry struct {
+	JobId    string
+	Name     string
+	Queue    string
+	Status   string
+	Reason   string
+	ExitCode string
+	Attempts int
+	VCPUs    float64
+	Memory   int64
+	Instance string
+	Created  time.Time
+	Runtime  time.Duration
+	Cost     float64
+	Unpriced int
+	// LogTail is the end of the log of a failed job.
+	LogTail []string
+}
+
+// Report is a set of jobs with totals.
+type Report struct {
+	Title     string
+	Generated time.Time
+	Entries   []Entry
+	// Counts is the number of jobs in each status.
+	Counts   map[string]int
+	Runtime  time.Duration
+	Cost     float64
+	Unpriced int
+}
+
+// Statuses returns the keys of Counts in the order jobs pass through them.
+func (r *Report) Statuses() []string {
+	var ss []string
+	for s := range r.Counts {
+		ss = append(ss, s)
+	}
+	order := map[string]int{}
+	for i, s := range []batchtypes.JobStatus{batchtypes.JobStatusSubmitted, batchtypes.JobStatusPending, batchtypes.JobStatusRunnable,
+		batchtypes.JobStatusStarting, batchtypes.JobStatusRunning, batchtypes.JobStatusSucceeded, batchtypes.JobStatusFailed} {
+		order[string(s)] = i
+	}
+	sort.Slice(ss, func(i, j int) bool { return order[ss[i]] < order[ss[j]] })
+	return ss
+}
+
+// Tail returns the last n lines of a log stream.
+func Tail(ctx context.Context, cloud *cloudwatchlogs.Client, stream string, n int64) ([]string, error) {
+	out, err := cloud.GetLogEvents(ctx, &cloudwatchlogs.GetLogEventsInput{
+		LogGroupName:  aws.String(logof.LogGroup),
+		LogStreamName: aws.String(stream),
+		StartFromHead: aws.Bool(false),
+		Limit:         aws.Int32(int32(n)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	lines := make([]string, len(out.Events))
+	for i, e := range out.Events {
+		lines[i] = strings.TrimRight(aws.ToString(e.Message), "\n")
+	}
+	return lines, nil
+}
+
+func fromMillis(ms int64) time.Time {
+	return time.Unix(0, ms*int64(time.Millisecond)).UTC()
+}
+
+// Build returns the report for jobs including up to tail lines of the log of each failed job.
+func Build(ctx context.Context, cfg aws.Config, jobs []*batchtypes.JobDetail, title string, tail int64) *Report {
+	now := time.Now()
+	start := now
+	for _, j := range jobs {
+		if t := fromMillis(aws.ToInt64(j.CreatedAt)); t.Before(start) {
+			start = t
+		}
+	}
+	is := cost.NewInstances(cfg)
+	pricer := cost.NewPricer(cfg, start, now)
+	cloud := cloudwatchlogs.NewFromConfig(cfg)
+
+	r := &Report{Title: title, Generated: now.UTC(), Counts: make(map[string]int)}
+	for _, j := range jobs {
+		e := Entry{
+			JobId:    aws.ToString(j.JobId),
+			Name:     aws.ToString(j.JobName),
+			Queue:    aws.ToString(j.JobQueue),
+			Status:   string(j.Status),
+			Reason:   aws.ToString(j.StatusReason),
+			Attempts: len(j.Attempts),
+			Created:  fromMillis(aws.ToInt64(j.CreatedAt)),
+		}
+		e.VCPUs, e.Memory = cost.Requested(j)
+		if j.Container != nil {
+			if j.Container.ExitCode != nil {
+				e.ExitCode = fmt.Sprint(*j.Container.ExitCode)
+			}
+			if j.Container.Reason != nil {
+				e.Reason = strings.TrimSpace(e.Reason + " " + *j.Container.Reason)
+			}
+		}
+		if j.StartedAt != nil {
+			stop := now
+			if j.StoppedAt != nil {
+				stop = fromMillis(*j.StoppedAt)
+			}
+			e.Runtime = stop.Sub(fromMillis(*j.StartedAt)).Round(time.Second)
+		}
+		row := cost.JobCost(ctx, is, pricer, j, now)
+		e.Instance, e.Cost, e.Unpriced = row.Instance, row.Cost, row.Unpriced
+		if j.Status == batchtypes.JobStatusFailed && tail > 0 && j.Container != nil && j.Container.LogStreamName != nil {
+			var err error
+			if e.LogTail, err = Tail(ctx, cloud, *j.Container.LogStreamName, tail); err != nil {
+				log.Printf("[batchit report] error getting log of %s: %s", e.JobId, err)
+			}
+		}
+		r.Entries = append(r.Entries, e)
+		r.Counts[e.Status]++
+		r.Runtime += e.Runtime
+		r.Cost += e.Cost
+		r.Unpriced += e.Unpriced
+	}
+	return r
+}
+
+var funcs = map[string]interface{}{
+	"dollars": func(f float64) string { return fmt.Sprintf("$%.2f", f) },
+	"date":    func(t time.Time) string { return t.Format("2006-01-02 15:04:05 MST") },
+	"join":    strings.Join,
+	// cell escapes a value for a Markdown table.
+	"cell": func(s string) string {
+		return strings.Replace(strings.Replace(s, "|", `\|`, -1), "\n", " ", -1)
+	},
+}
+
+const markdown = `# {{.Title}}
+
+Generated {{date .Generated}}.
+
+| status | jobs |
+|---|---|
+{{range .Statuses}}| {{.}} | {{index $.Counts .}} |
+{{end}}
+Total runtime {{.Runtime}}. Estimated cost {{dollars .Cost}}{{if .Unpriced}} ({{.Unpriced}} attempts could not be priced){{end}}.
+
+| job | id | status | exit | attempts | vCPUs | memory (MiB) | instance | runtime | cost | reason |
+|---|---|---|---|---|---|---|---|---|---|---|
+{{range .Entries}}| {{cell .Name}} | {{.JobId}} | {{.Status}} | {{.ExitCode}} | {{.Attempts}} | {{.VCPUs}} | {{.Memory}} | {{.Instance}} | {{.Runtime}} | {{dollars .Cost}} | {{cell .Reason}} |
+{{end}}{{range .Entries}}{{if .LogTail}}
+## {{.Name}} ({{.JobId}})
+
+` + "```" + `
+{{join .LogTail "\n"}}
+` + "```" + `
+{{end}}{{end}}`
+
+const html = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; }
+th { background: #f0f0f0; }
+.SUCCEEDED { color: #2a7d2a; }
+.FAILED { color: #c0392b; font-weight: bold; }
+pre { background: #f7f7f7; padding: 1em; overflow-x: auto; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>Generated {{date .Generated}}.</p>
+<table>
+<tr><th>status</th><th>jobs</th></tr>
+{{range .Statuses}}<tr><td class="{{.}}">{{.}}</td><td>{{index $.Counts .}}</td></tr>
+{{end}}</table>
+<p>Total runtime {{.Runtime}}. Estimated cost {{dollars .Cost}}{{if .Unpriced}} ({{.Unpriced}} attempts could not be priced){{end}}.</p>
+<table>
+<tr><th>job</th><th>id</th><th>status</th><th>exit</th><th>attempts</th><th>vCPUs</th><th>memory (MiB)</th><th>instance</th><th>runtime</th><th>cost</th><th>reason</th></tr>
+{{range .Entries}}<tr><td>{{.Name}}</td><td>{{.JobId}}</td><td class="{{.Status}}">{{.Status}}</td><td>{{.ExitCode}}</td><td>{{.Attempts}}</td><td>{{.VCPUs}}</td><td>{{.Memory}}</td><td>{{.Instance}}</td><td>{{.Runtime}}</td><td>{{dollars .Cost}}</td><td>{{.Reason}}</td></tr>
+{{end}}</table>
+{{range .Entries}}{{if .LogTail}}<h2>{{.Name}} ({{.JobId}})</h2>
+<pre>{{join .LogTail "\n"}}</pre>
+{{end}}{{end}}</body>
+</html>
+`
+
+var (
+	markdownTmpl = template.Must(template.New("markdown").Funcs(funcs).Parse(markdown))
+	htmlTmpl     = htemplate.Must(htemplate.New("html").Funcs(funcs).Parse(html))
+)
+
+// WriteMarkdown writes r as Markdown.
+func WriteMarkdown(w io.Writer, r *Report) error {
+	return markdownTmpl.Execute(w, r)
+}
+
+// WriteHTML writes r as a single HTML page.
+func WriteHTML(w io.Writer, r *Report) error {
+	return htmlTmpl.Execute(w, r)
+}
+
+func readIds(r io.Reader) ([]string, error) {
+	var ids []string
+	s := bufio.NewScanner(r)
+	s.Split(bufio.ScanWords)
+	for s.Scan() {
+		ids = append(ids, s.Text())
+	}
+	return ids, s.Err()
+}
+
+func Main() {
+	cli := &cliargs{Tail: 20, Title: "batchit report"}
+	p := batchit.MustParse(cli)
+	ids := cli.JobIds
+	if cli.Jobs != "" {
+		var r io.Reader = os.Stdin
+		if cli.Jobs != "-" {
+			f, err := os.Open(cli.Jobs)
+			if err != nil {
+				p.Fail(err.Error())
+			}
+			defer f.Close()
+			r = f
+		}
+		more, err := readIds(r)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ids = append(ids, more...)
+	}
+	if len(ids) == 0 {
+		p.Fail("no job ids given. use --jobs or pass them as arguments")
+	}
+
+	ctx := context.Background()
+	cfg, err := batchit.LoadConfig(ctx, cli.Region)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cli.Region = cfg.Region
+	b := batch.NewFromConfig(cfg)
+	jobs, err := logof.DescribeJobs(ctx, b, ids)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(jobs) < len(ids) {
+		log.Printf("[batchit report] %d of %d jobs not found in %s", len(ids)-len(jobs), len(ids), cli.Region)
+	}
+	if jobs, err = logof.Expand(ctx, b, jobs); err != nil {
+		log.Fatal(err)
+	}
+	r := Build(ctx, cfg, jobs, cli.Title, cli.Tail)
+
+	write := WriteMarkdown
+	var w io.Writer = os.Stdout
+	if cli.Out != "" {
+		f, err := os.Create(cli.Out)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		w = f
+		if ext := strings.ToLower(filepath.Ext(cli.Out)); ext == ".html" || ext == ".htm" {
+			write = WriteHTML
+		}
+	}
+	bw := bufio.NewWriter(w)
+	if err := write(bw, r); err != nil {
+		log.Fatal(err)
+	}
+	if err := bw.Flush(); err != nil {
+		log.Fatal(err)
+	}
+	if cli.Out != "" {
+		log.Printf("[batchit report] wrote %d jobs to %s", len(r.Entries), cli.Out)
+	}
+}
@@ -0,0 +1,214 @@
+package resubmit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/base2genomics/batchit"
+	"github.com/base2genomics/batchit/logof"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/batch"
+	batchtypes "github.com/aws/aws-sdk-go-v2/service/batch/types"
+)
+
+type cliargs struct {
+	Region  string `arg:"env:AWS_DEFAULT_REGION,help:region for batch setup. see batchit help for the default."`
+	Queue   string `arg:"help:submit to this queue rather than the queue of the original job."`
+	JobName string `arg:"help:name of the new job. default is the name of the original job."`
+	DryRun  bool   `arg:"help:report what would be resubmitted without submitting."`
+	JobId   string `arg:"required,positional,help:id of the job to resubmit."`
+}
+
+func (c cliargs) Version() string {
+	return batchit.Version
+}
+
+func (c cliargs) Description() string {
+	return `Submit a job again with the same definition, parameters, command and environment.
+For an array job, only the failed children are resubmitted as a new, smaller array (or a single job if only
+one failed). The new job has $BATCHIT_ARRAY_INDICES set to the comma-separated original indices and, for jobs
+from batchit submit, $AWS_BATCH_JOB_ARRAY_INDEX is remapped to the original index.`
+}
+
+// IndicesEnv holds the original array indices of the children of a resubmitted array job.
+const IndicesEnv = "BATCHIT_ARRAY_INDICES"
+
+// FailedIndices returns the array indices of the children that failed.
+func FailedIndices(kids []*batchtypes.JobDetail) []int64 {
+	var idx []int64
+	for _, k := range kids {
+		if k.Status == batchtypes.JobStatusFailed {
+			idx = append(idx, int64(aws.ToInt32(k.ArrayProperties.Index)))
+		}
+	}
+	return idx
+}
+
+// environment returns the environment of the container without the variables set by batch.
+func environment(j *batchtypes.JobDetail) []batchtypes.KeyValuePair {
+	var env []batchtypes.KeyValuePair
+	if j.Container == nil {
+		return env
+	}
+	for _, kv := range j.Container.Environment {
+		if strings.HasPrefix(aws.ToString(kv.Name), "AWS_BATCH_") || aws.ToString(kv.Name) == IndicesEnv {
+			continue
+		}
+		env = append(env, kv)
+	}
+	return env
+}
+
+// fromSubmit is true if the command is the prelude used by batchit submit, which evals each
+// argument in turn.
+func fromSubmit(cmd []string) bool {
+	return len(cmd) > 3 && cmd[0] == "/bin/bash" && strings.Contains(cmd[2], `eval "$i"`)
+}
+
+// remap adds a command that sets $AWS_BATCH_JOB_ARRAY_INDEX to the original index to a
+// command from batchit submit.
+func remap(cmd []string) []string {
+	line := fmt.Sprintf(`export AWS_BATCH_JOB_ARRAY_INDEX=$(echo $%s | cut -d, -f$((${AWS_BATCH_JOB_ARRAY_INDEX:-0}+1)))`, IndicesEnv)
+	out := append([]string{}, cmd[:4]...)
+	out = append(out, line)
+	return append(out, cmd[4:]...)
+}
+
+// ActiveDefinition returns a job definition that can be used to submit j. batchit submit
+// deregisters its definitions after submitting so an inactive definition is registered again.
+// The returned function deregisters any definition that was registered.
+func ActiveDefinition(ctx context.Context, b *batch.Client, j *batchtypes.JobDetail) (string, func(), error) {
+	noop := func() {}
+	do, err := b.DescribeJobDefinitions(ctx, &batch.DescribeJobDefinitionsInput{JobDefinitions: []string{aws.ToString(j.JobDefinition)}})
+	if err != nil {
+		return "", noop, err
+	}
+	if len(do.JobDefinitions) == 0 {
+		return "", noop, fmt.Errorf("resubmit: job definition %s not found", aws.ToString(j.JobDefinition))
+	}
+	jd := do.JobDefinitions[0]
+	if aws.ToString(jd.Status) == "ACTIVE" {
+		return *jd.JobDefinitionArn, noop, nil
+	}
+	ro, err := b.RegisterJobDefinition(ctx, &batch.RegisterJobDefinitionInput{
+		JobDefinitionName:   jd.JobDefinitionName,
+		ContainerProperties: jd.ContainerProperties,
+		Parameters:          jd.Parameters,
+		RetryStrategy:       jd.RetryStrategy,
+		Timeout:             jd.Timeout,
+		Type:                batchtypes.JobDefinitionType(aws.ToString(jd.Type)),
+		Tags:                jd.Tags,
+		PropagateTags:       jd.PropagateTags,
+	})
+	if err != nil {
+		return "", noop, err
+	}
+	return *ro.JobDefinitionArn, func() {
+		if _, err := b.DeregisterJobDefinition(ctx, &batch.DeregisterJobDefinitionInput{JobDefinition: ro.JobDefinitionArn}); err != nil {
+			log.Println(err)
+		}
+	}, nil
+}
+
+// Input returns the SubmitJobInput to run j again. If indices is not empty, only those
+// children of the array job j are run.
+func Input(j *batchtypes.JobDetail, indices []int64) *batch.SubmitJobInput {
+	sji := &batch.SubmitJobInput{
+		JobName:       j.JobName,
+		JobQueue:      j.JobQueue,
+		JobDefinition: j.JobDefinition,
+		Parameters:    j.Parameters,
+		RetryStrategy: j.RetryStrategy,
+		Timeout:       j.Timeout,
+		Tags:          j.Tags,
+		ContainerOverrides: &batchtypes.ContainerOverrides{
+			Environment: environment(j),
+		},
+	}
+	if j.Container != nil {
+		sji.ContainerOverrides.Command = j.Container.Command
+		sji.ContainerOverrides.Vcpus = j.Container.Vcpus
+		sji.ContainerOverrides.Memory = j.Container.Memory
+	}
+	if len(indices) == 0 {
+		return sji
+	}
+	strs := make([]string, len(indices))
+	for i, idx := range indices {
+		strs[i] = fmt.Sprint(idx)
+	}
+	sji.ContainerOverrides.Environment = append(sji.ContainerOverrides.Environment,
+		batchtypes.KeyValuePair{Name: aws.String(IndicesEnv), Value: aws.String(strings.Join(strs, ","))})
+	// batch requires an array of at least 2.
+	if len(indices) > 1 {
+		sji.ArrayProperties = &batchtypes.ArrayProperties{Size: aws.Int32(int32(len(indices)))}
+	}
+	if fromSubmit(sji.ContainerOverrides.Command) {
+		sji.ContainerOverrides.Command = remap(sji.ContainerOverrides.Command)
+	} else {
+		log.Printf("[batchit resubmit] %s was not from batchit submit. the job must use $%s to find its original index", *j.JobId, IndicesEnv)
+	}
+	return sji
+}
+
+func Main() error {
+	cli := &cliargs{}
+	batchit.MustParse(cli)
+	ctx := context.Background()
+	cfg, err := batchit.LoadConfig(ctx, cli.Region)
+	if err != nil {
+		return err
+	}
+	cli.Region = cfg.Region
+	b := batch.NewFromConfig(cfg)
+
+	jobs, err := logof.DescribeJobs(ctx, b, []string{cli.JobId})
+	if err != nil {
+		return err
+	}
+	if len(jobs) == 0 {
+		return batchit.Exit(batchit.ExitNotFound, fmt.Errorf("job %s not found in %s", cli.JobId, cli.Region))
+	}
+	j := jobs[0]
+	var indices []int64
+	if logof.IsArrayParent(j) {
+		kids, err := logof.Children(ctx, b, j)
+		if err != nil {
+			return err
+		}
+		if indices = FailedIndices(kids); len(indices) == 0 {
+			log.Printf("[batchit resubmit] no children of %s have failed", cli.JobId)
+			return nil
+		}
+		log.Printf("[batchit resubmit] resubmitting %d failed children of %s: %v", len(indices), cli.JobId, indices)
+	}
+	sji := Input(j, indices)
+	if cli.Queue != "" {
+		sji.JobQueue = aws.String(cli.Queue)
+	}
+	if cli.JobName != "" {
+		sji.JobName = aws.String(cli.JobName)
+	}
+	if cli.DryRun {
+		enc := json.NewEncoder(os.Stderr)
+		enc.SetIndent("", "  ")
+		return enc.Encode(sji)
+	}
+	def, cleanup, err := ActiveDefinition(ctx, b, j)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	sji.JobDefinition = aws.String(def)
+	so, err := b.SubmitJob(ctx, sji)
+	if err != nil {
+		return err
+	}
+	fmt.Println(*so.JobId)
+	return nil
+}
@@ -0,0 +1,166 @@
+package batchit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+)
+
+// RetryPolicy is how requests to AWS are retried. It is used by the clients from LoadConfig and
+// by Do for calls that are not made with those clients.
+type RetryPolicy struct {
+	// MaxAttempts is the number of times a request is tried.
+	MaxAttempts int
+	// Base is the delay before the first retry. It doubles with each retry up to Cap.
+	Base, Cap time.Duration
+	// Jitter is the fraction of each delay that is random, from 0 for none to 1 for a delay
+	// anywhere between 0 and the full delay.
+	Jitter float64
+	// Codes are error codes to retry in addition to throttling and timeouts, e.g. InternalError.
+	Codes []string
+}
+
+// DefaultRetryPolicy is used unless it is changed with the retry flags, environment or config.
+var DefaultRetryPolicy = RetryPolicy{MaxAttempts: 8, Base: time.Second, Cap: time.Minute, Jitter: 1}
+
+// Retry is the policy for this run. It is set by Configure.
+var Retry = DefaultRetryPolicy
+
+// retryFlags are the values of the global retry flags. They are parsed into Retry by Configure.
+var retryFlags = map[string]*string{
+	"max-attempts": new(string),
+	"retry-base":   new(string),
+	"retry-cap":    new(string),
+	"retry-jitter": new(string),
+	"retry-codes":  new(string),
+}
+
+// retryEnvVar returns the environment variable for a retry flag, e.g. BATCHIT_RETRY_BASE.
+func retryEnvVar(flag string) string {
+	return "BATCHIT_" + strings.ToUpper(strings.Replace(flag, "-", "_", -1))
+}
+
+// configureRetry sets Retry from the retry flags, then their environment variables and then s.
+func configureRetry(s map[string]interface{}) error {
+	p := DefaultRetryPolicy
+	for flag, v := range retryFlags {
+		value := *v
+		if value == "" {
+			value = os.Getenv(retryEnvVar(flag))
+		}
+		if c, ok := s[flag]; ok && value == "" {
+			value = fmt.Sprint(c)
+		}
+		if value == "" {
+			continue
+		}
+		var err error
+		switch flag {
+		case "max-attempts":
+			p.MaxAttempts, err = strconv.Atoi(value)
+			if err == nil && p.MaxAttempts < 1 {
+				err = errors.New("must be at least 1")
+			}
+		case "retry-base":
+			p.Base, err = time.ParseDuration(value)
+		case "retry-cap":
+			p.Cap, err = time.ParseDuration(value)
+		case "retry-jitter":
+			p.Jitter, err = strconv.ParseFloat(value, 64)
+			if err == nil && (p.Jitter < 0 || p.Jitter > 1) {
+				err = errors.New("must be between 0 and 1")
+			}
+		case "retry-codes":
+			p.Codes = strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' || r == '[' || r == ']' })
+		}
+		if err != nil {
+			return fmt.Errorf("batchit: --%s: %s", flag, err)
+		}
+	}
+	Retry = p
+	return nil
+}
+
+// Delay returns the time to wait before retry attempt (starting at 1).
+func (p RetryPolicy) Delay(attempt int) time.Duration {
+	d := p.Cap
+	if attempt < 1 {
+		attempt = 1
+	}
+	if attempt < 32 {
+		if b := p.Base << uint(attempt-1); b > 0 && b < p.Cap {
+			d = b
+		}
+	}
+	if p.Jitter > 0 {
+		d = time.Duration(float64(d) * (1 - p.Jitter + p.Jitter*rand.Float64()))
+	}
+	return d
+}
+
+// Retryable is true for errors that are throttling, timeouts or have one of Codes.
+func (p RetryPolicy) Retryable(err error) bool {
+	var aerr interface{ ErrorCode() string }
+	if !errors.As(err, &aerr) {
+		return false
+	}
+	code := aerr.ErrorCode()
+	if _, ok := retry.DefaultThrottleErrorCodes[code]; ok {
+		return true
+	}
+	if _, ok := retry.DefaultRetryableErrorCodes[code]; ok {
+		return true
+	}
+	for _, c := range p.Codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// Do calls fn until it succeeds, returns an error that is not Retryable or has been tried
+// MaxAttempts times.
+func (p RetryPolicy) Do(ctx context.Context, fn func() error) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = fn(); err == nil || attempt >= p.MaxAttempts || !p.Retryable(err) {
+			return err
+		}
+		d := p.Delay(attempt)
+		log.Printf("[batchit %s] retrying in %s after: %s", Command, d, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(d):
+		}
+	}
+}
+
+// Retryer returns the retryer for AWS clients. It is the adaptive mode of the SDK, which also
+// slows down all requests when throttled, with the attempts, delays and codes of p.
+func (p RetryPolicy) Retryer() aws.Retryer {
+	codes := make(map[string]struct{}, len(p.Codes))
+	for _, c := range p.Codes {
+		codes[c] = struct{}{}
+	}
+	return retry.NewAdaptiveMode(func(o *retry.AdaptiveModeOptions) {
+		o.StandardOptions = append(o.StandardOptions, func(so *retry.StandardOptions) {
+			so.MaxAttempts = p.MaxAttempts
+			so.MaxBackoff = p.Cap
+			so.Backoff = retry.BackoffDelayerFunc(func(attempt int, err error) (time.Duration, error) {
+				return p.Delay(attempt), nil
+			})
+			so.Retryables = append(so.Retryables, retry.RetryableErrorCode{Codes: codes})
+		})
+	})
+}
@@ -0,0 +1,177 @@
+package runlocal
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/base2genomics/batchit"
+	"github.com/base2genomics/batchit/preset"
+	"github.com/base2genomics/batchit/submit"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+type cliargs struct {
+	submit.Options
+	Scratch string `arg:"help:local directory for the EBS volume and host volumes. default is a new temporary directory."`
+	Index   int64  `arg:"help:array index to run when --arraysize is given."`
+	NoCreds bool   `arg:"help:do not pass AWS credentials from the environment to the container."`
+	Pull    bool   `arg:"help:pull the image even if it exists locally."`
+}
+
+func (c cliargs) Version() string {
+	return batchit.Version
+}
+
+func (c cliargs) Description() string {
+	return `Run a submission in the local docker daemon rather than in batch. It takes the same arguments as
+batchit submit and runs the same prelude and script in the image, privileged as in batch, with the
+AWS_BATCH_* variables set as they would be for a job. The EBS volume from --ebs and each host path from
+--volumes are directories under --scratch instead. Nothing is uploaded for --s3outputs.
+AWS credentials in the environment are passed to the container unless --nocreds is given.`
+}
+
+// credentialEnv are passed from the environment to the container.
+var credentialEnv = []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN", "AWS_DEFAULT_REGION", "AWS_REGION"}
+
+// imageExists is true if the local docker daemon has the image.
+func imageExists(image string) bool {
+	return exec.Command("docker", "image", "inspect", image).Run() == nil
+}
+
+// DockerArgs returns the arguments to docker to run the submission in cli with local directories
+// under scratch.
+func DockerArgs(cli *cliargs, image, scratch string) ([]string, error) {
+	opts := cli.Options
+	// the ebs volume and uploads can't be used locally.
+	opts.Ebs = ""
+	opts.S3Outputs = ""
+	c, err := submit.NewContainer(&opts)
+	if err != nil {
+		return nil, err
+	}
+	id := fmt.Sprintf("local-%d", time.Now().Unix())
+	args := []string{"run", "--rm", "-i", "--privileged",
+		"--cpus", fmt.Sprint(cli.CPUs),
+		"--memory", fmt.Sprintf("%dm", cli.Mem),
+		"--ulimit", "nofile=40000:40000",
+		"-e", "B64GZ=" + c.Payload,
+		"-e", "AWS_BATCH_JOB_ID=" + id,
+		"-e", "AWS_BATCH_JOB_ATTEMPT=1",
+		"-e", "AWS_BATCH_JQ_NAME=" + cli.Queue,
+		"-e", "AWS_BATCH_CE_NAME=local",
+	}
+	if cli.ArraySize > 0 {
+		args = append(args, "-e", fmt.Sprintf("AWS_BATCH_JOB_ARRAY_INDEX=%d", cli.Index))
+	}
+	if !cli.NoCreds {
+		for _, name := range credentialEnv {
+			if _, ok := os.LookupEnv(name); ok {
+				args = append(args, "-e", name)
+			}
+		}
+	}
+	for _, kv := range c.Environment {
+		args = append(args, "-e", aws.ToString(kv.Name)+"="+aws.ToString(kv.Value))
+	}
+	mounts := make(map[string]string, len(c.Volumes))
+	for i, v := range c.Volumes {
+		dir := filepath.Join(scratch, fmt.Sprintf("volume%d", i))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+		mounts[aws.ToString(v.Name)] = dir
+	}
+	for _, mp := range c.MountPoints {
+		m := mounts[aws.ToString(mp.SourceVolume)] + ":" + aws.ToString(mp.ContainerPath)
+		if aws.ToBool(mp.ReadOnly) {
+			m += ":ro"
+		}
+		args = append(args, "-v", m)
+	}
+	if cli.Ebs != "" {
+		mnt := strings.Split(cli.Ebs, ":")[0]
+		dir := filepath.Join(scratch, "ebs")
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+		args = append(args, "-v", dir+":"+mnt, "-e", "TMPDIR="+mnt, "-w", mnt)
+	}
+	args = append(args, image)
+	args = append(args, c.Command...)
+	return args, nil
+}
+
+func Main() {
+	cli := &cliargs{Options: submit.DefaultOptions}
+	expanded, err := preset.Expand(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Args = append(os.Args[:1], expanded...)
+	p := batchit.MustParse(cli)
+	if cli.ArraySize > 0 && (cli.Index < 0 || cli.Index >= cli.ArraySize) {
+		p.Fail("--index must be between 0 and --arraysize - 1")
+	}
+	if cli.S3Outputs != "" {
+		log.Printf("[batchit run-local] not uploading or checking --s3outputs")
+	}
+	if len(cli.DependsOn) > 0 {
+		log.Printf("[batchit run-local] ignoring --dependson")
+	}
+
+	// an image that exists locally is used as is. otherwise it's found as for batchit submit.
+	image := cli.Image
+	if cli.Registry != "" || !strings.Contains(image, "/") && (cli.Pull || !imageExists(image)) {
+		ctx := context.Background()
+		cfg, err := batchit.LoadConfig(ctx, cli.Region)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if image, err = submit.ResolveImage(ctx, cfg, &cli.Options); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if cli.Pull || !imageExists(image) {
+		// images in ECR need docker login first.
+		pull := exec.Command("docker", "pull", image)
+		pull.Stdout, pull.Stderr = os.Stderr, os.Stderr
+		if err := pull.Run(); err != nil {
+			log.Fatalf("[batchit run-local] error pulling %s: %s", image, err)
+		}
+	}
+
+	scratch := cli.Scratch
+	if scratch == "" {
+		var err error
+		if scratch, err = ioutil.TempDir("", "batchit-run-local-"); err != nil {
+			log.Fatal(err)
+		}
+		defer os.RemoveAll(scratch)
+	}
+	args, err := DockerArgs(cli, image, scratch)
+	if err != nil {
+		p.Fail(err.Error())
+	}
+	log.Printf("[batchit run-local] running %s in %s with scratch in %s", cli.JobName, image, scratch)
+	cmd := exec.Command("docker", args...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err = cmd.Run(); err == nil {
+		return
+	}
+	if cli.Scratch == "" {
+		os.RemoveAll(scratch)
+	}
+	if ee, ok := err.(*exec.ExitError); ok {
+		log.Printf("[batchit run-local] %s failed: %s", cli.JobName, ee)
+		os.Exit(ee.ExitCode())
+	}
+	log.Fatal(err)
+}
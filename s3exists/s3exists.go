@@ -0,0 +1,116 @@
+package s3exists
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/base2genomics/batchit"
+	"github.com/base2genomics/batchit/submit"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+type cliargs struct {
+	Region  string   `arg:"env:AWS_DEFAULT_REGION,help:region for batch setup. see batchit help for the default."`
+	JSON    bool     `arg:"help:print a JSON report of each path to stdout"`
+	S3Paths []string `arg:"required,positional,help:S3 paths to check."`
+}
+
+func (c cliargs) Version() string {
+	return batchit.Version
+}
+
+func (c cliargs) Description() string {
+	return `Check that each S3 path exists and is non-empty.
+This uses the same check as the --s3outputs argument to submit so that scripts can skip
+work that is already done.
+
+Exit status is 0 if all paths exist, 4 if any is missing and 3 if a request to check one failed.`
+}
+
+// Result reports the state of a single S3 path.
+type Result struct {
+	Path         string     `json:"path"`
+	Exists       bool       `json:"exists"`
+	Size         int64      `json:"size"`
+	LastModified *time.Time `json:"last_modified,omitempty"`
+	// Age is the number of seconds since the object was last modified.
+	Age   float64 `json:"age,omitempty"`
+	Error string  `json:"error,omitempty"`
+}
+
+// Check returns a Result for path. An error is returned only for problems other than
+// the object not being found.
+func Check(ctx context.Context, svc *s3.Client, path string) (Result, error) {
+	r := Result{Path: path}
+	ho, err := submit.HeadOutput(ctx, svc, path)
+	if err == submit.NotFound {
+		return r, nil
+	}
+	if err != nil {
+		r.Error = err.Error()
+		return r, err
+	}
+	if ho.ContentLength != nil {
+		r.Size = *ho.ContentLength
+	}
+	r.Exists = r.Size > 0
+	if ho.LastModified != nil {
+		r.LastModified = ho.LastModified
+		r.Age = time.Since(*ho.LastModified).Seconds()
+	}
+	return r, nil
+}
+
+// Main checks each of the paths. The error has ExitNotFound if any path is missing and the code of
+// the first error if any could not be checked.
+func Main() error {
+	cli := &cliargs{}
+	batchit.MustParse(cli)
+	ctx := context.Background()
+	cfg, err := batchit.LoadConfig(ctx, cli.Region)
+	if err != nil {
+		return err
+	}
+	svc := s3.NewFromConfig(cfg)
+
+	var missing, failed int
+	// first is the first error which sets the exit code.
+	var first error
+	results := make([]Result, 0, len(cli.S3Paths))
+	for _, p := range cli.S3Paths {
+		r, err := Check(ctx, svc, p)
+		results = append(results, r)
+		if err != nil {
+			log.Printf("[batchit s3exists] error checking %s: %s", p, err)
+			if failed++; first == nil {
+				first = err
+			}
+			continue
+		}
+		if !r.Exists {
+			missing++
+			if !cli.JSON {
+				fmt.Fprintf(os.Stderr, "[batchit s3exists] %s not found\n", p)
+			}
+		}
+	}
+	if cli.JSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(results); err != nil {
+			return err
+		}
+	}
+	if failed > 0 {
+		return batchit.Exit(batchit.ExitCode(first), fmt.Errorf("s3exists: %d of %d paths could not be checked", failed, len(cli.S3Paths)))
+	}
+	if missing > 0 {
+		return batchit.Exit(batchit.ExitNotFound, fmt.Errorf("s3exists: %d of %d paths were not found", missing, len(cli.S3Paths)))
+	}
+	return nil
+}
@@ -1,148 +1,565 @@
+// Package s3upload uploads local files to S3 in parallel as batchit s3upload does. Upload does
+// what the command does for Args and UploadStream sends a stream of unknown size.
 package s3upload
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/base2genomics/batchit"
 	"github.com/base2genomics/batchit/submit"
 
-	arg "github.com/alexflint/go-arg"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-type cliargs struct {
-	Region    string   `arg:"env:AWS_DEFAULT_REGION,help:region for batch setup"`
-	Check     bool     `arg:"-c,help:check if file exists before uploading and don't upload if it is same size."`
-	NoFail    bool     `arg:"help:don't fail if one of the local paths corresponding to an S3 path is not found."`
-	Processes int      `arg:"-p,help:number of parallel uploads."`
-	S3Paths   []string `arg:"required,positional,help:S3 destination paths. The final entry in the Key will be used to look for the local file."`
+// Args are the arguments to batchit s3upload. Start from DefaultArgs to use them with Upload.
+type Args struct {
+	Region      string   `arg:"env:AWS_DEFAULT_REGION,help:region for batch setup. see batchit help for the default."`
+	Check       bool     `arg:"-c,help:check if file exists before uploading and don't upload if it is same size."`
+	NoFail      bool     `arg:"help:don't fail if one of the local paths corresponding to an S3 path is not found."`
+	Processes   int      `arg:"-p,help:number of parallel uploads."`
+	Stdin       bool     `arg:"help:stream STDIN to the single S3 path given."`
+	DryRun      bool     `arg:"--dry-run,help:report what would be uploaded (and skipped with -c) without uploading."`
+	JSON        bool     `help:"print a JSON summary of each upload (key, bytes, duration, status, etag) to stdout."`
+	Accelerate  bool     `arg:"help:use the S3 Transfer Acceleration endpoint if it is enabled for the bucket(s)."`
+	First       bool     `help:"when several local files match a destination equally well, use the lexicographically first rather than failing."`
+	ScanWorkers int      `arg:"help:number of directories to scan and S3 paths to check in parallel before uploading."`
+	Retention   string   `help:"retention preset to tag uploaded objects with for bucket lifecycle rules. one of 7d, 30d, 90d, 365d or keep (aliases: scratch=7d, final=keep)."`
+	PrefixMap   []string `arg:"help:LOCAL_DIR=S3_PREFIX pairs. every file under LOCAL_DIR is uploaded under S3_PREFIX keeping its relative path."`
+	S3Paths     []string `arg:"positional,help:S3 destination paths. The end of the Key will be used to look for the local file."`
 }
 
-func (c cliargs) Description() string {
+func (c Args) Description() string {
 	return `Upload files to S3 in parallel using convention (file-naming)
 This program requires that if you want to upload to s3://bucket/where/to/send.txt
-a local file named 'send.txt' will exist. This program will upload the first 'send.txt' it finds.
+a local file named 'send.txt' will exist under the current directory. If several are found,
+the one sharing the most trailing path components with the key is used so that 'to/send.txt'
+is preferred over 'other/send.txt'. Of those sharing as many, one whose whole path is the end of
+the key is used so that 'to/send.txt' is preferred over 'x/to/send.txt'. If that is still ambiguous, it is an error unless --first is given.
 
 To upload only files that are not already present, use '-c'. To not fail even if a local file is not found, use --nofail.
 With '-c', if the local size does not match the size in S3, the file will be uploaded.
+
+To upload a whole directory tree keeping its structure, use --prefixmap, e.g.:
+    --prefixmap results=s3://bucket/runs/run42/
+will send results/a/b.txt to s3://bucket/runs/run42/a/b.txt.
+
+With --retention, each object is tagged with batchit-retention=<preset> (e.g. 90d or keep)
+so that bucket lifecycle rules filtering on that tag can expire scratch outputs while keeping
+final deliverables.
+
+With --accelerate, uploads use the bucket's transfer-acceleration endpoint if it is enabled
+for the bucket. This can be much faster when uploading from a region far from the bucket.
+
+Use --dry-run to list the local files that were matched, their destinations, what would be
+skipped by '-c' and the total bytes to transfer, without uploading anything. With --stdin, it
+reports the path that stdin would be streamed to without reading it.
+
+With --stdin, data is read from STDIN and streamed to a single S3 path using a multipart upload, e.g.:
+    samtools sort ... | batchit s3upload --stdin s3://bucket/sample.bam
 	`
 }
 
-func findIn(haystack []string, needle string) int {
-	for i, h := range haystack {
-		if needle == h {
-			return i
+// candidate is a local file that may be uploaded to an s3 path.
+type candidate struct {
+	path  string
+	size  int64
+	score int
+}
+
+// matchScore is twice the number of trailing path components that local shares with key
+// plus one if those are all of local, i.e. the key ends with the relative path. So 'a/b.txt'
+// scores higher than 'y/a/b.txt' for the key 'x/a/b.txt' though both share 2 components.
+func matchScore(local, key string) int {
+	lp := strings.Split(filepath.ToSlash(local), "/")
+	kp := strings.Split(key, "/")
+	n := 0
+	for n < len(lp) && n < len(kp) && lp[len(lp)-1-n] == kp[len(kp)-1-n] {
+		n++
+	}
+	if n == len(lp) {
+		return 2*n + 1
+	}
+	return 2 * n
+}
+
+// pick chooses the best local match among cands, those with the highest matchScore. If several files tie, it is an error unless
+// first is true in which case the lexicographically smallest path is used.
+func pick(s3path string, cands []candidate, first bool) (candidate, error) {
+	sort.Slice(cands, func(i, j int) bool {
+		if cands[i].score != cands[j].score {
+			return cands[i].score > cands[j].score
 		}
+		return cands[i].path < cands[j].path
+	})
+	best := cands[0]
+	if len(cands) > 1 && cands[1].score == best.score && !first {
+		var paths []string
+		for _, c := range cands {
+			if c.score == best.score {
+				paths = append(paths, c.path)
+			}
+		}
+		return best, fmt.Errorf("multiple local files match %s: %s. use --first to pick the first", s3path, strings.Join(paths, ", "))
 	}
-	return -1
+	return best, nil
 }
 
-func getupload(s3paths []string, svc *s3.S3, check bool, nofail bool) ([]*s3manager.UploadInput, error) {
-	uploads := make([]*s3manager.UploadInput, 0, len(s3paths))
-	localpaths := make([]string, len(s3paths))
-	founds := make([]bool, len(s3paths))
+// inS3 reports whether s3path exists with the given size.
+func inS3(ctx context.Context, svc submit.S3API, s3path string, size int64) (bool, error) {
+	exists, sz, err := submit.OutputExists(ctx, svc, s3path)
+	if err != nil && err != submit.NotFound {
+		return false, err
+	}
+	return err == nil && exists && sz == size, nil
+}
 
-	for i, s3path := range s3paths {
-		if strings.HasPrefix(s3path, "s3://") {
-			s3path = s3path[5:]
-		}
+// parsePrefixMap splits a LOCAL_DIR=S3_PREFIX pair and ensures the prefix ends in '/'.
+func parsePrefixMap(m string) (local, prefix string, err error) {
+	pair := strings.SplitN(m, "=", 2)
+	if len(pair) != 2 || pair[0] == "" || !strings.HasPrefix(pair[1], "s3://") {
+		return "", "", fmt.Errorf("expected prefix map of the form LOCAL_DIR=s3://bucket/prefix/, got %s", m)
+	}
+	prefix = pair[1]
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return filepath.Clean(pair[0]), prefix, nil
+}
+
+// upload is a local file to be sent to an s3 path. Files are only opened when they are
+// uploaded so that very large trees do not exhaust file descriptors.
+type upload struct {
+	local  string
+	size   int64
+	s3path string
+}
 
-		tmp := strings.Split(s3path, "/")
-		localpaths[i] = tmp[len(tmp)-1]
+// walkParallel calls fn for every file under root. Directories are read by workers
+// goroutines. fn may be called concurrently.
+func walkParallel(root string, workers int, fn func(path string, f os.FileInfo)) error {
+	if workers < 1 {
+		workers = 1
 	}
+	var mu sync.Mutex
+	cond := sync.NewCond(&mu)
+	dirs := []string{root}
+	// pending is the number of directories that are queued or being read.
+	pending := 1
+	var firstErr error
 
-	err := filepath.Walk(".", func(path string, f os.FileInfo, err error) error {
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for {
+				mu.Lock()
+				for len(dirs) == 0 && pending > 0 {
+					cond.Wait()
+				}
+				if pending == 0 {
+					mu.Unlock()
+					return
+				}
+				dir := dirs[len(dirs)-1]
+				dirs = dirs[:len(dirs)-1]
+				mu.Unlock()
+
+				sub, err := readDir(dir, fn)
+
+				mu.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				dirs = append(dirs, sub...)
+				pending += len(sub) - 1
+				mu.Unlock()
+				cond.Broadcast()
+			}
+		}()
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// readDir calls fn for each file in dir and returns the directories in it.
+func readDir(dir string, fn func(path string, f os.FileInfo)) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var dirs []string
+	for _, e := range entries {
+		path := filepath.Join(dir, e.Name())
+		if e.IsDir() {
+			dirs = append(dirs, path)
+			continue
+		}
+		f, err := e.Info()
 		if err != nil {
-			return err
+			return dirs, err
+		}
+		fn(path, f)
+	}
+	return dirs, nil
+}
+
+// filterPresent checks, using up to workers concurrent requests, which uploads are already
+// in s3 with the same size. It returns the remaining uploads and the skipped s3 paths.
+func filterPresent(ctx context.Context, svc submit.S3API, ups []upload, workers int) ([]upload, []string, error) {
+	if workers < 1 {
+		workers = 1
+	}
+	present := make([]bool, len(ups))
+	errs := make([]error, len(ups))
+	idxs := make(chan int, len(ups))
+	for i := range ups {
+		idxs <- i
+	}
+	close(idxs)
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			for i := range idxs {
+				present[i], errs[i] = inS3(ctx, svc, ups[i].s3path, ups[i].size)
+			}
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+
+	keep := ups[:0]
+	var skipped []string
+	for i, u := range ups {
+		if errs[i] != nil {
+			return nil, nil, errs[i]
 		}
-		if f.IsDir() {
-			return nil
+		if present[i] {
+			fmt.Fprintf(os.Stderr, "[batchit s3uploader] %s already in s3, skipping\n", u.local)
+			skipped = append(skipped, u.s3path)
+			continue
 		}
-		tmp := strings.Split(f.Name(), "/")
+		keep = append(keep, u)
+	}
+	return keep, skipped, nil
+}
 
-		idx := findIn(localpaths, tmp[len(tmp)-1])
-		if idx == -1 {
-			return nil
+// getprefixuploads walks each local directory in maps and returns an upload for every file
+// under the matching s3 prefix, preserving the relative path.
+func getprefixuploads(maps []string, workers int) ([]upload, error) {
+	var uploads []upload
+	var mu sync.Mutex
+	for _, m := range maps {
+		local, prefix, err := parsePrefixMap(m)
+		if err != nil {
+			return nil, err
 		}
-		founds[idx] = true
-		s3path := s3paths[idx]
-		if check {
-			// check if file exists in s3
-			exists, size, err := submit.OutputExists(svc, s3path)
-			if err != nil && err != submit.NotFound {
-				return err
-			}
-			if err == nil && exists && size == f.Size() {
-				fmt.Fprintf(os.Stderr, "[batchit s3uploader] %s already in s3, skipping\n", f.Name())
-				return nil
+		var relErr error
+		err = walkParallel(local, workers, func(path string, f os.FileInfo) {
+			rel, err := filepath.Rel(local, path)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				relErr = err
+				return
 			}
+			uploads = append(uploads, upload{local: path, size: f.Size(), s3path: prefix + filepath.ToSlash(rel)})
+		})
+		if err == nil {
+			err = relErr
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	// the parallel walk gives no order so sort for reproducible output.
+	sort.Slice(uploads, func(i, j int) bool { return uploads[i].s3path < uploads[j].s3path })
+	return uploads, nil
+}
+
+// getupload finds the local file for each s3 path.
+func getupload(s3paths []string, nofail bool, first bool, workers int) ([]upload, error) {
+	if len(s3paths) == 0 {
+		return nil, nil
+	}
+	uploads := make([]upload, 0, len(s3paths))
+	// multiple destinations may share a basename so we track a list of indexes.
+	byName := make(map[string][]int, len(s3paths))
+	keys := make([]string, len(s3paths))
+	cands := make([][]candidate, len(s3paths))
 
+	for i, s3path := range s3paths {
+		_, keys[i] = splitPath(s3path)
+		name := keys[i][strings.LastIndex(keys[i], "/")+1:]
+		byName[name] = append(byName[name], i)
+	}
+
+	var mu sync.Mutex
+	err := walkParallel(".", workers, func(path string, f os.FileInfo) {
+		idxs, ok := byName[f.Name()]
+		if !ok {
+			return
 		}
+		mu.Lock()
+		for _, idx := range idxs {
+			cands[idx] = append(cands[idx], candidate{path: path, size: f.Size(), score: matchScore(path, keys[idx])})
+		}
+		mu.Unlock()
+	})
+	if err != nil {
+		return nil, err
+	}
 
-		fp, err := os.Open(f.Name())
+	for i, s3path := range s3paths {
+		if len(cands[i]) == 0 {
+			if nofail {
+				log.Println("local file not found for " + s3path)
+				continue
+			}
+			return nil, batchit.Exit(batchit.ExitNotFound, fmt.Errorf("s3upload: local file not found for %s", s3path))
+		}
+		c, err := pick(s3path, cands[i], first)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		if strings.HasPrefix(s3path, "s3://") {
-			s3path = s3path[5:]
+		uploads = append(uploads, upload{local: c.path, size: c.size, s3path: s3path})
+	}
+	return uploads, nil
+}
+
+// dryRun reports the uploads that would be performed without sending anything.
+func dryRun(w io.Writer, uploads []upload, skipped []string) error {
+	if batchit.JSONL() {
+		for _, u := range uploads {
+			batchit.Emit(batchit.Event{Type: batchit.EventObjectUploaded, Path: u.s3path, Bytes: u.size, Message: u.local, DryRun: true})
 		}
-		bk := strings.SplitN(s3path, "/", 2)
-		uploads = append(uploads, &s3manager.UploadInput{
-			Bucket: aws.String(bk[0]),
-			Key:    aws.String(bk[1]),
-			Body:   fp,
-		})
-		return nil
-	})
-	for i, found := range founds {
-		if found {
-			continue
+		for _, s := range skipped {
+			batchit.Emit(batchit.Event{Type: batchit.EventObjectSkipped, Path: s, DryRun: true})
 		}
-		if nofail {
-			log.Println("local file not found for " + s3paths[i])
-		} else {
-			log.Fatal("local file not found for " + s3paths[i])
+		return nil
+	}
+	var total int64
+	for _, u := range uploads {
+		total += u.size
+		fmt.Fprintf(w, "upload\t%s\t%s\t%d\n", u.local, u.s3path, u.size)
+	}
+	for _, s := range skipped {
+		fmt.Fprintf(w, "skip\t\t%s\t\n", s)
+	}
+	fmt.Fprintf(w, "# %d files to upload (%d bytes), %d skipped\n", len(uploads), total, len(skipped))
+	return nil
+}
+
+// dryRunStream reports the stream from stdin that would be uploaded to s3path. Its size is not
+// known without reading it.
+func dryRunStream(w io.Writer, s3path string) error {
+	if batchit.JSONL() {
+		batchit.Emit(batchit.Event{Type: batchit.EventObjectUploaded, Path: s3path, Message: "-", DryRun: true})
+		return nil
+	}
+	fmt.Fprintf(w, "upload\t-\t%s\t\n", s3path)
+	fmt.Fprintf(w, "# stdin to stream to %s\n", s3path)
+	return nil
+}
+
+// RetentionTag is the object tag key set by --retention. Bucket lifecycle rules should
+// filter on this key with one of the RetentionPresets values.
+const RetentionTag = "batchit-retention"
+
+// RetentionPresets are the values accepted by --retention.
+var RetentionPresets = []string{"7d", "30d", "90d", "365d", "keep"}
+
+var retentionAliases = map[string]string{"scratch": "7d", "final": "keep"}
+
+// RetentionTagging returns the URL-encoded tag set for a retention preset to give to UploadStream.
+func RetentionTagging(preset string) (string, error) {
+	if a, ok := retentionAliases[preset]; ok {
+		preset = a
+	}
+	for _, r := range RetentionPresets {
+		if r == preset {
+			return url.Values{RetentionTag: []string{preset}}.Encode(), nil
 		}
+	}
+	return "", fmt.Errorf("unknown retention preset: %s. must be one of %s", preset, strings.Join(RetentionPresets, ", "))
+}
 
+// Result records the outcome of a single upload for the --json summary.
+type Result struct {
+	Local  string `json:"local,omitempty"`
+	Path   string `json:"path"`
+	Key    string `json:"key,omitempty"`
+	Bytes  int64  `json:"bytes"`
+	Status string `json:"status"`
+	ETag   string `json:"etag,omitempty"`
+	// Duration is the time taken for the upload in seconds.
+	Duration float64 `json:"duration"`
+	Error    string  `json:"error,omitempty"`
+}
+
+func splitPath(s3path string) (bucket, key string) {
+	if strings.HasPrefix(s3path, "s3://") {
+		s3path = s3path[5:]
+	}
+	bk := strings.SplitN(s3path, "/", 2)
+	if len(bk) != 2 {
+		return bk[0], ""
 	}
-	return uploads, err
+	return bk[0], bk[1]
 }
 
-func Main() {
+// UploadStream sends everything from r to s3path using a multipart upload so that the
+// size need not be known in advance. If ctx is canceled, the multipart upload is aborted.
+func UploadStream(ctx context.Context, svc manager.UploadAPIClient, r io.Reader, s3path string, tagging string) error {
+	_, err := uploadStream(ctx, svc, r, s3path, tagging)
+	return err
+}
 
-	// TODO: check Region with iid.
-	cli := &cliargs{Processes: 2, Region: "us-east-1"}
-	arg.MustParse(cli)
-	cfg := aws.NewConfig().WithRegion(cli.Region)
-	sess := session.Must(session.NewSession(cfg))
-	svc := s3.New(sess)
+// uploadStream is UploadStream that also returns the result of the upload.
+func uploadStream(ctx context.Context, svc manager.UploadAPIClient, r io.Reader, s3path string, tagging string) (Result, error) {
+	bucket, key := splitPath(s3path)
+	res := Result{Path: s3path, Key: key, Status: "uploaded"}
+	if key == "" {
+		err := fmt.Errorf("expected s3 path of the form s3://bucket/key, got %s", s3path)
+		res.Status, res.Error = "failed", err.Error()
+		return res, err
+	}
+	uploader := manager.NewUploader(svc, func(u *manager.Uploader) {
+		u.PartSize = 24 * 1024 * 1024
+		u.LeavePartsOnError = false
+		u.Concurrency = 5
+	})
+	t := time.Now()
+	fmt.Fprintf(os.Stderr, "[batchit s3upload] starting upload of stdin to %s\n", s3path)
+	cr := &counter{r: interruptible{ctx: ctx, r: r}}
+	ui := &s3.PutObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		Body:   cr,
+	}
+	if tagging != "" {
+		ui.Tagging = aws.String(tagging)
+	}
+	uctx, span := batchit.StartSpan(ctx, "s3upload.upload", attribute.String("batchit.path", s3path))
+	out, err := uploader.Upload(context.WithoutCancel(uctx), ui)
+	res.Bytes, res.Duration = cr.n, time.Since(t).Seconds()
+	if err := batchit.EndSpan(span, err); err != nil {
+		res.Status, res.Error = "failed", err.Error()
+		return res, err
+	}
+	if out.ETag != nil {
+		res.ETag = strings.Trim(*out.ETag, `"`)
+	}
+	fmt.Fprintf(os.Stderr, "[batchit s3upload] uploaded stdin to %s in %s\n", s3path, time.Since(t))
+	return res, nil
+}
 
-	uploads, err := getupload(cli.S3Paths, svc, cli.Check, cli.NoFail)
-	if err != nil {
-		log.Fatal(err)
+// counter counts the bytes read from r.
+type counter struct {
+	r io.Reader
+	n int64
+}
+
+func (c *counter) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// interruptible fails to read once ctx is done. Uploads read through it with a context that is
+// not canceled so that when batchit is interrupted, the uploader stops and can still abort the
+// multipart upload rather than leaving its parts in the bucket.
+type interruptible struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (i interruptible) Read(p []byte) (int, error) {
+	if err := i.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return i.r.Read(p)
+}
+
+// interruptibleFile is interruptible for a file. It can be read at offsets so that the uploader
+// reads parts from the file rather than buffering them.
+type interruptibleFile struct {
+	interruptible
+	f *os.File
+}
+
+func (i interruptibleFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := i.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return i.f.ReadAt(p, off)
+}
+
+func (i interruptibleFile) Seek(offset int64, whence int) (int64, error) {
+	return i.f.Seek(offset, whence)
+}
+
+// accelerated returns a client using the transfer-acceleration endpoint if it is enabled
+// for all buckets in s3paths. Otherwise it logs why and returns svc.
+func accelerated(ctx context.Context, cfg aws.Config, svc *s3.Client, s3paths []string) *s3.Client {
+	seen := make(map[string]bool)
+	for _, p := range s3paths {
+		bucket, _ := splitPath(p)
+		if seen[bucket] {
+			continue
+		}
+		seen[bucket] = true
+		out, err := svc.GetBucketAccelerateConfiguration(ctx, &s3.GetBucketAccelerateConfigurationInput{Bucket: aws.String(bucket)})
+		if err != nil {
+			log.Printf("[batchit s3upload] unable to get accelerate configuration for %s, not using acceleration: %s", bucket, err)
+			return svc
+		}
+		if out.Status != s3types.BucketAccelerateStatusEnabled {
+			log.Printf("[batchit s3upload] transfer acceleration is not enabled for %s, not using acceleration", bucket)
+			return svc
+		}
 	}
+	return s3.NewFromConfig(cfg, func(o *s3.Options) { o.UseAccelerate = true })
+}
 
-	iter := make(chan *s3manager.UploadInput, len(uploads))
+// uploadAll uploads the files with processes uploaders at once. A file that fails does not stop
+// the others. It returns a result for each upload and the number that failed.
+func uploadAll(ctx context.Context, svc manager.UploadAPIClient, uploads []upload, processes int, tagging string) ([]Result, int) {
+	iter := make(chan upload, len(uploads))
 	for _, u := range uploads {
 		iter <- u
 	}
 	close(iter)
 
+	var mu sync.Mutex
+	results := make([]Result, 0, len(uploads))
+	failed := 0
+
 	var wg sync.WaitGroup
-	wg.Add(cli.Processes)
+	wg.Add(processes)
 
-	for i := 0; i < cli.Processes; i++ {
+	for i := 0; i < processes; i++ {
 		go func() {
 			// NOTE: using multiple uploaders, each of which has concurrency. Might want to tune this later.
-			uploader := s3manager.NewUploaderWithClient(svc, func(u *s3manager.Uploader) {
+			uploader := manager.NewUploader(svc, func(u *manager.Uploader) {
 				u.PartSize = 16 * 1024 * 1024 // 64MB per part
 				u.LeavePartsOnError = false
 				u.Concurrency = 5
@@ -150,16 +567,53 @@ func Main() {
 			for u := range iter {
 
 				t := time.Now()
-				fmt.Fprintf(os.Stderr, "[batchit s3upload] starting upload of %s\n", u.Body.(*os.File).Name())
+				fmt.Fprintf(os.Stderr, "[batchit s3upload] starting upload of %s\n", u.local)
+				bucket, key := splitPath(u.s3path)
+				r := Result{Local: u.local, Path: u.s3path, Key: key, Bytes: u.size, Status: "uploaded"}
+				var out *manager.UploadOutput
+				uctx, span := batchit.StartSpan(ctx, "s3upload.upload", attribute.String("batchit.path", u.s3path),
+					attribute.String("batchit.local", u.local), attribute.Int64("batchit.bytes", u.size))
+				// files that have not started when batchit is interrupted are not uploaded.
+				var fp *os.File
+				err := ctx.Err()
+				if err == nil {
+					fp, err = os.Open(u.local)
+				}
+				if err == nil {
+					ui := &s3.PutObjectInput{
+						Bucket: aws.String(bucket),
+						Key:    aws.String(key),
+						Body:   interruptibleFile{interruptible{ctx: ctx, r: fp}, fp},
+					}
+					if tagging != "" {
+						ui.Tagging = aws.String(tagging)
+					}
 
-				_, err := uploader.Upload(u, func(u *s3manager.Uploader) {
-					u.PartSize = 24 * 1024 * 1024 // 64MB per part
-					u.LeavePartsOnError = false
-				})
+					out, err = uploader.Upload(context.WithoutCancel(uctx), ui, func(u *manager.Uploader) {
+						u.PartSize = 24 * 1024 * 1024 // 64MB per part
+						u.LeavePartsOnError = false
+					})
+					fp.Close()
+				}
+				batchit.EndSpan(span, err)
+				r.Duration = time.Since(t).Seconds()
+				if err != nil {
+					// keep going so that one bad file does not stop the others.
+					log.Printf("[batchit s3upload] error uploading %s: %s", u.local, err)
+					r.Status, r.Error = "failed", err.Error()
+				} else {
+					if out.ETag != nil {
+						r.ETag = strings.Trim(*out.ETag, `"`)
+					}
+					fmt.Fprintf(os.Stderr, "[batchit s3upload] uploaded %s in %s\n", u.local, time.Since(t))
+				}
+				batchit.Emit(batchit.Event{Type: batchit.EventObjectUploaded, Path: r.Path, Bytes: r.Bytes, Message: r.Local, Error: r.Error})
+				mu.Lock()
+				results = append(results, r)
 				if err != nil {
-					log.Fatal(err)
+					failed++
 				}
-				fmt.Fprintf(os.Stderr, "[batchit s3upload] uploaded %s in %s\n", u.Body.(*os.File).Name(), time.Since(t))
+				mu.Unlock()
 
 			}
 			wg.Done()
@@ -167,4 +621,123 @@ func Main() {
 	}
 	wg.Wait()
 
+	return results, failed
+}
+
+// DefaultArgs are used by the s3upload command unless overridden.
+var DefaultArgs = Args{Processes: 2, ScanWorkers: 8}
+
+// Validate returns an error if the arguments can not be used together.
+func (cli *Args) Validate() error {
+	if cli.Retention != "" {
+		if _, err := RetentionTagging(cli.Retention); err != nil {
+			return err
+		}
+	}
+	if cli.Stdin && len(cli.S3Paths) != 1 {
+		return errors.New("--stdin requires exactly one S3 path")
+	}
+	if len(cli.S3Paths) == 0 && len(cli.PrefixMap) == 0 {
+		return errors.New("specify S3 paths and/or --prefixmap")
+	}
+	if cli.Processes < 1 || cli.ScanWorkers < 1 {
+		return errors.New("--processes and --scanworkers must be at least 1")
+	}
+	return nil
+}
+
+// Upload finds the local file for each of cli.S3Paths and those under each of cli.PrefixMap and
+// uploads them, or with Stdin, uploads stdin to the single S3 path. It returns a result for each
+// file uploaded or skipped by Check, or for stdin. With DryRun, what would be uploaded is written to stdout
+// instead. The error has ExitPartial if some of the files were not uploaded.
+func Upload(ctx context.Context, cfg aws.Config, cli *Args) ([]Result, error) {
+	if err := cli.Validate(); err != nil {
+		return nil, batchit.Exit(batchit.ExitUsage, err)
+	}
+	svc := s3.NewFromConfig(cfg)
+	if cli.Accelerate {
+		dests := append([]string{}, cli.S3Paths...)
+		for _, m := range cli.PrefixMap {
+			if _, prefix, err := parsePrefixMap(m); err == nil {
+				dests = append(dests, prefix)
+			}
+		}
+		svc = accelerated(ctx, cfg, svc, dests)
+	}
+
+	var tagging string
+	if cli.Retention != "" {
+		tagging, _ = RetentionTagging(cli.Retention)
+	}
+
+	if cli.Stdin && cli.DryRun {
+		return nil, dryRunStream(os.Stdout, cli.S3Paths[0])
+	}
+	if cli.Stdin {
+		r, err := uploadStream(ctx, svc, os.Stdin, cli.S3Paths[0], tagging)
+		batchit.Emit(batchit.Event{Type: batchit.EventObjectUploaded, Path: r.Path, Bytes: r.Bytes, Error: r.Error})
+		return []Result{r}, err
+	}
+
+	_, span := batchit.StartSpan(ctx, "s3upload.scan")
+	uploads, err := getupload(cli.S3Paths, cli.NoFail, cli.First, cli.ScanWorkers)
+	if err != nil {
+		return nil, batchit.EndSpan(span, err)
+	}
+	if len(cli.PrefixMap) > 0 {
+		pu, err := getprefixuploads(cli.PrefixMap, cli.ScanWorkers)
+		if err != nil {
+			return nil, batchit.EndSpan(span, err)
+		}
+		uploads = append(uploads, pu...)
+	}
+	span.SetAttributes(attribute.Int("batchit.files", len(uploads)))
+	batchit.EndSpan(span, nil)
+	var skipped []string
+	if cli.Check {
+		cctx, span := batchit.StartSpan(ctx, "s3upload.check")
+		uploads, skipped, err = filterPresent(cctx, svc, uploads, cli.ScanWorkers)
+		if err = batchit.EndSpan(span, err); err != nil {
+			return nil, err
+		}
+	}
+	if cli.DryRun {
+		return nil, dryRun(os.Stdout, uploads, skipped)
+	}
+
+	results := make([]Result, 0, len(uploads)+len(skipped))
+	for _, sk := range skipped {
+		results = append(results, Result{Path: sk, Status: "skipped"})
+		batchit.Emit(batchit.Event{Type: batchit.EventObjectSkipped, Path: sk})
+	}
+	uploaded, failed := uploadAll(ctx, svc, uploads, cli.Processes, tagging)
+	results = append(results, uploaded...)
+	if failed > 0 {
+		return results, batchit.Exit(batchit.ExitPartial, fmt.Errorf("s3upload: %d of %d files were not uploaded", failed, len(uploads)))
+	}
+	return results, nil
+}
+
+func Main() error {
+	// TODO: check Region with iid.
+	cli := DefaultArgs
+	p := batchit.MustParse(&cli)
+	if err := cli.Validate(); err != nil {
+		p.Fail(err.Error())
+	}
+	ctx := batchit.Context()
+	cfg, err := batchit.LoadConfig(ctx, cli.Region)
+	if err != nil {
+		return err
+	}
+	results, err := Upload(ctx, cfg, &cli)
+	// with --output jsonl each result has been emitted.
+	if cli.JSON && results != nil && !batchit.JSONL() {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if jerr := enc.Encode(results); jerr != nil && err == nil {
+			err = jerr
+		}
+	}
+	return err
 }
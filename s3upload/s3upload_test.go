@@ -0,0 +1,213 @@
+package s3upload
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/base2genomics/batchit/fake"
+)
+
+func TestUploadAll(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{"a.txt": "a", "b.txt": "bb", "c.txt": "ccc"}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	up := func(name string) upload {
+		return upload{local: filepath.Join(dir, name), size: int64(len(files[name])), s3path: "s3://b/out/" + name}
+	}
+
+	for _, c := range []struct {
+		name      string
+		uploads   []upload
+		processes int
+		tagging   string
+		// fail is the number of requests to S3 that fail.
+		fail int
+		// status are the statuses of the results in the order of the local files.
+		status []string
+	}{
+		{name: "one", uploads: []upload{up("a.txt")}, processes: 1, status: []string{"uploaded"}},
+		{name: "parallel", uploads: []upload{up("a.txt"), up("b.txt"), up("c.txt")}, processes: 2,
+			status: []string{"uploaded", "uploaded", "uploaded"}},
+		{name: "more processes than files", uploads: []upload{up("a.txt"), up("b.txt")}, processes: 4,
+			status: []string{"uploaded", "uploaded"}},
+		{name: "tagging", uploads: []upload{up("a.txt")}, processes: 1, tagging: "retention=30d", status: []string{"uploaded"}},
+		{name: "missing file", uploads: []upload{up("a.txt"), {local: filepath.Join(dir, "missing.txt"), s3path: "s3://b/out/missing.txt"}},
+			processes: 1, status: []string{"uploaded", "failed"}},
+		{name: "request fails", uploads: []upload{up("a.txt"), up("b.txt")}, processes: 1, fail: 1,
+			status: []string{"failed", "uploaded"}},
+		{name: "empty", processes: 2},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			svc := fake.NewS3()
+			if c.fail > 0 {
+				svc.FailNext(c.fail, fake.APIError("InternalError", "We encountered an internal error. Please try again."))
+			}
+			results, failed := uploadAll(context.Background(), svc, c.uploads, c.processes, c.tagging)
+			if len(results) != len(c.status) {
+				t.Fatalf("expected %d results. got %d", len(c.status), len(results))
+			}
+			sort.Slice(results, func(i, j int) bool { return results[i].Local < results[j].Local })
+			nfailed := 0
+			for i, r := range results {
+				if r.Status != c.status[i] {
+					t.Errorf("%s: expected %s. got %s (%s)", r.Local, c.status[i], r.Status, r.Error)
+				}
+				_, key := splitPath(r.Path)
+				data, ok := svc.Objects["b/"+key]
+				if r.Status == "failed" {
+					nfailed++
+					if ok || r.Error == "" {
+						t.Errorf("%s: expected no object and an error. got %v and %q", r.Local, ok, r.Error)
+					}
+					continue
+				}
+				if string(data) != files[filepath.Base(r.Local)] || r.Bytes != int64(len(data)) {
+					t.Errorf("%s: expected %q. got %q (%d bytes)", r.Local, files[filepath.Base(r.Local)], data, r.Bytes)
+				}
+				if r.ETag == "" {
+					t.Errorf("%s: expected an etag", r.Local)
+				}
+				if svc.Tagging["b/"+key] != c.tagging {
+					t.Errorf("%s: expected tagging %q. got %q", r.Local, c.tagging, svc.Tagging["b/"+key])
+				}
+			}
+			if failed != nfailed {
+				t.Errorf("expected %d to fail. got %d", nfailed, failed)
+			}
+		})
+	}
+}
+
+func TestUploadStream(t *testing.T) {
+	svc := fake.NewS3()
+	r, err := uploadStream(context.Background(), svc, strings.NewReader("streamed"), "s3://b/out/stdin.txt", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Status != "uploaded" || r.Bytes != int64(len("streamed")) || r.Key != "out/stdin.txt" || r.ETag == "" {
+		t.Errorf("unexpected result %+v", r)
+	}
+	if got := string(svc.Objects["b/out/stdin.txt"]); got != "streamed" {
+		t.Errorf("expected the object to be streamed. got %q", got)
+	}
+
+	svc.FailNext(0, fake.APIError("AccessDenied", "Access Denied"))
+	r, err = uploadStream(context.Background(), svc, strings.NewReader("streamed"), "s3://b/out/denied.txt", "")
+	if err == nil || r.Status != "failed" || r.Error == "" {
+		t.Errorf("expected a failed result. got %+v and %v", r, err)
+	}
+}
+
+func TestWalkParallel(t *testing.T) {
+	dir := t.TempDir()
+	var want []string
+	for _, p := range []string{"a", "x/b", "x/y/c", "x/y/z/d", "w/e"} {
+		path := filepath.Join(dir, p)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(p), 0644); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, path)
+	}
+	sort.Strings(want)
+	for _, workers := range []int{0, 1, 3, 16} {
+		var mu sync.Mutex
+		var got []string
+		err := walkParallel(dir, workers, func(path string, f os.FileInfo) {
+			mu.Lock()
+			got = append(got, path)
+			mu.Unlock()
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(got)
+		if strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Errorf("%d workers: expected %v. got %v", workers, want, got)
+		}
+	}
+	if err := walkParallel(filepath.Join(dir, "missing"), 2, func(string, os.FileInfo) {}); err == nil {
+		t.Error("expected an error for a missing directory")
+	}
+}
+
+func TestDryRunStream(t *testing.T) {
+	var b strings.Builder
+	if err := dryRunStream(&b, "s3://b/out/stdin.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(b.String(), "upload\t-\ts3://b/out/stdin.txt\t\n") {
+		t.Errorf("unexpected report %q", b.String())
+	}
+}
+
+func TestMatchScore(t *testing.T) {
+	for _, c := range []struct {
+		local, key string
+		score      int
+	}{
+		{"b.txt", "b.txt", 3},
+		{"b.txt", "x/a/b.txt", 3},
+		{"a/b.txt", "x/a/b.txt", 5},
+		{"y/a/b.txt", "x/a/b.txt", 4},
+		{"y/b.txt", "x/a/b.txt", 2},
+		{"x/a/b.txt", "x/a/b.txt", 7},
+		{"w/x/a/b.txt", "x/a/b.txt", 6},
+		{"c.txt", "x/a/b.txt", 0},
+	} {
+		if got := matchScore(c.local, c.key); got != c.score {
+			t.Errorf("%s %s: expected %d. got %d", c.local, c.key, c.score, got)
+		}
+	}
+}
+
+func TestPick(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		key   string
+		paths []string
+		first bool
+		// want is the path picked or empty for an error.
+		want string
+	}{
+		{name: "one", key: "x/b.txt", paths: []string{"b.txt"}, want: "b.txt"},
+		{name: "more components", key: "x/a/b.txt", paths: []string{"y/b.txt", "a/b.txt"}, want: "a/b.txt"},
+		{name: "exact before deeper", key: "x/a/b.txt", paths: []string{"y/a/b.txt", "a/b.txt"}, want: "a/b.txt"},
+		{name: "exact before deeper first", key: "x/a/b.txt", paths: []string{"y/a/b.txt", "a/b.txt"}, first: true, want: "a/b.txt"},
+		{name: "whole key", key: "x/a/b.txt", paths: []string{"a/b.txt", "x/a/b.txt", "w/x/a/b.txt"}, want: "x/a/b.txt"},
+		{name: "tie", key: "x/a/b.txt", paths: []string{"z/b.txt", "y/b.txt"}},
+		{name: "tie first", key: "x/a/b.txt", paths: []string{"z/b.txt", "y/b.txt"}, first: true, want: "y/b.txt"},
+		{name: "deeper tie", key: "x/a/b.txt", paths: []string{"z/a/b.txt", "y/a/b.txt"}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			var cands []candidate
+			for _, p := range c.paths {
+				cands = append(cands, candidate{path: p, score: matchScore(p, c.key)})
+			}
+			got, err := pick("s3://b/"+c.key, cands, c.first)
+			if c.want == "" {
+				if err == nil {
+					t.Fatalf("expected an error. got %s", got.path)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.path != c.want {
+				t.Errorf("expected %s. got %s", c.want, got.path)
+			}
+		})
+	}
+}
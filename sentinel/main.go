@@ -0,0 +1,287 @@
+package sentinel
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/base2genomics/batchit"
+
+	"github.com/aws/aws-sdk-go-v2/service/batch"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+var subs = map[string]struct {
+	help string
+	main func()
+}{
+	"done":  {"write the success or failure marker of a step", DoneMain},
+	"check": {"check the markers of steps, optionally waiting for them", CheckMain},
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: batchit sentinel <command> [options]\n\ncommands:")
+	var keys []string
+	for k := range subs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(os.Stderr, "  %-8s: %s\n", k, subs[k].help)
+	}
+	fmt.Fprintf(os.Stderr, "\nmarkers are written as %s or %s under the S3 prefix of a step.\n", SuccessName, FailureName)
+	os.Exit(1)
+}
+
+// Main dispatches to the sentinel commands.
+func Main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	s, ok := subs[os.Args[1]]
+	if !ok {
+		usage()
+	}
+	// remove the command name as is done for batchit itself.
+	os.Args = append(os.Args[:1], os.Args[2:]...)
+	s.main()
+}
+
+type doneArgs struct {
+	Region  string   `arg:"env:AWS_DEFAULT_REGION,help:region for batch setup. see batchit help for the default."`
+	Status  int      `help:"exit status of the step, e.g. $?. non-zero writes the failure marker."`
+	Started string   `arg:"help:start time of the step as RFC3339 or seconds since the epoch. default is the start of the batch job."`
+	Message string   `arg:"help:message to add to the marker."`
+	NoJob   bool     `arg:"help:do not look up the name and start time of the batch job."`
+	Prefix  string   `arg:"required,positional" help:"S3 prefix of the step, e.g. s3://bucket/run42/step1/."`
+	Command []string `arg:"positional,help:command to run after --. its exit status is used for the marker."`
+}
+
+func (c doneArgs) Version() string {
+	return batchit.Version
+}
+
+func (c doneArgs) Description() string {
+	return `Write a marker for a step under its S3 prefix, e.g. at the end of a job script:
+    batchit sentinel done --status $? s3://bucket/run42/step1/
+or around the command of the step:
+    batchit sentinel done s3://bucket/run42/step1/ -- bwa mem ref.fa r1.fq r2.fq
+The marker is a small JSON object with the job id, name, attempt and array index, the exit status and the start
+and finish times. It is written as _SUCCESS if the exit status is 0 and as _FAILURE otherwise, and the other
+marker is removed. With a command, batchit sentinel exits with the exit status of the command.`
+}
+
+func parseTime(s string) (time.Time, error) {
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(secs, 0).UTC(), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// run runs the command, passing on signals, and returns its exit status.
+func run(command []string) (int, error) {
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	go func() {
+		for s := range sigs {
+			cmd.Process.Signal(s)
+		}
+	}()
+	err := cmd.Wait()
+	if ee, ok := err.(*exec.ExitError); ok {
+		return ee.ExitCode(), nil
+	}
+	return 0, err
+}
+
+func DoneMain() {
+	cli := &doneArgs{}
+	p := batchit.MustParse(cli)
+	if !strings.HasPrefix(cli.Prefix, "s3://") {
+		p.Fail("expected an S3 prefix like s3://bucket/run42/step1/")
+	}
+	var started *time.Time
+	if cli.Started != "" {
+		t, err := parseTime(cli.Started)
+		if err != nil {
+			p.Fail("--started must be RFC3339 or seconds since the epoch")
+		}
+		started = &t
+	}
+	status := cli.Status
+	if len(cli.Command) > 0 {
+		if started == nil {
+			t := time.Now().UTC()
+			started = &t
+		}
+		var err error
+		if status, err = run(cli.Command); err != nil {
+			fmt.Fprintf(os.Stderr, "[batchit sentinel] %s\n", err)
+			status = 127
+		}
+	}
+
+	ctx := context.Background()
+	cfg, err := batchit.LoadConfig(ctx, cli.Region)
+	if err != nil {
+		log.Fatal(err)
+	}
+	m := FromEnv(status)
+	m.Started, m.Message = started, cli.Message
+	if !cli.NoJob {
+		// the marker is still useful without the job details, e.g. if the job role can not describe jobs.
+		if err := m.SetJob(ctx, batch.NewFromConfig(cfg)); err != nil {
+			log.Printf("[batchit sentinel] error describing job %s: %s", m.JobID, err)
+		}
+	}
+	key, err := Write(ctx, s3.NewFromConfig(cfg), cli.Prefix, m)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("[batchit sentinel] wrote %s", key)
+	os.Exit(status)
+}
+
+type checkArgs struct {
+	Region   string        `arg:"env:AWS_DEFAULT_REGION,help:region for batch setup. see batchit help for the default."`
+	Wait     time.Duration `help:"wait up to this long for each step to have a marker, e.g. 2h. default is not to wait."`
+	Interval time.Duration `arg:"help:how often to check while waiting."`
+	JSON     bool          `arg:"help:write the markers as JSON rather than a table."`
+	Prefixes []string      `arg:"required,positional,help:S3 prefixes of the steps."`
+}
+
+func (c checkArgs) Version() string {
+	return batchit.Version
+}
+
+func (c checkArgs) Description() string {
+	return `Check the markers written by batchit sentinel done for one or more steps, e.g. to gate the next step of a
+workflow:
+    batchit sentinel check --wait 2h s3://bucket/run42/step1/ s3://bucket/run42/step2/
+An empty _SUCCESS as written by Hadoop or Spark is also a success. batchit sentinel check exits with 0 if every
+step succeeded, 1 if any step failed and 2 if any step has no marker. With --wait, it waits for every step to
+have a marker but stops at the first failure.`
+}
+
+// Status is the marker of a step.
+type Status struct {
+	Prefix string  `json:"prefix"`
+	Marker *Marker `json:"marker"`
+}
+
+func (s Status) state() string {
+	switch {
+	case s.Marker == nil:
+		return "missing"
+	case s.Marker.Succeeded():
+		return "success"
+	}
+	return "failure"
+}
+
+// Check reads the markers of the prefixes.
+func Check(ctx context.Context, svc *s3.Client, prefixes []string) ([]Status, error) {
+	ss := make([]Status, len(prefixes))
+	for i, p := range prefixes {
+		m, err := Read(ctx, svc, p)
+		if err != nil {
+			return nil, err
+		}
+		ss[i] = Status{Prefix: p, Marker: m}
+	}
+	return ss, nil
+}
+
+// WriteTable writes the state of each step.
+func WriteTable(w io.Writer, ss []Status) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "PREFIX\tSTATE\tEXIT\tJOB\tFINISHED")
+	for _, s := range ss {
+		if s.Marker == nil {
+			fmt.Fprintf(tw, "%s\t%s\t-\t-\t-\n", s.Prefix, s.state())
+			continue
+		}
+		job := s.Marker.JobID
+		if job == "" {
+			job = "-"
+		} else if s.Marker.JobName != "" {
+			job = s.Marker.JobName + " (" + job + ")"
+		}
+		finished := "-"
+		if !s.Marker.Finished.IsZero() {
+			finished = s.Marker.Finished.Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\n", s.Prefix, s.state(), s.Marker.ExitStatus, job, finished)
+	}
+	return tw.Flush()
+}
+
+func CheckMain() {
+	cli := &checkArgs{Interval: 30 * time.Second}
+	p := batchit.MustParse(cli)
+	if cli.Interval <= 0 {
+		p.Fail("--interval must be positive")
+	}
+	for _, pre := range cli.Prefixes {
+		if !strings.HasPrefix(pre, "s3://") {
+			p.Fail("expected S3 prefixes like s3://bucket/run42/step1/")
+		}
+	}
+	ctx := context.Background()
+	cfg, err := batchit.LoadConfig(ctx, cli.Region)
+	if err != nil {
+		log.Fatal(err)
+	}
+	svc := s3.NewFromConfig(cfg)
+
+	deadline := time.Now().Add(cli.Wait)
+	var ss []Status
+	code := 0
+	for {
+		var err error
+		if ss, err = Check(ctx, svc, cli.Prefixes); err != nil {
+			log.Fatal(err)
+		}
+		code = 0
+		for _, s := range ss {
+			if st := s.state(); st == "failure" {
+				code = 1
+				break
+			} else if st == "missing" {
+				code = 2
+			}
+		}
+		if code != 2 || !time.Now().Add(cli.Interval).Before(deadline) {
+			break
+		}
+		time.Sleep(cli.Interval)
+	}
+
+	if cli.JSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(ss); err != nil {
+			log.Fatal(err)
+		}
+	} else if err := WriteTable(os.Stdout, ss); err != nil {
+		log.Fatal(err)
+	}
+	os.Exit(code)
+}
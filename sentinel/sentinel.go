@@ -0,0 +1,164 @@
+package sentinel
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/batch"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// the marker of a step is written under its prefix with the names used by Hadoop and Spark so
+// that workflow engines that already look for them need no changes.
+const (
+	SuccessName = "_SUCCESS"
+	FailureName = "_FAILURE"
+)
+
+// Marker is the content of a sentinel object.
+type Marker struct {
+	JobID      string     `json:"job_id,omitempty"`
+	JobName    string     `json:"job_name,omitempty"`
+	Attempt    int        `json:"attempt,omitempty"`
+	ArrayIndex *int       `json:"array_index,omitempty"`
+	Queue      string     `json:"queue,omitempty"`
+	Host       string     `json:"host,omitempty"`
+	ExitStatus int        `json:"exit_status"`
+	Started    *time.Time `json:"started,omitempty"`
+	Finished   time.Time  `json:"finished"`
+	Message    string     `json:"message,omitempty"`
+}
+
+// Succeeded returns true if the step exited with 0.
+func (m *Marker) Succeeded() bool {
+	return m.ExitStatus == 0
+}
+
+// FromEnv returns a Marker for the exit status with the job fields set from the variables that
+// batch sets in a job. They are empty outside of batch.
+func FromEnv(status int) *Marker {
+	m := &Marker{
+		JobID:      os.Getenv("AWS_BATCH_JOB_ID"),
+		Queue:      os.Getenv("AWS_BATCH_JQ_NAME"),
+		ExitStatus: status,
+		Finished:   time.Now().UTC(),
+	}
+	m.Host, _ = os.Hostname()
+	if a, err := strconv.Atoi(os.Getenv("AWS_BATCH_JOB_ATTEMPT")); err == nil {
+		m.Attempt = a
+	}
+	if i, err := strconv.Atoi(os.Getenv("AWS_BATCH_JOB_ARRAY_INDEX")); err == nil {
+		m.ArrayIndex = &i
+	}
+	return m
+}
+
+// SetJob sets the name and start time of the job from batch.
+func (m *Marker) SetJob(ctx context.Context, b *batch.Client) error {
+	if m.JobID == "" {
+		return nil
+	}
+	out, err := b.DescribeJobs(ctx, &batch.DescribeJobsInput{Jobs: []string{m.JobID}})
+	if err != nil {
+		return err
+	}
+	if len(out.Jobs) == 0 {
+		return fmt.Errorf("sentinel: job %s not found", m.JobID)
+	}
+	j := out.Jobs[0]
+	m.JobName = aws.ToString(j.JobName)
+	if m.Started == nil && aws.ToInt64(j.StartedAt) > 0 {
+		t := time.Unix(0, aws.ToInt64(j.StartedAt)*int64(time.Millisecond)).UTC()
+		m.Started = &t
+	}
+	return nil
+}
+
+func splitPath(s3path string) (bucket, prefix string) {
+	s3path = strings.TrimPrefix(s3path, "s3://")
+	bk := strings.SplitN(s3path, "/", 2)
+	if len(bk) != 2 || bk[1] == "" {
+		return bk[0], ""
+	}
+	if !strings.HasSuffix(bk[1], "/") {
+		bk[1] += "/"
+	}
+	return bk[0], bk[1]
+}
+
+// Write writes the marker under the s3 prefix of a step as _SUCCESS or _FAILURE and removes the
+// other so that a step that is run again only has the marker of its last run.
+func Write(ctx context.Context, svc *s3.Client, s3prefix string, m *Marker) (string, error) {
+	bucket, prefix := splitPath(s3prefix)
+	name, other := SuccessName, FailureName
+	if !m.Succeeded() {
+		name, other = other, name
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	_, err = svc.PutObject(ctx, &s3.PutObjectInput{Bucket: aws.String(bucket), Key: aws.String(prefix + name),
+		Body: bytes.NewReader(append(data, '\n')), ContentType: aws.String("application/json")})
+	if err != nil {
+		return "", err
+	}
+	if _, err := svc.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(bucket), Key: aws.String(prefix + other)}); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("s3://%s/%s%s", bucket, prefix, name), nil
+}
+
+func get(ctx context.Context, svc *s3.Client, bucket, key string) (*Marker, time.Time, error) {
+	out, err := svc.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	var missing *s3types.NoSuchKey
+	if errors.As(err, &missing) {
+		return nil, time.Time{}, nil
+	}
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer out.Body.Close()
+	m := &Marker{}
+	// an empty _SUCCESS as written by other tools is a success with no details.
+	if aws.ToInt64(out.ContentLength) != 0 {
+		if err := json.NewDecoder(out.Body).Decode(m); err != nil {
+			return nil, time.Time{}, fmt.Errorf("sentinel: reading s3://%s/%s: %s", bucket, key, err)
+		}
+	}
+	return m, aws.ToTime(out.LastModified), nil
+}
+
+// Read returns the marker under the s3 prefix of a step or nil if there is none. If both are
+// present, e.g. because a step was run twice at once, the one written last is used.
+func Read(ctx context.Context, svc *s3.Client, s3prefix string) (*Marker, error) {
+	bucket, prefix := splitPath(s3prefix)
+	ok, okTime, err := get(ctx, svc, bucket, prefix+SuccessName)
+	if err != nil {
+		return nil, err
+	}
+	failed, failedTime, err := get(ctx, svc, bucket, prefix+FailureName)
+	if err != nil {
+		return nil, err
+	}
+	if failed != nil && failed.Succeeded() {
+		// a _FAILURE from another tool may not have an exit status.
+		failed.ExitStatus = 1
+	}
+	switch {
+	case ok == nil:
+		return failed, nil
+	case failed == nil || okTime.After(failedTime):
+		return ok, nil
+	}
+	return failed, nil
+}
@@ -0,0 +1,51 @@
+package batchit
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// cleanupTimeout is how long a subcommand has to undo what it did after an interrupt.
+const cleanupTimeout = 2 * time.Minute
+
+var interrupt struct {
+	once sync.Once
+	ctx  context.Context
+}
+
+// Context returns a context that is canceled when batchit gets SIGINT or SIGTERM, e.g. when CI
+// cancels a step, so that a subcommand stops and undoes what it has done rather than leaving
+// job definitions, volumes or uploads behind. A second signal exits at once with
+// ExitInterrupted.
+func Context() context.Context {
+	interrupt.once.Do(func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		interrupt.ctx = ctx
+		sigs := make(chan os.Signal, 2)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			s := <-sigs
+			log.Printf("[batchit %s] got %s. cleaning up. send it again to exit now", Command, s)
+			cancel()
+			<-sigs
+			os.Exit(ExitInterrupted)
+		}()
+	})
+	return interrupt.ctx
+}
+
+// Interrupted is true once the context from Context has been canceled by a signal.
+func Interrupted() bool {
+	return interrupt.ctx != nil && interrupt.ctx.Err() != nil
+}
+
+// CleanupContext returns a context with the values of ctx that is not canceled with it, so that
+// cleanup still runs after an interrupt, but that ends after cleanupTimeout.
+func CleanupContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.WithoutCancel(ctx), cleanupTimeout)
+}
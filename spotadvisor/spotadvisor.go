@@ -0,0 +1,312 @@
+package spotadvisor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/base2genomics/batchit"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+type cliargs struct {
+	Region    string `arg:"env:AWS_DEFAULT_REGION,help:region for batch setup. see batchit help for the default."`
+	VCPUs     int64  `arg:"required,help:vCPUs of the job."`
+	Mem       int64  `arg:"required,help:memory of the job in MiB."`
+	Arch      string `arg:"help:processor architecture of the instance types: x86_64 or arm64."`
+	MaxFactor int64  `arg:"help:skip instance types with more than this many times the vCPUs of the job."`
+	Top       int    `arg:"help:number of instance types to show."`
+	JSON      bool   `arg:"help:print a JSON array rather than a table."`
+}
+
+func (c cliargs) Version() string {
+	return batchit.Version
+}
+
+func (c cliargs) Description() string {
+	return `Recommend spot instance types and an allocation strategy for a compute environment that runs jobs
+of the given size. Instance types are ranked by how often spot instances of that type are interrupted
+(from the AWS Spot Instance Advisor) and then by the current spot price per job, which accounts for the
+number of jobs that fit on an instance.`
+}
+
+// AdvisorURL is the data behind the AWS Spot Instance Advisor.
+const AdvisorURL = "https://spot-bid-advisor.s3.amazonaws.com/spot-advisor-data.json"
+
+// Overhead is the fraction of the memory of an instance that ECS does not make available to jobs.
+const Overhead = 0.05
+
+// Candidate is an instance type that fits at least one job.
+type Candidate struct {
+	InstanceType string `json:"instance_type"`
+	VCPUs        int64  `json:"vcpus"`
+	Memory       int64  `json:"memory"`
+	// Jobs is the number of jobs that fit on one instance.
+	Jobs int64 `json:"jobs"`
+	// SpotPrice is the mean current spot price across the zones it is offered in.
+	SpotPrice float64 `json:"spot_price"`
+	Zones     int     `json:"zones"`
+	// ZonePrices is the current spot price in each zone.
+	ZonePrices map[string]float64 `json:"zone_prices"`
+	// JobPrice is the spot price per job-hour.
+	JobPrice float64 `json:"job_price"`
+	// Savings is the percent saved over on-demand according to the advisor.
+	Savings      int    `json:"savings"`
+	Interruption string `json:"interruption"`
+	// Rank is the interruption range with 0 the least often interrupted.
+	Rank int `json:"-"`
+}
+
+// Candidates returns the current generation instance types that support spot and fit at least one job
+// of vcpus and mem (MiB) without having more than maxFactor times the vcpus of the job.
+func Candidates(ctx context.Context, svc *ec2.Client, vcpus, mem int64, arch string, maxFactor int64) ([]*Candidate, error) {
+	var out []*Candidate
+	pages := ec2.NewDescribeInstanceTypesPaginator(svc, &ec2.DescribeInstanceTypesInput{
+		Filters: []ec2types.Filter{
+			{Name: aws.String("current-generation"), Values: []string{"true"}},
+			{Name: aws.String("supported-usage-class"), Values: []string{"spot"}},
+			{Name: aws.String("processor-info.supported-architecture"), Values: []string{arch}},
+		},
+	})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return out, err
+		}
+		for _, it := range page.InstanceTypes {
+			if it.VCpuInfo == nil || it.MemoryInfo == nil || it.GpuInfo != nil {
+				continue
+			}
+			v := int64(aws.ToInt32(it.VCpuInfo.DefaultVCpus))
+			m := aws.ToInt64(it.MemoryInfo.SizeInMiB)
+			if maxFactor > 0 && v > maxFactor*vcpus {
+				continue
+			}
+			n := v / vcpus
+			if byMem := int64(float64(m)*(1-Overhead)) / mem; byMem < n {
+				n = byMem
+			}
+			if n == 0 {
+				continue
+			}
+			out = append(out, &Candidate{InstanceType: string(it.InstanceType), VCPUs: v, Memory: m, Jobs: n})
+		}
+	}
+	return out, nil
+}
+
+// SetPrices sets the current spot price of each candidate and removes those with no price.
+func SetPrices(ctx context.Context, svc *ec2.Client, cands []*Candidate) ([]*Candidate, error) {
+	byType := make(map[string]*Candidate, len(cands))
+	types := make([]ec2types.InstanceType, 0, len(cands))
+	for _, c := range cands {
+		byType[c.InstanceType] = c
+		types = append(types, ec2types.InstanceType(c.InstanceType))
+	}
+	// a start time of now gives the current price in each zone.
+	now := time.Now()
+	seen := make(map[string]bool)
+	for len(types) > 0 {
+		chunk := types
+		if len(chunk) > 100 {
+			chunk = chunk[:100]
+		}
+		types = types[len(chunk):]
+		pages := ec2.NewDescribeSpotPriceHistoryPaginator(svc, &ec2.DescribeSpotPriceHistoryInput{
+			InstanceTypes:       chunk,
+			ProductDescriptions: []string{"Linux/UNIX"},
+			StartTime:           aws.Time(now),
+			EndTime:             aws.Time(now),
+		})
+		for pages.HasMorePages() {
+			page, err := pages.NextPage(ctx)
+			if err != nil {
+				return nil, err
+			}
+			for _, sp := range page.SpotPriceHistory {
+				c := byType[string(sp.InstanceType)]
+				key := string(sp.InstanceType) + "/" + aws.ToString(sp.AvailabilityZone)
+				if c == nil || seen[key] {
+					continue
+				}
+				v, err := strconv.ParseFloat(aws.ToString(sp.SpotPrice), 64)
+				if err != nil {
+					continue
+				}
+				seen[key] = true
+				if c.ZonePrices == nil {
+					c.ZonePrices = make(map[string]float64)
+				}
+				c.ZonePrices[aws.ToString(sp.AvailabilityZone)] = v
+				c.SpotPrice += v
+				c.Zones++
+			}
+		}
+	}
+	var out []*Candidate
+	for _, c := range cands {
+		if c.Zones == 0 {
+			continue
+		}
+		c.SpotPrice /= float64(c.Zones)
+		c.JobPrice = c.SpotPrice / float64(c.Jobs)
+		out = append(out, c)
+	}
+	return out, nil
+}
+
+// Advisor is the part of the Spot Instance Advisor data that is used.
+type Advisor struct {
+	Ranges []struct {
+		Index int    `json:"index"`
+		Label string `json:"label"`
+	} `json:"ranges"`
+	// SpotAdvisor is keyed by region, then operating system, then instance type. s is the
+	// percent saved over on-demand and r is the index of the interruption range.
+	SpotAdvisor map[string]map[string]map[string]struct {
+		S int `json:"s"`
+		R int `json:"r"`
+	} `json:"spot_advisor"`
+}
+
+// ReadAdvisor downloads the Spot Instance Advisor data.
+func ReadAdvisor() (*Advisor, error) {
+	client, err := batchit.HTTPClient(30 * time.Second)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Get(AdvisorURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("spot-advisor: %s from %s", resp.Status, AdvisorURL)
+	}
+	a := &Advisor{}
+	if err := json.NewDecoder(resp.Body).Decode(a); err != nil {
+		return nil, fmt.Errorf("spot-advisor: reading %s: %s", AdvisorURL, err)
+	}
+	return a, nil
+}
+
+// Rank sets the interruption range and savings of each candidate in region and sorts them by
+// interruption range and then by price per job. Types missing from the advisor are ranked last.
+func (a *Advisor) Rank(region string, cands []*Candidate) {
+	labels := make(map[int]string, len(a.Ranges))
+	for _, r := range a.Ranges {
+		labels[r.Index] = r.Label
+	}
+	linux := a.SpotAdvisor[region]["Linux"]
+	for _, c := range cands {
+		d, ok := linux[c.InstanceType]
+		if !ok {
+			c.Rank = len(a.Ranges)
+			c.Interruption = "unknown"
+			continue
+		}
+		c.Rank = d.R
+		c.Interruption = labels[d.R]
+		c.Savings = d.S
+	}
+	sort.SliceStable(cands, func(i, j int) bool {
+		if cands[i].Rank != cands[j].Rank {
+			return cands[i].Rank < cands[j].Rank
+		}
+		return cands[i].JobPrice < cands[j].JobPrice
+	})
+}
+
+// Strategy recommends an allocation strategy for a compute environment using the ranked candidates.
+// Price and capacity optimized is preferred unless the cheapest types are often interrupted, in which
+// case only capacity should be considered.
+func Strategy(cands []*Candidate) string {
+	if len(cands) == 0 {
+		return "SPOT_CAPACITY_OPTIMIZED"
+	}
+	cheapest := cands[0]
+	for _, c := range cands {
+		if c.JobPrice < cheapest.JobPrice {
+			cheapest = c
+		}
+	}
+	// ranges 0 and 1 are interrupted less than 10% of the time.
+	if cheapest.Rank > 1 {
+		return "SPOT_CAPACITY_OPTIMIZED"
+	}
+	return "SPOT_PRICE_CAPACITY_OPTIMIZED"
+}
+
+// WriteTable writes the candidates as a table.
+func WriteTable(w io.Writer, cands []*Candidate) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TYPE\tVCPUS\tMEMORY\tJOBS\tSPOT $/H\t$/JOB-HOUR\tSAVINGS\tINTERRUPTION\tZONES")
+	for _, c := range cands {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%.4f\t%.4f\t%d%%\t%s\t%d\n", c.InstanceType, c.VCPUs, c.Memory, c.Jobs, c.SpotPrice, c.JobPrice, c.Savings, c.Interruption, c.Zones)
+	}
+	return tw.Flush()
+}
+
+func Main() {
+	cli := &cliargs{Arch: "x86_64", MaxFactor: 8, Top: 15}
+	p := batchit.MustParse(cli)
+	if cli.VCPUs <= 0 || cli.Mem <= 0 {
+		p.Fail("--vcpus and --mem must be greater than 0")
+	}
+	ctx := context.Background()
+	cfg, err := batchit.LoadConfig(ctx, cli.Region)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cli.Region = cfg.Region
+	svc := ec2.NewFromConfig(cfg)
+
+	cands, err := Candidates(ctx, svc, cli.VCPUs, cli.Mem, cli.Arch, cli.MaxFactor)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(cands) == 0 {
+		log.Fatalf("[batchit spot-advisor] no %s instance types fit a job with %d vCPUs and %d MiB", cli.Arch, cli.VCPUs, cli.Mem)
+	}
+	if cands, err = SetPrices(ctx, svc, cands); err != nil {
+		log.Fatal(err)
+	}
+	a, err := ReadAdvisor()
+	if err != nil {
+		log.Fatal(err)
+	}
+	a.Rank(cli.Region, cands)
+	if cli.Top > 0 && len(cands) > cli.Top {
+		cands = cands[:cli.Top]
+	}
+
+	if cli.JSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(cands); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if err := WriteTable(os.Stdout, cands); err != nil {
+		log.Fatal(err)
+	}
+	types := make([]string, 0, len(cands))
+	for _, c := range cands {
+		types = append(types, c.InstanceType)
+	}
+	// more types give the allocation strategy more pools to choose from.
+	fmt.Printf("\nfor batchit ce create:\n\n    type: SPOT\n    instance_types: [%s]\n    allocation_strategy: %s\n", strings.Join(types, ", "), Strategy(cands))
+}
@@ -0,0 +1,184 @@
+package sqsconsume
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/base2genomics/batchit"
+	"github.com/base2genomics/batchit/pipeline"
+	"github.com/base2genomics/batchit/submit"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+type cliargs struct {
+	Region        string `arg:"env:AWS_DEFAULT_REGION,help:region for batch setup. see batchit help for the default."`
+	SQS           string `arg:"required,help:URL of the SQS queue to read."`
+	Template      string `arg:"required,help:YAML file describing the job to submit for each message."`
+	ExitWhenEmpty bool   `arg:"help:exit once the SQS queue is empty rather than waiting for more messages."`
+	DryRun        bool   `arg:"help:log the job for each message without submitting it or deleting the message."`
+}
+
+func (c cliargs) Version() string {
+	return batchit.Version
+}
+
+func (c cliargs) Description() string {
+	return `Submit a job for each message in an SQS queue. The template has the same fields as a job in a pipeline:
+
+    name: align-${sample}
+    queue: myqueue
+    role: myrole
+    image: aligner:1.0
+    script: align.sh
+    cpus: 16
+    env:
+      REFERENCE: s3://bucket/hg38.fa
+
+Each message must be a JSON object of strings, e.g. {"sample": "NA12878", "fastq": "s3://bucket/NA12878.fq.gz"}.
+Each key is set as an environment variable of the job and ${key} is replaced in the name and env of the template.
+A message is deleted once its job is submitted. Otherwise it becomes visible again and is retried, so the SQS
+queue should have a dead-letter queue for messages that can never be submitted.`
+}
+
+var invalidName = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// Job returns the job for a message by filling the template with the fields of body.
+func Job(tmpl pipeline.Job, body string) (pipeline.Job, error) {
+	var fields map[string]string
+	if err := json.Unmarshal([]byte(body), &fields); err != nil {
+		return tmpl, fmt.Errorf("sqs-consume: message must be a JSON object of strings: %s", err)
+	}
+	return Fill(tmpl, fields), nil
+}
+
+// Fill replaces ${key} in the name and env of the template with each field and adds the fields
+// to the environment.
+func Fill(tmpl pipeline.Job, fields map[string]string) pipeline.Job {
+	expand := func(s string) string {
+		return os.Expand(s, func(k string) string {
+			if v, ok := fields[k]; ok {
+				return v
+			}
+			// leave variables that are not in the message for the shell in the job.
+			return "${" + k + "}"
+		})
+	}
+	j := tmpl
+	j.Name = invalidName.ReplaceAllString(expand(tmpl.Name), "-")
+	if len(j.Name) > 128 {
+		j.Name = j.Name[:128]
+	}
+	j.Env = make(map[string]string, len(tmpl.Env)+len(fields))
+	for k, v := range tmpl.Env {
+		j.Env[k] = expand(v)
+	}
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		j.Env[k] = fields[k]
+	}
+	return j
+}
+
+// Consumer submits a job for each message.
+type Consumer struct {
+	URL      string
+	Template pipeline.Job
+	// Dir is the directory of the template which scripts are relative to.
+	Dir    string
+	DryRun bool
+
+	cfg aws.Config
+	sqs *sqs.Client
+}
+
+// handle submits the job for a message and returns its id.
+func (c *Consumer) handle(ctx context.Context, m *sqstypes.Message) (string, error) {
+	j, err := Job(c.Template, aws.ToString(m.Body))
+	if err != nil {
+		return "", err
+	}
+	if c.DryRun {
+		log.Printf("[batchit sqs-consume] would submit %s for message %s with %v", j.Name, aws.ToString(m.MessageId), j.Env)
+		return "", nil
+	}
+	return submit.Submit(ctx, c.cfg, j.Options(c.Dir, c.cfg.Region))
+}
+
+// Poll waits up to 20 seconds for messages and submits a job for each. It returns the number
+// of messages received.
+func (c *Consumer) Poll(ctx context.Context) (int, error) {
+	ro, err := c.sqs.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+		QueueUrl:            aws.String(c.URL),
+		MaxNumberOfMessages: 10,
+		WaitTimeSeconds:     20,
+	})
+	if err != nil {
+		return 0, err
+	}
+	for i := range ro.Messages {
+		m := &ro.Messages[i]
+		id, err := c.handle(ctx, m)
+		if err == submit.ErrOutputsExist {
+			log.Printf("[batchit sqs-consume] outputs exist for message %s. not submitting", aws.ToString(m.MessageId))
+		} else if err != nil {
+			log.Printf("[batchit sqs-consume] error with message %s: %s. it will be retried", aws.ToString(m.MessageId), err)
+			continue
+		}
+		if c.DryRun {
+			continue
+		}
+		if id != "" {
+			fmt.Println(id)
+		}
+		if _, err := c.sqs.DeleteMessage(ctx, &sqs.DeleteMessageInput{QueueUrl: aws.String(c.URL), ReceiptHandle: m.ReceiptHandle}); err != nil {
+			return len(ro.Messages), err
+		}
+	}
+	return len(ro.Messages), nil
+}
+
+func Main() {
+	cli := &cliargs{}
+	p := batchit.MustParse(cli)
+	tmpl, err := pipeline.ReadJob(cli.Template)
+	if err != nil {
+		p.Fail(err.Error())
+	}
+	if path := tmpl.Options(filepath.Dir(cli.Template), "").Path; !strings.HasPrefix(path, "script:") {
+		if _, err := os.Stat(path); err != nil {
+			p.Fail(fmt.Sprintf("script in template: %s", err))
+		}
+	}
+	ctx := context.Background()
+	cfg, err := batchit.LoadConfig(ctx, cli.Region)
+	if err != nil {
+		log.Fatal(err)
+	}
+	c := &Consumer{URL: cli.SQS, Template: *tmpl, Dir: filepath.Dir(cli.Template), DryRun: cli.DryRun,
+		cfg: cfg, sqs: sqs.NewFromConfig(cfg)}
+
+	log.Printf("[batchit sqs-consume] submitting jobs for messages from %s", cli.SQS)
+	for {
+		n, err := c.Poll(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if n == 0 && cli.ExitWhenEmpty {
+			return
+		}
+	}
+}
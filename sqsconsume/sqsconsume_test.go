@@ -0,0 +1,41 @@
+package sqsconsume
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/base2genomics/batchit/pipeline"
+)
+
+func TestFill(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		tmpl   pipeline.Job
+		fields map[string]string
+		job    string
+		env    map[string]string
+	}{
+		{name: "fields", tmpl: pipeline.Job{Name: "align-${sample}", Env: map[string]string{"in": "s3://b/${sample}.bam"}},
+			fields: map[string]string{"sample": "NA12878"}, job: "align-NA12878",
+			env: map[string]string{"in": "s3://b/NA12878.bam", "sample": "NA12878"}},
+		{name: "missing field", tmpl: pipeline.Job{Name: "align", Env: map[string]string{"out": "$TMPDIR/${sample}.bam"}},
+			job: "align", env: map[string]string{"out": "${TMPDIR}/${sample}.bam"}},
+		{name: "invalid name", tmpl: pipeline.Job{Name: "${key}"}, fields: map[string]string{"key": "in/a b.bam"},
+			job: "in-a-b-bam", env: map[string]string{"key": "in/a b.bam"}},
+		{name: "long name", tmpl: pipeline.Job{Name: "${sample}"}, fields: map[string]string{"sample": strings.Repeat("a", 200)},
+			job: strings.Repeat("a", 128), env: map[string]string{"sample": strings.Repeat("a", 200)}},
+		{name: "field over env", tmpl: pipeline.Job{Name: "j", Env: map[string]string{"sample": "default"}},
+			fields: map[string]string{"sample": "NA12878"}, job: "j", env: map[string]string{"sample": "NA12878"}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			j := Fill(c.tmpl, c.fields)
+			if j.Name != c.job {
+				t.Errorf("expected name %s. got %s", c.job, j.Name)
+			}
+			if !reflect.DeepEqual(j.Env, c.env) {
+				t.Errorf("expected environment %v. got %v", c.env, j.Env)
+			}
+		})
+	}
+}
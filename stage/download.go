@@ -0,0 +1,376 @@
+package stage
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// a file is downloaded to path+partialSuffix and the parts that are done are recorded in
+// path+journalSuffix so that an interrupted stage can resume.
+const (
+	partialSuffix = ".batchit-partial"
+	journalSuffix = ".batchit-parts"
+)
+
+// Object is an S3 object and the local path it is staged to.
+type Object struct {
+	Key  string
+	Size int64
+	ETag string
+	Path string
+}
+
+// Summary counts what was staged.
+type Summary struct {
+	Files   int
+	Skipped int
+	Bytes   int64
+	// Unverified is the number of files that could not be checked against their ETag, e.g. because
+	// they are encrypted with KMS.
+	Unverified int
+}
+
+// Stager downloads objects from a bucket with ranged GETs that are shared by all of the objects so
+// that both large and small files keep every connection busy.
+type Stager struct {
+	Bucket string
+	// PartSize is the size of each GET. Objects from a multipart upload are fetched in the parts
+	// of the upload when Verify is true so that they can be checked.
+	PartSize    int64
+	Concurrency int
+	// Verify checks each file against the ETag of its object.
+	Verify bool
+
+	svc     *s3.Client
+	mu      sync.Mutex
+	summary Summary
+}
+
+// NewStager returns a Stager for bucket.
+func NewStager(svc *s3.Client, bucket string, partSize int64, concurrency int) *Stager {
+	return &Stager{svc: svc, Bucket: bucket, PartSize: partSize, Concurrency: concurrency, Verify: true}
+}
+
+// download is an object that is being staged.
+type download struct {
+	*Object
+	f        *os.File
+	journal  *os.File
+	partSize int64
+	// multipart is true if partSize is that of the upload so the ETag can be checked.
+	multipart bool
+	// md5s are the digests of the parts. They are nil for parts that are not done.
+	md5s [][]byte
+	mu   sync.Mutex
+	left int
+}
+
+type part struct {
+	d *download
+	i int
+}
+
+// readJournal sets the digests of the parts recorded in the journal at path and returns how many
+// there are. Nothing is used if the journal is for another version or part size of the object.
+func readJournal(path, header string, md5s [][]byte) int {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() || scanner.Text() != header {
+		return 0
+	}
+	n := 0
+	for scanner.Scan() {
+		var i int
+		var sum string
+		// the last line may be incomplete if stage was killed.
+		if _, err := fmt.Sscanf(scanner.Text(), "%d %s", &i, &sum); err != nil || i < 0 || i >= len(md5s) || md5s[i] != nil {
+			continue
+		}
+		if b, err := hex.DecodeString(sum); err == nil && len(b) == md5.Size {
+			md5s[i] = b
+			n++
+		}
+	}
+	return n
+}
+
+// prepare opens the partial file and journal of o, resuming from them if they match the object.
+func (s *Stager) prepare(ctx context.Context, o *Object) (*download, error) {
+	d := &download{Object: o, partSize: s.PartSize}
+	etag := strings.Trim(o.ETag, `"`)
+	if s.Verify && strings.Contains(etag, "-") && o.Size > 0 {
+		// the ETag of a multipart upload is the MD5 of the MD5s of its parts so fetching the same
+		// parts allows it to be checked. the size of the first part gives the part size.
+		ho, err := s.svc.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String(s.Bucket), Key: aws.String(o.Key),
+			IfMatch: aws.String(o.ETag), PartNumber: aws.Int32(1)})
+		if err != nil {
+			return nil, err
+		}
+		ps := aws.ToInt64(ho.ContentLength)
+		if ps > 0 && (o.Size+ps-1)/ps == int64(aws.ToInt32(ho.PartsCount)) && ho.ServerSideEncryption != s3types.ServerSideEncryptionAwsKms {
+			d.partSize, d.multipart = ps, true
+		}
+	}
+	d.md5s = make([][]byte, (o.Size+d.partSize-1)/d.partSize)
+	if err := os.MkdirAll(filepath.Dir(o.Path), 0755); err != nil {
+		return nil, err
+	}
+	header := fmt.Sprintf("%s %d %d", etag, o.Size, d.partSize)
+	done := readJournal(o.Path+journalSuffix, header, d.md5s)
+	if _, err := os.Stat(o.Path + partialSuffix); done > 0 && err != nil {
+		done = 0
+		d.md5s = make([][]byte, len(d.md5s))
+	}
+	flags := os.O_RDWR | os.O_CREATE
+	jflags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if done == 0 {
+		flags |= os.O_TRUNC
+		jflags |= os.O_TRUNC
+	} else {
+		log.Printf("[batchit stage] resuming %s with %d of %d parts", o.Path, done, len(d.md5s))
+	}
+	var err error
+	if d.f, err = os.OpenFile(o.Path+partialSuffix, flags, 0644); err != nil {
+		return nil, err
+	}
+	if err := d.f.Truncate(o.Size); err != nil {
+		return nil, err
+	}
+	if d.journal, err = os.OpenFile(o.Path+journalSuffix, jflags, 0644); err != nil {
+		return nil, err
+	}
+	if done == 0 {
+		if _, err := fmt.Fprintln(d.journal, header); err != nil {
+			return nil, err
+		}
+	}
+	d.left = len(d.md5s) - done
+	return d, nil
+}
+
+// get writes bytes [start, end) of the object to its file and returns their MD5.
+func (s *Stager) get(ctx context.Context, d *download, start, end int64, buf []byte) ([]byte, error) {
+	out, err := s.svc.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(d.Key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", start, end-1)),
+		// parts must all be from the same version of the object.
+		IfMatch: aws.String(d.ETag),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+	h := md5.New()
+	off := start
+	for {
+		n, rerr := io.ReadFull(out.Body, buf)
+		if n > 0 {
+			if _, err := d.f.WriteAt(buf[:n], off); err != nil {
+				return nil, err
+			}
+			h.Write(buf[:n])
+			off += int64(n)
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rerr != nil {
+			return nil, rerr
+		}
+	}
+	if off != end {
+		return nil, fmt.Errorf("stage: got %d bytes of %s at %d. expected %d", off-start, d.Key, start, end-start)
+	}
+	return h.Sum(nil), nil
+}
+
+// fetch downloads a part and records it. It returns true if it was the last part of its file.
+func (s *Stager) fetch(ctx context.Context, p part, buf []byte) (bool, error) {
+	d := p.d
+	start := int64(p.i) * d.partSize
+	end := start + d.partSize
+	if end > d.Size {
+		end = d.Size
+	}
+	var sum []byte
+	var err error
+	// the SDK retries requests but not errors while reading the body.
+	for attempt := 0; attempt < 3; attempt++ {
+		if sum, err = s.get(ctx, d, start, end, buf); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return false, err
+	}
+	s.mu.Lock()
+	s.summary.Bytes += end - start
+	s.mu.Unlock()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.md5s[p.i] = sum
+	if _, err := fmt.Fprintf(d.journal, "%d %x\n", p.i, sum); err != nil {
+		return false, err
+	}
+	d.left--
+	return d.left == 0, nil
+}
+
+// check compares the file to the ETag of its object. It returns false if that is not possible.
+func (s *Stager) check(ctx context.Context, d *download) (bool, error) {
+	etag := strings.Trim(d.ETag, `"`)
+	var got string
+	switch {
+	case d.multipart:
+		h := md5.New()
+		for _, sum := range d.md5s {
+			h.Write(sum)
+		}
+		got = fmt.Sprintf("%x-%d", h.Sum(nil), len(d.md5s))
+	case strings.Contains(etag, "-"):
+		// the parts of the upload are not known.
+		return false, nil
+	case len(d.md5s) == 1:
+		got = hex.EncodeToString(d.md5s[0])
+	default:
+		h := md5.New()
+		if _, err := io.Copy(h, io.NewSectionReader(d.f, 0, d.Size)); err != nil {
+			return false, err
+		}
+		got = hex.EncodeToString(h.Sum(nil))
+	}
+	if got == etag {
+		return true, nil
+	}
+	if !d.multipart {
+		// the ETag of an object encrypted with KMS is not its MD5.
+		ho, err := s.svc.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String(s.Bucket), Key: aws.String(d.Key)})
+		if err != nil {
+			return false, err
+		}
+		if ho.ServerSideEncryption == s3types.ServerSideEncryptionAwsKms {
+			return false, nil
+		}
+	}
+	// a retry must start again.
+	os.Remove(d.Path + partialSuffix)
+	os.Remove(d.Path + journalSuffix)
+	return false, fmt.Errorf("stage: s3://%s/%s does not match its ETag (got %s, expected %s)", s.Bucket, d.Key, got, etag)
+}
+
+// finish checks the file and moves it to its path.
+func (s *Stager) finish(ctx context.Context, d *download) error {
+	d.journal.Close()
+	verified := false
+	if s.Verify {
+		var err error
+		if verified, err = s.check(ctx, d); err != nil {
+			d.f.Close()
+			return err
+		}
+	}
+	if err := d.f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(d.Path+partialSuffix, d.Path); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.summary.Files++
+	if s.Verify && !verified {
+		s.summary.Unverified++
+	}
+	s.mu.Unlock()
+	return os.Remove(d.Path + journalSuffix)
+}
+
+// Stage downloads each object that is not already at its path with the same size.
+func (s *Stager) Stage(ctx context.Context, objs []*Object) (Summary, error) {
+	parts := make(chan part, s.Concurrency)
+	var mu sync.Mutex
+	var first error
+	fail := func(err error) {
+		mu.Lock()
+		if first == nil {
+			first = err
+		}
+		mu.Unlock()
+	}
+	failed := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return first != nil
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(s.Concurrency)
+	for i := 0; i < s.Concurrency; i++ {
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, 1<<20)
+			for p := range parts {
+				if failed() {
+					continue
+				}
+				last, err := s.fetch(ctx, p, buf)
+				if err == nil && last {
+					err = s.finish(ctx, p.d)
+				}
+				if err != nil {
+					fail(err)
+				}
+			}
+		}()
+	}
+
+	for _, o := range objs {
+		if failed() {
+			break
+		}
+		if fi, err := os.Stat(o.Path); err == nil && fi.Size() == o.Size {
+			s.mu.Lock()
+			s.summary.Skipped++
+			s.mu.Unlock()
+			continue
+		}
+		d, err := s.prepare(ctx, o)
+		if err != nil {
+			fail(err)
+			break
+		}
+		if d.left == 0 {
+			// empty or every part was done before stage was interrupted.
+			if err := s.finish(ctx, d); err != nil {
+				fail(err)
+			}
+			continue
+		}
+		for i := range d.md5s {
+			if d.md5s[i] == nil {
+				parts <- part{d: d, i: i}
+			}
+		}
+	}
+	close(parts)
+	wg.Wait()
+	return s.summary, first
+}
@@ -0,0 +1,148 @@
+package stage
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/base2genomics/batchit"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+type cliargs struct {
+	Region      string `arg:"env:AWS_DEFAULT_REGION,help:region for batch setup. see batchit help for the default."`
+	Concurrency int    `arg:"help:number of ranged GETs to run at once across all files."`
+	PartSize    int64  `arg:"help:size in MiB of each ranged GET."`
+	NoVerify    bool   `arg:"help:do not check files against the ETag of their object."`
+	Src         string `arg:"required,positional,help:S3 object or prefix ending in / to download."`
+	Dest        string `arg:"required,positional,help:local file or directory."`
+}
+
+func (c cliargs) Version() string {
+	return batchit.Version
+}
+
+func (c cliargs) Description() string {
+	return `Download an S3 object or every object under a prefix to local scratch, e.g.:
+    batchit stage s3://bucket/prefix/ /mnt/scratch/inputs --concurrency 32
+Objects are fetched with ranged GETs that run in parallel across all of the files, which can fill a RAID0
+EBS scratch volume at several GB/s. Files that exist with the size of their object are skipped. An interrupted
+stage resumes from the parts that were done when it is run again. Each file is checked against the ETag of its
+object unless it is encrypted with KMS or, for multipart uploads, the parts of the upload are not uniform.`
+}
+
+func splitPath(s3path string) (bucket, key string) {
+	s3path = strings.TrimPrefix(s3path, "s3://")
+	bk := strings.SplitN(s3path, "/", 2)
+	if len(bk) != 2 {
+		return bk[0], ""
+	}
+	return bk[0], bk[1]
+}
+
+// List returns the objects to stage from src to dest. If src is a prefix ending in /, the objects
+// under it keep their path relative to the prefix under dest. Otherwise src is a single object that
+// is written to dest or, if dest is a directory, to a file of the same name in it.
+func List(ctx context.Context, svc *s3.Client, src, dest string) (string, []*Object, error) {
+	bucket, key := splitPath(src)
+	var objs []*Object
+	if key != "" && !strings.HasSuffix(key, "/") {
+		ho, err := svc.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+		if err != nil {
+			return bucket, nil, fmt.Errorf("stage: %s: %s", src, err)
+		}
+		p := dest
+		if fi, err := os.Stat(dest); (err == nil && fi.IsDir()) || strings.HasSuffix(dest, "/") {
+			p = filepath.Join(dest, path.Base(key))
+		}
+		objs = append(objs, &Object{Key: key, Size: aws.ToInt64(ho.ContentLength), ETag: aws.ToString(ho.ETag), Path: p})
+		return bucket, objs, nil
+	}
+	pages := s3.NewListObjectsV2Paginator(svc, &s3.ListObjectsV2Input{Bucket: aws.String(bucket), Prefix: aws.String(key)})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return bucket, objs, err
+		}
+		for _, o := range page.Contents {
+			k := aws.ToString(o.Key)
+			// keys ending in / are folders made by the console.
+			if strings.HasSuffix(k, "/") {
+				continue
+			}
+			rel := filepath.FromSlash(k[len(key):])
+			if rel = filepath.Clean(rel); rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) || filepath.IsAbs(rel) {
+				log.Printf("[batchit stage] skipping %s which would be outside of %s", k, dest)
+				continue
+			}
+			objs = append(objs, &Object{Key: k, Size: aws.ToInt64(o.Size), ETag: aws.ToString(o.ETag), Path: filepath.Join(dest, rel)})
+		}
+	}
+	return bucket, objs, nil
+}
+
+// client returns an S3 client that keeps a connection open for each of concurrency requests.
+func client(ctx context.Context, region string, concurrency int) (*s3.Client, error) {
+	cfg, err := batchit.LoadConfig(ctx, region)
+	if err != nil {
+		return nil, err
+	}
+	cfg.HTTPClient = awshttp.NewBuildableClient().WithTransportOptions(func(tr *http.Transport) {
+		tr.MaxIdleConns = concurrency
+		tr.MaxIdleConnsPerHost = concurrency
+	})
+	return s3.NewFromConfig(cfg), nil
+}
+
+// rate formats bytes per second for the time taken.
+func rate(bytes int64, d time.Duration) string {
+	if d <= 0 {
+		d = time.Millisecond
+	}
+	return fmt.Sprintf("%.1f MB/s", float64(bytes)/1e6/d.Seconds())
+}
+
+func Main() {
+	cli := &cliargs{Concurrency: 16, PartSize: 64}
+	p := batchit.MustParse(cli)
+	if cli.Concurrency <= 0 || cli.PartSize <= 0 {
+		p.Fail("--concurrency and --partsize must be greater than 0")
+	}
+	if !strings.HasPrefix(cli.Src, "s3://") {
+		p.Fail("expected an S3 path like s3://bucket/prefix/")
+	}
+	ctx := context.Background()
+	svc, err := client(ctx, cli.Region, cli.Concurrency)
+	if err != nil {
+		log.Fatal(err)
+	}
+	bucket, objs, err := List(ctx, svc, cli.Src, cli.Dest)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(objs) == 0 {
+		log.Fatalf("[batchit stage] no objects found at %s", cli.Src)
+	}
+	s := NewStager(svc, bucket, cli.PartSize<<20, cli.Concurrency)
+	s.Verify = !cli.NoVerify
+
+	t := time.Now()
+	sum, err := s.Stage(ctx, objs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("[batchit stage] downloaded %d files (%.2f GB) in %s (%s). %d were already staged",
+		sum.Files, float64(sum.Bytes)/1e9, time.Since(t).Round(time.Second), rate(sum.Bytes, time.Since(t)), sum.Skipped)
+	if sum.Unverified > 0 {
+		log.Printf("[batchit stage] %d files could not be checked against their ETag", sum.Unverified)
+	}
+}
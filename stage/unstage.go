@@ -0,0 +1,289 @@
+package stage
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/base2genomics/batchit"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+type unstageArgs struct {
+	Region      string `arg:"env:AWS_DEFAULT_REGION,help:region for batch setup. see batchit help for the default."`
+	Concurrency int    `arg:"help:number of files to upload at once."`
+	Parts       int    `arg:"help:number of parts of each file to upload at once."`
+	PartSize    int64  `arg:"help:size in MiB of each part."`
+	Manifest    string `arg:"help:name of the manifest written under the S3 prefix. empty for none."`
+	Delete      bool   `arg:"help:delete each local file once it is in S3."`
+	Src         string `arg:"required,positional,help:local directory to upload."`
+	Dest        string `arg:"required,positional" help:"S3 prefix, e.g. s3://bucket/run42/."`
+}
+
+func (c unstageArgs) Version() string {
+	return batchit.Version
+}
+
+func (c unstageArgs) Description() string {
+	return `Upload every file under a local directory to an S3 prefix keeping their relative paths, e.g.:
+    batchit unstage /mnt/scratch/results s3://bucket/run42/ --delete
+Files are sent as parallel multipart uploads. Files that are already in S3 with the same size and ETag are
+skipped so an interrupted unstage can be run again. A JSON manifest of the key, size and ETag of each file is written under
+the prefix once every file is uploaded. With --delete, each local file is removed as soon as it is in S3 so that
+a job can drain its scratch before its instance is reclaimed.`
+}
+
+// Entry is a file in the manifest.
+type Entry struct {
+	Path   string `json:"path"`
+	Key    string `json:"key"`
+	Bytes  int64  `json:"bytes"`
+	ETag   string `json:"etag"`
+	Status string `json:"status"`
+}
+
+// Local returns an entry for each file under dir with its key under prefix. Files left by an
+// interrupted stage are not included.
+func Local(dir, prefix string) ([]*Entry, error) {
+	var es []*Entry
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() || strings.HasSuffix(path, partialSuffix) || strings.HasSuffix(path, journalSuffix) {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		es = append(es, &Entry{Path: path, Key: prefix + filepath.ToSlash(rel), Bytes: fi.Size()})
+		return nil
+	})
+	return es, err
+}
+
+// existing returns the size and ETag of each object under prefix.
+func existing(ctx context.Context, svc *s3.Client, bucket, prefix string) (map[string]*s3types.Object, error) {
+	objs := make(map[string]*s3types.Object)
+	pages := s3.NewListObjectsV2Paginator(svc, &s3.ListObjectsV2Input{Bucket: aws.String(bucket), Prefix: aws.String(prefix)})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return objs, err
+		}
+		for i := range page.Contents {
+			objs[aws.ToString(page.Contents[i].Key)] = &page.Contents[i]
+		}
+	}
+	return objs, nil
+}
+
+// Unstage uploads the entries that are not in the bucket with the same content, setting their
+// ETag and status. Each local file is removed once it is uploaded or its content is found to be in
+// S3 if remove is true.
+func Unstage(ctx context.Context, up *manager.Uploader, bucket string, es []*Entry, have map[string]*s3types.Object, concurrency int, remove bool) error {
+	todo := make(chan *Entry, len(es))
+	for _, e := range es {
+		todo <- e
+	}
+	close(todo)
+	var mu sync.Mutex
+	var first error
+	var wg sync.WaitGroup
+	wg.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			defer wg.Done()
+			for e := range todo {
+				err := upload(ctx, up, bucket, e, have[e.Key])
+				if err == nil && remove {
+					err = os.Remove(e.Path)
+				}
+				if err != nil {
+					log.Printf("[batchit unstage] error with %s: %s", e.Path, err)
+					e.Status = "failed"
+					mu.Lock()
+					if first == nil {
+						first = err
+					}
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return first
+}
+
+func upload(ctx context.Context, up *manager.Uploader, bucket string, e *Entry, have *s3types.Object) error {
+	if have != nil && aws.ToInt64(have.Size) == e.Bytes {
+		etag := strings.Trim(aws.ToString(have.ETag), `"`)
+		same, err := sameETag(e.Path, etag, up.PartSize)
+		if err != nil {
+			return err
+		}
+		if same {
+			e.ETag, e.Status = etag, "skipped"
+			return nil
+		}
+	}
+	f, err := os.Open(e.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	out, err := Upload(ctx, up, &s3.PutObjectInput{Bucket: aws.String(bucket), Key: aws.String(e.Key), Body: f})
+	if err != nil {
+		return err
+	}
+	e.ETag, e.Status = strings.Trim(aws.ToString(out.ETag), `"`), "uploaded"
+	return nil
+}
+
+// Upload uploads in with up. If a multipart upload fails, e.g. as ctx was canceled by an interrupt,
+// it is aborted with a cleanup context so that its parts are not left in the bucket. up would abort
+// it with ctx which is canceled by then.
+func Upload(ctx context.Context, up *manager.Uploader, in *s3.PutObjectInput) (*manager.UploadOutput, error) {
+	out, err := up.Upload(ctx, in, func(u *manager.Uploader) { u.LeavePartsOnError = true })
+	var mf manager.MultiUploadFailure
+	if errors.As(err, &mf) {
+		cctx, cancel := batchit.CleanupContext(ctx)
+		defer cancel()
+		if _, aerr := up.S3.AbortMultipartUpload(cctx, &s3.AbortMultipartUploadInput{Bucket: in.Bucket, Key: in.Key,
+			UploadId: aws.String(mf.UploadID())}); aerr != nil {
+			log.Printf("[batchit %s] error aborting the upload to s3://%s/%s: %s", batchit.Command, aws.ToString(in.Bucket), aws.ToString(in.Key), aerr)
+		}
+	}
+	return out, err
+}
+
+// sameETag reports whether the file at path has etag as S3 computes it for an upload in a single
+// part or in parts of partSize. An object of the same size is only skipped if this is true as
+// files are deleted once they are in S3. ETags that are not MD5s, e.g. with SSE-KMS, never match.
+func sameETag(path, etag string, partSize int64) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	if !strings.Contains(etag, "-") {
+		h := md5.New()
+		if _, err := io.Copy(h, f); err != nil {
+			return false, err
+		}
+		return hex.EncodeToString(h.Sum(nil)) == etag, nil
+	}
+	// a multipart ETag is the MD5 of the MD5s of the parts and the number of parts.
+	var sums []byte
+	n := 0
+	for {
+		h := md5.New()
+		w, err := io.CopyN(h, f, partSize)
+		if err != nil && err != io.EOF {
+			return false, err
+		}
+		if w == 0 {
+			break
+		}
+		sums = append(sums, h.Sum(nil)...)
+		n++
+		if w < partSize {
+			break
+		}
+	}
+	sum := md5.Sum(sums)
+	return fmt.Sprintf("%x-%d", sum, n) == etag, nil
+}
+
+// WriteManifest writes the entries as JSON to key.
+func WriteManifest(ctx context.Context, svc *s3.Client, bucket, key string, es []*Entry) error {
+	sort.Slice(es, func(i, j int) bool { return es[i].Key < es[j].Key })
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(es); err != nil {
+		return err
+	}
+	_, err := svc.PutObject(ctx, &s3.PutObjectInput{Bucket: aws.String(bucket), Key: aws.String(key),
+		Body: bytes.NewReader(b.Bytes()), ContentType: aws.String("application/json")})
+	return err
+}
+
+func UnstageMain() error {
+	cli := &unstageArgs{Concurrency: 8, Parts: 4, PartSize: 64, Manifest: "manifest.json"}
+	p := batchit.MustParse(cli)
+	if cli.Concurrency <= 0 || cli.Parts <= 0 || cli.PartSize < 5 {
+		p.Fail("--concurrency and --parts must be greater than 0 and --partsize must be at least 5")
+	}
+	if !strings.HasPrefix(cli.Dest, "s3://") {
+		p.Fail("expected an S3 prefix like s3://bucket/run42/")
+	}
+	bucket, prefix := splitPath(cli.Dest)
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	es, err := Local(cli.Src, prefix)
+	if err != nil {
+		return err
+	}
+	if len(es) == 0 {
+		return fmt.Errorf("no files found in %s", cli.Src)
+	}
+	// an interrupt stops the uploads and aborts those that are multipart.
+	ctx := batchit.Context()
+	svc, err := client(ctx, cli.Region, cli.Concurrency*cli.Parts)
+	if err != nil {
+		return err
+	}
+	have, err := existing(ctx, svc, bucket, prefix)
+	if err != nil {
+		return err
+	}
+	up := manager.NewUploader(svc, func(u *manager.Uploader) {
+		u.PartSize = cli.PartSize << 20
+		u.Concurrency = cli.Parts
+	})
+
+	t := time.Now()
+	err = Unstage(ctx, up, bucket, es, have, cli.Concurrency, cli.Delete)
+	var n, skipped int
+	var total int64
+	for _, e := range es {
+		switch e.Status {
+		case "uploaded":
+			n++
+			total += e.Bytes
+		case "skipped":
+			skipped++
+		}
+	}
+	log.Printf("[batchit unstage] uploaded %d files (%.2f GB) in %s (%s). %d were already in S3",
+		n, float64(total)/1e9, time.Since(t).Round(time.Second), rate(total, time.Since(t)), skipped)
+	if err != nil {
+		return fmt.Errorf("%d files were not uploaded. the first error was: %w", len(es)-n-skipped, err)
+	}
+	if cli.Manifest != "" {
+		if err := WriteManifest(ctx, svc, bucket, prefix+cli.Manifest, es); err != nil {
+			return err
+		}
+		log.Printf("[batchit unstage] wrote s3://%s/%s%s", bucket, prefix, cli.Manifest)
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package stage
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/base2genomics/batchit/fake"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// abortS3 is an S3 that records the uploads that are aborted and whether their context was done.
+type abortS3 struct {
+	*fake.S3
+	aborted []string
+	done    bool
+}
+
+func (a *abortS3) AbortMultipartUpload(ctx context.Context, in *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
+	a.aborted = append(a.aborted, aws.ToString(in.Key))
+	a.done = ctx.Err() != nil
+	return a.S3.AbortMultipartUpload(ctx, in, optFns...)
+}
+
+// failReader returns n zero bytes and then err.
+type failReader struct {
+	n   int
+	err error
+}
+
+func (r *failReader) Read(p []byte) (int, error) {
+	if r.n == 0 {
+		return 0, r.err
+	}
+	if len(p) > r.n {
+		p = p[:r.n]
+	}
+	for i := range p {
+		p[i] = 0
+	}
+	r.n -= len(p)
+	return len(p), nil
+}
+
+func TestSameETag(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "f")
+	if err := os.WriteFile(path, []byte("abcdefghij"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var sums []byte
+	for _, p := range []string{"abcd", "efgh", "ij"} {
+		s := md5.Sum([]byte(p))
+		sums = append(sums, s[:]...)
+	}
+	multipart := fmt.Sprintf("%x-3", md5.Sum(sums))
+
+	for _, c := range []struct {
+		etag     string
+		partSize int64
+		same     bool
+	}{
+		{fmt.Sprintf("%x", md5.Sum([]byte("abcdefghij"))), 4, true},
+		{fmt.Sprintf("%x", md5.Sum([]byte("abcdefghiJ"))), 4, false},
+		{multipart, 4, true},
+		// parts of another size give another ETag.
+		{multipart, 5, false},
+		{"not-an-md5", 4, false},
+	} {
+		same, err := sameETag(path, c.etag, c.partSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if same != c.same {
+			t.Errorf("%s with parts of %d: expected %v. got %v", c.etag, c.partSize, c.same, same)
+		}
+	}
+}
+
+func TestUnstage(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		// have is the content of the object already in S3 if it is not empty.
+		have   string
+		status string
+	}{
+		{name: "new", status: "uploaded"},
+		{name: "same", have: "local", status: "skipped"},
+		{name: "same size", have: "LOCAL", status: "uploaded"},
+		{name: "other size", have: "other content", status: "uploaded"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "f.txt")
+			if err := os.WriteFile(path, []byte("local"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			svc := fake.NewS3()
+			have := map[string]*s3types.Object{}
+			if c.have != "" {
+				svc.Objects["b/run/f.txt"] = []byte(c.have)
+				have["run/f.txt"] = &s3types.Object{Key: aws.String("run/f.txt"), Size: aws.Int64(int64(len(c.have))),
+					ETag: aws.String(fmt.Sprintf(`"%x"`, md5.Sum([]byte(c.have))))}
+			}
+			es := []*Entry{{Path: path, Key: "run/f.txt", Bytes: 5}}
+			if err := Unstage(context.Background(), manager.NewUploader(svc), "b", es, have, 1, true); err != nil {
+				t.Fatal(err)
+			}
+			if es[0].Status != c.status {
+				t.Errorf("expected %s. got %s", c.status, es[0].Status)
+			}
+			if got := string(svc.Objects["b/run/f.txt"]); got != "local" {
+				t.Errorf("expected the object to have the local content. got %q", got)
+			}
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Errorf("expected the local file to be removed once it is in S3")
+			}
+		})
+	}
+}
+
+func TestUpload(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		body io.Reader
+		// interrupt cancels the context of the upload.
+		interrupt bool
+		fail      bool
+		// aborted is whether the multipart upload is aborted.
+		aborted bool
+	}{
+		{name: "single part", body: bytes.NewReader([]byte("abc"))},
+		{name: "multipart", body: &failReader{n: 12 << 20, err: io.EOF}},
+		{name: "multipart fails", body: &failReader{n: 6 << 20, err: errors.New("disk error")}, fail: true, aborted: true},
+		{name: "multipart interrupted", body: &failReader{n: 12 << 20, err: io.EOF}, interrupt: true, fail: true, aborted: true},
+		{name: "single part fails", body: &failReader{n: 3, err: errors.New("disk error")}, fail: true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			svc := &abortS3{S3: fake.NewS3()}
+			ctx, cancel := context.WithCancel(context.Background())
+			if c.interrupt {
+				cancel()
+			}
+			defer cancel()
+			up := manager.NewUploader(svc, func(u *manager.Uploader) { u.PartSize = 5 << 20 })
+			_, err := Upload(ctx, up, &s3.PutObjectInput{Bucket: aws.String("b"), Key: aws.String("k"), Body: c.body})
+			if (err != nil) != c.fail {
+				t.Fatalf("expected an error: %v. got %v", c.fail, err)
+			}
+			if got := len(svc.aborted) > 0; got != c.aborted {
+				t.Fatalf("expected the upload to be aborted: %v. got %v", c.aborted, svc.aborted)
+			}
+			if svc.done {
+				t.Error("expected the upload to be aborted with a context that is not done")
+			}
+			if _, ok := svc.Objects["b/k"]; ok == c.fail {
+				t.Errorf("expected the object to be in S3: %v", !c.fail)
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package status
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/base2genomics/batchit"
+	"github.com/base2genomics/batchit/db"
+	"github.com/base2genomics/batchit/logof"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/batch"
+	batchtypes "github.com/aws/aws-sdk-go-v2/service/batch/types"
+)
+
+type cliargs struct {
+	Region     string   `arg:"env:AWS_DEFAULT_REGION,help:region for batch setup. see batchit help for the default."`
+	JSON       bool     `arg:"help:print a JSON array rather than a table."`
+	Name       string   `arg:"help:show the most recent job with this name (requires --queue) rather than specifying job ids."`
+	History    int      `help:"with --name, show the last N jobs with that name."`
+	Queue      string   `arg:"help:job queue to search with --name."`
+	NoInstance bool     `arg:"help:don't look up the instance type of each job. this saves several API calls per job."`
+	JobIds     []string `arg:"positional,help:job id(s) to show."`
+}
+
+func (c cliargs) Version() string {
+	return batchit.Version
+}
+
+func (c cliargs) Description() string {
+	return `Show the status, reason, exit code, times, attempts and instance type of jobs as a table.`
+}
+
+// Row is the status of a single job.
+type Row struct {
+	JobId        string     `json:"job_id"`
+	JobName      string     `json:"job_name"`
+	Status       string     `json:"status"`
+	StatusReason string     `json:"status_reason,omitempty"`
+	ExitCode     *int64     `json:"exit_code,omitempty"`
+	Created      *time.Time `json:"created,omitempty"`
+	Started      *time.Time `json:"started,omitempty"`
+	Stopped      *time.Time `json:"stopped,omitempty"`
+	Attempts     int        `json:"attempts"`
+	InstanceType string     `json:"instance_type,omitempty"`
+	// Array is the number of children in each state for an array job.
+	Array string `json:"array,omitempty"`
+}
+
+func toTime(ms *int64) *time.Time {
+	if ms == nil {
+		return nil
+	}
+	t := time.Unix(0, *ms*int64(time.Millisecond)).UTC()
+	return &t
+}
+
+// NewRow gets the status of j.
+func NewRow(j *batchtypes.JobDetail) Row {
+	r := Row{
+		JobId:        aws.ToString(j.JobId),
+		JobName:      aws.ToString(j.JobName),
+		Status:       string(j.Status),
+		StatusReason: aws.ToString(j.StatusReason),
+		Created:      toTime(j.CreatedAt),
+		Started:      toTime(j.StartedAt),
+		Stopped:      toTime(j.StoppedAt),
+		Attempts:     len(j.Attempts),
+		Array:        logof.ArraySummary(j),
+	}
+	if j.Container != nil {
+		if j.Container.ExitCode != nil {
+			r.ExitCode = aws.Int64(int64(*j.Container.ExitCode))
+		}
+		if r.StatusReason == "" {
+			r.StatusReason = aws.ToString(j.Container.Reason)
+		}
+	}
+	return r
+}
+
+func fmtTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Format("2006-01-02 15:04:05")
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// WriteTable writes the rows as aligned columns.
+func WriteTable(w io.Writer, rows []Row) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "JOB ID\tNAME\tSTATUS\tEXIT\tATTEMPTS\tCREATED\tSTARTED\tSTOPPED\tINSTANCE\tREASON")
+	for _, r := range rows {
+		exit := "-"
+		if r.ExitCode != nil {
+			exit = fmt.Sprint(*r.ExitCode)
+		}
+		status := r.Status
+		if r.Array != "" {
+			status += " (" + r.Array + ")"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\t%s\t%s\n", r.JobId, r.JobName, status, exit, r.Attempts,
+			fmtTime(r.Created), fmtTime(r.Started), fmtTime(r.Stopped), dash(r.InstanceType), dash(r.StatusReason))
+	}
+	return tw.Flush()
+}
+
+func Main() error {
+	cli := &cliargs{History: 1}
+	p := batchit.MustParse(cli)
+	if cli.Name != "" && cli.Queue == "" {
+		p.Fail("--name requires --queue")
+	}
+	if (cli.Name == "") == (len(cli.JobIds) == 0) {
+		p.Fail("specify either job ids or --name")
+	}
+	ctx := context.Background()
+	cfg, err := batchit.LoadConfig(ctx, cli.Region)
+	if err != nil {
+		return err
+	}
+	b := batch.NewFromConfig(cfg)
+
+	if cli.Name != "" {
+		ids, err := logof.JobsByName(ctx, b, cli.Queue, cli.Name, cli.History)
+		if err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			return batchit.Exit(batchit.ExitNotFound, fmt.Errorf("no jobs named %s found in %s", cli.Name, cli.Queue))
+		}
+		cli.JobIds = ids
+	}
+	jobs, err := logof.DescribeJobs(ctx, b, cli.JobIds)
+	if err != nil {
+		return err
+	}
+	db.Observe(ctx, cfg, jobs)
+	// jobs on the same instance share the lookup.
+	instances := make(map[string]string)
+	rows := make([]Row, 0, len(jobs))
+	for _, j := range jobs {
+		r := NewRow(j)
+		if !cli.NoInstance && j.Container != nil && j.Container.ContainerInstanceArn != nil {
+			arn := *j.Container.ContainerInstanceArn
+			it, ok := instances[arn]
+			if !ok {
+				it = logof.InstanceType(ctx, cfg, b, j)
+				instances[arn] = it
+			}
+			r.InstanceType = it
+		}
+		rows = append(rows, r)
+	}
+	if cli.JSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(rows)
+	} else {
+		err = WriteTable(os.Stdout, rows)
+	}
+	if err != nil {
+		return err
+	}
+	if len(jobs) != len(cli.JobIds) {
+		return batchit.Exit(batchit.ExitNotFound, fmt.Errorf("only found %d of %d jobs", len(jobs), len(cli.JobIds)))
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package submit
+
+import (
+	"context"
+
+	"github.com/base2genomics/batchit/db"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/batch"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// BatchAPI is the part of the Batch client that submit uses.
+type BatchAPI interface {
+	RegisterJobDefinition(context.Context, *batch.RegisterJobDefinitionInput, ...func(*batch.Options)) (*batch.RegisterJobDefinitionOutput, error)
+	DeregisterJobDefinition(context.Context, *batch.DeregisterJobDefinitionInput, ...func(*batch.Options)) (*batch.DeregisterJobDefinitionOutput, error)
+	SubmitJob(context.Context, *batch.SubmitJobInput, ...func(*batch.Options)) (*batch.SubmitJobOutput, error)
+	DescribeJobs(context.Context, *batch.DescribeJobsInput, ...func(*batch.Options)) (*batch.DescribeJobsOutput, error)
+}
+
+// IAMAPI is the part of the IAM client that submit uses.
+type IAMAPI interface {
+	GetRole(context.Context, *iam.GetRoleInput, ...func(*iam.Options)) (*iam.GetRoleOutput, error)
+}
+
+// STSAPI is the part of the STS client that submit uses.
+type STSAPI interface {
+	GetCallerIdentity(context.Context, *sts.GetCallerIdentityInput, ...func(*sts.Options)) (*sts.GetCallerIdentityOutput, error)
+}
+
+// S3API is the part of the S3 client that submit uses to check for outputs.
+type S3API interface {
+	HeadObject(context.Context, *s3.HeadObjectInput, ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+}
+
+// Clients are what Submit uses to register and submit jobs. The clients from NewClients
+// can be replaced, e.g. by the in-memory fakes in github.com/base2genomics/batchit/fake.
+type Clients struct {
+	Batch BatchAPI
+	IAM   IAMAPI
+	STS   STSAPI
+	S3    S3API
+	// Region is used for images in ECR.
+	Region string
+	// Track records each submitted job if it is not nil.
+	Track func(context.Context, *db.Record)
+}
+
+// NewClients returns the clients for cfg. Jobs are recorded with db.Track.
+func NewClients(cfg aws.Config) *Clients {
+	return &Clients{
+		Batch:  batch.NewFromConfig(cfg),
+		IAM:    iam.NewFromConfig(cfg),
+		STS:    sts.NewFromConfig(cfg),
+		S3:     s3.NewFromConfig(cfg),
+		Region: cfg.Region,
+		Track:  func(ctx context.Context, r *db.Record) { db.Track(ctx, cfg, r) },
+	}
+}
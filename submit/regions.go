@@ -0,0 +1,222 @@
+package submit
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/base2genomics/batchit"
+	"github.com/base2genomics/batchit/gate"
+	"github.com/base2genomics/batchit/queues"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/batch"
+	batchtypes "github.com/aws/aws-sdk-go-v2/service/batch/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const queueFilePrefix = "file:"
+
+// Candidate is a queue in a region that a job can be submitted to.
+type Candidate struct {
+	Region string
+	Queue  string
+	// Free is the number of vCPUs the compute environments of the queue can still add less those
+	// of the jobs that are already waiting for them.
+	Free int64
+	// Runnable is the number of RUNNABLE jobs in the queue.
+	Runnable int64
+	// Local is true if the region has the buckets of the S3 paths of the job.
+	Local bool
+}
+
+// ParseQueues returns the candidates for the --queue of batchit submit which is a queue name, a
+// comma-separated list of region:queue or file: and the path of a YAML file that maps each region
+// to a queue or a list of queues. Queues without a region are in region.
+func ParseQueues(queue, region string) ([]*Candidate, error) {
+	var cs []*Candidate
+	if strings.HasPrefix(queue, queueFilePrefix) {
+		data, err := ioutil.ReadFile(queue[len(queueFilePrefix):])
+		if err != nil {
+			return nil, err
+		}
+		var m map[string]interface{}
+		if err := yaml.Unmarshal(data, &m); err != nil {
+			return nil, fmt.Errorf("submit: reading %s: %s", queue[len(queueFilePrefix):], err)
+		}
+		regions := make([]string, 0, len(m))
+		for r := range m {
+			regions = append(regions, r)
+		}
+		sort.Strings(regions)
+		for _, r := range regions {
+			switch v := m[r].(type) {
+			case string:
+				cs = append(cs, &Candidate{Region: r, Queue: v})
+			case []interface{}:
+				for _, q := range v {
+					cs = append(cs, &Candidate{Region: r, Queue: fmt.Sprint(q)})
+				}
+			default:
+				return nil, fmt.Errorf("submit: expected a queue or a list of queues for %s in %s", r, queue[len(queueFilePrefix):])
+			}
+		}
+	} else {
+		for _, q := range strings.Split(queue, ",") {
+			c := &Candidate{Region: region, Queue: strings.TrimSpace(q)}
+			// queue ARNs also have colons.
+			if i := strings.Index(c.Queue, ":"); i != -1 && !strings.HasPrefix(c.Queue, "arn:") {
+				c.Region, c.Queue = c.Queue[:i], c.Queue[i+1:]
+			}
+			cs = append(cs, c)
+		}
+	}
+	for _, c := range cs {
+		if c.Region == "" || c.Queue == "" {
+			return nil, usageError(fmt.Sprintf("expected queues like us-east-1:spot-q,us-west-2:spot-q. got %s", queue))
+		}
+	}
+	if len(cs) == 0 {
+		return nil, usageError("no queues given")
+	}
+	return cs, nil
+}
+
+// s3Paths returns the S3 paths in the environment and outputs of cli.
+func s3Paths(cli *Options) []string {
+	var paths []string
+	for _, e := range cli.EnvVars {
+		pair := strings.SplitN(e, "=", 2)
+		if len(pair) == 2 && strings.HasPrefix(pair[1], "s3://") {
+			paths = append(paths, pair[1])
+		}
+	}
+	if cli.S3Outputs != "" {
+		for _, p := range strings.Split(cli.S3Outputs, ",") {
+			if strings.HasPrefix(p, "s3://") {
+				paths = append(paths, p)
+			}
+		}
+	}
+	return paths
+}
+
+// bucketRegion returns the region of a bucket from its location constraint.
+func bucketRegion(loc s3types.BucketLocationConstraint) string {
+	switch loc {
+	case "":
+		return "us-east-1"
+	case s3types.BucketLocationConstraintEu:
+		return "eu-west-1"
+	}
+	return string(loc)
+}
+
+// BucketRegions returns the regions of the buckets of the S3 paths.
+func BucketRegions(ctx context.Context, cfg aws.Config, paths []string) (map[string]bool, error) {
+	svc := s3.NewFromConfig(cfg)
+	regions := make(map[string]bool)
+	seen := make(map[string]bool)
+	for _, p := range paths {
+		bucket := strings.SplitN(strings.TrimPrefix(p, "s3://"), "/", 2)[0]
+		if seen[bucket] {
+			continue
+		}
+		seen[bucket] = true
+		out, err := svc.GetBucketLocation(ctx, &s3.GetBucketLocationInput{Bucket: aws.String(bucket)})
+		if err != nil {
+			return nil, fmt.Errorf("submit: finding the region of %s: %s", bucket, err)
+		}
+		regions[bucketRegion(out.LocationConstraint)] = true
+	}
+	return regions, nil
+}
+
+// measure sets the free capacity and RUNNABLE jobs of the candidate for jobs of cpus vCPUs.
+func (c *Candidate) measure(ctx context.Context, b *batch.Client, cpus int) error {
+	free, err := gate.FreeVCPUs(ctx, b, c.Queue)
+	if err != nil {
+		return err
+	}
+	if c.Runnable, err = queues.Count(ctx, b, c.Queue, batchtypes.JobStatusRunnable); err != nil {
+		return err
+	}
+	// the vCPUs of the waiting jobs are not known so they are taken to be like this one.
+	c.Free = free - c.Runnable*int64(cpus)
+	return nil
+}
+
+// Choose returns the candidate with room for a job of cpus vCPUs. Candidates in a region with the
+// data of the job are preferred and then those with the most free capacity. If none have room, the
+// one with the fewest RUNNABLE jobs is used.
+func Choose(cs []*Candidate, cpus int) *Candidate {
+	sort.SliceStable(cs, func(i, j int) bool {
+		ri, rj := cs[i].Free >= int64(cpus), cs[j].Free >= int64(cpus)
+		if ri != rj {
+			return ri
+		}
+		if cs[i].Local != cs[j].Local {
+			return cs[i].Local
+		}
+		if ri {
+			return cs[i].Free > cs[j].Free
+		}
+		return cs[i].Runnable < cs[j].Runnable
+	})
+	return cs[0]
+}
+
+// SelectQueue sets the region and queue of cli to the queue with the most room when --queue has
+// more than one queue or a queue in another region. Each region is checked with its own config.
+func SelectQueue(ctx context.Context, cli *Options) error {
+	if cli.Region == "" {
+		// queues without a region are in the one that LoadConfig resolves.
+		cfg, err := batchit.LoadConfig(ctx, "")
+		if err != nil {
+			return err
+		}
+		cli.Region = cfg.Region
+	}
+	cs, err := ParseQueues(cli.Queue, cli.Region)
+	if err != nil {
+		return err
+	}
+	if len(cs) == 1 {
+		cli.Region, cli.Queue = cs[0].Region, cs[0].Queue
+		return nil
+	}
+	cfgs := make(map[string]aws.Config)
+	for _, c := range cs {
+		if _, ok := cfgs[c.Region]; !ok {
+			if cfgs[c.Region], err = batchit.LoadConfig(ctx, c.Region); err != nil {
+				return err
+			}
+		}
+	}
+	local, err := BucketRegions(ctx, cfgs[cs[0].Region], s3Paths(cli))
+	if err != nil {
+		// the data may be in a bucket that can not be described but the job can still run.
+		log.Printf("[batchit submit] %s. not preferring a region for the data", err)
+	}
+	var ok []*Candidate
+	for _, c := range cs {
+		if err := c.measure(ctx, batch.NewFromConfig(cfgs[c.Region]), cli.CPUs); err != nil {
+			log.Printf("[batchit submit] skipping %s in %s: %s", c.Queue, c.Region, err)
+			continue
+		}
+		c.Local = local[c.Region]
+		ok = append(ok, c)
+	}
+	if len(ok) == 0 {
+		return fmt.Errorf("submit: none of the queues in %s could be checked", cli.Queue)
+	}
+	c := Choose(ok, cli.CPUs)
+	log.Printf("[batchit submit] using %s in %s with %d RUNNABLE jobs and room for %d more vCPUs", c.Queue, c.Region, c.Runnable, c.Free)
+	cli.Region, cli.Queue = c.Region, c.Queue
+	return nil
+}
@@ -0,0 +1,88 @@
+package submit
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/base2genomics/batchit"
+)
+
+func TestParseQueues(t *testing.T) {
+	dir := t.TempDir()
+	file := func(name, data string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return queueFilePrefix + path
+	}
+	for _, c := range []struct {
+		name   string
+		queue  string
+		region string
+		// queues are region:queue for each candidate.
+		queues []string
+		// code is the exit code of the error or 0 for none. -1 is any error.
+		code int
+	}{
+		{name: "one", queue: "spot-q", region: "us-east-1", queues: []string{"us-east-1:spot-q"}},
+		{name: "list", queue: "spot-q, ondemand-q", region: "us-east-1", queues: []string{"us-east-1:spot-q", "us-east-1:ondemand-q"}},
+		{name: "regions", queue: "us-east-1:spot-q,us-west-2:spot-q", queues: []string{"us-east-1:spot-q", "us-west-2:spot-q"}},
+		{name: "arn", queue: "arn:aws:batch:us-east-1:123456789012:job-queue/q", region: "us-east-1",
+			queues: []string{"us-east-1:arn:aws:batch:us-east-1:123456789012:job-queue/q"}},
+		{name: "file", queue: file("queues.yaml", "us-west-2: spot-q\nus-east-1: [spot-q, ondemand-q]\n"),
+			queues: []string{"us-east-1:spot-q", "us-east-1:ondemand-q", "us-west-2:spot-q"}},
+		{name: "no region", queue: "spot-q", code: batchit.ExitUsage},
+		{name: "empty queue", queue: "us-east-1:", code: batchit.ExitUsage},
+		{name: "empty", queue: "", region: "us-east-1", code: batchit.ExitUsage},
+		{name: "file value", queue: file("bad.yaml", "us-east-1: {q: 1}\n"), code: -1},
+		{name: "file missing", queue: queueFilePrefix + filepath.Join(dir, "missing.yaml"), code: -1},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			cs, err := ParseQueues(c.queue, c.region)
+			if c.code != 0 {
+				if err == nil {
+					t.Fatalf("expected an error. got %d candidates", len(cs))
+				}
+				if code := batchit.ExitCode(err); c.code != -1 && code != c.code {
+					t.Errorf("expected exit code %d. got %d for %v", c.code, code, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var queues []string
+			for _, c := range cs {
+				queues = append(queues, c.Region+":"+c.Queue)
+			}
+			if !reflect.DeepEqual(queues, c.queues) {
+				t.Errorf("expected %v. got %v", c.queues, queues)
+			}
+		})
+	}
+}
+
+func TestChoose(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		cs   []*Candidate
+		cpus int
+		want string
+	}{
+		{name: "most free", cpus: 4, want: "b", cs: []*Candidate{{Queue: "a", Free: 8}, {Queue: "b", Free: 16}}},
+		{name: "room before local", cpus: 4, want: "b", cs: []*Candidate{{Queue: "a", Free: 2, Local: true}, {Queue: "b", Free: 8}}},
+		{name: "local with room", cpus: 4, want: "a", cs: []*Candidate{{Queue: "a", Free: 8, Local: true}, {Queue: "b", Free: 16}}},
+		{name: "fewest runnable", cpus: 4, want: "b", cs: []*Candidate{{Queue: "a", Runnable: 10}, {Queue: "b", Runnable: 3}}},
+		{name: "local without room", cpus: 4, want: "a", cs: []*Candidate{{Queue: "a", Runnable: 10, Local: true}, {Queue: "b", Runnable: 3}}},
+		{name: "tie keeps order", cpus: 4, want: "a", cs: []*Candidate{{Queue: "a", Free: 8}, {Queue: "b", Free: 8}}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if got := Choose(c.cs, c.cpus); got.Queue != c.want {
+				t.Errorf("expected %s. got %s", c.want, got.Queue)
+			}
+		})
+	}
+}
@@ -1,9 +1,15 @@
+// Package submit registers and submits AWS Batch jobs that run a local script in an image, as
+// batchit submit does. Set up Options, starting from DefaultOptions, and call Submit, or
+// Clients.Submit to use other clients such as those of the fake package.
 package submit
 
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"log"
@@ -13,64 +19,76 @@ import (
 	"time"
 
 	"github.com/base2genomics/batchit"
-
-	arg "github.com/alexflint/go-arg"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/batch"
-	"github.com/aws/aws-sdk-go/service/ec2"
-	"github.com/aws/aws-sdk-go/service/ecs"
-	"github.com/aws/aws-sdk-go/service/iam"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/base2genomics/batchit/arraymap"
+	"github.com/base2genomics/batchit/db"
+	"github.com/base2genomics/batchit/preset"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/batch"
+	batchtypes "github.com/aws/aws-sdk-go-v2/service/batch/types"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	iamtypes "github.com/aws/aws-sdk-go-v2/service/iam/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/smithy-go"
 	"github.com/brentp/xopen"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-type cliargs struct {
-	Image     string   `arg:"-i,required,help:image like $acct.dkr.ecr.$region.amazonaws.com/$image:$tag or $image:$tag"`
-	Registry  string   `arg:"env" help:"Docker image registry. [default: $acct.dkr.ecr.$region.amazonaws.com]"`
-	Role      string   `arg:"-r,required,help:existing role name"`
-	Region    string   `arg:"env:AWS_DEFAULT_REGION,help:region for batch setup"`
-	Queue     string   `arg:"-q,required,help:job queue"`
-	ArraySize int64    `arg:"-a,help:optional size of array job"`
-	DependsOn []string `arg:"-d,help:jobId(s) that this job depends on"`
-	Retries   int64    `arg:"-r,help:number of times to retry this job on failure"`
-	EnvVars   []string `arg:"-v,help:key-value environment pairs of the form NAME=value"`
-	CPUs      int      `arg:"-c,help:number of cpus reserved by the job"`
-	Volumes   []string `arg:"-o,help:HOST_PATH=CONTAINER_PATH"`
-	S3Outputs string   `arg:"help:comma-delimited list of s3 paths indicating the output of this run. If all present job will *not* be run."`
-	Mem       int      `arg:"-m,help:memory (MiB) reserved by the job"`
-	Ebs       string   `arg:"-e,help:args for ebs mount. format mount-point:size:volume-type:fstype eg /mnt/xx:500:sc1:ext4 where last 2 arguments are optional and default as shown. This assumes that batchit is installed on the host. If type==io1 the 5th argument must specify the IOPs (between 100 and 20000)"`
-	JobName   string   `arg:"-j,required,help:name of job"`
-	Path      string   `arg:"required,positional,help:path of bash script to run. With '-' it will be read from STDIN. Prefix with 'script:' to send a string."`
+// Options are the arguments to batchit submit. They can be given to Submit by other commands.
+type Options struct {
+	Image         string   `arg:"-i,required,help:image like $acct.dkr.ecr.$region.amazonaws.com/$image:$tag or $image:$tag"`
+	Registry      string   `arg:"env" help:"Docker image registry. [default: $acct.dkr.ecr.$region.amazonaws.com]"`
+	Role          string   `arg:"-r,required,env:BATCHIT_ROLE,help:existing role name"`
+	Region        string   `arg:"env:AWS_DEFAULT_REGION,help:region for batch setup. see batchit help for the default."`
+	Queue         string   `arg:"-q,required,env:BATCHIT_QUEUE" help:"job queue. with queues in several regions like us-east-1:spot-q,us-west-2:spot-q or file:queues.yaml, the one with the most room is used."`
+	ArraySize     int64    `arg:"-a,help:optional size of array job. it is the number of rows of --array-manifest if that is given."`
+	ArrayManifest string   `arg:"--array-manifest,help:S3 path or local file of a manifest for batchit array-map with a row for each child of the array job."`
+	ArrayHeader   bool     `arg:"--array-header,help:the first row of --array-manifest names the columns as with batchit array-map --header. it is not a child."`
+	DependsOn     []string `arg:"-d,help:jobId(s) that this job depends on"`
+	Retries       int64    `arg:"-r,help:number of times to retry this job on failure"`
+	EnvVars       []string `arg:"-v,help:key-value environment pairs of the form NAME=value"`
+	CPUs          int      `arg:"-c,help:number of cpus reserved by the job"`
+	Volumes       []string `arg:"-o,help:HOST_PATH=CONTAINER_PATH with :ro to mount it read-only"`
+	S3Outputs     string   `arg:"help:comma-delimited list of s3 paths indicating the output of this run. If all present job will *not* be run."`
+	Mem           int      `arg:"-m,help:memory (MiB) reserved by the job"`
+	Ebs           string   `arg:"-e,help:args for ebs mount. format mount-point:size:volume-type:fstype eg /mnt/xx:500:sc1:ext4 where last 2 arguments are optional and default as shown. This assumes that batchit is installed on the host. If type==io1 the 5th argument must specify the IOPs (between 100 and 20000)"`
+	JobName       string   `arg:"-j,required,help:name of job"`
+	Preset        string   `arg:"help:name of a preset from batchit preset save. options given here take precedence over those of the preset."`
+	Path          string   `arg:"required,positional,help:path of bash script to run. With '-' it will be read from STDIN. Prefix with 'script:' to send a string."`
 }
 
-func (c cliargs) Version() string {
+func (c Options) Version() string {
 	return batchit.Version
 }
 
-func getRole(svc *iam.IAM, role string) *iam.Role {
+func getRole(ctx context.Context, svc IAMAPI, role string) (*iamtypes.Role, error) {
 	inp := &iam.GetRoleInput{RoleName: &role}
-	op, err := svc.GetRole(inp)
+	op, err := svc.GetRole(ctx, inp)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	return op.Role
+	return op.Role, nil
 }
 
+// CreatedTag is added to job definitions with the time (RFC3339) they were registered as
+// batch does not record it. This is used by clean-defs.
+const CreatedTag = "batchit-created"
+
 const scriptPrefix = "script:"
 const interactivePrefix = "interactive:"
 
 // gzip and then base64 encode a shell script.
-func shellEncode(path string) string {
+func shellEncode(path string) (payload, hash string, err error) {
 	var b bytes.Buffer
 	enc := base64.NewEncoder(base64.StdEncoding, &b)
-	z := gzip.NewWriter(enc)
+	gz := gzip.NewWriter(enc)
+	h := sha256.New()
+	z := io.MultiWriter(gz, h)
 	if strings.HasPrefix(path, scriptPrefix) {
 		if _, err := z.Write([]byte(path[len(scriptPrefix):])); err != nil {
-			panic(err)
+			return "", "", err
 		}
 	} else if strings.HasPrefix(path, interactivePrefix) {
 		tmp := strings.Split(path, ":")
@@ -80,36 +98,77 @@ func shellEncode(path string) string {
 			if err == nil {
 				minutes = m
 			} else {
-				log.Println("couldn't parse minutes from %s", tmp[1])
+				log.Printf("couldn't parse minutes from %s", tmp[1])
 			}
 		}
 		if _, err := z.Write([]byte(fmt.Sprintf("sleep %d", minutes*60))); err != nil {
-			panic(err)
+			return "", "", err
 		}
 	} else {
 		rdr, err := xopen.Ropen(path)
 		if err != nil {
-			panic(err)
+			return "", "", batchit.Exit(batchit.ExitNotFound, fmt.Errorf("submit: reading script: %w", err))
 		}
-		_, err = io.Copy(z, rdr)
-		if err != nil {
-			panic(err)
+		defer rdr.Close()
+		if _, err = io.Copy(z, rdr); err != nil {
+			return "", "", err
 		}
 	}
-	if err := z.Close(); err != nil {
-		panic(err)
+	if err := gz.Close(); err != nil {
+		return "", "", err
 	}
 	if err := enc.Close(); err != nil {
-		panic(err)
+		return "", "", err
+	}
+	return b.String(), hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Volume is a directory of the host that is mounted in the container, from --volumes.
+type Volume struct {
+	Host      string
+	Container string
+	ReadOnly  bool
+}
+
+// ParseVolume parses HOST_PATH=CONTAINER_PATH followed by options after a colon, e.g.
+// /ref=/ref:ro. The only options are ro and rw.
+func ParseVolume(v string) (Volume, error) {
+	host, rest, _ := strings.Cut(v, "=")
+	container, opts, _ := strings.Cut(rest, ":")
+	if host == "" || container == "" || strings.Contains(rest, "=") {
+		return Volume{}, fmt.Errorf("expected volume in the form HOST_PATH=CONTAINER_PATH[:ro]. got %s", v)
+	}
+	vol := Volume{Host: host, Container: container}
+	if opts == "" {
+		return vol, nil
+	}
+	for _, o := range strings.Split(opts, ",") {
+		switch o {
+		case "ro":
+			vol.ReadOnly = true
+		case "rw":
+			vol.ReadOnly = false
+		default:
+			return Volume{}, fmt.Errorf("unknown option %s for volume %s. use ro or rw", o, v)
+		}
 	}
-	return b.String()
+	return vol, nil
 }
 
-func getTmp(cli *cliargs) string {
-	if len(cli.Volumes) == 0 {
+// getTmp returns the script that makes $TMPDIR and /tmp a directory in the first volume that
+// can be written.
+func getTmp(cli *Options) string {
+	var mnt string
+	for _, v := range cli.Volumes {
+		// errors are reported when the mount points are made.
+		if vol, err := ParseVolume(v); err == nil && !vol.ReadOnly {
+			mnt = vol.Container
+			break
+		}
+	}
+	if mnt == "" {
 		return ""
 	}
-	mnt := strings.Split(cli.Volumes[0], "=")[1]
 	tmp := fmt.Sprintf(`# thanks Hao
 export TMPDIR="$(mktemp -d -p %s)"
 cleanup() { echo "batchit: deleting temp dir ${TMPDIR}"; umount -l /tmp/; rm -rf ${TMPDIR}; }
@@ -120,64 +179,133 @@ cd $TMPDIR`, mnt)
 	return tmp
 }
 
-var NotFound = errors.New("not found")
+var NotFound = batchit.Exit(batchit.ExitNotFound, errors.New("not found"))
 
-// return that the file exists, its size, and any error
-func OutputExists(s3o *s3.S3, path string) (bool, int64, error) {
+// HeadOutput returns the HeadObject response for an s3 path. It returns NotFound
+// if the object does not exist.
+func HeadOutput(ctx context.Context, s3o S3API, path string) (*s3.HeadObjectOutput, error) {
 	if strings.HasPrefix(path, "s3://") {
 		path = path[5:]
 	}
 	bk := strings.SplitN(path, "/", 2)
-	ho, err := s3o.HeadObject(&s3.HeadObjectInput{Bucket: aws.String(bk[0]), Key: aws.String(bk[1])})
+	if len(bk) != 2 {
+		return nil, fmt.Errorf("expected s3 path of the form s3://bucket/key, got %s", path)
+	}
+	ho, err := s3o.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String(bk[0]), Key: aws.String(bk[1])})
 	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
+		var aerr smithy.APIError
+		if errors.As(err, &aerr) {
+			switch aerr.ErrorCode() {
 			case "Forbidden":
-				return false, 0, fmt.Errorf("you do not have permissions to access %s", path)
+				return nil, fmt.Errorf("you do not have permissions to access %s", path)
 			case "NotFound":
-				return false, 0, NotFound
+				return nil, NotFound
 			default:
-				return false, 0, aerr
+				return nil, aerr
 			}
 
 		}
+		return nil, err
+	}
+	return ho, nil
+}
+
+// return that the file exists, its size, and any error
+func OutputExists(ctx context.Context, s3o S3API, path string) (bool, int64, error) {
+	ho, err := HeadOutput(ctx, s3o, path)
+	if err != nil {
 		return false, 0, err
 	}
 
-	return ho.ContentLength != nil && *ho.ContentLength > 0, *ho.ContentLength, nil
+	return aws.ToInt64(ho.ContentLength) > 0, aws.ToInt64(ho.ContentLength), nil
 }
 
-func outputsExist(sess *session.Session, paths []string) bool {
-	svc := s3.New(sess)
+func outputsExist(ctx context.Context, svc S3API, paths []string) (bool, error) {
 	for _, p := range paths {
-		found, _, err := OutputExists(svc, p)
+		found, _, err := OutputExists(ctx, svc, p)
 		if err != nil && err != NotFound {
-			log.Fatal(err)
+			return false, err
 		}
 		if !found {
-			return false
+			return false, nil
 		}
 	}
-	return true
+	return true, nil
 }
 
-func Main() {
-	cli := &cliargs{CPUs: 1, Mem: 1048, Retries: 1, Region: "us-east-1"}
-	p := arg.MustParse(cli)
+// DefaultOptions are used by the submit command unless overridden.
+var DefaultOptions = Options{CPUs: 1, Mem: 1048, Retries: 1}
 
-	cfg := aws.NewConfig().WithRegion(cli.Region)
-	sess := session.Must(session.NewSession(cfg))
+func Main() error {
+	opts := DefaultOptions
+	cli := &opts
+	expanded, err := preset.Expand(os.Args[1:])
+	if err != nil {
+		return batchit.Exit(batchit.ExitUsage, err)
+	}
+	os.Args = append(os.Args[:1], expanded...)
+	p := batchit.MustParse(cli)
+	ctx := batchit.Context()
+	if err := SelectQueue(ctx, cli); err != nil {
+		if batchit.ExitCode(err) == batchit.ExitUsage {
+			p.Fail(err.Error())
+		}
+		return err
+	}
 
-	if cli.S3Outputs != "" {
-		if outputsExist(sess, strings.Split(cli.S3Outputs, ",")) {
-			max := 100
-			if max > len(cli.S3Outputs) {
-				max = len(cli.S3Outputs)
-			}
-			fmt.Fprintln(os.Stderr, "[batchit submit] all output found for "+cli.S3Outputs[0:max]+"... not re-running\n")
-			return
+	cfg, err := batchit.LoadConfig(ctx, cli.Region)
+	if err != nil {
+		return err
+	}
+
+	jobId, err := Submit(ctx, cfg, cli)
+	if err == ErrOutputsExist {
+		max := 100
+		if max > len(cli.S3Outputs) {
+			max = len(cli.S3Outputs)
 		}
+		fmt.Fprintln(os.Stderr, "[batchit submit] all output found for "+cli.S3Outputs[0:max]+"... not re-running\n")
+		return nil
 	}
+	if err != nil {
+		if batchit.ExitCode(err) == batchit.ExitUsage {
+			p.Fail(err.Error())
+		}
+		return err
+	}
+	if strings.HasPrefix(cli.Path, interactivePrefix) {
+		showConnectionInfo(ctx, batch.NewFromConfig(cfg), jobId, cli.Region)
+	}
+	if batchit.JSONL() {
+		batchit.Emit(batchit.Event{Type: batchit.EventJobSubmitted, JobId: jobId, JobName: cli.JobName, Queue: cli.Queue, Region: cli.Region})
+		return nil
+	}
+	fmt.Println(jobId)
+	return nil
+}
+
+// ErrOutputsExist is returned by Submit when every path in S3Outputs exists so the job was not submitted.
+var ErrOutputsExist = errors.New("all outputs exist")
+
+// usageError is a problem with the options rather than with submitting.
+func usageError(msg string) error { return batchit.Exit(batchit.ExitUsage, errors.New(msg)) }
+
+// Container is what runs for a submission. It is used by Submit and by batchit run-local.
+type Container struct {
+	// Command runs the prelude and then the script.
+	Command []string
+	// Payload is the gzipped and base64 encoded script which is sent as $B64GZ.
+	Payload string
+	// ScriptHash is the hex SHA-256 of the script.
+	ScriptHash string
+	// Environment has $cpus, $TMPDIR for EBS and the EnvVars.
+	Environment []batchtypes.KeyValuePair
+	Volumes     []batchtypes.Volume
+	MountPoints []batchtypes.MountPoint
+}
+
+// NewContainer returns the container for cli. The image is not resolved.
+func NewContainer(cli *Options) (*Container, error) {
 	cleanupDefault := `cleanup_volume() { true; }`
 	var ebsCmd [3]string
 	if len(cli.Ebs) > 0 {
@@ -188,16 +316,16 @@ func Main() {
 		if len(ebs) == 2 {
 			_, err := strconv.Atoi(ebs[1])
 			if err != nil {
-				panic(fmt.Sprintf("error with specified ebs drive size: %s, %s", ebs[1], err))
+				return nil, usageError(fmt.Sprintf("error with specified ebs drive size: %s, %s", ebs[1], err))
 			}
 			ebs = append(ebs, []string{"gp2", "ext4"}...)
 		}
 		if len(ebs) != 4 && len(ebs) != 5 {
-			p.Fail(fmt.Sprintf("expected Ebs argument to have 2 or 4 arguments"))
+			return nil, usageError("expected Ebs argument to have 2 or 4 arguments")
 		}
 		sz, err := strconv.Atoi(ebs[1])
 		if err != nil {
-			panic(fmt.Sprintf("error with specified ebs drive size: %s, %s", ebs[1], err))
+			return nil, usageError(fmt.Sprintf("error with specified ebs drive size: %s, %s", ebs[1], err))
 		}
 		//Ebs   /mnt/local:500:gp2:ext4
 		// if possible, we raid-0 2 or 3 drives for better performance.
@@ -215,19 +343,18 @@ func Main() {
 		// mount the ebs volume and set trap to delete and detach the volume upon exit.
 		ebsCmd[1] = `echo "vid: $vid"`
 		// volumes get deleted at instance termination, but this will delete when the container exits.
-		// unsets the trap for exit if it was already set to avoid loop.
-		ebsCmd[2] = fmt.Sprintf(`cleanup_volume() { set +e; sig="$1"; echo "batchit: cleaning up volume $vid on signal $sig"; cd /; umount %s || umount -l %s; batchit ddv $vid; if [[ $sig != EXIT ]]; then trap - $sig EXIT; kill -s $sig $$; fi }; for sig in INT TERM EXIT; do trap "cleanup_volume $sig" $sig; done; cd %s;`, ebs[0], ebs[0], ebs[0])
+		// unsets the trap for exit if it was already set to avoid loop. if nothing is mounted, e.g.
+		// when the filesystem could not be made, the volume ids printed by ebsmount are deleted.
+		ebsCmd[2] = fmt.Sprintf(`cleanup_volume() { set +e; sig="$1"; echo "batchit: cleaning up volume at %s on signal $sig"; cd /; batchit ddv --mount %s || { [[ -z "${vid:-}" ]] || batchit ddv $vid; }; if [[ $sig != EXIT ]]; then trap - $sig EXIT; kill -s $sig $$; fi }; for sig in INT TERM EXIT; do trap "cleanup_volume $sig" $sig; done; cd %s;`, ebs[0], ebs[0], ebs[0])
 	}
 
-	role := getRole(iam.New(sess, cfg), cli.Role)
-	if role == nil {
-		panic(fmt.Sprintf("role: %s not found for your account in region: %s", cli.Role, cli.Region))
-	}
-	b := batch.New(sess, cfg)
 	tmpMnt := getTmp(cli)
 
-	payload := shellEncode(cli.Path)
-	var commands []*string
+	c := &Container{}
+	var err error
+	if c.Payload, c.ScriptHash, err = shellEncode(cli.Path); err != nil {
+		return nil, err
+	}
 	// prelude copied from aegea.
 	for _, line := range strings.Split(strings.TrimSpace(fmt.Sprintf(`
 /bin/bash
@@ -251,260 +378,272 @@ $BATCH_SCRIPT
 			`, cleanupDefault, ebsCmd[0], ebsCmd[1], ebsCmd[2], tmpMnt)), "\n") {
 		tmp := strings.TrimSpace(line[:])
 		if len(tmp) != 0 {
-			commands = append(commands, &tmp)
+			c.Command = append(c.Command, tmp)
 		}
 	}
 
 	if cli.S3Outputs != "" {
 		cmd := fmt.Sprintf("batchit s3upload -c --region %s --nofail %s", cli.Region, strings.Join(strings.Split(cli.S3Outputs, ","), " "))
-		commands = append(commands, &cmd)
-	}
-
-	if cli.Registry == "" {
-		if !strings.Contains(cli.Image, "/") {
-			stsvc := sts.New(sess)
-			user, err := stsvc.GetCallerIdentity(&sts.GetCallerIdentityInput{})
-			if err != nil {
-				panic(err)
-			}
-			cli.Image = fmt.Sprintf("%s.dkr.ecr.%s.amazonaws.com/%s", *user.Account, *sess.Config.Region, cli.Image)
-		}
-	} else {
-		if cli.Registry == "hub.docker.com" || cli.Registry == "docker.com" {
-			cli.Registry = "registry.hub.docker.com"
-		}
-		if cli.Registry == "registry.hub.docker.com" {
-			if !strings.Contains(cli.Image, "/") {
-				cli.Image = fmt.Sprintf("library/%s", cli.Image)
-			}
-		}
-		cli.Image = fmt.Sprintf("%s/%s", cli.Registry, cli.Image)
-	}
-	var arrayProp *batch.ArrayProperties
-	if cli.ArraySize != 0 {
-		arrayProp = &batch.ArrayProperties{Size: aws.Int64(cli.ArraySize)}
+		c.Command = append(c.Command, cmd)
 	}
 
-	jdef := &batch.RegisterJobDefinitionInput{
-		JobDefinitionName: &cli.JobName,
-		RetryStrategy:     &batch.RetryStrategy{Attempts: aws.Int64(cli.Retries)},
-		ContainerProperties: &batch.ContainerProperties{Image: &cli.Image, JobRoleArn: role.Arn,
-			Memory:  aws.Int64(int64(cli.Mem)),
-			Command: commands,
-			Ulimits: []*batch.Ulimit{&batch.Ulimit{HardLimit: aws.Int64(40000), SoftLimit: aws.Int64(40000), Name: aws.String("nofile")}},
-			Environment: []*batch.KeyValuePair{&batch.KeyValuePair{Name: aws.String("B64GZ"),
-				Value: aws.String(payload)}},
-			Privileged: aws.Bool(true),
-			Vcpus:      aws.Int64(int64(cli.CPUs))},
-		Type: aws.String("container"),
-	}
 	if cli.Ebs != "" {
 		// see: http://docs.aws.amazon.com/AmazonECS/latest/developerguide/using_data_volumes.html
 		// without cloud-init, we must mount /dev by name.This means that the the EBS vol won't get
 		// cleaned up by default.
-		jdef.ContainerProperties.Volumes = []*batch.Volume{
-			&batch.Volume{Name: aws.String("vol00"), Host: &batch.Host{SourcePath: aws.String("/dev")}},
+		c.Volumes = []batchtypes.Volume{
+			{Name: aws.String("vol00"), Host: &batchtypes.Host{SourcePath: aws.String("/dev")}},
 		}
-		jdef.ContainerProperties.MountPoints = []*batch.MountPoint{&batch.MountPoint{
+		c.MountPoints = []batchtypes.MountPoint{{
 			SourceVolume:  aws.String("vol00"),
 			ContainerPath: aws.String("/dev"),
 		}}
 	}
 	if len(cli.Volumes) > 0 {
 		for k, v := range cli.Volumes {
-			split := strings.Split(v, "=")
-			if len(split) != 2 {
-				panic("expected Volumes in the form: HOST_PATH=CONTAINER_PATH")
+			vol, err := ParseVolume(v)
+			if err != nil {
+				return nil, usageError(err.Error())
 			}
 			name := fmt.Sprintf("volxx%d", k)
-			jdef.ContainerProperties.Volumes = append(jdef.ContainerProperties.Volumes,
-				&batch.Volume{Host: &batch.Host{SourcePath: aws.String(split[0])}, Name: aws.String(name)})
-			jdef.ContainerProperties.MountPoints = append(jdef.ContainerProperties.MountPoints,
-				&batch.MountPoint{SourceVolume: aws.String(name), ContainerPath: aws.String(split[1])})
+			c.Volumes = append(c.Volumes,
+				batchtypes.Volume{Host: &batchtypes.Host{SourcePath: aws.String(vol.Host)}, Name: aws.String(name)})
+			mp := batchtypes.MountPoint{SourceVolume: aws.String(name), ContainerPath: aws.String(vol.Container)}
+			if vol.ReadOnly {
+				mp.ReadOnly = aws.Bool(true)
+			}
+			c.MountPoints = append(c.MountPoints, mp)
 		}
 	}
 
-	ro, err := b.RegisterJobDefinition(jdef)
-	if err != nil {
-		panic(errors.Wrap(err, "error registering job definition"))
-	}
-	// Ignore return value; there's not much we can do if it fails
-	// (and we're no worse off than before.)
-	defer deleteJobDefinition(b, ro)
-	var deps []*batch.JobDependency
-	for _, dep := range cli.DependsOn {
-		deps = append(deps, &batch.JobDependency{JobId: aws.String(dep)})
-	}
-
-	submit := &batch.SubmitJobInput{
-		DependsOn:       deps,
-		JobDefinition:   ro.JobDefinitionName,
-		JobName:         aws.String(cli.JobName),
-		ArrayProperties: arrayProp,
-		JobQueue:        aws.String(cli.Queue),
-		ContainerOverrides: &batch.ContainerOverrides{
-			Command: commands,
-			Environment: []*batch.KeyValuePair{
-				&batch.KeyValuePair{Name: aws.String("B64GZ"),
-					Value: aws.String(payload)},
-				&batch.KeyValuePair{Name: aws.String("cpus"),
-					Value: aws.String(strconv.Itoa(cli.CPUs))},
-			},
-		},
+	c.Environment = []batchtypes.KeyValuePair{
+		{Name: aws.String("cpus"),
+			Value: aws.String(strconv.Itoa(cli.CPUs))},
 	}
 	if cli.Ebs != "" {
 		// set TMPDIR to the EBS mount.
 		ebs := strings.Split(cli.Ebs, ":")
-		submit.ContainerOverrides.Environment = append(submit.ContainerOverrides.Environment,
-			&batch.KeyValuePair{Name: aws.String("TMPDIR"), Value: aws.String(ebs[0])})
+		c.Environment = append(c.Environment,
+			batchtypes.KeyValuePair{Name: aws.String("TMPDIR"), Value: aws.String(ebs[0])})
 	}
 
 	for _, e := range cli.EnvVars {
 		pair := strings.SplitN(e, "=", 2)
 		if len(pair) != 2 {
-			panic(fmt.Sprintf("expecting EnvVars of format key=value. got %s", e))
+			return nil, usageError(fmt.Sprintf("expecting EnvVars of format key=value. got %s", e))
 		}
-		submit.ContainerOverrides.Environment = append(submit.ContainerOverrides.Environment,
-			&batch.KeyValuePair{Name: aws.String(pair[0]), Value: aws.String(pair[1])})
+		c.Environment = append(c.Environment,
+			batchtypes.KeyValuePair{Name: aws.String(pair[0]), Value: aws.String(pair[1])})
 	}
+	return c, nil
+}
 
-	resp, err := b.SubmitJob(submit)
-	if err != nil {
-		if resp != nil {
-			fmt.Fprintln(os.Stderr, resp)
+// ResolveImage returns the full name of the image of cli. An image without a registry is
+// assumed to be in ECR in the account and region of cfg unless --registry is given.
+func ResolveImage(ctx context.Context, cfg aws.Config, cli *Options) (string, error) {
+	return resolveImage(ctx, sts.NewFromConfig(cfg), cfg.Region, cli)
+}
+
+func resolveImage(ctx context.Context, stsvc STSAPI, region string, cli *Options) (string, error) {
+	if cli.Registry == "" {
+		if strings.Contains(cli.Image, "/") {
+			return cli.Image, nil
 		}
-		panic(errors.Wrap(err, "error submitting job"))
+		user, err := stsvc.GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+		if err != nil {
+			return "", err
+		}
+		return batchit.ECRRegistry(*user.Account, region) + "/" + cli.Image, nil
 	}
-
-	if strings.HasPrefix(cli.Path, interactivePrefix) {
-		showConnectionInfo(b, *resp.JobId, sess, cli.Queue)
+	registry, image := cli.Registry, cli.Image
+	if registry == "hub.docker.com" || registry == "docker.com" {
+		registry = "registry.hub.docker.com"
+	}
+	if registry == "registry.hub.docker.com" {
+		if !strings.Contains(image, "/") {
+			image = fmt.Sprintf("library/%s", image)
+		}
 	}
-	fmt.Println(*resp.JobId)
+	return fmt.Sprintf("%s/%s", registry, image), nil
 }
 
-func getCluster(b *batch.Batch, q string, keyPair *string) string {
+// Submit registers a job definition for the script in cli.Path, submits it and returns the job id.
+// The definition is deregistered once the job has been submitted.
+func Submit(ctx context.Context, cfg aws.Config, cli *Options) (string, error) {
+	return NewClients(cfg).Submit(ctx, cli)
+}
 
-	qi := &batch.DescribeJobQueuesInput{JobQueues: []*string{&q}}
-	qr, err := b.DescribeJobQueues(qi)
+// setArraySize sets the ArraySize of cli to the number of rows of its ArrayManifest, after the
+// header with ArrayHeader, as counted by arraymap.Count. A size that was given must match it.
+func (cs *Clients) setArraySize(ctx context.Context, cli *Options) error {
+	if cli.ArrayManifest == "" {
+		return nil
+	}
+	// S3API only needs HeadObject so other clients may not be able to get the manifest.
+	svc, _ := cs.S3.(arraymap.GetObjectAPI)
+	if svc == nil && strings.HasPrefix(cli.ArrayManifest, "s3://") {
+		return fmt.Errorf("submit: the S3 client can not get %s", cli.ArrayManifest)
+	}
+	rc, err := arraymap.Open(ctx, svc, cli.ArrayManifest)
+	if err != nil {
+		return batchit.Exit(batchit.ExitNotFound, fmt.Errorf("submit: reading array manifest: %w", err))
+	}
+	defer rc.Close()
+	n, err := arraymap.Count(rc, []rune(arraymap.DefaultSep(cli.ArrayManifest))[0], cli.ArrayHeader)
 	if err != nil {
-		log.Println(err)
-		os.Exit(0)
+		return fmt.Errorf("submit: reading array manifest %s: %w", cli.ArrayManifest, err)
+	}
+	if cli.ArraySize != 0 && cli.ArraySize != int64(n) {
+		return usageError(fmt.Sprintf("array size %d does not match the %d rows of %s", cli.ArraySize, n, cli.ArrayManifest))
 	}
-	if len(qr.JobQueues) > 1 {
-		log.Println("instance info only supported for queues with a single compute env")
+	if n < 2 || n > 10000 {
+		return usageError(fmt.Sprintf("%s has %d rows. an array job has from 2 to 10000 children", cli.ArrayManifest, n))
 	}
-	ce := qr.JobQueues[0].ComputeEnvironmentOrder[0].ComputeEnvironment
+	cli.ArraySize = int64(n)
+	return nil
+}
 
-	ci := &batch.DescribeComputeEnvironmentsInput{
-		ComputeEnvironments: []*string{ce},
+// Submit is Submit with the clients of cs.
+func (cs *Clients) Submit(ctx context.Context, cli *Options) (string, error) {
+	if err := cs.setArraySize(ctx, cli); err != nil {
+		return "", err
+	}
+	if cli.S3Outputs != "" {
+		exist, err := outputsExist(ctx, cs.S3, strings.Split(cli.S3Outputs, ","))
+		if err != nil {
+			return "", err
+		}
+		if exist {
+			return "", ErrOutputsExist
+		}
 	}
-	cr, err := b.DescribeComputeEnvironments(ci)
+	_, span := batchit.StartSpan(ctx, "submit.encode-script", attribute.String("batchit.path", cli.Path))
+	c, err := NewContainer(cli)
+	if err := batchit.EndSpan(span, err); err != nil {
+		return "", err
+	}
+
+	role, err := getRole(ctx, cs.IAM, cli.Role)
 	if err != nil {
-		log.Println(err)
-		os.Exit(0)
+		return "", err
 	}
-	*keyPair = *cr.ComputeEnvironments[0].ComputeResources.Ec2KeyPair
-	return *cr.ComputeEnvironments[0].EcsClusterArn
+	if role == nil {
+		return "", fmt.Errorf("role: %s not found for your account in region: %s", cli.Role, cli.Region)
+	}
+	b := cs.Batch
+
+	if cli.Image, err = resolveImage(ctx, cs.STS, cs.Region, cli); err != nil {
+		return "", err
+	}
+	var arrayProp *batchtypes.ArrayProperties
+	if cli.ArraySize != 0 {
+		arrayProp = &batchtypes.ArrayProperties{Size: aws.Int32(int32(cli.ArraySize))}
+	}
+
+	payload := batchtypes.KeyValuePair{Name: aws.String("B64GZ"), Value: aws.String(c.Payload)}
+	jdef := &batch.RegisterJobDefinitionInput{
+		JobDefinitionName: &cli.JobName,
+		RetryStrategy:     &batchtypes.RetryStrategy{Attempts: aws.Int32(int32(cli.Retries))},
+		ContainerProperties: &batchtypes.ContainerProperties{Image: &cli.Image, JobRoleArn: role.Arn,
+			Memory:      aws.Int32(int32(cli.Mem)),
+			Command:     c.Command,
+			Ulimits:     []batchtypes.Ulimit{{HardLimit: aws.Int32(40000), SoftLimit: aws.Int32(40000), Name: aws.String("nofile")}},
+			Environment: []batchtypes.KeyValuePair{payload},
+			Privileged:  aws.Bool(true),
+			Vcpus:       aws.Int32(int32(cli.CPUs)),
+			Volumes:     c.Volumes,
+			MountPoints: c.MountPoints},
+		Type: batchtypes.JobDefinitionTypeContainer,
+		Tags: map[string]string{CreatedTag: time.Now().UTC().Format(time.RFC3339)},
+	}
+
+	rctx, span := batchit.StartSpan(ctx, "submit.register-definition", attribute.String("batchit.job_name", cli.JobName))
+	ro, err := b.RegisterJobDefinition(rctx, jdef)
+	if err := batchit.EndSpan(span, err); err != nil {
+		return "", errors.Wrap(err, "error registering job definition")
+	}
+	// Ignore return value; there's not much we can do if it fails
+	// (and we're no worse off than before.) It is also deregistered if batchit is interrupted.
+	defer func() {
+		cctx, cancel := batchit.CleanupContext(ctx)
+		defer cancel()
+		deleteJobDefinition(cctx, b, ro)
+	}()
+	var deps []batchtypes.JobDependency
+	for _, dep := range cli.DependsOn {
+		deps = append(deps, batchtypes.JobDependency{JobId: aws.String(dep)})
+	}
+
+	submit := &batch.SubmitJobInput{
+		DependsOn:       deps,
+		JobDefinition:   ro.JobDefinitionName,
+		JobName:         aws.String(cli.JobName),
+		ArrayProperties: arrayProp,
+		JobQueue:        aws.String(cli.Queue),
+		ContainerOverrides: &batchtypes.ContainerOverrides{
+			Command:     c.Command,
+			Environment: append([]batchtypes.KeyValuePair{payload}, c.Environment...),
+		},
+	}
+
+	sctx, span := batchit.StartSpan(ctx, "submit.submit-job", attribute.String("batchit.job_name", cli.JobName),
+		attribute.String("batchit.queue", cli.Queue))
+	resp, err := b.SubmitJob(sctx, submit)
+	if resp != nil && resp.JobId != nil {
+		span.SetAttributes(attribute.String("batchit.job_id", *resp.JobId))
+	}
+	if err := batchit.EndSpan(span, err); err != nil {
+		if resp != nil {
+			fmt.Fprintln(os.Stderr, resp)
+		}
+		return "", errors.Wrap(err, "error submitting job")
+	}
+	// EnvVars were checked by NewContainer.
+	env := make(map[string]string, len(cli.EnvVars))
+	for _, e := range cli.EnvVars {
+		pair := strings.SplitN(e, "=", 2)
+		env[pair[0]] = pair[1]
+	}
+	now := time.Now().UTC()
+	if cs.Track != nil {
+		cs.Track(ctx, &db.Record{JobId: *resp.JobId, Name: cli.JobName, Queue: cli.Queue, Region: cli.Region, Image: cli.Image,
+			ScriptHash: c.ScriptHash, Env: env, CPUs: cli.CPUs, Mem: cli.Mem, ArraySize: cli.ArraySize,
+			Status: string(batchtypes.JobStatusSubmitted), Submitted: now, Updated: now})
+	}
+	return *resp.JobId, nil
 }
 
-func showConnectionInfo(b *batch.Batch, jobid string, sess *session.Session, queue string) {
+func showConnectionInfo(ctx context.Context, b BatchAPI, jobid string, region string) {
 	log.Println("waiting for job to start to get connection info")
 
 	dji := &batch.DescribeJobsInput{
-		Jobs: []*string{&jobid},
+		Jobs: []string{jobid},
 	}
 	for i := 0; i < 100; i++ {
 		time.Sleep(20 * time.Second)
-		djo, err := b.DescribeJobs(dji)
+		djo, err := b.DescribeJobs(ctx, dji)
 		if err != nil {
 			log.Println(err)
-			os.Exit(0)
+			return
 		}
-		if djo == nil {
+		if djo == nil || len(djo.Jobs) == 0 {
 			break
 		}
 		var j = djo.Jobs[0]
-		if *j.Status != "RUNNING" {
-			log.Println("job status is ", *j.Status, " waiting")
+		if j.Status != batchtypes.JobStatusRunning {
+			log.Println("job status is ", j.Status, " waiting")
 			continue
 		}
-
-		var ec = ecs.New(sess)
-		var keyPair = ""
-		var cluster = getCluster(b, queue, &keyPair)
-
-		tmp := strings.Split(*j.Container.ContainerInstanceArn, "/")
-		ei := &ecs.DescribeContainerInstancesInput{
-			Cluster:            aws.String(cluster),
-			ContainerInstances: []*string{&tmp[1]},
-		}
-
-		eo, err := ec.DescribeContainerInstances(ei)
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		instanceId := *eo.ContainerInstances[0].Ec2InstanceId
-		ec2s := ec2.New(sess)
-		log.Println("instance-id:", instanceId)
-
-		di := &ec2.DescribeInstancesInput{InstanceIds: []*string{&instanceId}}
-
-		do, err := ec2s.DescribeInstances(di)
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		ti := &ecs.DescribeTasksInput{Cluster: aws.String(cluster), Tasks: []*string{j.Container.TaskArn}}
-		to, err := ec.DescribeTasks(ti)
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		if len(to.Tasks) != 1 {
-			log.Println("couldn't find container id")
-		}
-
-		c := to.Tasks[0].Containers[0]
-		_ = c
-		//log.Println(to)
-		//log.Println(j.Container)
-
-		dockerCmd := fmt.Sprintf(`docker exec -it $(curl -s "http://127.0.0.1:51678/v1/tasks?taskarn=%s" | grep -oP "DockerId..\"[^\"]+" | cut -d\" -f 3) bash`, *j.Container.TaskArn)
-
-		log.Printf("ssh -ti ~/.ssh/%s.pem ec2-user@%s '%s'", keyPair, *do.Reservations[0].Instances[0].PublicIpAddress, dockerCmd)
-		//log.Println("TODO: get container from Task:", *j.Container.TaskArn, " https://docs.aws.amazon.com/sdk-for-go/api/service/ecs/#Task")
-		// ssh -ti ~/.ssh/istore.pem ec2-user@34.203.245.158 'docker exec -it $(curl -s "http://127.0.0.1:51678/v1/tasks?taskarn=arn:aws:ecs:us-east-1:321620740768:task/c8fcafec-2f0b-4129-8b21-7fae81ae8be9" | grep -oP "DockerId..\"[^\"]+" | cut -d\" -f 3) bash'
+		log.Printf("connect with: batchit exec --region %s %s", region, jobid)
 		break
-		/*
-
-			di := &ec2.DescribeAddressesInput{
-				//Filters: []*ec2.Filter{
-				//	&ec2.Filter{Name: aws.String("instance-id"), Values: []*string{&instanceId}}},
-				Filters: []*ec2.Filter{
-					{
-						Name:   aws.String("domain"),
-						Values: aws.StringSlice([]string{"vpc"}),
-					},
-				},
-			}
-			do, err := ec2s.DescribeAddresses(di)
-			if err != nil {
-				log.Fatal(err)
-			}
-			log.Println(do)
-			log.Println(*do.Addresses[0].PublicIp)
-		*/
-
 	}
-
 }
 
-func deleteJobDefinition(b *batch.Batch, jdef *batch.RegisterJobDefinitionOutput) error {
-	jobDefToDelete := fmt.Sprintf("%s:%d", *jdef.JobDefinitionName, *jdef.Revision)
+func deleteJobDefinition(ctx context.Context, b BatchAPI, jdef *batch.RegisterJobDefinitionOutput) error {
+	jobDefToDelete := fmt.Sprintf("%s:%d", aws.ToString(jdef.JobDefinitionName), aws.ToInt32(jdef.Revision))
 	input := &batch.DeregisterJobDefinitionInput{
 		JobDefinition: aws.String(jobDefToDelete),
 	}
-	_, err := b.DeregisterJobDefinition(input)
+	_, err := b.DeregisterJobDefinition(ctx, input)
 	return err
 }
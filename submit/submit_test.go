@@ -0,0 +1,200 @@
+package submit
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/base2genomics/batchit"
+	"github.com/base2genomics/batchit/fake"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/batch"
+	batchtypes "github.com/aws/aws-sdk-go-v2/service/batch/types"
+)
+
+// env returns the environment as a map.
+func env(kvs []batchtypes.KeyValuePair) map[string]string {
+	m := make(map[string]string, len(kvs))
+	for _, kv := range kvs {
+		m[aws.ToString(kv.Name)] = aws.ToString(kv.Value)
+	}
+	return m
+}
+
+func decode(t *testing.T, payload string) string {
+	t.Helper()
+	gz, err := gzip.NewReader(base64.NewDecoder(base64.StdEncoding, strings.NewReader(payload)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestNewContainer(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		cli  Options
+		// command is a part of the last line of the command.
+		command string
+		env     map[string]string
+		volumes int
+		// readOnly is whether the last mount point is read only.
+		readOnly bool
+		// code is the exit code of the error or 0 for none.
+		code int
+	}{
+		{name: "script", cli: Options{Path: "script:echo hi", CPUs: 2},
+			command: "$BATCH_SCRIPT", env: map[string]string{"cpus": "2"}},
+		{name: "ebs", cli: Options{Path: "script:echo hi", CPUs: 1, Ebs: "/mnt/local:500:gp2:ext4"},
+			command: "$BATCH_SCRIPT", env: map[string]string{"cpus": "1", "TMPDIR": "/mnt/local"}, volumes: 1},
+		{name: "ebs defaults", cli: Options{Path: "script:echo hi", CPUs: 1, Ebs: "/mnt/local:500"},
+			command: "$BATCH_SCRIPT", env: map[string]string{"cpus": "1", "TMPDIR": "/mnt/local"}, volumes: 1},
+		{name: "ebs size", cli: Options{Path: "script:echo hi", Ebs: "/mnt/local:big"}, code: batchit.ExitUsage},
+		{name: "ebs fields", cli: Options{Path: "script:echo hi", Ebs: "/mnt/local"}, code: batchit.ExitUsage},
+		{name: "volumes", cli: Options{Path: "script:echo hi", CPUs: 1, Volumes: []string{"/scratch=/tmp", "/ref=/ref:ro"}},
+			command: "$BATCH_SCRIPT", env: map[string]string{"cpus": "1"}, volumes: 2, readOnly: true},
+		{name: "volume", cli: Options{Path: "script:echo hi", Volumes: []string{"/ref"}}, code: batchit.ExitUsage},
+		{name: "env", cli: Options{Path: "script:echo hi", CPUs: 1, EnvVars: []string{"A=1", "B=x=y"}},
+			command: "$BATCH_SCRIPT", env: map[string]string{"cpus": "1", "A": "1", "B": "x=y"}},
+		{name: "env format", cli: Options{Path: "script:echo hi", EnvVars: []string{"A"}}, code: batchit.ExitUsage},
+		{name: "outputs", cli: Options{Path: "script:echo hi", CPUs: 1, Region: "us-east-1", S3Outputs: "s3://b/x.bam,s3://b/x.bai"},
+			command: "batchit s3upload -c --region us-east-1 --nofail s3://b/x.bam s3://b/x.bai", env: map[string]string{"cpus": "1"}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			cn, err := NewContainer(&c.cli)
+			if c.code != 0 {
+				if code := batchit.ExitCode(err); code != c.code {
+					t.Fatalf("expected exit code %d. got %d for %v", c.code, code, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if last := cn.Command[len(cn.Command)-1]; !strings.Contains(last, c.command) {
+				t.Errorf("expected the command to end with %q. got %q", c.command, last)
+			}
+			if script := decode(t, cn.Payload); script != "echo hi" {
+				t.Errorf("expected the payload to be the script. got %q", script)
+			}
+			got := env(cn.Environment)
+			if len(got) != len(c.env) {
+				t.Errorf("expected environment %v. got %v", c.env, got)
+			}
+			for k, v := range c.env {
+				if got[k] != v {
+					t.Errorf("expected $%s to be %q. got %q", k, v, got[k])
+				}
+			}
+			if len(cn.Volumes) != c.volumes || len(cn.MountPoints) != c.volumes {
+				t.Fatalf("expected %d volumes. got %d and %d mount points", c.volumes, len(cn.Volumes), len(cn.MountPoints))
+			}
+			if c.volumes > 0 && aws.ToBool(cn.MountPoints[c.volumes-1].ReadOnly) != c.readOnly {
+				t.Errorf("expected the last mount point to be read only: %v", c.readOnly)
+			}
+		})
+	}
+}
+
+func TestNewContainerEbs(t *testing.T) {
+	for _, c := range []struct {
+		ebs   string
+		mount string
+	}{
+		{"/mnt/local:500:gp2:ext4", "batchit ebsmount -n 1 -m /mnt/local -s 500 -v gp2 -t ext4"},
+		{"/mnt/local:500:st1", "batchit ebsmount -n 1 -m /mnt/local -s 500 -v st1 -t ext4"},
+		// large volumes are RAID-0'd for speed.
+		{"/mnt/local:4000:gp2:xfs", "batchit ebsmount -n 2 -m /mnt/local -s 4000 -v gp2 -t xfs"},
+		{"/mnt/local:500:io1:ext4:5000", "batchit ebsmount -n 1 -m /mnt/local -s 500 -v io1 -t ext4 -i 5000"},
+	} {
+		cn, err := NewContainer(&Options{Path: "script:echo hi", Ebs: c.ebs})
+		if err != nil {
+			t.Fatal(err)
+		}
+		command := strings.Join(cn.Command, "\n")
+		if !strings.Contains(command, c.mount) {
+			t.Errorf("%s: expected the command to have %q. got %q", c.ebs, c.mount, cn.Command)
+		}
+		if cleanup := "batchit ddv --mount /mnt/local || { [[ -z \"${vid:-}\" ]] || batchit ddv $vid; }"; !strings.Contains(command, cleanup) {
+			t.Errorf("%s: expected the command to have %q. got %q", c.ebs, cleanup, cn.Command)
+		}
+	}
+}
+
+func TestSubmit(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		role    string
+		outputs string
+		fail    error
+		// ok is whether a job is submitted.
+		ok bool
+	}{
+		{name: "submit", role: "batch", ok: true},
+		{name: "outputs missing", role: "batch", outputs: "s3://b/missing.bam", ok: true},
+		{name: "outputs exist", role: "batch", outputs: "s3://b/x.bam"},
+		{name: "no role", role: "other"},
+		{name: "submit fails", role: "batch", fail: fake.APIError("ClientException", "queue does not exist")},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			b := fake.NewBatch("us-east-1")
+			s3 := fake.NewS3()
+			s3.Objects["b/x.bam"] = []byte("bam")
+			cs := &Clients{Batch: b, IAM: fake.NewIAM("batch"), STS: &fake.STS{User: "me"}, S3: s3, Region: "us-east-1"}
+			cli := &Options{Path: "script:echo hi", JobName: "test", Queue: "q", Image: "ubuntu", Role: c.role,
+				CPUs: 1, Mem: 1024, Retries: 1, Region: "us-east-1", S3Outputs: c.outputs}
+			if c.fail != nil {
+				cs.Batch = failSubmit{b, c.fail}
+			}
+			id, err := cs.Submit(context.Background(), cli)
+			if !c.ok {
+				if err == nil {
+					t.Fatalf("expected an error. got job %s", id)
+				}
+				if c.outputs != "" && err != ErrOutputsExist {
+					t.Errorf("expected %v. got %v", ErrOutputsExist, err)
+				}
+				if len(b.Jobs) != 0 {
+					t.Errorf("expected no jobs. got %d", len(b.Jobs))
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				j, ok := b.Jobs[id]
+				if !ok {
+					t.Fatalf("job %s was not submitted", id)
+				}
+				if img := aws.ToString(j.Container.Image); img != batchit.ECRRegistry(fake.Account, "us-east-1")+"/ubuntu" {
+					t.Errorf("expected the image to be in ECR. got %s", img)
+				}
+				if script := decode(t, env(j.Container.Environment)["B64GZ"]); script != "echo hi" {
+					t.Errorf("expected the script in $B64GZ. got %q", script)
+				}
+			}
+			for def := range b.Definitions {
+				if !b.Deregistered[def] {
+					t.Errorf("expected job definition %s to be deregistered", def)
+				}
+			}
+		})
+	}
+}
+
+// failSubmit is a Batch that fails to submit jobs.
+type failSubmit struct {
+	*fake.Batch
+	err error
+}
+
+func (f failSubmit) SubmitJob(ctx context.Context, in *batch.SubmitJobInput, optFns ...func(*batch.Options)) (*batch.SubmitJobOutput, error) {
+	return nil, f.err
+}
@@ -0,0 +1,158 @@
+package tag
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/base2genomics/batchit"
+	"github.com/base2genomics/batchit/logof"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/batch"
+	batchtypes "github.com/aws/aws-sdk-go-v2/service/batch/types"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+type cliargs struct {
+	Region  string   `arg:"env:AWS_DEFAULT_REGION,help:region for batch setup. see batchit help for the default."`
+	NoDef   bool     `arg:"help:do not tag the job definition of the job."`
+	Volumes bool     `arg:"help:also tag the EBS volumes created by batchit ebsmount for the job."`
+	DryRun  bool     `arg:"help:show what would be tagged without tagging it."`
+	JobId   string   `arg:"required,positional,help:id of the job to tag."`
+	Tags    []string `arg:"required,positional,help:tags as key=value."`
+}
+
+func (c cliargs) Version() string {
+	return batchit.Version
+}
+
+func (c cliargs) Description() string {
+	return `Add tags to a job and its job definition after it was submitted, e.g. to fix cost-allocation tags.
+Existing tags with the same keys are replaced. Tags on a job definition apply to every job that uses it.
+With --volumes, EBS volumes named batchit-<instance id> on the instance that ran the job and created while
+it ran are also tagged. Volumes are deleted when a job exits so this is only useful while it is running.`
+}
+
+// Parse returns the tags from key=value strings.
+func Parse(kvs []string) (map[string]string, error) {
+	tags := make(map[string]string, len(kvs))
+	for _, kv := range kvs {
+		i := strings.Index(kv, "=")
+		if i < 1 {
+			return nil, fmt.Errorf("tag: expected key=value, got %s", kv)
+		}
+		tags[kv[:i]] = kv[i+1:]
+	}
+	return tags, nil
+}
+
+// Volumes returns the ids of the volumes created by batchit ebsmount on the instance iid while j ran.
+func Volumes(ctx context.Context, svc *ec2.Client, iid string, j *batchtypes.JobDetail) ([]string, error) {
+	start := time.Unix(0, aws.ToInt64(j.StartedAt)*int64(time.Millisecond))
+	stop := time.Now()
+	if j.StoppedAt != nil {
+		stop = time.Unix(0, *j.StoppedAt*int64(time.Millisecond))
+	}
+	var ids []string
+	pages := ec2.NewDescribeVolumesPaginator(svc, &ec2.DescribeVolumesInput{
+		Filters: []ec2types.Filter{{Name: aws.String("tag:Name"), Values: []string{"batchit-" + iid, "batchit-" + iid + "-*"}}},
+	})
+	for pages.HasMorePages() {
+		out, err := pages.NextPage(ctx)
+		if err != nil {
+			return ids, err
+		}
+		for _, v := range out.Volumes {
+			if t := aws.ToTime(v.CreateTime); !t.Before(start) && !t.After(stop) {
+				ids = append(ids, aws.ToString(v.VolumeId))
+			}
+		}
+	}
+	return ids, nil
+}
+
+func Main() {
+	cli := &cliargs{}
+	p := batchit.MustParse(cli)
+	tags, err := Parse(cli.Tags)
+	if err != nil {
+		p.Fail(err.Error())
+	}
+	ctx := context.Background()
+	cfg, err := batchit.LoadConfig(ctx, cli.Region)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cli.Region = cfg.Region
+	b := batch.NewFromConfig(cfg)
+
+	jobs, err := logof.DescribeJobs(ctx, b, []string{cli.JobId})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(jobs) == 0 {
+		log.Fatalf("[batchit tag] job %s not found in %s", cli.JobId, cli.Region)
+	}
+	j := jobs[0]
+
+	arns := []string{aws.ToString(j.JobArn)}
+	if !cli.NoDef {
+		arns = append(arns, aws.ToString(j.JobDefinition))
+	}
+	code := 0
+	for _, arn := range arns {
+		if cli.DryRun {
+			log.Printf("[batchit tag] would tag %s", arn)
+			continue
+		}
+		if _, err := b.TagResource(ctx, &batch.TagResourceInput{ResourceArn: aws.String(arn), Tags: tags}); err != nil {
+			log.Printf("[batchit tag] error tagging %s: %s", arn, err)
+			code = 1
+			continue
+		}
+		log.Printf("[batchit tag] tagged %s", arn)
+	}
+
+	if cli.Volumes {
+		iid := logof.InstanceId(ctx, cfg, b, j)
+		if iid == "" {
+			log.Fatalf("[batchit tag] instance of job %s not found. has it started?", cli.JobId)
+		}
+		svc := ec2.NewFromConfig(cfg)
+		ids, err := Volumes(ctx, svc, iid, j)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(ids) == 0 {
+			log.Printf("[batchit tag] no volumes found for job %s on %s", cli.JobId, iid)
+		}
+		keys := make([]string, 0, len(tags))
+		for k := range tags {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		etags := make([]ec2types.Tag, len(keys))
+		for i, k := range keys {
+			etags[i] = ec2types.Tag{Key: aws.String(k), Value: aws.String(tags[k])}
+		}
+		for _, id := range ids {
+			if cli.DryRun {
+				log.Printf("[batchit tag] would tag volume %s", id)
+				continue
+			}
+			if _, err := svc.CreateTags(ctx, &ec2.CreateTagsInput{Resources: []string{id}, Tags: etags}); err != nil {
+				log.Printf("[batchit tag] error tagging volume %s: %s", id, err)
+				code = 1
+				continue
+			}
+			log.Printf("[batchit tag] tagged volume %s", id)
+		}
+	}
+	os.Exit(code)
+}
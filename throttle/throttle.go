@@ -0,0 +1,239 @@
+package throttle
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/base2genomics/batchit"
+	"github.com/base2genomics/batchit/pipeline"
+	"github.com/base2genomics/batchit/queues"
+	"github.com/base2genomics/batchit/submit"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/batch"
+	batchtypes "github.com/aws/aws-sdk-go-v2/service/batch/types"
+	yaml "gopkg.in/yaml.v2"
+)
+
+type cliargs struct {
+	Region     string        `arg:"env:AWS_DEFAULT_REGION,help:region for batch setup. see batchit help for the default."`
+	Rate       string        `help:"maximum rate of submission, e.g. 5/s or 100/m."`
+	MaxInQueue int64         `arg:"--max-in-queue,help:pause while a queue has this many RUNNABLE jobs. 0 for no limit."`
+	Check      time.Duration `arg:"help:how often to count the RUNNABLE jobs of a queue with --max-in-queue."`
+	Defaults   string        `help:"YAML file with the fields used for specs that do not set them, as for the defaults of a pipeline."`
+	DryRun     bool          `arg:"help:log each job without submitting it."`
+}
+
+func (c cliargs) Version() string {
+	return batchit.Version
+}
+
+func (c cliargs) Description() string {
+	return `Submit a job for each line of JSON on STDIN at a limited rate so that thousands of jobs can be
+submitted without being throttled by the batch API or filling a queue. Each line has the fields of a job in a
+pipeline, e.g.:
+
+    {"name": "align-NA12878", "queue": "big-q", "script": "align.sh", "cpus": 16, "env": {"sample": "NA12878"}}
+
+Scripts are relative to the current directory. depends_on may have the names of jobs on earlier lines or job ids.
+With --max-in-queue, submission pauses while the RUNNABLE jobs of the queue of the next job reach the limit.
+The id of each job is written to STDOUT.`
+}
+
+// ParseRate returns the time between submissions for a rate such as 5/s, 100/m or 2 (per second).
+func ParseRate(rate string) (time.Duration, error) {
+	n, unit := rate, "s"
+	if i := strings.Index(rate, "/"); i != -1 {
+		n, unit = rate[:i], rate[i+1:]
+	}
+	per := map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour}[unit]
+	v, err := strconv.ParseFloat(n, 64)
+	if err != nil || v <= 0 || per == 0 {
+		return 0, fmt.Errorf("throttle: rate must be like 5/s, 100/m or 1000/h. got %s", rate)
+	}
+	return time.Duration(float64(per) / v), nil
+}
+
+// backlog tracks the RUNNABLE jobs of a queue between counts.
+type backlog struct {
+	n       int64
+	counted time.Time
+}
+
+// Throttle submits jobs no faster than Interval and waits while the queue of a job has MaxInQueue
+// RUNNABLE jobs.
+type Throttle struct {
+	Interval   time.Duration
+	MaxInQueue int64
+	// Check is how often the RUNNABLE jobs are counted. Jobs submitted since the last count are
+	// assumed to be RUNNABLE.
+	Check  time.Duration
+	DryRun bool
+
+	cfg      aws.Config
+	b        *batch.Client
+	last     time.Time
+	backlogs map[string]*backlog
+	// ids are the ids of the submitted jobs by name for depends_on.
+	ids map[string]string
+}
+
+// New returns a Throttle that submits at most one job per interval.
+func New(cfg aws.Config, interval time.Duration, maxInQueue int64) *Throttle {
+	return &Throttle{Interval: interval, MaxInQueue: maxInQueue, Check: 30 * time.Second, cfg: cfg,
+		b: batch.NewFromConfig(cfg), backlogs: make(map[string]*backlog), ids: make(map[string]string)}
+}
+
+// wait returns once the queue has room for another job.
+func (t *Throttle) wait(ctx context.Context, queue string) error {
+	if t.MaxInQueue <= 0 || t.DryRun {
+		return nil
+	}
+	bl, ok := t.backlogs[queue]
+	if !ok {
+		bl = &backlog{}
+		t.backlogs[queue] = bl
+	}
+	paused := false
+	for {
+		if bl.counted.IsZero() || time.Since(bl.counted) >= t.Check || bl.n >= t.MaxInQueue {
+			if paused {
+				time.Sleep(t.Check)
+			}
+			n, err := queues.Count(ctx, t.b, queue, batchtypes.JobStatusRunnable)
+			if err != nil {
+				return err
+			}
+			bl.n, bl.counted = n, time.Now()
+		}
+		if bl.n < t.MaxInQueue {
+			if paused {
+				log.Printf("[batchit throttle] %s has %d RUNNABLE jobs. resuming", queue, bl.n)
+			}
+			return nil
+		}
+		if !paused {
+			log.Printf("[batchit throttle] %s has %d RUNNABLE jobs. pausing until it has fewer than %d", queue, bl.n, t.MaxInQueue)
+			paused = true
+		}
+	}
+}
+
+// Submit waits for the rate and the queue and then submits j. Scripts are relative to dir.
+func (t *Throttle) Submit(ctx context.Context, j pipeline.Job, dir string) (string, error) {
+	if err := t.wait(ctx, j.Queue); err != nil {
+		return "", err
+	}
+	if d := t.Interval - time.Since(t.last); d > 0 {
+		time.Sleep(d)
+	}
+	t.last = time.Now()
+
+	o := j.Options(dir, t.cfg.Region)
+	for _, d := range j.DependsOn {
+		if id, ok := t.ids[d]; ok {
+			d = id
+		}
+		o.DependsOn = append(o.DependsOn, d)
+	}
+	if t.DryRun {
+		log.Printf("[batchit throttle] would submit %s to %s with %v", j.Name, j.Queue, o.EnvVars)
+		return "", nil
+	}
+	id, err := submit.Submit(ctx, t.cfg, o)
+	if err != nil {
+		return "", err
+	}
+	t.ids[j.Name] = id
+	if bl, ok := t.backlogs[j.Queue]; ok {
+		bl.n++
+	}
+	return id, nil
+}
+
+// Run submits a job for each line of r and writes the ids to w. Lines that can not be read or
+// submitted are logged and skipped. It returns the number of lines that failed.
+func (t *Throttle) Run(ctx context.Context, r io.Reader, w io.Writer, defaults pipeline.Job, dir string) (int, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	line, failed, submitted := 0, 0, 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		var j pipeline.Job
+		// JSON is YAML so this uses the same field names as a pipeline.
+		if err := yaml.UnmarshalStrict([]byte(text), &j); err != nil {
+			log.Printf("[batchit throttle] line %d: %s", line, err)
+			failed++
+			continue
+		}
+		j.SetDefaults(defaults)
+		if j.Script == "" {
+			j.Script = defaults.Script
+		}
+		id, err := t.Submit(ctx, j, dir)
+		if err == submit.ErrOutputsExist {
+			log.Printf("[batchit throttle] line %d: outputs exist for %s. not submitting", line, j.Name)
+			continue
+		}
+		if err != nil {
+			log.Printf("[batchit throttle] line %d: error submitting %s: %s", line, j.Name, err)
+			failed++
+			continue
+		}
+		submitted++
+		if id != "" {
+			fmt.Fprintln(w, id)
+		}
+	}
+	if !t.DryRun {
+		log.Printf("[batchit throttle] submitted %d jobs", submitted)
+	}
+	return failed, scanner.Err()
+}
+
+func Main() {
+	cli := &cliargs{Rate: "5/s", Check: 30 * time.Second}
+	p := batchit.MustParse(cli)
+	interval, err := ParseRate(cli.Rate)
+	if err != nil {
+		p.Fail(err.Error())
+	}
+	if cli.Check <= 0 {
+		p.Fail("--check must be positive")
+	}
+	var defaults pipeline.Job
+	if cli.Defaults != "" {
+		d, err := pipeline.ReadJob(cli.Defaults)
+		if err != nil {
+			p.Fail(err.Error())
+		}
+		defaults = *d
+	}
+	ctx := context.Background()
+	cfg, err := batchit.LoadConfig(ctx, cli.Region)
+	if err != nil {
+		log.Fatal(err)
+	}
+	t := New(cfg, interval, cli.MaxInQueue)
+	t.Check = cli.Check
+	t.DryRun = cli.DryRun
+
+	failed, err := t.Run(ctx, os.Stdin, os.Stdout, defaults, ".")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if failed > 0 {
+		log.Fatalf("[batchit throttle] %d lines were not submitted", failed)
+	}
+}
@@ -0,0 +1,39 @@
+package throttle
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	for _, c := range []struct {
+		rate     string
+		interval time.Duration
+		// ok is false if rate is invalid.
+		ok bool
+	}{
+		{"5/s", 200 * time.Millisecond, true},
+		{"5", 200 * time.Millisecond, true},
+		{"100/m", 600 * time.Millisecond, true},
+		{"1000/h", 3600 * time.Millisecond, true},
+		{"0.5/s", 2 * time.Second, true},
+		{"5/d", 0, false},
+		{"0/s", 0, false},
+		{"-1/s", 0, false},
+		{"fast", 0, false},
+		{"", 0, false},
+	} {
+		interval, err := ParseRate(c.rate)
+		if !c.ok {
+			if err == nil {
+				t.Errorf("%q: expected an error. got %s", c.rate, interval)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", c.rate, err)
+		} else if interval != c.interval {
+			t.Errorf("%q: expected %s. got %s", c.rate, c.interval, interval)
+		}
+	}
+}
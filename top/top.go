@@ -0,0 +1,211 @@
+package top
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/base2genomics/batchit"
+	"github.com/base2genomics/batchit/logof"
+	"github.com/base2genomics/batchit/ls"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/batch"
+	batchtypes "github.com/aws/aws-sdk-go-v2/service/batch/types"
+)
+
+type cliargs struct {
+	Region   string        `arg:"env:AWS_DEFAULT_REGION,help:region for batch setup. see batchit help for the default."`
+	Queue    string        `arg:"required,help:job queue to monitor."`
+	Interval time.Duration `arg:"help:time between refreshes."`
+	Once     bool          `arg:"help:print a single screen and exit."`
+	Rows     int           `arg:"help:maximum number of running jobs and changes to show."`
+}
+
+func (c cliargs) Version() string {
+	return batchit.Version
+}
+
+func (c cliargs) Description() string {
+	return `Monitor a job queue in the terminal, showing the number of jobs in each state, the vCPUs in use,
+the longest running jobs and recent changes of state. Press ctrl+c to exit.`
+}
+
+// active are the states of jobs that have not finished.
+var active = ls.Statuses[:len(ls.Statuses)-2]
+
+// change is a job moving from one state to another.
+type change struct {
+	at       time.Time
+	id, name string
+	from, to string
+}
+
+// monitor holds the state between refreshes.
+type monitor struct {
+	b       *batch.Client
+	cli     *cliargs
+	last    map[string]*batchtypes.JobSummary
+	changes []change
+}
+
+// capacity returns the vCPUs used by the running jobs and the desired and max vCPUs of the
+// compute environments of the queue.
+func (m *monitor) capacity(ctx context.Context, running []*batchtypes.JobSummary) (used, desired, max int64, err error) {
+	ids := make([]string, len(running))
+	for i, j := range running {
+		ids[i] = *j.JobId
+	}
+	jobs, err := logof.DescribeJobs(ctx, m.b, ids)
+	if err != nil {
+		return
+	}
+	for _, j := range jobs {
+		if j.Container != nil {
+			used += int64(aws.ToInt32(j.Container.Vcpus))
+		}
+	}
+	// the capacity changes as top runs so it is not from the responses kept by LoadConfig.
+	ctx = batchit.Fresh(ctx)
+	qo, err := m.b.DescribeJobQueues(ctx, &batch.DescribeJobQueuesInput{JobQueues: []string{m.cli.Queue}})
+	if err != nil || len(qo.JobQueues) == 0 {
+		return
+	}
+	var ces []string
+	for _, o := range qo.JobQueues[0].ComputeEnvironmentOrder {
+		ces = append(ces, aws.ToString(o.ComputeEnvironment))
+	}
+	co, err := m.b.DescribeComputeEnvironments(ctx, &batch.DescribeComputeEnvironmentsInput{ComputeEnvironments: ces})
+	if err != nil {
+		return
+	}
+	for _, ce := range co.ComputeEnvironments {
+		if ce.ComputeResources != nil {
+			desired += int64(aws.ToInt32(ce.ComputeResources.DesiredvCpus))
+			max += int64(aws.ToInt32(ce.ComputeResources.MaxvCpus))
+		}
+	}
+	return
+}
+
+// refresh lists the active jobs and records the changes since the last refresh.
+func (m *monitor) refresh(ctx context.Context) ([]*batchtypes.JobSummary, error) {
+	jobs, err := ls.List(ctx, m.b, ls.Query{Queue: m.cli.Queue, Statuses: active})
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	cur := make(map[string]*batchtypes.JobSummary, len(jobs))
+	for _, j := range jobs {
+		cur[*j.JobId] = j
+		if p, ok := m.last[*j.JobId]; ok && p.Status != j.Status {
+			m.changes = append(m.changes, change{now, *j.JobId, aws.ToString(j.JobName), string(p.Status), string(j.Status)})
+		}
+	}
+	// jobs that are no longer active have finished so find out how.
+	var gone []string
+	for id := range m.last {
+		if _, ok := cur[id]; !ok {
+			gone = append(gone, id)
+		}
+	}
+	if len(gone) > 0 {
+		done, err := logof.DescribeJobs(ctx, m.b, gone)
+		if err != nil {
+			return nil, err
+		}
+		for _, j := range done {
+			m.changes = append(m.changes, change{now, *j.JobId, aws.ToString(j.JobName), string(m.last[*j.JobId].Status), string(j.Status)})
+		}
+	}
+	if m.last != nil && len(m.changes) > m.cli.Rows {
+		m.changes = m.changes[len(m.changes)-m.cli.Rows:]
+	}
+	m.last = cur
+	return jobs, nil
+}
+
+// draw writes a single screen.
+func (m *monitor) draw(ctx context.Context, w io.Writer, jobs []*batchtypes.JobSummary) error {
+	counts := make(map[string]int)
+	var running []*batchtypes.JobSummary
+	for _, j := range jobs {
+		counts[string(j.Status)]++
+		if j.Status == batchtypes.JobStatusRunning {
+			running = append(running, j)
+		}
+	}
+	used, desired, max, err := m.capacity(ctx, running)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "batchit top - %s - queue: %s\n\n", time.Now().Format("15:04:05"), m.cli.Queue)
+	for _, s := range active {
+		fmt.Fprintf(w, "%s: %d  ", s, counts[string(s)])
+	}
+	fmt.Fprintf(w, "\nvCPUs: %d used, %d desired, %d max\n\n", used, desired, max)
+
+	sort.Slice(running, func(i, j int) bool {
+		return aws.ToInt64(running[i].StartedAt) < aws.ToInt64(running[j].StartedAt)
+	})
+	if len(running) > m.cli.Rows {
+		running = running[:m.cli.Rows]
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "JOB ID\tNAME\tRUNTIME")
+	for _, j := range running {
+		rt := "-"
+		if j.StartedAt != nil {
+			rt = time.Since(time.Unix(0, *j.StartedAt*int64(time.Millisecond))).Round(time.Second).String()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", *j.JobId, aws.ToString(j.JobName), rt)
+	}
+	tw.Flush()
+
+	fmt.Fprintln(w, "\nRECENT CHANGES")
+	tw = tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for i := len(m.changes) - 1; i >= 0; i-- {
+		c := m.changes[i]
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s -> %s\n", c.at.Format("15:04:05"), c.id, c.name, c.from, c.to)
+	}
+	return tw.Flush()
+}
+
+func Main() {
+	cli := &cliargs{Interval: 5 * time.Second, Rows: 20}
+	p := batchit.MustParse(cli)
+	if cli.Interval < time.Second {
+		p.Fail("--interval must be at least 1s")
+	}
+	ctx := context.Background()
+	cfg, err := batchit.LoadConfig(ctx, cli.Region)
+	if err != nil {
+		log.Fatal(err)
+	}
+	m := &monitor{b: batch.NewFromConfig(cfg), cli: cli}
+	for {
+		jobs, err := m.refresh(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// draw to a buffer so the screen is cleared and redrawn at once.
+		var buf bytes.Buffer
+		if !cli.Once {
+			buf.WriteString("\033[H\033[2J")
+		}
+		if err := m.draw(ctx, &buf, jobs); err != nil {
+			log.Fatal(err)
+		}
+		os.Stdout.Write(buf.Bytes())
+		if cli.Once {
+			return
+		}
+		time.Sleep(cli.Interval)
+	}
+}
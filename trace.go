@@ -0,0 +1,139 @@
+package batchit
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/smithy-go/middleware"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/aws/aws-sdk-go-v2/otelaws"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TraceEndpointEnvVar is the environment variable of the OpenTelemetry collector to send spans
+// to, e.g. http://localhost:4318. Tracing is off unless it or $OTEL_EXPORTER_OTLP_TRACES_ENDPOINT
+// is set.
+const TraceEndpointEnvVar = "OTEL_EXPORTER_OTLP_ENDPOINT"
+
+// traceShutdownTimeout is how long StopTracing waits to send the spans that are left.
+const traceShutdownTimeout = 5 * time.Second
+
+var tracing struct {
+	provider *sdktrace.TracerProvider
+	root     trace.Span
+	ctx      context.Context
+}
+
+// TracingEnabled is true if spans are sent to a collector. It is false until StartTracing.
+func TracingEnabled() bool {
+	return tracing.provider != nil
+}
+
+// StartTracing starts a span for the run of Command if $OTEL_EXPORTER_OTLP_ENDPOINT is set.
+// Spans are sent with OTLP over HTTP and the exporter takes the rest of its settings, such as
+// $OTEL_EXPORTER_OTLP_HEADERS, from the environment as well. $OTEL_SERVICE_NAME and
+// $OTEL_RESOURCE_ATTRIBUTES are added to the service batchit. Each AWS call from a config from
+// LoadConfig and each phase from StartSpan is then a span within it. StopTracing must be called
+// before exiting or the spans are lost.
+func StartTracing(ctx context.Context) error {
+	if os.Getenv(TraceEndpointEnvVar) == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return nil
+	}
+	if strings.EqualFold(os.Getenv("OTEL_SDK_DISABLED"), "true") {
+		return nil
+	}
+	var opts []otlptracehttp.Option
+	pool, err := rootCAs()
+	if err != nil {
+		return err
+	}
+	if pool != nil {
+		opts = append(opts, otlptracehttp.WithTLSClientConfig(&tls.Config{RootCAs: pool}))
+	}
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return err
+	}
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceName("batchit"), semconv.ServiceVersion(Version)),
+		resource.WithFromEnv(), resource.WithTelemetrySDK())
+	if err != nil {
+		return err
+	}
+	tracing.provider = sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(tracing.provider)
+	tracing.ctx, tracing.root = tracer().Start(ctx, "batchit "+Command,
+		trace.WithAttributes(attribute.String("batchit.subcommand", Command)))
+	return nil
+}
+
+// StopTracing ends the span of the run with err and sends the spans that have not been sent yet.
+func StopTracing(err error) {
+	if tracing.provider == nil {
+		return
+	}
+	EndSpan(tracing.root, err)
+	ctx, cancel := context.WithTimeout(context.Background(), traceShutdownTimeout)
+	defer cancel()
+	if err := tracing.provider.Shutdown(ctx); err != nil {
+		log.Printf("[batchit %s] error sending traces: %s", Command, err)
+	}
+	tracing.provider = nil
+}
+
+func tracer() trace.Tracer {
+	return otel.Tracer("github.com/base2genomics/batchit")
+}
+
+// traceParent returns ctx within the span of the run if it is not already within a span.
+func traceParent(ctx context.Context) context.Context {
+	if tracing.root == nil || trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx
+	}
+	return trace.ContextWithSpan(ctx, tracing.root)
+}
+
+// StartSpan starts a span for a phase of a subcommand, e.g. submit.register-definition, within
+// the span of ctx or else of the run. The AWS calls with the returned context are within it.
+// It does nothing unless tracing is on.
+func StartSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer().Start(traceParent(ctx), name, trace.WithAttributes(attrs...))
+}
+
+// EndSpan ends span, marking it as failed if err is not nil, and returns err so that it can be
+// used in a return statement.
+func EndSpan(span trace.Span, err error) error {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+	return err
+}
+
+// traceConfig adds a span for each call made with a client of cfg.
+func traceConfig(cfg *aws.Config) {
+	if tracing.provider == nil {
+		return
+	}
+	otelaws.AppendMiddlewares(&cfg.APIOptions, otelaws.WithTracerProvider(tracing.provider))
+	// added after otelaws so that it is before it in the stack. most calls are made with a
+	// context that is not in a span, so their spans would otherwise each be a trace of their own.
+	cfg.APIOptions = append(cfg.APIOptions, func(stack *middleware.Stack) error {
+		return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("BatchitTraceParent",
+			func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+				return next.HandleInitialize(traceParent(ctx), in)
+			}), middleware.Before)
+	})
+}
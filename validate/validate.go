@@ -0,0 +1,236 @@
+package validate
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/base2genomics/batchit"
+	"github.com/base2genomics/batchit/arraymap"
+	"github.com/base2genomics/batchit/ce"
+	"github.com/base2genomics/batchit/doctor"
+	"github.com/base2genomics/batchit/pipeline"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/batch"
+	batchtypes "github.com/aws/aws-sdk-go-v2/service/batch/types"
+	yaml "gopkg.in/yaml.v2"
+)
+
+type cliargs struct {
+	Region      string   `arg:"env:AWS_DEFAULT_REGION,help:region for batch setup. see batchit help for the default."`
+	Offline     bool     `help:"only check the files; don't look up queues, roles and images."`
+	ArrayHeader bool     `arg:"--array-header,help:the first row of each manifest names the columns as with batchit submit --array-header."`
+	Files       []string `arg:"required,positional,help:pipeline or compute environment YAML file(s) or .tsv or .csv array manifest(s) to check."`
+}
+
+func (c cliargs) Version() string {
+	return batchit.Version
+}
+
+func (c cliargs) Description() string {
+	return `Check pipeline files and batchit ce create configurations before anything is submitted or created.
+Each file is checked for unknown or missing fields, invalid values, missing scripts and dependency cycles.
+Files ending in .tsv or .csv are manifests for batchit submit --array-manifest. They must have from 2 to 10000
+rows and each row must have as many columns as the first.
+Unless --offline is given, the queues, job roles and images that a pipeline uses are also looked up with
+read-only calls. The exit code is 1 if there are any problems.`
+}
+
+// Kind returns "manifest" for a .tsv or .csv file and otherwise "pipeline" or "ce" according to
+// the top-level keys of a YAML file.
+func Kind(path string) (string, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".tsv", ".csv":
+		return "manifest", nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	var top map[string]interface{}
+	if err := yaml.Unmarshal(data, &top); err != nil {
+		return "", err
+	}
+	if _, ok := top["jobs"]; ok {
+		return "pipeline", nil
+	}
+	if _, ok := top["max_vcpus"]; ok {
+		return "ce", nil
+	}
+	return "", fmt.Errorf("%s is not a pipeline (no jobs:), compute environment (no max_vcpus:) or manifest (.tsv or .csv)", path)
+}
+
+// Manifest returns the problems with an array manifest read as by batchit array-map: the number
+// of rows must be a valid array size and every row, including the header if header is true, must
+// have as many columns as the first.
+func Manifest(r io.Reader, sep rune, header bool) []string {
+	cr := csv.NewReader(r)
+	cr.Comma = sep
+	cr.FieldsPerRecord = -1
+	cr.LazyQuotes = true
+	var out []string
+	rows, columns := 0, -1
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return append(out, err.Error())
+		}
+		line, _ := cr.FieldPos(0)
+		if header {
+			header = false
+			for i, name := range rec {
+				if strings.TrimPrefix(name, "#") == "" {
+					out = append(out, fmt.Sprintf("line %d: column %d has no name in the header", line, i+1))
+				}
+			}
+		} else if strings.HasPrefix(rec[0], "#") {
+			continue
+		} else {
+			rows++
+		}
+		if columns == -1 {
+			columns = len(rec)
+		} else if len(rec) != columns {
+			out = append(out, fmt.Sprintf("line %d: has %d columns. expected %d as in the first row", line, len(rec), columns))
+		}
+	}
+	if rows < 2 || rows > 10000 {
+		out = append(out, fmt.Sprintf("has %d rows. an array job has from 2 to 10000 children", rows))
+	}
+	return out
+}
+
+// Resolver looks up the AWS resources used by a pipeline. Each is looked up once.
+type Resolver struct {
+	b    *batch.Client
+	d    *doctor.Doctor
+	seen map[string][]string
+}
+
+// NewResolver returns a Resolver using cfg.
+func NewResolver(cfg aws.Config) *Resolver {
+	return &Resolver{b: batch.NewFromConfig(cfg), d: doctor.New(cfg), seen: make(map[string][]string)}
+}
+
+func problems(fs []doctor.Finding) []string {
+	var out []string
+	for _, f := range fs {
+		if f.Level != doctor.OK {
+			out = append(out, f.Message)
+		}
+	}
+	return out
+}
+
+func (r *Resolver) queue(ctx context.Context, q string) []string {
+	qo, err := r.b.DescribeJobQueues(ctx, &batch.DescribeJobQueuesInput{JobQueues: []string{q}})
+	if err != nil {
+		return []string{err.Error()}
+	}
+	if len(qo.JobQueues) == 0 {
+		return []string{fmt.Sprintf("queue %s not found", q)}
+	}
+	jq := qo.JobQueues[0]
+	if jq.State != batchtypes.JQStateEnabled || jq.Status != batchtypes.JQStatusValid {
+		return []string{fmt.Sprintf("queue %s is %s and %s", q, jq.State, jq.Status)}
+	}
+	return nil
+}
+
+// Pipeline returns problems with the queues, roles and images used by p.
+func (r *Resolver) Pipeline(ctx context.Context, p *pipeline.Pipeline) []string {
+	var out []string
+	check := func(key, value string, fn func() []string) {
+		// a missing value is reported by Check.
+		if value == "" {
+			return
+		}
+		key += ":" + value
+		res, ok := r.seen[key]
+		if !ok {
+			res = fn()
+			r.seen[key] = res
+			// report each problem once.
+			out = append(out, res...)
+		}
+	}
+	for _, j := range p.Jobs {
+		q, role, image := j.Queue, j.Role, j.Image
+		check("queue", q, func() []string { return r.queue(ctx, q) })
+		check("role", role, func() []string { return problems(r.d.JobRole(ctx, role)) })
+		check("image", image, func() []string { return problems(r.d.Image(ctx, image)) })
+	}
+	return out
+}
+
+// File returns the problems found in the file at path. header is whether a manifest has a header.
+// r is nil to skip lookups.
+func File(ctx context.Context, path string, header bool, r *Resolver) []string {
+	kind, err := Kind(path)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	if kind == "manifest" {
+		f, err := os.Open(path)
+		if err != nil {
+			return []string{err.Error()}
+		}
+		defer f.Close()
+		return Manifest(f, []rune(arraymap.DefaultSep(path))[0], header)
+	}
+	if kind == "ce" {
+		if _, err := ce.ReadConfig(path); err != nil {
+			return []string{err.Error()}
+		}
+		return nil
+	}
+	p, err := pipeline.Read(path)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	var out []string
+	for _, err := range p.Check() {
+		out = append(out, err.Error())
+	}
+	if r != nil {
+		out = append(out, r.Pipeline(ctx, p)...)
+	}
+	return out
+}
+
+func Main() {
+	cli := &cliargs{}
+	batchit.MustParse(cli)
+	// a queue that was disabled since the last run must be reported.
+	ctx := batchit.Fresh(context.Background())
+	var r *Resolver
+	if !cli.Offline {
+		cfg, err := batchit.LoadConfig(ctx, cli.Region)
+		if err != nil {
+			log.Fatal(err)
+		}
+		r = NewResolver(cfg)
+	}
+	n := 0
+	for _, f := range cli.Files {
+		for _, p := range File(ctx, f, cli.ArrayHeader, r) {
+			fmt.Printf("%s: %s\n", f, p)
+			n++
+		}
+	}
+	if n > 0 {
+		log.Printf("[batchit validate] found %d problems", n)
+		os.Exit(1)
+	}
+	log.Printf("[batchit validate] %d files ok", len(cli.Files))
+}
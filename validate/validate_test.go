@@ -0,0 +1,49 @@
+package validate
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestManifest(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		data   string
+		sep    rune
+		header bool
+		// problems are parts of each problem found.
+		problems []string
+	}{
+		{name: "tsv", data: "a\t1\nb\t2\n", sep: '\t'},
+		{name: "csv", data: "a,1\nb,2\n", sep: ','},
+		{name: "comments", data: "#sample\tn\na\t1\n\n# b is not done\nc\t3\n", sep: '\t'},
+		{name: "header", data: "#sample\tn\na\t1\nb\t2\n", sep: '\t', header: true},
+		{name: "one row", data: "#sample\tn\na\t1\n", sep: '\t', header: true, problems: []string{"has 1 rows"}},
+		{name: "empty", data: "", sep: '\t', problems: []string{"has 0 rows"}},
+		{name: "columns", data: "a\t1\nb\n", sep: '\t', problems: []string{"line 2: has 1 columns. expected 2"}},
+		{name: "header columns", data: "sample\na\t1\nb\t2\n", sep: '\t', header: true,
+			problems: []string{"line 2: has 2 columns. expected 1", "line 3: has 2 columns. expected 1"}},
+		{name: "header name", data: "sample\t\na\t1\nb\t2\n", sep: '\t', header: true, problems: []string{"column 2 has no name"}},
+		{name: "wrong separator", data: "a,1\nb\t2\n", sep: '\t', problems: []string{"line 2: has 2 columns. expected 1"}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			got := Manifest(strings.NewReader(c.data), c.sep, c.header)
+			if len(got) != len(c.problems) {
+				t.Fatalf("expected %d problems. got %q", len(c.problems), got)
+			}
+			for i, p := range c.problems {
+				if !strings.Contains(got[i], p) {
+					t.Errorf("expected %q in %q", p, got[i])
+				}
+			}
+		})
+	}
+}
+
+func TestKind(t *testing.T) {
+	for _, path := range []string{"samples.tsv", "samples.CSV"} {
+		if kind, err := Kind(path); err != nil || kind != "manifest" {
+			t.Errorf("%s: expected a manifest. got %q and %v", path, kind, err)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package wait
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/base2genomics/batchit"
+	"github.com/base2genomics/batchit/db"
+	"github.com/base2genomics/batchit/logof"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/batch"
+	batchtypes "github.com/aws/aws-sdk-go-v2/service/batch/types"
+)
+
+type cliargs struct {
+	Region   string        `arg:"env:AWS_DEFAULT_REGION,help:region for batch setup. see batchit help for the default."`
+	For      string        `help:"status to wait for. one of SUCCEEDED, FAILED or RUNNING."`
+	Interval time.Duration `arg:"help:how often to check the status of the jobs."`
+	Timeout  time.Duration `arg:"help:give up after this long. the default is to wait forever."`
+	Quiet    bool          `arg:"-q,help:don't report progress to stderr."`
+	JobIds   []string      `arg:"required,positional,help:job id(s) to wait for."`
+}
+
+func (c cliargs) Version() string {
+	return batchit.Version
+}
+
+func (c cliargs) Description() string {
+	return `Block until each job reaches the requested status.
+Waiting for RUNNING is satisfied by any job that has started, even if it has since finished.
+Exit status is 0 if every job reached the status, 5 if any finished without reaching it
+(e.g. it FAILED when waiting for SUCCEEDED) and 2 on timeout. Other errors exit as for
+other subcommands: 3 if a request to AWS failed, 4 if a job was not found and 1 otherwise.`
+}
+
+// Exit codes used by wait. Other errors have the codes of batchit.ExitCode.
+const (
+	ExitReached  = 0
+	ExitMismatch = batchit.ExitPartial
+	ExitTimeout  = batchit.ExitTimeout
+)
+
+// ErrTimeout is returned by Wait when the timeout passes before all jobs are done.
+var ErrTimeout = errors.New("wait: timed out")
+
+func terminal(status batchtypes.JobStatus) bool {
+	return status == batchtypes.JobStatusSucceeded || status == batchtypes.JobStatusFailed
+}
+
+// Reached reports whether j is finished waiting for status and, if so, whether it
+// reached that status.
+func Reached(j *batchtypes.JobDetail, status batchtypes.JobStatus) (done, ok bool) {
+	s := j.Status
+	if status == batchtypes.JobStatusRunning {
+		if s == batchtypes.JobStatusRunning || j.StartedAt != nil {
+			return true, true
+		}
+		return terminal(s), false
+	}
+	if !terminal(s) {
+		return false, false
+	}
+	return true, s == status
+}
+
+// summary describes the state of j and, for an array job, the number of children in each state.
+func summary(j *batchtypes.JobDetail) string {
+	s := fmt.Sprintf("%s %s", *j.JobId, j.Status)
+	if a := logof.ArraySummary(j); a != "" {
+		s += " (" + a + ")"
+	}
+	return s
+}
+
+// Wait polls the jobs every interval until each is done waiting for status (see Reached).
+// It returns the last details of every job. If timeout is non-zero and passes first,
+// ErrTimeout is returned with the details. Progress is written to w if it is not nil and emitted
+// as job.status events with --output jsonl.
+func Wait(ctx context.Context, b *batch.Client, ids []string, status batchtypes.JobStatus, interval, timeout time.Duration, w io.Writer) ([]*batchtypes.JobDetail, error) {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	last := make(map[string]string)
+	for {
+		jobs, err := logof.DescribeJobs(ctx, b, ids)
+		if err != nil {
+			return nil, err
+		}
+		if len(jobs) != len(ids) {
+			return jobs, batchit.Exit(batchit.ExitNotFound, fmt.Errorf("wait: only found %d of %d jobs", len(jobs), len(ids)))
+		}
+		finished := 0
+		for _, j := range jobs {
+			if s := summary(j); last[*j.JobId] != s {
+				if w != nil {
+					fmt.Fprintf(w, "[batchit wait] %s %s\n", time.Now().Format(time.Stamp), s)
+				}
+				batchit.Emit(batchit.Event{Type: batchit.EventJobStatus, JobId: *j.JobId, JobName: aws.ToString(j.JobName),
+					Status: string(j.Status), Message: s})
+				last[*j.JobId] = s
+			}
+			if done, _ := Reached(j, status); done {
+				finished++
+			}
+		}
+		if finished == len(jobs) {
+			return jobs, nil
+		}
+		sleep := interval
+		if !deadline.IsZero() {
+			left := time.Until(deadline)
+			if left <= 0 {
+				return jobs, ErrTimeout
+			}
+			// check once more at the deadline.
+			if left < sleep {
+				sleep = left
+			}
+		}
+		time.Sleep(sleep)
+	}
+}
+
+func Main() error {
+	cli := &cliargs{For: string(batchtypes.JobStatusSucceeded), Interval: 30 * time.Second}
+	p := batchit.MustParse(cli)
+	status := batchtypes.JobStatus(strings.ToUpper(cli.For))
+	if status != batchtypes.JobStatusSucceeded && status != batchtypes.JobStatusFailed && status != batchtypes.JobStatusRunning {
+		p.Fail("--for must be one of SUCCEEDED, FAILED or RUNNING")
+	}
+	if cli.Interval < time.Second {
+		p.Fail("--interval must be at least 1s")
+	}
+	ctx := context.Background()
+	cfg, err := batchit.LoadConfig(ctx, cli.Region)
+	if err != nil {
+		return err
+	}
+	b := batch.NewFromConfig(cfg)
+
+	var w io.Writer = os.Stderr
+	if cli.Quiet {
+		w = nil
+	}
+	jobs, err := Wait(ctx, b, cli.JobIds, status, cli.Interval, cli.Timeout, w)
+	db.Observe(ctx, cfg, jobs)
+	if err == ErrTimeout {
+		return batchit.Exit(ExitTimeout, fmt.Errorf("wait: timed out after %s", cli.Timeout))
+	}
+	if err != nil {
+		return err
+	}
+	mismatched := 0
+	for _, j := range jobs {
+		if _, ok := Reached(j, status); !ok {
+			log.Printf("[batchit wait] %s finished as %s, not %s", *j.JobId, j.Status, status)
+			mismatched++
+		}
+	}
+	if mismatched > 0 {
+		return batchit.Exit(ExitMismatch, fmt.Errorf("wait: %d of %d jobs finished without reaching %s", mismatched, len(jobs), status))
+	}
+	return nil
+}
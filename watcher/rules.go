@@ -0,0 +1,201 @@
+package watcher
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/batch"
+	batchtypes "github.com/aws/aws-sdk-go-v2/service/batch/types"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// The kinds of failure found by Classify.
+const (
+	Spot  = "spot"
+	Pull  = "pull"
+	OOM   = "oom"
+	Other = "other"
+)
+
+// Rule says how to retry failures that match it.
+type Rule struct {
+	// Match is spot, pull, oom or a regular expression matched against the failure reason.
+	Match      string `yaml:"match"`
+	MaxRetries int    `yaml:"max_retries"`
+	// MemoryFactor and VcpusFactor scale the resources of the job when it is resubmitted.
+	MemoryFactor float64 `yaml:"memory_factor"`
+	VcpusFactor  float64 `yaml:"vcpus_factor"`
+	// MaxMemory (MiB) caps the memory after scaling.
+	MaxMemory int64 `yaml:"max_memory"`
+
+	re *regexp.Regexp
+}
+
+// DefaultRules retry spot reclaims and image pull failures as they are and give jobs that ran out
+// of memory 50% more each time.
+var DefaultRules = []Rule{
+	{Match: Spot, MaxRetries: 3},
+	{Match: Pull, MaxRetries: 2},
+	{Match: OOM, MaxRetries: 2, MemoryFactor: 1.5},
+}
+
+// ReadRules reads rules from YAML like:
+//
+//	rules:
+//	  - match: oom
+//	    max_retries: 3
+//	    memory_factor: 2
+//	    max_memory: 256000
+//	  - match: "Task failed to start"
+//	    max_retries: 1
+func ReadRules(path string) ([]Rule, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f struct {
+		Rules []Rule `yaml:"rules"`
+	}
+	if err := yaml.UnmarshalStrict(data, &f); err != nil {
+		return nil, fmt.Errorf("watcher: %s: %s", path, err)
+	}
+	if len(f.Rules) == 0 {
+		return nil, fmt.Errorf("watcher: no rules in %s", path)
+	}
+	for i := range f.Rules {
+		r := &f.Rules[i]
+		if r.MaxRetries <= 0 {
+			return nil, fmt.Errorf("watcher: rule %q must have max_retries greater than 0", r.Match)
+		}
+		if r.MemoryFactor < 0 || r.VcpusFactor < 0 {
+			return nil, fmt.Errorf("watcher: rule %q has a negative factor", r.Match)
+		}
+	}
+	return f.Rules, nil
+}
+
+// reasons returns the status reasons of j and of each of its attempts.
+func reasons(j *batchtypes.JobDetail) []string {
+	rs := []string{aws.ToString(j.StatusReason)}
+	if j.Container != nil {
+		rs = append(rs, aws.ToString(j.Container.Reason))
+	}
+	for _, a := range j.Attempts {
+		rs = append(rs, aws.ToString(a.StatusReason))
+		if a.Container != nil {
+			rs = append(rs, aws.ToString(a.Container.Reason))
+		}
+	}
+	return rs
+}
+
+// Reason returns the reasons j failed as a single string.
+func Reason(j *batchtypes.JobDetail) string {
+	var out []string
+	for _, r := range reasons(j) {
+		if r != "" {
+			out = append(out, r)
+		}
+	}
+	return strings.Join(out, "; ")
+}
+
+// Classify returns the kind of failure of j using the reason of its last attempt.
+func Classify(j *batchtypes.JobDetail) string {
+	reason := aws.ToString(j.StatusReason)
+	if n := len(j.Attempts); n > 0 {
+		a := j.Attempts[n-1]
+		reason += " " + aws.ToString(a.StatusReason)
+		if a.Container != nil {
+			reason += " " + aws.ToString(a.Container.Reason)
+		}
+	} else if j.Container != nil {
+		reason += " " + aws.ToString(j.Container.Reason)
+	}
+	switch {
+	case strings.Contains(reason, "Host EC2") && strings.Contains(reason, "terminated"):
+		return Spot
+	case strings.Contains(reason, "CannotPullContainerError") || strings.Contains(reason, "DockerTimeoutError"):
+		return Pull
+	case strings.Contains(reason, "OutOfMemoryError") || strings.Contains(reason, "OutOfMemory"):
+		return OOM
+	}
+	return Other
+}
+
+// Find returns the first rule that matches the failure of j or nil.
+func Find(rules []Rule, j *batchtypes.JobDetail) (*Rule, error) {
+	kind := Classify(j)
+	reason := Reason(j)
+	for i := range rules {
+		r := &rules[i]
+		switch r.Match {
+		case Spot, Pull, OOM:
+			if r.Match == kind {
+				return r, nil
+			}
+			continue
+		}
+		if r.re == nil {
+			re, err := regexp.Compile(r.Match)
+			if err != nil {
+				return nil, fmt.Errorf("watcher: bad rule %q: %s", r.Match, err)
+			}
+			r.re = re
+		}
+		if r.re.MatchString(reason) {
+			return r, nil
+		}
+	}
+	return nil, nil
+}
+
+func scale(v int64, f float64) int64 {
+	if f == 0 {
+		return v
+	}
+	return int64(float64(v)*f + 0.5)
+}
+
+// Adjust scales the memory and vcpus of the resubmission sji of j according to r.
+func (r *Rule) Adjust(sji *batch.SubmitJobInput, j *batchtypes.JobDetail) {
+	if j.Container == nil || (r.MemoryFactor == 0 && r.VcpusFactor == 0) {
+		return
+	}
+	co := sji.ContainerOverrides
+	mem := scale(int64(aws.ToInt32(j.Container.Memory)), r.MemoryFactor)
+	if r.MaxMemory > 0 && mem > r.MaxMemory {
+		mem = r.MaxMemory
+	}
+	if mem > 0 {
+		co.Memory = aws.Int32(int32(mem))
+	}
+	if v := scale(int64(aws.ToInt32(j.Container.Vcpus)), r.VcpusFactor); v > 0 {
+		co.Vcpus = aws.Int32(int32(v))
+	}
+	// definitions that use resource requirements must be overridden the same way.
+	for _, rr := range j.Container.ResourceRequirements {
+		v, err := strconv.ParseFloat(aws.ToString(rr.Value), 64)
+		if err != nil {
+			continue
+		}
+		switch rr.Type {
+		case batchtypes.ResourceTypeMemory:
+			m := scale(int64(v), r.MemoryFactor)
+			if r.MaxMemory > 0 && m > r.MaxMemory {
+				m = r.MaxMemory
+			}
+			co.Memory = nil
+			co.ResourceRequirements = append(co.ResourceRequirements, batchtypes.ResourceRequirement{Type: rr.Type, Value: aws.String(strconv.FormatInt(m, 10))})
+		case batchtypes.ResourceTypeVcpu:
+			if r.VcpusFactor != 0 {
+				co.Vcpus = nil
+				co.ResourceRequirements = append(co.ResourceRequirements, batchtypes.ResourceRequirement{Type: rr.Type, Value: aws.String(strconv.FormatFloat(v*r.VcpusFactor, 'f', -1, 64))})
+			}
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package watcher
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	batchtypes "github.com/aws/aws-sdk-go-v2/service/batch/types"
+)
+
+func TestClassify(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		job  batchtypes.JobDetail
+		kind string
+	}{
+		{name: "spot", kind: Spot, job: batchtypes.JobDetail{Attempts: []batchtypes.AttemptDetail{
+			{StatusReason: aws.String("Host EC2 (instance i-0123) terminated.")}}}},
+		{name: "pull", kind: Pull, job: batchtypes.JobDetail{Attempts: []batchtypes.AttemptDetail{
+			{Container: &batchtypes.AttemptContainerDetail{Reason: aws.String("CannotPullContainerError: pull access denied")}}}}},
+		{name: "docker timeout", kind: Pull, job: batchtypes.JobDetail{StatusReason: aws.String("DockerTimeoutError: Could not transition to created")}},
+		{name: "oom", kind: OOM, job: batchtypes.JobDetail{Attempts: []batchtypes.AttemptDetail{
+			{Container: &batchtypes.AttemptContainerDetail{Reason: aws.String("OutOfMemoryError: Container killed due to memory usage")}}}}},
+		{name: "container without attempts", kind: OOM, job: batchtypes.JobDetail{
+			Container: &batchtypes.ContainerDetail{Reason: aws.String("OutOfMemoryError: Container killed due to memory usage")}}},
+		{name: "last attempt", kind: Other, job: batchtypes.JobDetail{Attempts: []batchtypes.AttemptDetail{
+			{StatusReason: aws.String("Host EC2 (instance i-0123) terminated.")},
+			{StatusReason: aws.String("Essential container in task exited")}}}},
+		{name: "exit code", kind: Other, job: batchtypes.JobDetail{StatusReason: aws.String("Essential container in task exited")}},
+		{name: "no reason", kind: Other},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if got := Classify(&c.job); got != c.kind {
+				t.Errorf("expected %s. got %s", c.kind, got)
+			}
+		})
+	}
+}
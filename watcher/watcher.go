@@ -0,0 +1,215 @@
+package watcher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/base2genomics/batchit"
+	"github.com/base2genomics/batchit/events"
+	"github.com/base2genomics/batchit/logof"
+	"github.com/base2genomics/batchit/resubmit"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/batch"
+	batchtypes "github.com/aws/aws-sdk-go-v2/service/batch/types"
+)
+
+type cliargs struct {
+	Region string `arg:"env:AWS_DEFAULT_REGION,help:region for batch setup. see batchit help for the default."`
+	Queue  string `arg:"required,help:job queue to watch for failures."`
+	Rules  string `help:"YAML file of retry rules. default retries spot reclaims, image pull failures and out of memory errors."`
+	SQSURL string `arg:"help:read events from this existing SQS queue rather than creating a rule and queue."`
+	DryRun bool   `arg:"help:log what would be resubmitted without submitting."`
+}
+
+func (c cliargs) Version() string {
+	return batchit.Version
+}
+
+func (c cliargs) Description() string {
+	return `Watch a queue for failed jobs and resubmit those whose failure matches a retry rule.
+Failures are classified as spot (the host was reclaimed), pull (the image could not be pulled), oom (out of
+memory) or other, and a rule can also match the failure reason with a regular expression. A rule can scale
+the memory and vCPUs of the resubmitted job. The number of retries is carried in $BATCHIT_WATCHER_RETRIES
+so that a job is not retried more than max_retries times. Events are received as with batchit events.`
+}
+
+// RetriesEnv holds the number of times the watcher has resubmitted a job.
+const RetriesEnv = "BATCHIT_WATCHER_RETRIES"
+
+func env(j *batchtypes.JobDetail, name string) string {
+	if j.Container == nil {
+		return ""
+	}
+	for _, kv := range j.Container.Environment {
+		if aws.ToString(kv.Name) == name {
+			return aws.ToString(kv.Value)
+		}
+	}
+	return ""
+}
+
+// Retries returns the number of times j has already been resubmitted by the watcher.
+func Retries(j *batchtypes.JobDetail) int {
+	n, _ := strconv.Atoi(env(j, RetriesEnv))
+	return n
+}
+
+// Watcher resubmits failed jobs according to its rules.
+type Watcher struct {
+	b      *batch.Client
+	rules  []Rule
+	dryRun bool
+}
+
+// Input returns the submission to retry j. A child of an array job is resubmitted on its own
+// with its original index.
+func (w *Watcher) Input(ctx context.Context, j *batchtypes.JobDetail) (*batch.SubmitJobInput, error) {
+	id := aws.ToString(j.JobId)
+	if j.ArrayProperties == nil || j.ArrayProperties.Index == nil || !strings.Contains(id, ":") {
+		sji := resubmit.Input(j, nil)
+		// a child that was already resubmitted on its own still needs its original index.
+		if idx := env(j, resubmit.IndicesEnv); idx != "" {
+			sji.ContainerOverrides.Environment = setEnv(sji.ContainerOverrides.Environment, resubmit.IndicesEnv, idx)
+		}
+		return sji, nil
+	}
+	// the parent has the command and environment that the remapping of the index expects.
+	parents, err := logof.DescribeJobs(ctx, w.b, []string{id[:strings.LastIndex(id, ":")]})
+	if err != nil {
+		return nil, err
+	}
+	if len(parents) == 0 {
+		return nil, fmt.Errorf("watcher: parent of %s not found", id)
+	}
+	idx := int64(*j.ArrayProperties.Index)
+	sji := resubmit.Input(parents[0], []int64{idx})
+	sji.JobName = aws.String(fmt.Sprintf("%s-%d", aws.ToString(j.JobName), idx))
+	return sji, nil
+}
+
+// Handle resubmits the failed job j if a rule matches and it has retries left. It returns the
+// id of the new job or "" if it was not resubmitted.
+func (w *Watcher) Handle(ctx context.Context, j *batchtypes.JobDetail) (string, error) {
+	id := aws.ToString(j.JobId)
+	if logof.IsArrayParent(j) {
+		// each failed child has its own event.
+		return "", nil
+	}
+	r, err := Find(w.rules, j)
+	if err != nil {
+		return "", err
+	}
+	if r == nil {
+		log.Printf("[batchit watcher] %s (%s) failed with no matching rule: %s", id, aws.ToString(j.JobName), Reason(j))
+		return "", nil
+	}
+	n := Retries(j)
+	if n >= r.MaxRetries {
+		log.Printf("[batchit watcher] %s (%s) failed (%s) after %d retries. giving up", id, aws.ToString(j.JobName), r.Match, n)
+		return "", nil
+	}
+	sji, err := w.Input(ctx, j)
+	if err != nil {
+		return "", err
+	}
+	sji.ContainerOverrides.Environment = setEnv(sji.ContainerOverrides.Environment, RetriesEnv, strconv.Itoa(n+1))
+	r.Adjust(sji, j)
+	if w.dryRun {
+		data, _ := json.Marshal(sji)
+		log.Printf("[batchit watcher] would resubmit %s (%s) which failed (%s) as retry %d of %d: %s", id, aws.ToString(j.JobName), r.Match, n+1, r.MaxRetries, data)
+		return "", nil
+	}
+	def, cleanup, err := resubmit.ActiveDefinition(ctx, w.b, j)
+	if err != nil {
+		return "", err
+	}
+	defer cleanup()
+	sji.JobDefinition = aws.String(def)
+	so, err := w.b.SubmitJob(ctx, sji)
+	if err != nil {
+		return "", err
+	}
+	log.Printf("[batchit watcher] resubmitted %s (%s) which failed (%s) as %s, retry %d of %d", id, aws.ToString(j.JobName), r.Match, *so.JobId, n+1, r.MaxRetries)
+	return *so.JobId, nil
+}
+
+func setEnv(env []batchtypes.KeyValuePair, name, value string) []batchtypes.KeyValuePair {
+	for i := range env {
+		if aws.ToString(env[i].Name) == name {
+			env[i].Value = aws.String(value)
+			return env
+		}
+	}
+	return append(env, batchtypes.KeyValuePair{Name: aws.String(name), Value: aws.String(value)})
+}
+
+// event is the part of a job state change event that is needed.
+type event struct {
+	Detail struct {
+		JobId  string `json:"jobId"`
+		Status string `json:"status"`
+	} `json:"detail"`
+}
+
+func (w *Watcher) event(ctx context.Context, body []byte) error {
+	var e event
+	if err := json.Unmarshal(body, &e); err != nil {
+		log.Printf("[batchit watcher] skipping message that is not an event: %s", err)
+		return nil
+	}
+	if e.Detail.Status != string(batchtypes.JobStatusFailed) {
+		return nil
+	}
+	jobs, err := logof.DescribeJobs(ctx, w.b, []string{e.Detail.JobId})
+	if err != nil {
+		return err
+	}
+	if len(jobs) == 0 {
+		log.Printf("[batchit watcher] failed job %s not found", e.Detail.JobId)
+		return nil
+	}
+	if _, err := w.Handle(ctx, jobs[0]); err != nil {
+		// a job that can't be resubmitted shouldn't stop the others.
+		log.Printf("[batchit watcher] error resubmitting %s: %s", e.Detail.JobId, err)
+	}
+	return nil
+}
+
+func Main() error {
+	cli := &cliargs{}
+	p := batchit.MustParse(cli)
+	rules := DefaultRules
+	if cli.Rules != "" {
+		var err error
+		if rules, err = ReadRules(cli.Rules); err != nil {
+			p.Fail(err.Error())
+		}
+	}
+	ctx := batchit.Context()
+	cfg, err := batchit.LoadConfig(ctx, cli.Region)
+	if err != nil {
+		return err
+	}
+	b := batch.NewFromConfig(cfg)
+	w := &Watcher{b: b, rules: rules, dryRun: cli.DryRun}
+
+	src := events.Source{URL: cli.SQSURL}
+	if cli.SQSURL == "" {
+		qo, err := b.DescribeJobQueues(batchit.Mapping(ctx), &batch.DescribeJobQueuesInput{JobQueues: []string{cli.Queue}})
+		if err != nil {
+			return err
+		}
+		if len(qo.JobQueues) == 0 {
+			return batchit.Exit(batchit.ExitNotFound, fmt.Errorf("job queue %s not found", cli.Queue))
+		}
+		src.Name = "batchit-watcher-" + cli.Queue
+		src.Pattern = events.Pattern(*qo.JobQueues[0].JobQueueArn, string(batchtypes.JobStatusFailed))
+	}
+	log.Printf("[batchit watcher] watching %s for failed jobs with %d rules", cli.Queue, len(rules))
+	return events.Watch(ctx, cfg, src, func(body []byte) error { return w.event(ctx, body) })
+}
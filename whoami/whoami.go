@@ -0,0 +1,145 @@
+package whoami
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/base2genomics/batchit"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/batch"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+type cliargs struct {
+	Region string `arg:"env:AWS_DEFAULT_REGION,help:region for batch setup. see batchit help for the default."`
+	JSON   bool   `arg:"help:print a JSON object rather than a table."`
+}
+
+func (c cliargs) Version() string {
+	return batchit.Version
+}
+
+func (c cliargs) Description() string {
+	return `Show the account, identity and region that batchit commands will use along with the default queue
+and role from $BATCHIT_QUEUE and $BATCHIT_ROLE, so that it's clear where jobs will be submitted.`
+}
+
+// Identity is who and where batchit commands run as.
+type Identity struct {
+	Account     string `json:"account"`
+	Arn         string `json:"arn"`
+	UserId      string `json:"user_id"`
+	Partition   string `json:"partition"`
+	Region      string `json:"region"`
+	RegionFrom  string `json:"region_source"`
+	Profile     string `json:"profile,omitempty"`
+	Credentials string `json:"credentials,omitempty"`
+	Queue       string `json:"queue,omitempty"`
+	QueueState  string `json:"queue_state,omitempty"`
+	Role        string `json:"role,omitempty"`
+}
+
+// Partition returns the partition of an ARN, e.g. aws, aws-cn or aws-us-gov.
+func Partition(arn string) string {
+	parts := strings.SplitN(arn, ":", 3)
+	if len(parts) < 3 {
+		return ""
+	}
+	return parts[1]
+}
+
+// Get returns the identity of the credentials in cfg and the defaults from the environment.
+func Get(ctx context.Context, cfg aws.Config) (*Identity, error) {
+	id, err := sts.NewFromConfig(cfg).GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return nil, err
+	}
+	who := &Identity{
+		Account:    aws.ToString(id.Account),
+		Arn:        aws.ToString(id.Arn),
+		UserId:     aws.ToString(id.UserId),
+		Partition:  Partition(aws.ToString(id.Arn)),
+		Region:     cfg.Region,
+		RegionFrom: batchit.RegionSource(cfg),
+		Profile:    batchit.Profile,
+		Queue:      os.Getenv("BATCHIT_QUEUE"),
+		Role:       os.Getenv("BATCHIT_ROLE"),
+	}
+	if who.Profile == "" {
+		who.Profile = os.Getenv("AWS_PROFILE")
+	}
+	if cfg.Credentials != nil {
+		if v, err := cfg.Credentials.Retrieve(ctx); err == nil {
+			who.Credentials = v.Source
+		}
+	}
+	if who.Queue != "" {
+		who.QueueState = "not found"
+		qo, err := batch.NewFromConfig(cfg).DescribeJobQueues(ctx, &batch.DescribeJobQueuesInput{JobQueues: []string{who.Queue}})
+		if err != nil {
+			who.QueueState = err.Error()
+		} else if len(qo.JobQueues) > 0 {
+			q := qo.JobQueues[0]
+			who.QueueState = string(q.State) + " " + string(q.Status)
+		}
+	}
+	return who, nil
+}
+
+// WriteTable writes the identity with a row for each field.
+func WriteTable(w io.Writer, who *Identity) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	or := func(v, unset string) string {
+		if v == "" {
+			return unset
+		}
+		return v
+	}
+	queue := or(who.Queue, "(not set)")
+	if who.QueueState != "" {
+		queue += " (" + who.QueueState + ")"
+	}
+	fmt.Fprintf(tw, "account\t%s\n", who.Account)
+	fmt.Fprintf(tw, "arn\t%s\n", who.Arn)
+	fmt.Fprintf(tw, "user id\t%s\n", who.UserId)
+	fmt.Fprintf(tw, "partition\t%s\n", who.Partition)
+	fmt.Fprintf(tw, "region\t%s (from %s)\n", who.Region, or(who.RegionFrom, "-"))
+	fmt.Fprintf(tw, "profile\t%s\n", or(who.Profile, "default"))
+	fmt.Fprintf(tw, "credentials\t%s\n", or(who.Credentials, "-"))
+	fmt.Fprintf(tw, "queue\t%s\n", queue)
+	fmt.Fprintf(tw, "role\t%s\n", or(who.Role, "(not set)"))
+	return tw.Flush()
+}
+
+func Main() {
+	cli := &cliargs{}
+	batchit.MustParse(cli)
+	ctx := batchit.Fresh(context.Background())
+	cfg, err := batchit.LoadConfig(ctx, cli.Region)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	who, err := Get(ctx, cfg)
+	if err != nil {
+		log.Fatalf("[batchit whoami] no usable AWS credentials: %s", err)
+	}
+	if cli.JSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(who); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if err := WriteTable(os.Stdout, who); err != nil {
+		log.Fatal(err)
+	}
+}